@@ -0,0 +1,245 @@
+package tcapflow
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AdminDialogue is the view of a tracked dialogue in the admin API. Key is
+// the state key "<gt>-<ssn>-<tid>". The other fields are empty when the
+// state does not keep them.
+type AdminDialogue struct {
+	State              string      `json:"state"`
+	Key                string      `json:"key"`
+	StartTime          time.Time   `json:"startTime"`
+	Age                float64     `json:"ageMs"`
+	Otid               string      `json:"otid,omitempty"`
+	Dtid               string      `json:"dtid,omitempty"`
+	Calling            addressJSON `json:"calling"`
+	Called             addressJSON `json:"called"`
+	ApplicationContext string      `json:"applicationContext,omitempty"`
+	Operations         []int       `json:"operations,omitempty"`
+}
+
+func NewAdminDialogue(state, key string, start time.Time, age time.Duration, calling, called SCCPAddress, otid, dtid []byte, ac string, infos []ROSInfo) AdminDialogue {
+	d := AdminDialogue{
+		State:              state,
+		Key:                key,
+		StartTime:          start,
+		Age:                milliseconds(age),
+		Otid:               hex.EncodeToString(otid),
+		Dtid:               hex.EncodeToString(dtid),
+		Calling:            addressToJSON(calling),
+		Called:             addressToJSON(called),
+		ApplicationContext: ac,
+	}
+	for _, info := range infos {
+		if info.Type == ROSInvoke {
+			d.Operations = append(d.Operations, info.OpCode)
+		}
+	}
+	return d
+}
+
+// DialogueFilter selects dialogues of the admin API. A GT matches as prefix
+// of either party, a TID either side of the dialogue. Negative SSN and
+// OpCode match everything.
+type DialogueFilter struct {
+	Tid    string
+	Gt     string
+	Ssn    int
+	OpCode int
+	MinAge time.Duration
+	Limit  int
+}
+
+func ParseDialogueFilter(values url.Values) (DialogueFilter, error) {
+	f := DialogueFilter{Ssn: -1, OpCode: -1, Limit: 100}
+	f.Gt = values.Get("gt")
+	f.Tid = strings.ToLower(values.Get("tid"))
+	if _, err := hex.DecodeString(f.Tid); err != nil {
+		return f, fmt.Errorf("tid: %v", err)
+	}
+
+	ints := []struct {
+		name  string
+		value *int
+	}{{"ssn", &f.Ssn}, {"opcode", &f.OpCode}, {"limit", &f.Limit}}
+	for _, param := range ints {
+		if s := values.Get(param.name); len(s) > 0 {
+			v, err := strconv.Atoi(s)
+			if err != nil {
+				return f, fmt.Errorf("%s: %v", param.name, err)
+			}
+			*param.value = v
+		}
+	}
+	if s := values.Get("min-age"); len(s) > 0 {
+		age, err := time.ParseDuration(s)
+		if err != nil {
+			return f, fmt.Errorf("min-age: %v", err)
+		}
+		f.MinAge = age
+	}
+	return f, nil
+}
+
+func (f *DialogueFilter) Match(d *AdminDialogue) bool {
+	parts := strings.SplitN(d.Key, "-", 3)
+	for len(parts) < 3 {
+		parts = append(parts, "")
+	}
+
+	if len(f.Tid) > 0 && f.Tid != d.Otid && f.Tid != d.Dtid && f.Tid != parts[2] {
+		return false
+	}
+	if len(f.Gt) > 0 && !strings.HasPrefix(d.Calling.Gt, f.Gt) &&
+		!strings.HasPrefix(d.Called.Gt, f.Gt) && !strings.HasPrefix(parts[0], f.Gt) {
+		return false
+	}
+	if f.Ssn >= 0 && f.Ssn != int(d.Calling.Ssn) && f.Ssn != int(d.Called.Ssn) && strconv.Itoa(f.Ssn) != parts[1] {
+		return false
+	}
+	if f.OpCode >= 0 {
+		found := false
+		for _, op := range d.Operations {
+			found = found || op == f.OpCode
+		}
+		if !found {
+			return false
+		}
+	}
+	return d.Age >= milliseconds(f.MinAge)
+}
+
+// SortDialogues puts the oldest first and keeps limit of them unless zero
+func SortDialogues(dialogues []AdminDialogue, limit int) []AdminDialogue {
+	sort.Slice(dialogues, func(i, j int) bool {
+		return dialogues[i].Age > dialogues[j].Age
+	})
+	if limit > 0 && len(dialogues) > limit {
+		dialogues = dialogues[:limit]
+	}
+	return dialogues
+}
+
+// OldestDialogues collects the oldest dialogues matching a filter up to its
+// limit. Sources call Wants before building a dialogue so that a full list
+// skips the younger ones without copying them.
+type OldestDialogues struct {
+	Filter    *DialogueFilter
+	Dialogues []AdminDialogue // Oldest first once the limit is reached
+}
+
+func (o *OldestDialogues) full() bool {
+	return o.Filter.Limit > 0 && len(o.Dialogues) >= o.Filter.Limit
+}
+
+// Wants tells if a dialogue of this age could still make it into the list
+func (o *OldestDialogues) Wants(age time.Duration) bool {
+	if age < o.Filter.MinAge {
+		return false
+	}
+	return !o.full() || milliseconds(age) > o.Dialogues[len(o.Dialogues)-1].Age
+}
+
+func (o *OldestDialogues) Add(d AdminDialogue) {
+	if !o.Filter.Match(&d) {
+		return
+	}
+	if o.Filter.Limit <= 0 {
+		o.Dialogues = append(o.Dialogues, d)
+		return
+	}
+	if o.full() {
+		o.Dialogues = o.Dialogues[:len(o.Dialogues)-1]
+	}
+	i := sort.Search(len(o.Dialogues), func(i int) bool {
+		return o.Dialogues[i].Age < d.Age
+	})
+	o.Dialogues = append(o.Dialogues, AdminDialogue{})
+	copy(o.Dialogues[i+1:], o.Dialogues[i:])
+	o.Dialogues[i] = d
+}
+
+// AdminSource gives the admin API access to the live state. Dialogues
+// returns the matching dialogues and Stats a JSON encodable summary.
+type AdminSource interface {
+	Dialogues(filter *DialogueFilter) []AdminDialogue
+	Stats() interface{}
+}
+
+func writeAdminJSON(w http.ResponseWriter, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(data, '\n'))
+}
+
+// HandleAdminJSON serves what get returns as JSON at path
+func HandleAdminJSON(mux *http.ServeMux, path string, get func() interface{}) {
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, get())
+	})
+}
+
+// NewAdminMux serves /dialogues (oldest first, filtered by the query
+// parameters tid, gt, ssn, opcode, min-age and limit), /stats, /healthz
+// and /readyz.
+func NewAdminMux(source AdminSource, ready func() bool) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dialogues", func(w http.ResponseWriter, r *http.Request) {
+		filter, err := ParseDialogueFilter(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		dialogues := SortDialogues(source.Dialogues(&filter), filter.Limit)
+		if dialogues == nil {
+			dialogues = []AdminDialogue{}
+		}
+		writeAdminJSON(w, dialogues)
+	})
+	HandleAdminJSON(mux, "/stats", source.Stats)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !ready() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	return mux
+}
+
+// HandlePprof adds pprof below /debug/pprof/. It is not authenticated and
+// shows the command line, so only add it on request.
+func HandlePprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+func ServeAdmin(address string, mux *http.ServeMux) {
+	go func() {
+		err := http.ListenAndServe(address, mux)
+		if err != nil {
+			fmt.Printf("ERROR: admin listener: %v\n", err)
+		}
+	}()
+}
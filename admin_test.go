@@ -0,0 +1,131 @@
+package tcapflow
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testAdminSource []AdminDialogue
+
+func (s testAdminSource) Dialogues(filter *DialogueFilter) []AdminDialogue {
+	oldest := OldestDialogues{Filter: filter}
+	for _, d := range s {
+		if oldest.Wants(time.Duration(d.Age) * time.Millisecond) {
+			oldest.Add(d)
+		}
+	}
+	return oldest.Dialogues
+}
+
+func (s testAdminSource) Stats() interface{} {
+	return map[string]int{"dialogues": len(s)}
+}
+
+func testDialogue(age time.Duration, op int) AdminDialogue {
+	return NewAdminDialogue("session", "4912345-7-01", time.Unix(1000, 0), age,
+		SCCPAddress{Number: "4912345", Ssn: 7}, SCCPAddress{Number: "4970000", Ssn: 6},
+		[]byte{1}, nil, "", []ROSInfo{{Type: ROSInvoke, OpCode: op}})
+}
+
+func TestOldestDialoguesKeepsLimit(t *testing.T) {
+	oldest := OldestDialogues{Filter: &DialogueFilter{Ssn: -1, OpCode: -1, Limit: 3}}
+	ages := []int{5, 1, 9, 3, 7, 2, 8}
+	for _, age := range ages {
+		if oldest.Wants(time.Duration(age) * time.Second) {
+			oldest.Add(testDialogue(time.Duration(age)*time.Second, 2))
+		}
+	}
+	if len(oldest.Dialogues) != 3 {
+		t.Fatalf("%d dialogues", len(oldest.Dialogues))
+	}
+	for i, want := range []float64{9000, 8000, 7000} {
+		if oldest.Dialogues[i].Age != want {
+			t.Errorf("dialogue %d is %vms old, want %v", i, oldest.Dialogues[i].Age, want)
+		}
+	}
+	if oldest.Wants(6 * time.Second) {
+		t.Errorf("wants a younger dialogue once full")
+	}
+
+	unlimited := OldestDialogues{Filter: &DialogueFilter{Ssn: -1, OpCode: -1}}
+	for _, age := range ages {
+		unlimited.Add(testDialogue(time.Duration(age)*time.Second, 2))
+	}
+	if len(unlimited.Dialogues) != len(ages) {
+		t.Errorf("%d dialogues without a limit", len(unlimited.Dialogues))
+	}
+}
+
+func TestOldestDialoguesFilter(t *testing.T) {
+	oldest := OldestDialogues{Filter: &DialogueFilter{Ssn: -1, OpCode: 0, MinAge: time.Second, Limit: 10}}
+	if oldest.Wants(time.Millisecond) {
+		t.Errorf("wants a dialogue younger than the minimum age")
+	}
+	oldest.Add(testDialogue(2*time.Second, 2))
+	oldest.Add(testDialogue(2*time.Second, 0))
+	if len(oldest.Dialogues) != 1 || oldest.Dialogues[0].Operations[0] != 0 {
+		t.Errorf("dialogues %+v", oldest.Dialogues)
+	}
+}
+
+func TestAdminMux(t *testing.T) {
+	source := testAdminSource{testDialogue(time.Second, 2), testDialogue(3*time.Second, 2), testDialogue(2*time.Second, 45)}
+	ready := false
+	mux := NewAdminMux(source, func() bool { return ready })
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+	if rec := get("/readyz"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("readyz %d before ready", rec.Code)
+	}
+	ready = true
+	if rec := get("/readyz"); rec.Code != http.StatusOK {
+		t.Errorf("readyz %d", rec.Code)
+	}
+	if rec := get("/healthz"); rec.Code != http.StatusOK {
+		t.Errorf("healthz %d", rec.Code)
+	}
+	if rec := get("/stats"); rec.Body.String() != "{\n  \"dialogues\": 3\n}\n" {
+		t.Errorf("stats %q", rec.Body.String())
+	}
+	if rec := get("/dialogues?opcode=x"); rec.Code != http.StatusBadRequest {
+		t.Errorf("bad opcode gave %d", rec.Code)
+	}
+	rec := get("/dialogues?opcode=2&limit=1")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"ageMs": 3000`) || strings.Contains(rec.Body.String(), `"ageMs": 1000`) {
+		t.Errorf("dialogues %s", rec.Body.String())
+	}
+	if rec := get("/dialogues?gt=1"); rec.Body.String() != "[]\n" {
+		t.Errorf("no match gave %q", rec.Body.String())
+	}
+
+	// pprof is only served on request
+	if rec := get("/debug/pprof/cmdline"); rec.Code != http.StatusNotFound {
+		t.Errorf("pprof served by default: %d", rec.Code)
+	}
+	HandlePprof(mux)
+	if rec := get("/debug/pprof/cmdline"); rec.Code != http.StatusOK {
+		t.Errorf("pprof %d", rec.Code)
+	}
+}
+
+func TestParseDialogueFilter(t *testing.T) {
+	f, err := ParseDialogueFilter(map[string][]string{"tid": {"CAFE"}, "ssn": {"6"}, "min-age": {"2s"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Tid != "cafe" || f.Ssn != 6 || f.OpCode != -1 || f.MinAge != 2*time.Second || f.Limit != 100 {
+		t.Errorf("filter %+v", f)
+	}
+	for _, bad := range []map[string][]string{{"tid": {"xyz"}}, {"limit": {"a"}}, {"min-age": {"1"}}} {
+		if _, err := ParseDialogueFilter(bad); err == nil {
+			t.Errorf("%v accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package tcapflow
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no certificates found", caFile)
+	}
+	return pool, nil
+}
+
+// ServerTLSConfig loads the server certificate. With a clientCA the probes
+// may present a certificate signed by it. Whether they must is up to the
+// Authenticator as probes can use a token instead.
+func ServerTLSConfig(certFile, keyFile, clientCA string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if len(clientCA) > 0 {
+		config.ClientCAs, err = loadCertPool(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// ClientTLSConfig verifies the server with the CA (system roots when empty)
+// and presents the certificate if one is given.
+func ClientTLSConfig(certFile, keyFile, ca, serverName string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12}
+	if len(ca) > 0 {
+		pool, err := loadCertPool(ca)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if len(certFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// TokenCredentials sends a bearer token with every RPC. It refuses to
+// send it in plaintext so dialing without TLS fails.
+type TokenCredentials struct {
+	Token string
+}
+
+func (c TokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + c.Token}, nil
+}
+
+func (c TokenCredentials) RequireTransportSecurity() bool {
+	return true
+}
+
+// ReadToken reads a token from the first line of the file
+func ReadToken(filename string) (string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(strings.SplitN(string(data), "\n", 2)[0])
+	if len(token) == 0 {
+		return "", fmt.Errorf("%s: no token", filename)
+	}
+	return token, nil
+}
+
+// Authenticator identifies the probe of each RPC by its verified client
+// certificate or bearer token. RPCs without either are rejected.
+type Authenticator struct {
+	// Token to probe name
+	Tokens map[string]string
+}
+
+// LoadTokens reads lines of '<token> <probe>'. Empty lines and lines
+// starting with # are skipped.
+func (a *Authenticator) LoadTokens(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if a.Tokens == nil {
+		a.Tokens = make(map[string]string)
+	}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: expected '<token> <probe>'", filename, line)
+		}
+		a.Tokens[fields[0]] = fields[1]
+	}
+	return scanner.Err()
+}
+
+type probeKey struct{}
+
+// ProbeFromContext returns the identity of the probe or "" when unknown
+func ProbeFromContext(ctx context.Context) string {
+	probe, _ := ctx.Value(probeKey{}).(string)
+	return probe
+}
+
+func certificateIdentity(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 {
+		return ""
+	}
+	cert := info.State.VerifiedChains[0][0]
+	if len(cert.Subject.CommonName) > 0 {
+		return cert.Subject.CommonName
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return ""
+}
+
+// Identify returns the context with the probe identity. A token wins over
+// the certificate as it names the probe rather than the host.
+func (a *Authenticator) Identify(ctx context.Context) (context.Context, error) {
+	probe := certificateIdentity(ctx)
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, value := range md["authorization"] {
+			if !strings.HasPrefix(value, "Bearer ") {
+				continue
+			}
+			name, found := a.Tokens[strings.TrimPrefix(value, "Bearer ")]
+			if !found {
+				return ctx, status.Errorf(codes.Unauthenticated, "unknown token")
+			}
+			probe = name
+		}
+	}
+	if len(probe) == 0 {
+		return ctx, status.Errorf(codes.Unauthenticated, "no client certificate or token")
+	}
+	return context.WithValue(ctx, probeKey{}, probe), nil
+}
+
+func (a *Authenticator) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := a.Identify(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+type identifiedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s identifiedStream) Context() context.Context {
+	return s.ctx
+}
+
+func (a *Authenticator) StreamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := a.Identify(stream.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, identifiedStream{stream, ctx})
+}
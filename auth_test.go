@@ -0,0 +1,55 @@
+package tcapflow
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// A token is never sent in plaintext
+func TestTokenNeedsTLS(t *testing.T) {
+	conn, err := grpc.Dial("localhost:5345", grpc.WithInsecure(), grpc.WithPerRPCCredentials(TokenCredentials{Token: "secret"}))
+	if err == nil {
+		conn.Close()
+		t.Fatal("dialed without TLS")
+	}
+}
+
+func TestAuthenticatorTokens(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "tokens")
+	ioutil.WriteFile(name, []byte("# probes\nsecret probe-a\n\nother probe-b\n"), 0644)
+
+	a := &Authenticator{}
+	if err := a.LoadTokens(name); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		authorization, probe string
+	}{
+		{"Bearer secret", "probe-a"},
+		{"Bearer other", "probe-b"},
+		{"Bearer unknown", ""},
+		{"", ""},
+	} {
+		ctx := context.Background()
+		if len(c.authorization) > 0 {
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", c.authorization))
+		}
+		ctx, err := a.Identify(ctx)
+		if probe := ProbeFromContext(ctx); probe != c.probe || (err == nil) != (c.probe != "") {
+			t.Errorf("%q identified as %q: %v", c.authorization, probe, err)
+		}
+	}
+
+	ioutil.WriteFile(name, []byte("secret\n"), 0644)
+	if err := a.LoadTokens(name); err == nil {
+		t.Error("loaded a token without a probe")
+	}
+}
@@ -0,0 +1,176 @@
+package tcapflow
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// Helpers to build captures of M3UA/SCCP/TCAP over SCTP for the tests
+
+func testTLV(tag byte, value []byte) []byte {
+	return append([]byte{tag, byte(len(value))}, value...)
+}
+
+// Route on GT with SSN 6, TT 0, E.164
+func testGT(digits string) []byte {
+	b := []byte{0x12, 6, 0, 0x12, 0x04}
+	if len(digits)%2 == 1 {
+		b[3] = 0x11
+	}
+	for i := 0; i < len(digits); i += 2 {
+		lo := digits[i] - '0'
+		hi := byte(0)
+		if i+1 < len(digits) {
+			hi = digits[i+1] - '0'
+		}
+		b = append(b, lo|hi<<4)
+	}
+	return b
+}
+
+func testInvoke(op int) []byte {
+	return testTLV(0xa1, []byte{2, 1, 1, 2, 1, byte(op)})
+}
+
+func testResultLast() []byte {
+	return testTLV(0xa2, []byte{2, 1, 1})
+}
+
+func testTCAP(tag int, otid, dtid []byte, component []byte) []byte {
+	var body []byte
+	if otid != nil {
+		body = append(body, testTLV(0x48, otid)...)
+	}
+	if dtid != nil {
+		body = append(body, testTLV(0x49, dtid)...)
+	}
+	body = append(body, testTLV(0x6c, component)...)
+	return testTLV(byte(0x60|tag), body)
+}
+
+func testUDT(called, calling, data []byte) []byte {
+	b := []byte{0x09, 0x80, 3, byte(3 + len(called)), byte(3 + len(called) + len(calling))}
+	b = append(b, byte(len(called)))
+	b = append(b, called...)
+	b = append(b, byte(len(calling)))
+	b = append(b, calling...)
+	b = append(b, byte(len(data)))
+	return append(b, data...)
+}
+
+// M3UA DATA with OPC 1, DPC 2, SI 3
+func testM3UA(sccp []byte) []byte {
+	data := append([]byte{0, 0, 0, 1, 0, 0, 0, 2, 3, 0, 0, 0}, sccp...)
+	length := 4 + len(data)
+	param := append([]byte{0x02, 0x10, byte(length >> 8), byte(length)}, data...)
+	for len(param)%4 != 0 {
+		param = append(param, 0)
+	}
+	total := 8 + len(param)
+	return append([]byte{1, 0, 1, 1, byte(total >> 24), byte(total >> 16), byte(total >> 8), byte(total)}, param...)
+}
+
+// An Ethernet frame with one SCTP DATA chunk of M3UA between 10.0.0.src
+// and 10.0.0.dst. flags 3 is an unfragmented chunk.
+func testFrame(src, dst byte, tsn uint32, flags byte, payload []byte) []byte {
+	eth := &layers.Ethernet{SrcMAC: make([]byte, 6), DstMAC: make([]byte, 6), EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolSCTP, SrcIP: []byte{10, 0, 0, src}, DstIP: []byte{10, 0, 0, dst}}
+	header := []byte{0x0b, 0x59, 0x0b, 0x59, 0, 0, 0, 0, 0, 0, 0, 0}
+	length := 16 + len(payload)
+	chunk := append([]byte{0, flags, byte(length >> 8), byte(length),
+		byte(tsn >> 24), byte(tsn >> 16), byte(tsn >> 8), byte(tsn), 0, 0, 0, 0, 0, 0, 0, 3}, payload...)
+	for len(chunk)%4 != 0 {
+		chunk = append(chunk, 0)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, eth, ip, gopacket.Payload(append(header, chunk...)))
+	return buf.Bytes()
+}
+
+type testCapture struct {
+	t      *testing.T
+	file   *os.File
+	writer *pcapgo.Writer
+	tsn    uint32
+}
+
+func newTestCapture(t *testing.T, name string) *testCapture {
+	file, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := pcapgo.NewWriter(file)
+	w.WriteFileHeader(65536, layers.LinkTypeEthernet)
+	return &testCapture{t: t, file: file, writer: w}
+}
+
+// Add a TCAP message sent from the calling to the called GT
+func (c *testCapture) add(at time.Time, called, calling string, tcap []byte) {
+	c.tsn++
+	src, dst := byte(1), byte(2)
+	if calling > called {
+		src, dst = dst, src
+	}
+	data := testFrame(src, dst, c.tsn, 3, testM3UA(testUDT(testGT(called), testGT(calling), tcap)))
+	err := c.writer.WritePacket(gopacket.CaptureInfo{Timestamp: at, CaptureLength: len(data), Length: len(data)}, data)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *testCapture) close() {
+	c.file.Close()
+}
+
+// recordingHandler keeps the messages it was handed
+type recordingHandler struct {
+	sync.Mutex
+	shard       int
+	messages    []recordedMessage
+	errors      int
+	packets     int
+	reassembled int
+	expired     int
+}
+
+type recordedMessage struct {
+	called, calling SCCPAddress
+	data            []byte
+	at              time.Time
+}
+
+func (r *recordingHandler) OnData(called_gt SCCPAddress, calling_gt SCCPAddress, data []uint8, packet gopacket.Packet) {
+	r.Lock()
+	defer r.Unlock()
+	r.messages = append(r.messages, recordedMessage{called_gt, calling_gt, data, packet.Metadata().Timestamp})
+}
+
+func (r *recordingHandler) AfterOnePacket() {
+	r.Lock()
+	r.packets++
+	r.Unlock()
+}
+
+func (r *recordingHandler) ParseError(data []uint8, recovered interface{}) {
+	r.Lock()
+	r.errors++
+	r.Unlock()
+}
+
+func (r *recordingHandler) OnIPReassembled() {
+	r.Lock()
+	r.reassembled++
+	r.Unlock()
+}
+
+func (r *recordingHandler) OnIPFragmentsExpired(count int) {
+	r.Lock()
+	r.expired += count
+	r.Unlock()
+}
@@ -0,0 +1,220 @@
+package tcapflow
+
+import (
+	"bufio"
+	"hash/fnv"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HashRing maps dialogue hashes to servers by consistent hashing. Each
+// member has Replicas points on the ring so adding or removing one only
+// moves the dialogues of the ring segments it owns.
+type HashRing struct {
+	members []string
+	points  []uint32
+	owners  map[uint32]string
+}
+
+// Spread the similar FNV hashes of the point names around the ring
+func mix32(h uint32) uint32 {
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
+
+func NewHashRing(members []string, replicas int) *HashRing {
+	r := &HashRing{owners: make(map[uint32]string)}
+	sorted := append([]string(nil), members...)
+	sort.Strings(sorted)
+	for i, member := range sorted {
+		if i == 0 || member != sorted[i-1] {
+			r.members = append(r.members, member)
+		}
+	}
+	for _, member := range r.members {
+		for i := 0; i < replicas; i++ {
+			h := fnv.New32a()
+			h.Write([]byte(member + "#" + strconv.Itoa(i)))
+			point := mix32(h.Sum32())
+			// The lower name wins a collision independent of the order
+			if _, taken := r.owners[point]; taken {
+				continue
+			}
+			r.owners[point] = member
+			r.points = append(r.points, point)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// Members returns the members ordered by name
+func (r *HashRing) Members() []string {
+	return r.members
+}
+
+// Lookup returns the member owning hash or "" for an empty ring
+func (r *HashRing) Lookup(hash uint32) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	hash = mix32(hash)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= hash })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+func sameMembers(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ClusterRouter picks the server for each message of a dialogue. After a
+// membership change the responses of dialogues begun before it still go
+// to the previous owner for Drain, so removed members are only retired
+// once Drain is over.
+type ClusterRouter struct {
+	Replicas int
+	Drain    time.Duration
+
+	sync.Mutex
+	ring     *HashRing
+	previous *HashRing
+	changed  time.Time
+	begins   map[uint32]string    // Owners of the dialogues begun since the change
+	retired  map[string]time.Time // Removed members and when to close them
+}
+
+func NewClusterRouter(replicas int, drain time.Duration) *ClusterRouter {
+	return &ClusterRouter{
+		Replicas: replicas,
+		Drain:    drain,
+		ring:     NewHashRing(nil, replicas),
+		begins:   make(map[uint32]string),
+		retired:  make(map[string]time.Time),
+	}
+}
+
+// SetMembers changes the members and returns the ones that are new. It
+// returns false when nothing changed.
+func (c *ClusterRouter) SetMembers(members []string, now time.Time) ([]string, bool) {
+	c.Lock()
+	defer c.Unlock()
+	ring := NewHashRing(members, c.Replicas)
+	if sameMembers(ring.Members(), c.ring.Members()) {
+		return nil, false
+	}
+	current := make(map[string]bool)
+	for _, member := range c.ring.Members() {
+		current[member] = true
+	}
+
+	var added []string
+	for _, member := range ring.Members() {
+		if current[member] {
+			delete(current, member)
+			continue
+		}
+		if _, ok := c.retired[member]; ok {
+			// Still connected while draining
+			delete(c.retired, member)
+			continue
+		}
+		added = append(added, member)
+	}
+	for member := range current {
+		c.retired[member] = now.Add(c.Drain)
+	}
+	c.previous = nil
+	if len(c.ring.Members()) > 0 {
+		c.previous = c.ring
+	}
+	c.ring = ring
+	c.changed = now
+	c.begins = make(map[uint32]string)
+	return added, true
+}
+
+// Route returns the member to send a message of the dialogue with hash
+// to. A TC-Begin is always sent to the current owner.
+func (c *ClusterRouter) Route(hash uint32, begin bool, now time.Time) string {
+	c.Lock()
+	defer c.Unlock()
+	owner := c.ring.Lookup(hash)
+	if c.previous == nil {
+		return owner
+	}
+	if now.Sub(c.changed) >= c.Drain {
+		c.previous = nil
+		c.begins = make(map[uint32]string)
+		return owner
+	}
+	if begin {
+		c.begins[hash] = owner
+		return owner
+	}
+	if member, ok := c.begins[hash]; ok {
+		return member
+	}
+	return c.previous.Lookup(hash)
+}
+
+// Retire returns the removed members whose drain is over. They are no
+// longer routed to.
+func (c *ClusterRouter) Retire(now time.Time) []string {
+	c.Lock()
+	defer c.Unlock()
+	var done []string
+	for member, at := range c.retired {
+		if !now.Before(at) {
+			done = append(done, member)
+			delete(c.retired, member)
+		}
+	}
+	sort.Strings(done)
+	return done
+}
+
+// Members returns the current members ordered by name
+func (c *ClusterRouter) Members() []string {
+	c.Lock()
+	defer c.Unlock()
+	return c.ring.Members()
+}
+
+// ReadMembers reads the addresses of the cluster, one per line
+func ReadMembers(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var members []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		members = append(members, line)
+	}
+	return members, scanner.Err()
+}
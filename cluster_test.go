@@ -0,0 +1,118 @@
+package tcapflow
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHashRingMovesOnlyToNewMember(t *testing.T) {
+	three := NewHashRing([]string{"a:1", "b:1", "c:1"}, 128)
+	four := NewHashRing([]string{"c:1", "a:1", "b:1", "d:1", "a:1"}, 128)
+	if !reflect.DeepEqual(four.Members(), []string{"a:1", "b:1", "c:1", "d:1"}) {
+		t.Fatalf("members %v", four.Members())
+	}
+
+	const dialogues = 100000
+	counts := make(map[string]int)
+	moved := 0
+	for i := 0; i < dialogues; i++ {
+		h := DialogueKeyHash("4912345-6-" + strconv.Itoa(i))
+		before, after := three.Lookup(h), four.Lookup(h)
+		counts[after]++
+		if before != after {
+			if after != "d:1" {
+				t.Fatalf("moved from %v to %v", before, after)
+			}
+			moved++
+		}
+	}
+	for member, count := range counts {
+		if count < dialogues/8 || count > dialogues/3 {
+			t.Errorf("%v owns %d of %d", member, count, dialogues)
+		}
+	}
+	if moved < dialogues/8 || moved > dialogues/3 {
+		t.Errorf("%d of %d moved", moved, dialogues)
+	}
+	if NewHashRing(nil, 128).Lookup(1) != "" {
+		t.Error("empty ring has an owner")
+	}
+}
+
+// Hashes the ring with a, b and c gives to c
+func hashesMovingTo(member string, count int) []uint32 {
+	ring := NewHashRing([]string{"a", "b", "c"}, 128)
+	var hashes []uint32
+	for h := uint32(1); len(hashes) < count; h++ {
+		if ring.Lookup(h) == member {
+			hashes = append(hashes, h)
+		}
+	}
+	return hashes
+}
+
+func TestClusterRouterDrains(t *testing.T) {
+	c := NewClusterRouter(128, time.Minute)
+	now := time.Unix(1000, 0)
+	if added, changed := c.SetMembers([]string{"a", "b"}, now); !changed || len(added) != 2 {
+		t.Fatalf("added %v", added)
+	}
+	if _, changed := c.SetMembers([]string{"b", "a"}, now); changed {
+		t.Error("the same members in another order changed")
+	}
+
+	previous := NewHashRing([]string{"a", "b"}, 128)
+	hashes := hashesMovingTo("c", 2)
+	open, begun := hashes[0], hashes[1]
+	if added, _ := c.SetMembers([]string{"a", "b", "c"}, now); !reflect.DeepEqual(added, []string{"c"}) {
+		t.Fatalf("added %v", added)
+	}
+
+	// Responses of dialogues begun before the change go to the previous owner
+	if got := c.Route(open, false, now); got != previous.Lookup(open) {
+		t.Errorf("open dialogue routed to %v", got)
+	}
+	if got := c.Route(begun, true, now); got != "c" {
+		t.Errorf("TC-Begin routed to %v", got)
+	}
+	if got := c.Route(begun, false, now); got != "c" {
+		t.Errorf("response of a new dialogue routed to %v", got)
+	}
+	if got := c.Route(open, false, now.Add(time.Minute)); got != "c" {
+		t.Errorf("routed to %v after the drain", got)
+	}
+
+	c.SetMembers([]string{"a", "c"}, now)
+	if retired := c.Retire(now.Add(30 * time.Second)); len(retired) != 0 {
+		t.Errorf("retired %v while draining", retired)
+	}
+	if retired := c.Retire(now.Add(time.Minute)); !reflect.DeepEqual(retired, []string{"b"}) {
+		t.Errorf("retired %v", retired)
+	}
+	if !reflect.DeepEqual(c.Members(), []string{"a", "c"}) {
+		t.Errorf("members %v", c.Members())
+	}
+}
+
+func TestReadMembers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "members")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "members")
+	ioutil.WriteFile(name, []byte("# servers\nserver-a:5345\n\n  server-b:5345  \n"), 0644)
+
+	members, err := ReadMembers(name)
+	if err != nil || !reflect.DeepEqual(members, []string{"server-a:5345", "server-b:5345"}) {
+		t.Errorf("members %v %v", members, err)
+	}
+	if _, err := ReadMembers(filepath.Join(dir, "missing")); err == nil {
+		t.Error("missing file read")
+	}
+}
@@ -5,17 +5,576 @@ import (
 	"encoding/hex"
 	"flag"
 	"fmt"
+	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
 	"github.com/google/gopacket"
 	. "github.com/moiji-mobile/tcapflow"
 	"github.com/moiji-mobile/tcapflow/rpc"
 	"google.golang.org/grpc"
-	"gopkg.in/alexcesaro/statsd.v2"
+	"google.golang.org/grpc/credentials"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type ClientFlowDataHandler struct {
-	Statsd    *statsd.Client
-	RpcClient rpc.TCAPFlowClient
+	Metrics Metrics
+
+	// The servers to send the messages to. Keys routes the later messages
+	// of the initiator with the rest of the dialogue.
+	Cluster *Cluster
+	Keys    *DialogueKeys
+
+	// Match dialogues at the probe. Nil sends every message. mu guards it
+	// and the sequences of the cluster members against the expiry.
+	Local *LocalCorrelator
+	mu    sync.Mutex
+
+	// Sent with each message to let the server detect losses
+	Probe string
+
+	// Labelled metrics for Prometheus. Nil without a metrics listener.
+	Prometheus *PrometheusRegistry
+	Peers      *PeerLabels
+}
+
+// Count the forwarded message by its TCAP type and the receiving peer
+func countMessage(t *ClientFlowDataHandler, state *rpc.StateInfo, outcome string) {
+	if t.Prometheus == nil {
+		return
+	}
+	tag, called_gt := int(state.Tcap.Tag), sccpAddress(state.Called)
+	ac, infos := state.Tcap.ApplicationContext, rosInfos(state.Ros)
+	if ac == "" {
+		ac = "none"
+	}
+	labels := Labels{
+		"message":             TCprocName(tag),
+		"operation":           OperationLabel(infos),
+		"application_context": ac,
+		"ssn":                 strconv.Itoa(int(called_gt.Ssn)),
+		"peer":                t.Peers.Label(called_gt.Number),
+		"outcome":             outcome,
+	}
+	t.Prometheus.Add("tcapflow_client_messages_total", labels, 1)
+}
+
+// Forwarder sends the messages to the server in batches on a stream. The
+// capture only queues them and is not held up by the network. While the
+// server can not be reached the batches go to the Spool and are replayed
+// in order once connected again. Without a spool they are dropped, as
+// are messages arriving on a full queue.
+type Forwarder struct {
+	// Messages that were not sent. First to be 64-bit aligned.
+	Dropped uint64
+
+	// Address of the server to label the metrics with
+	Server     string
+	Client     rpc.TCAPFlowClient
+	Metrics    Metrics
+	Prometheus *PrometheusRegistry
+	BatchSize  int
+	Interval   time.Duration
+	Spool      *Spool
+
+	// Delay between reconnects doubling from MinBackoff to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	queue    chan *rpc.StateInfo
+	finished chan struct{}
+	sequence uint64
+	stream   *batchStream
+	backoff  time.Duration
+	retryAt  time.Time
+}
+
+// How long to wait for the acks of replayed batches before reconnecting
+const ackTimeout = 10 * time.Second
+
+// Replayed batches sent before waiting for their acks
+const replayBatches = 8
+
+type pendingBatch struct {
+	sent   time.Time
+	states []*rpc.StateInfo
+	acked  chan struct{}
+}
+
+// A stream with the batches waiting for their ack. done is closed once
+// the stream ended.
+type batchStream struct {
+	rpc.TCAPFlow_StreamStatesClient
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu      sync.Mutex
+	pending map[uint64]pendingBatch
+}
+
+// Take the batches that will not be acknowledged, oldest first
+func (s *batchStream) unacked() []pendingBatch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sequences := make([]uint64, 0, len(s.pending))
+	for sequence := range s.pending {
+		sequences = append(sequences, sequence)
+	}
+	sort.Slice(sequences, func(i, j int) bool { return sequences[i] < sequences[j] })
+
+	batches := make([]pendingBatch, 0, len(sequences))
+	for _, sequence := range sequences {
+		batches = append(batches, s.pending[sequence])
+		delete(s.pending, sequence)
+	}
+	return batches
+}
+
+func (s *batchStream) broken() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func NewForwarder(client rpc.TCAPFlowClient, metrics Metrics, queueSize, batchSize int, interval time.Duration) *Forwarder {
+	f := &Forwarder{
+		Client:     client,
+		Metrics:    metrics,
+		BatchSize:  batchSize,
+		Interval:   interval,
+		MinBackoff: 100 * time.Millisecond,
+		MaxBackoff: 30 * time.Second,
+		queue:      make(chan *rpc.StateInfo, queueSize),
+		finished:   make(chan struct{}),
+	}
+	return f
+}
+
+func (f *Forwarder) Start() {
+	f.backoff = f.MinBackoff
+	go f.run()
+}
+
+// Queue returns false when the message was dropped
+func (f *Forwarder) Queue(state *rpc.StateInfo) bool {
+	select {
+	case f.queue <- state:
+		return true
+	default:
+		f.drop(1)
+		return false
+	}
+}
+
+func (f *Forwarder) count(event string, count int) {
+	if count == 0 {
+		return
+	}
+	f.Metrics.Count("tcapflow-client."+event, int64(count))
+	if f.Prometheus != nil {
+		f.Prometheus.Add("tcapflow_client_spool_messages_total", Labels{"event": event}, float64(count))
+	}
+}
+
+func (f *Forwarder) drop(count int) {
+	atomic.AddUint64(&f.Dropped, uint64(count))
+	f.count("dropped", count)
+}
+
+func (f *Forwarder) observe(outcome string, latency time.Duration) {
+	if f.Prometheus != nil {
+		f.Prometheus.Observe("tcapflow_client_rpc_latency_seconds", Labels{"outcome": outcome}, latency.Seconds())
+	}
+}
+
+func (f *Forwarder) run() {
+	defer close(f.finished)
+
+	batch := make([]*rpc.StateInfo, 0, f.BatchSize)
+	ticker := time.NewTicker(f.Interval)
+	defer ticker.Stop()
+
+	for {
+		closed := false
+		select {
+		case state, ok := <-f.queue:
+			if ok {
+				batch = append(batch, state)
+				if len(batch) < f.BatchSize {
+					continue
+				}
+			}
+			closed = !ok
+		case <-ticker.C:
+			f.Metrics.Gauge("tcapflow-client.queue", float64(len(f.queue)))
+			if f.Spool != nil {
+				f.Metrics.Gauge("tcapflow-client.spool", float64(f.Spool.Len()))
+				if f.Prometheus != nil {
+					f.Prometheus.Set("tcapflow_client_spool_size", Labels{"server": f.Server}, float64(f.Spool.Len()))
+				}
+			}
+		}
+
+		f.checkStream()
+		f.replay()
+		if len(batch) > 0 {
+			f.forward(batch)
+			batch = batch[:0]
+		}
+		if closed {
+			break
+		}
+	}
+
+	// Wait for the last acks
+	if f.stream != nil {
+		f.stream.CloseSend()
+		select {
+		case <-f.stream.done:
+		case <-time.After(5 * time.Second):
+		}
+		f.checkStream()
+		f.giveUp()
+	}
+}
+
+func (f *Forwarder) spool(states []*rpc.StateInfo) {
+	if f.Spool == nil {
+		f.drop(len(states))
+		return
+	}
+	for i, state := range states {
+		data, err := proto.Marshal(state)
+		if err == nil {
+			err = f.Spool.Append(data)
+		}
+		if err != nil {
+			fmt.Printf("ERROR: spool: %v\n", err)
+			f.drop(len(states) - i)
+			return
+		}
+		f.count("spooled", 1)
+	}
+}
+
+// Give up the stream and retry after the backoff. The batches that were
+// not acknowledged are spooled again unless they came from the spool.
+func (f *Forwarder) giveUp() {
+	if f.stream == nil {
+		return
+	}
+	f.stream.cancel()
+	for _, batch := range f.stream.unacked() {
+		if batch.acked == nil {
+			f.spool(batch.states)
+		}
+	}
+	f.stream = nil
+	f.retryAt = time.Now().Add(f.backoff)
+	f.backoff *= 2
+	if f.backoff > f.MaxBackoff {
+		f.backoff = f.MaxBackoff
+	}
+}
+
+func (f *Forwarder) checkStream() {
+	if f.stream != nil && f.stream.broken() {
+		f.giveUp()
+	}
+}
+
+// Open the stream unless waiting for the backoff
+func (f *Forwarder) connect() bool {
+	if f.stream != nil {
+		return true
+	}
+	if time.Now().Before(f.retryAt) {
+		return false
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	client, err := f.Client.StreamStates(ctx)
+	if err != nil {
+		cancel()
+		fmt.Printf("RPC error: (%v)\n", err)
+		f.Metrics.Increment("tcapflow-client.rpcError")
+		f.retryAt = time.Now().Add(f.backoff)
+		f.backoff *= 2
+		if f.backoff > f.MaxBackoff {
+			f.backoff = f.MaxBackoff
+		}
+		return false
+	}
+	f.Metrics.Increment("tcapflow-client.connect")
+	f.backoff = f.MinBackoff
+	f.stream = &batchStream{
+		TCAPFlow_StreamStatesClient: client,
+		cancel:                      cancel,
+		done:                        make(chan struct{}),
+		pending:                     make(map[uint64]pendingBatch),
+	}
+	go f.receiveAcks(f.stream)
+	return true
+}
+
+// Send a batch on the stream. The states must not be modified later.
+func (f *Forwarder) send(states []*rpc.StateInfo, acked chan struct{}) bool {
+	f.sequence++
+	f.stream.mu.Lock()
+	f.stream.pending[f.sequence] = pendingBatch{sent: time.Now(), states: states, acked: acked}
+	f.stream.mu.Unlock()
+
+	err := f.stream.Send(&rpc.StateBatch{Sequence: f.sequence, States: states})
+	if err != nil {
+		fmt.Printf("RPC error: (%v)\n", err)
+		f.Metrics.Increment("tcapflow-client.rpcError")
+		f.giveUp()
+		return false
+	}
+	f.Metrics.Increment("tcapflow-client.batchSent")
+	return true
+}
+
+// Send a batch from the queue. It is spooled while the spool is replayed
+// to keep the order.
+func (f *Forwarder) forward(batch []*rpc.StateInfo) {
+	states := append([]*rpc.StateInfo(nil), batch...)
+	if (f.Spool != nil && f.Spool.Len() > 0) || !f.connect() {
+		f.spool(states)
+		return
+	}
+	f.send(states, nil)
+}
+
+// Send the spooled batches replayBatches at a time. They stay in the
+// spool until all of them are acknowledged.
+func (f *Forwarder) replay() {
+	for f.Spool != nil && f.Spool.Len() > 0 && f.connect() {
+		records, err := f.Spool.Peek(replayBatches * f.BatchSize)
+		if err != nil {
+			fmt.Printf("ERROR: spool: %v\n", err)
+			return
+		}
+		if len(records) == 0 {
+			return
+		}
+		states := make([]*rpc.StateInfo, 0, len(records))
+		for _, record := range records {
+			state := &rpc.StateInfo{}
+			if proto.Unmarshal(record, state) == nil {
+				states = append(states, state)
+			}
+		}
+
+		var acks []chan struct{}
+		for start := 0; start < len(states); start += f.BatchSize {
+			end := start + f.BatchSize
+			if end > len(states) {
+				end = len(states)
+			}
+			acked := make(chan struct{})
+			if !f.send(states[start:end], acked) {
+				return
+			}
+			acks = append(acks, acked)
+		}
+		timeout := time.After(ackTimeout)
+		for _, acked := range acks {
+			select {
+			case <-acked:
+			case <-f.stream.done:
+				f.giveUp()
+				return
+			case <-timeout:
+				fmt.Printf("RPC error: no ack for the replayed batches\n")
+				f.Metrics.Increment("tcapflow-client.rpcError")
+				f.giveUp()
+				return
+			}
+		}
+		if err := f.Spool.Commit(len(records)); err != nil {
+			fmt.Printf("ERROR: spool: %v\n", err)
+		}
+		f.count("replayed", len(states))
+
+		// Keep the queue going
+		if len(f.queue) > cap(f.queue)/2 {
+			return
+		}
+	}
+}
+
+func (f *Forwarder) receiveAcks(stream *batchStream) {
+	defer close(stream.done)
+	for {
+		ack, err := stream.Recv()
+		if err != nil {
+			if err != io.EOF {
+				fmt.Printf("RPC error: (%v)\n", err)
+				f.observe("rpc_error", 0)
+			}
+			return
+		}
+
+		stream.mu.Lock()
+		batch, ok := stream.pending[ack.Sequence]
+		delete(stream.pending, ack.Sequence)
+		stream.mu.Unlock()
+		if ok {
+			latency := time.Since(batch.sent)
+			f.Metrics.Increment("tcapflow-client.batchAcked")
+			f.Metrics.Timing("tcapflow-client.ackLatency", float64(latency/time.Millisecond))
+			f.observe("acked", latency)
+			if batch.acked != nil {
+				close(batch.acked)
+			}
+		}
+	}
+}
+
+// Close sends what is queued and waits for the acks. What is not sent
+// stays in the spool.
+func (f *Forwarder) Close() {
+	close(f.queue)
+	<-f.finished
+	if f.Spool != nil {
+		f.Spool.Close()
+	}
+}
+
+// A tcapflow-server of the cluster. Without batches forwarder is nil and
+// each message is sent with AddState. Each server gets its own sequence
+// so it can tell missing messages from the ones sent to the others.
+type clusterMember struct {
+	sequence  uint64
+	address   string
+	conn      *grpc.ClientConn
+	client    rpc.TCAPFlowClient
+	forwarder *Forwarder
+}
+
+func (m *clusterMember) close() {
+	if m.forwarder != nil {
+		m.forwarder.Close()
+	}
+	m.conn.Close()
+}
+
+// Cluster sends all messages of a dialogue to the same tcapflow-server.
+// Connect is called for each server joining the cluster.
+type Cluster struct {
+	Router  *ClusterRouter
+	Connect func(address string) (*clusterMember, error)
+
+	mu      sync.Mutex
+	members map[string]*clusterMember
+	closed  chan struct{}
+}
+
+func NewCluster(router *ClusterRouter, connect func(string) (*clusterMember, error)) *Cluster {
+	return &Cluster{
+		Router:  router,
+		Connect: connect,
+		members: make(map[string]*clusterMember),
+		closed:  make(chan struct{}),
+	}
+}
+
+// Update connects to the new addresses and routes to them. Removed
+// servers keep getting the rest of their dialogues until retired.
+func (c *Cluster) Update(addresses []string) error {
+	for _, address := range addresses {
+		c.mu.Lock()
+		_, ok := c.members[address]
+		c.mu.Unlock()
+		if ok {
+			continue
+		}
+		member, err := c.Connect(address)
+		if err != nil {
+			return fmt.Errorf("Failed to connect to %v: %v", address, err)
+		}
+		c.mu.Lock()
+		c.members[address] = member
+		c.mu.Unlock()
+	}
+	if _, changed := c.Router.SetMembers(addresses, time.Now()); changed {
+		fmt.Printf("Cluster members: %v\n", c.Router.Members())
+	}
+	c.retire()
+	return nil
+}
+
+// Close the servers whose drain is over
+func (c *Cluster) retire() {
+	var retired []*clusterMember
+	c.mu.Lock()
+	for _, address := range c.Router.Retire(time.Now()) {
+		if member, ok := c.members[address]; ok {
+			retired = append(retired, member)
+			delete(c.members, address)
+		}
+	}
+	c.mu.Unlock()
+	for _, member := range retired {
+		fmt.Printf("Retired cluster member %v\n", member.address)
+		member.close()
+	}
+}
+
+// Member returns the server for the dialogue with hash or nil if there
+// is none
+func (c *Cluster) Member(hash uint32, begin bool) *clusterMember {
+	address := c.Router.Route(hash, begin, time.Now())
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.members[address]
+}
+
+// Watch reloads the members from file every interval
+func (c *Cluster) Watch(file string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.closed:
+			return
+		case <-ticker.C:
+		}
+		addresses, err := ReadMembers(file)
+		if err == nil && len(addresses) == 0 {
+			err = fmt.Errorf("%v: no members", file)
+		}
+		if err != nil {
+			fmt.Printf("ERROR: Keeping the cluster members: %v\n", err)
+			c.retire()
+			continue
+		}
+		err = c.Update(addresses)
+		if err != nil {
+			fmt.Printf("ERROR: %v\n", err)
+		}
+	}
+}
+
+func (c *Cluster) Close() {
+	close(c.closed)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for address, member := range c.members {
+		member.close()
+		delete(c.members, address)
+	}
 }
 
 func SCCPAddressProto(addr SCCPAddress) *rpc.SCCPAddress {
@@ -27,6 +586,184 @@ func SCCPAddressProto(addr SCCPAddress) *rpc.SCCPAddress {
 	}
 }
 
+func buildKey(gt *rpc.SCCPAddress, tid []byte) string {
+	return gt.Number + "-" + strconv.Itoa(int(gt.Ssn)) + "-" + hex.EncodeToString(tid)
+}
+
+type localEntry struct {
+	key   string
+	added time.Time
+}
+
+type heldBegin struct {
+	state *rpc.StateInfo
+	added time.Time
+}
+
+// A continued dialogue is known by the side of each peer
+type oldDialogue struct {
+	added time.Time
+	other string
+}
+
+// LocalCorrelator matches the TC-Begin and first response of dialogues
+// seen by this probe like the server does. A matched dialogue is sent as
+// its TC-Begin with a summary of the response. TC-Begins not answered
+// within Hold and responses without a TC-Begin are sent as they are for
+// the server to correlate. Further messages of a dialogue that continued
+// are not sent for ExpireEnded as the server would ignore them. These
+// are addressed to the initiator's or to the responder's side.
+type LocalCorrelator struct {
+	Hold        time.Duration
+	ExpireEnded time.Duration
+	Metrics     Metrics
+	Prometheus  *PrometheusRegistry
+
+	begins     map[string]heldBegin
+	beginOrder []localEntry
+	old        map[string]oldDialogue
+	oldOrder   []localEntry
+}
+
+func NewLocalCorrelator(hold, expireEnded time.Duration, metrics Metrics) *LocalCorrelator {
+	return &LocalCorrelator{
+		Hold:        hold,
+		ExpireEnded: expireEnded,
+		Metrics:     metrics,
+		begins:      make(map[string]heldBegin),
+		old:         make(map[string]oldDialogue),
+	}
+}
+
+func (c *LocalCorrelator) count(event string) {
+	c.Metrics.Increment("tcapflow-client.local." + event)
+	if c.Prometheus != nil {
+		c.Prometheus.Add("tcapflow_client_local_messages_total", Labels{"event": event}, 1)
+	}
+}
+
+// Hold the TC-Begin until its response arrives
+func (c *LocalCorrelator) hold(key string, state *rpc.StateInfo, now time.Time) []*rpc.StateInfo {
+	var send []*rpc.StateInfo
+	if held, ok := c.begins[key]; ok {
+		// The TID was reused
+		send = append(send, held.state)
+		c.count("unanswered")
+	}
+	if dialogue, ok := c.old[key]; ok {
+		delete(c.old, key)
+		delete(c.old, dialogue.other)
+	}
+	c.begins[key] = heldBegin{state, now}
+	c.beginOrder = append(c.beginOrder, localEntry{key, now})
+	return send
+}
+
+// Add returns the messages to send now
+func (c *LocalCorrelator) Add(state *rpc.StateInfo, now time.Time) []*rpc.StateInfo {
+	send := c.Expire(now)
+	switch state.Tcap.Tag {
+	case TCbeginApp:
+		return append(send, c.hold(buildKey(state.Calling, state.Tcap.Otid), state, now)...)
+	case TCendApp, TCcontinueApp, TCabortApp:
+	default:
+		return append(send, state)
+	}
+
+	key := buildKey(state.Called, state.Tcap.Dtid)
+	if held, ok := c.begins[key]; ok {
+		delete(c.begins, key)
+		begin := held.state
+		begin.Response = &rpc.ResponseSummary{
+			Time:    state.Time,
+			Tag:     state.Tcap.Tag,
+			Ros:     state.Ros,
+			Calling: state.Calling,
+			Otid:    state.Tcap.Otid,
+		}
+		if state.Tcap.Tag == TCcontinueApp {
+			responder := buildKey(state.Calling, state.Tcap.Otid)
+			c.old[key] = oldDialogue{now, responder}
+			c.old[responder] = oldDialogue{now, key}
+			c.oldOrder = append(c.oldOrder, localEntry{key, now}, localEntry{responder, now})
+		}
+		c.count("matched")
+		return append(send, begin)
+	}
+	if dialogue, ok := c.old[key]; ok {
+		if state.Tcap.Tag != TCcontinueApp {
+			delete(c.old, key)
+			delete(c.old, dialogue.other)
+		}
+		c.count("ignored")
+		return send
+	}
+	c.count("unmatched")
+	return append(send, state)
+}
+
+// Expire returns the TC-Begins held for longer than Hold
+func (c *LocalCorrelator) Expire(now time.Time) []*rpc.StateInfo {
+	var send []*rpc.StateInfo
+	for len(c.beginOrder) > 0 && now.Sub(c.beginOrder[0].added) >= c.Hold {
+		entry := c.beginOrder[0]
+		c.beginOrder[0] = localEntry{}
+		c.beginOrder = c.beginOrder[1:]
+		// Skip entries of answered or replaced TC-Begins
+		held, ok := c.begins[entry.key]
+		if !ok || !held.added.Equal(entry.added) {
+			continue
+		}
+		delete(c.begins, entry.key)
+		send = append(send, held.state)
+		c.count("unanswered")
+	}
+	for len(c.oldOrder) > 0 && now.Sub(c.oldOrder[0].added) >= c.ExpireEnded {
+		entry := c.oldOrder[0]
+		c.oldOrder[0] = localEntry{}
+		c.oldOrder = c.oldOrder[1:]
+		if dialogue, ok := c.old[entry.key]; ok && dialogue.added.Equal(entry.added) {
+			delete(c.old, entry.key)
+		}
+	}
+	return send
+}
+
+// Flush returns all held TC-Begins
+func (c *LocalCorrelator) Flush() []*rpc.StateInfo {
+	var send []*rpc.StateInfo
+	for _, entry := range c.beginOrder {
+		if held, ok := c.begins[entry.key]; ok && held.added.Equal(entry.added) {
+			delete(c.begins, entry.key)
+			send = append(send, held.state)
+			c.count("unanswered")
+		}
+	}
+	c.beginOrder = nil
+	return send
+}
+
+func sccpAddress(addr *rpc.SCCPAddress) SCCPAddress {
+	return SCCPAddress{
+		Ssn:    uint8(addr.Ssn),
+		Ton:    uint8(addr.Ton),
+		Npi:    uint8(addr.Npi),
+		Number: addr.Number,
+	}
+}
+
+func rosInfos(infos []*rpc.ROSInfo) []ROSInfo {
+	result := make([]ROSInfo, 0, len(infos))
+	for _, info := range infos {
+		result = append(result, ROSInfo{
+			Type:     int(info.Type),
+			InvokeId: int(info.InvokeId),
+			OpCode:   int(info.OpCode),
+		})
+	}
+	return result
+}
+
 func ROSInfoProto(infos []ROSInfo) []*rpc.ROSInfo {
 	rpcInfos := make([]*rpc.ROSInfo, 0, len(infos))
 	for _, info := range infos {
@@ -40,35 +777,127 @@ func ROSInfoProto(infos []ROSInfo) []*rpc.ROSInfo {
 }
 
 func (t *ClientFlowDataHandler) OnData(called_gt SCCPAddress, calling_gt SCCPAddress, data []uint8, packet gopacket.Packet) {
-	tag, otid, dtid, _, comp, _ := DecodeTCAP(data)
+	tag, otid, dtid, dialogue, comp, _ := DecodeTCAP(data)
 	infos, _ := DecodeROS(comp.Bytes)
+	ac, _ := DecodeApplicationContext(dialogue)
 
 	rpcTime, _ := ptypes.TimestampProto(packet.Metadata().Timestamp)
-	rpc := &rpc.StateInfo{
+	state := &rpc.StateInfo{
 		Time:    rpcTime,
 		Calling: SCCPAddressProto(calling_gt),
 		Called:  SCCPAddressProto(called_gt),
 		Tcap: &rpc.TCAPInfo{
-			Otid: otid.Bytes,
-			Dtid: dtid.Bytes,
-			Tag:  int32(tag)},
-		Ros: ROSInfoProto(infos),
+			Otid:               otid.Bytes,
+			Dtid:               dtid.Bytes,
+			Tag:                int32(tag),
+			ApplicationContext: ac.String()},
+		Ros:   ROSInfoProto(infos),
+		Probe: t.Probe,
+	}
+
+	if t.Local == nil {
+		t.send(state)
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, state := range t.Local.Add(state, time.Now()) {
+		t.send(state)
+	}
+}
+
+// Send the TC-Begins that were not answered in time
+func (t *ClientFlowDataHandler) expireLocal() {
+	for now := range time.Tick(t.Local.Hold / 4) {
+		t.mu.Lock()
+		for _, state := range t.Local.Expire(now) {
+			t.send(state)
+		}
+		t.mu.Unlock()
+	}
+}
+
+// Flush sends the TC-Begins still held for local correlation
+func (t *ClientFlowDataHandler) Flush() {
+	if t.Local == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, state := range t.Local.Flush() {
+		t.send(state)
+	}
+}
+
+func (t *ClientFlowDataHandler) send(state *rpc.StateInfo) {
+	tag := int(state.Tcap.Tag)
+	capt, _ := ptypes.Timestamp(state.Time)
+	key := t.Keys.Key(tag, buildKey(state.Calling, state.Tcap.Otid), buildKey(state.Called, state.Tcap.Dtid), capt)
+	// The initiator addresses the responder of a locally matched dialogue
+	if response := state.Response; response != nil && response.Tag == TCcontinueApp {
+		calling := state.Called
+		if response.Calling != nil {
+			calling = response.Calling
+		}
+		t.Keys.Key(TCcontinueApp, buildKey(calling, response.Otid), key, capt)
+	}
+	member := t.Cluster.Member(DialogueKeyHash(key), tag == TCbeginApp)
+	if member == nil {
+		t.Metrics.Increment("tcapflow-client.noServer")
+		countMessage(t, state, "no_server")
+		return
+	}
+	member.sequence++
+	state.Sequence = member.sequence
+	if member.forwarder != nil {
+		if member.forwarder.Queue(state) {
+			countMessage(t, state, "queued")
+		} else {
+			countMessage(t, state, "dropped")
+		}
+		return
 	}
 
-	_, err := t.RpcClient.AddState(context.Background(), rpc)
+	start := time.Now()
+	_, err := member.client.AddState(context.Background(), state)
+	if t.Prometheus != nil {
+		outcome := "sent"
+		if err != nil {
+			outcome = "rpc_error"
+		}
+		t.Prometheus.Observe("tcapflow_client_rpc_latency_seconds", Labels{"outcome": outcome}, time.Since(start).Seconds())
+	}
 	if err != nil {
 		fmt.Printf("RPC error: (%v)\n", err)
-		t.Statsd.Increment("tcapflow-client.rpcError")
+		t.Metrics.Increment("tcapflow-client.rpcError")
+		countMessage(t, state, "rpc_error")
+		return
 	}
+	countMessage(t, state, "sent")
 }
 
 func (t *ClientFlowDataHandler) ParseError(data []uint8, r interface{}) {
 	fmt.Printf("ParseError: SCTP(%v) %v\n", hex.EncodeToString(data), r)
-	t.Statsd.Increment("tcapflow-client.parseError")
+	t.Metrics.Increment("tcapflow-client.parseError")
+	if t.Prometheus != nil {
+		t.Prometheus.Add("tcapflow_client_parse_errors_total", nil, 1)
+	}
+}
+
+func (t *ClientFlowDataHandler) OnIPReassembled() {
+	t.Metrics.Increment("tcapflow-client.ipReassembled")
+}
+
+func (t *ClientFlowDataHandler) OnIPFragmentsExpired(count int) {
+	t.Metrics.Count("tcapflow-client.ipFragmentsExpired", int64(count))
+}
+
+// Data returned by the network, counted by its return cause
+func (t *ClientFlowDataHandler) OnSCCPService(msg *Message, cause uint8) {
+	t.Metrics.Increment("tcapflow-client.sccpService", Tag{Key: "type", Value: SCCPTypeName(msg.SCCPType)}, Tag{Key: "cause", Value: strconv.Itoa(int(cause))})
 }
 
 func (t *ClientFlowDataHandler) AfterOnePacket() {
-	t.Statsd.Flush()
 }
 
 func main() {
@@ -80,22 +909,156 @@ func main() {
 	pcapDevice := flag.String("pcap-device", "any", "Device to sniff")
 	pcapFilter := flag.String("pcap-filter", "sctp", "Filter for live sniffing")
 	statsdPrefix := flag.String("statsd-prefix", "", "Prefix for statsd messages")
-	serverAddr := flag.String("remote-address", "localhost:5345", "Hostname:port for RPC")
+	metricsBackend := flag.String("metrics-backend", MetricsStatsd, "Metrics backend: statsd, dogstatsd, influx or none")
+	metricsRemote := flag.String("metrics-remote-address", "", "Hostname:port of the metrics backend (empty picks its default)")
+	metricsFlush := flag.Duration("metrics-flush-interval", time.Second, "Interval to send batched metrics")
+	serverAddr := flag.String("remote-address", "localhost:5345", "Hostname:port for RPC, comma separated for a cluster")
+	clusterFile := flag.String("cluster-file", "", "File with the hostname:port of each server, reloaded every -cluster-refresh (overrides -remote-address)")
+	clusterRefresh := flag.Duration("cluster-refresh", 10*time.Second, "Interval to reload the -cluster-file")
+	clusterDrain := flag.Duration("cluster-drain", time.Minute, "Keep sending the dialogues begun before a membership change to their old server")
+	clusterReplicas := flag.Int("cluster-replicas", 128, "Points per server on the hash ring")
+	metricsAddr := flag.String("metrics-address", "", "Hostname:port to serve Prometheus /metrics on (empty disables it)")
+	metricsGtPrefix := flag.Int("metrics-gt-prefix", 5, "Digits of the peer GT used as metric label")
+	metricsPartners := flag.String("metrics-partners", "", "File with lines of '<gt prefix> <partner>' to label peers by name")
+	batchSize := flag.Int("batch-size", 100, "Messages per batch sent on the stream (0 sends each with AddState)")
+	batchInterval := flag.Duration("batch-interval", 100*time.Millisecond, "Send incomplete batches after this time")
+	queueSize := flag.Int("queue-size", 10000, "Messages to queue for sending before dropping them")
+	spoolDir := flag.String("spool-dir", "", "Directory to keep messages in while a server is unreachable, one subdirectory per server (empty drops them)")
+	spoolSize := flag.Int64("spool-size", 256<<20, "Maximum bytes to spool")
+	reconnectMin := flag.Duration("reconnect-min", 100*time.Millisecond, "First delay before reconnecting to the server")
+	reconnectMax := flag.Duration("reconnect-max", 30*time.Second, "Maximum delay between reconnects")
+	localCorrelation := flag.Bool("local-correlation", false, "Match dialogues at the probe and send one message with the TC-Begin and its first response")
+	localHold := flag.Duration("local-hold", time.Second, "Time to hold a TC-Begin for its response (keep below -expire-pending of the server)")
+	localEnded := flag.Duration("local-expired-ended", 10*time.Second, "Time to not send further messages of a locally matched dialogue that continued")
+	probeName := flag.String("probe-name", "", "Name of this probe at the server (empty uses the hostname)")
+	useTLS := flag.Bool("tls", false, "Connect to the server with TLS (implied by the other -tls flags)")
+	tlsCA := flag.String("tls-ca", "", "PEM CA to verify the server with (empty uses the system roots)")
+	tlsCert := flag.String("tls-cert", "", "PEM client certificate to authenticate with")
+	tlsKey := flag.String("tls-key", "", "PEM key of the client certificate")
+	tlsServerName := flag.String("tls-server-name", "", "Name to verify the server certificate against (empty uses the host of -remote-address)")
+	authTokenFile := flag.String("auth-token-file", "", "File with a bearer token to authenticate with (needs TLS)")
 	flag.Parse()
 
-	flowHandler.Statsd, err = statsd.New(statsd.Prefix(*statsdPrefix))
+	if *batchSize < 0 || *queueSize < 0 {
+		fmt.Printf("ERROR: -batch-size and -queue-size can not be negative\n")
+		return
+	}
+	if *batchSize > 0 && *batchInterval <= 0 {
+		fmt.Printf("ERROR: -batch-interval needs to be positive\n")
+		return
+	}
+
+	flowHandler.Probe = *probeName
+	if len(flowHandler.Probe) == 0 {
+		flowHandler.Probe, _ = os.Hostname()
+	}
+
+	flowHandler.Metrics, err = NewMetrics(*metricsBackend, *metricsRemote, *statsdPrefix, *metricsFlush)
 	if err != nil {
-		fmt.Printf("ERROR: Failed to create statsd client\n")
+		fmt.Printf("ERROR: Failed to create metrics client: %v\n", err)
 		return
 	}
-	defer flowHandler.Statsd.Close()
+	defer flowHandler.Metrics.Close()
+
+	if len(*metricsAddr) > 0 {
+		flowHandler.Peers = &PeerLabels{PrefixLength: *metricsGtPrefix}
+		if len(*metricsPartners) > 0 {
+			err = flowHandler.Peers.LoadPartners(*metricsPartners)
+			if err != nil {
+				fmt.Printf("ERROR: %v\n", err)
+				return
+			}
+		}
+		flowHandler.Prometheus = NewPrometheusRegistry()
+		flowHandler.Prometheus.NewCounter("tcapflow_client_messages_total", "TCAP messages forwarded to the server.")
+		flowHandler.Prometheus.NewHistogram("tcapflow_client_rpc_latency_seconds", "Duration of the AddState call or until a batch is acknowledged.", LatencyBuckets)
+		flowHandler.Prometheus.NewCounter("tcapflow_client_parse_errors_total", "Messages that failed to parse.")
+		flowHandler.Prometheus.NewCounter("tcapflow_client_spool_messages_total", "Messages spooled, replayed or dropped.")
+		flowHandler.Prometheus.NewGauge("tcapflow_client_spool_size", "Messages in the spool.")
+		flowHandler.Prometheus.NewCounter("tcapflow_client_local_messages_total", "Messages matched, unmatched, unanswered or ignored by local correlation.")
+		ServePrometheus(*metricsAddr, flowHandler.Prometheus)
+	}
+
+	var options []grpc.DialOption
+	secure := *useTLS || len(*tlsCA) > 0 || len(*tlsCert) > 0 || len(*tlsServerName) > 0
+	if secure {
+		config, err := ClientTLSConfig(*tlsCert, *tlsKey, *tlsCA, *tlsServerName)
+		if err != nil {
+			fmt.Printf("ERROR: %v\n", err)
+			return
+		}
+		options = append(options, grpc.WithTransportCredentials(credentials.NewTLS(config)))
+	} else {
+		options = append(options, grpc.WithInsecure())
+	}
+	if len(*authTokenFile) > 0 {
+		if !secure {
+			fmt.Printf("ERROR: -auth-token-file needs -tls to not send the token in plaintext\n")
+			return
+		}
+		token, err := ReadToken(*authTokenFile)
+		if err != nil {
+			fmt.Printf("ERROR: %v\n", err)
+			return
+		}
+		options = append(options, grpc.WithPerRPCCredentials(TokenCredentials{Token: token}))
+	}
 
-	rpcConn, err := grpc.Dial(*serverAddr, grpc.WithInsecure())
+	connect := func(address string) (*clusterMember, error) {
+		conn, err := grpc.Dial(address, options...)
+		if err != nil {
+			return nil, err
+		}
+		member := &clusterMember{address: address, conn: conn, client: rpc.NewTCAPFlowClient(conn)}
+		if *batchSize == 0 {
+			return member, nil
+		}
+		member.forwarder = NewForwarder(member.client, flowHandler.Metrics, *queueSize, *batchSize, *batchInterval)
+		member.forwarder.Server = address
+		member.forwarder.Prometheus = flowHandler.Prometheus
+		member.forwarder.MinBackoff = *reconnectMin
+		member.forwarder.MaxBackoff = *reconnectMax
+		if len(*spoolDir) > 0 {
+			// Each server has its own spool
+			member.forwarder.Spool, err = OpenSpool(filepath.Join(*spoolDir, url.PathEscape(address)), *spoolSize, 4<<20)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		member.forwarder.Start()
+		return member, nil
+	}
+
+	var addresses []string
+	for _, address := range strings.Split(*serverAddr, ",") {
+		if address = strings.TrimSpace(address); len(address) > 0 {
+			addresses = append(addresses, address)
+		}
+	}
+	if len(*clusterFile) > 0 {
+		addresses, err = ReadMembers(*clusterFile)
+		if err != nil {
+			fmt.Printf("ERROR: %v\n", err)
+			return
+		}
+	}
+	flowHandler.Cluster = NewCluster(NewClusterRouter(*clusterReplicas, *clusterDrain), connect)
+	flowHandler.Keys = NewDialogueKeys(10 * time.Minute)
+	err = flowHandler.Cluster.Update(addresses)
 	if err != nil {
-		fmt.Printf("ERROR: Failed to open RPC connection\n")
+		fmt.Printf("ERROR: %v\n", err)
 		return
 	}
-	defer rpcConn.Close()
-	flowHandler.RpcClient = rpc.NewTCAPFlowClient(rpcConn)
+	defer flowHandler.Cluster.Close()
+	if len(*clusterFile) > 0 {
+		go flowHandler.Cluster.Watch(*clusterFile, *clusterRefresh)
+	}
+	if *localCorrelation {
+		flowHandler.Local = NewLocalCorrelator(*localHold, *localEnded, flowHandler.Metrics)
+		flowHandler.Local.Prometheus = flowHandler.Prometheus
+		go flowHandler.expireLocal()
+	}
 	RunLoop(*pcapFile, *pcapDevice, *pcapFilter, &flowHandler)
+	flowHandler.Flush()
 }
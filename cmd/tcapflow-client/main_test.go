@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/empty"
+	"google.golang.org/grpc"
+
+	. "github.com/moiji-mobile/tcapflow"
+	"github.com/moiji-mobile/tcapflow/rpc"
+)
+
+var (
+	vlr = &rpc.SCCPAddress{Number: "4912345", Ssn: 7}
+	hlr = &rpc.SCCPAddress{Number: "4970000", Ssn: 6}
+)
+
+func testState(tag int, called, calling *rpc.SCCPAddress, otid, dtid []byte) *rpc.StateInfo {
+	return &rpc.StateInfo{
+		Called:  called,
+		Calling: calling,
+		Tcap:    &rpc.TCAPInfo{Tag: int32(tag), Otid: otid, Dtid: dtid},
+	}
+}
+
+// testClient records the messages sent with AddState or on a stream.
+// Streams can only be opened with streams set.
+type testClient struct {
+	rpc.TCAPFlowClient
+	streams bool
+
+	mu     sync.Mutex
+	states []*rpc.StateInfo
+}
+
+func (c *testClient) AddState(ctx context.Context, in *rpc.StateInfo, opts ...grpc.CallOption) (*empty.Empty, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.states = append(c.states, in)
+	return &empty.Empty{}, nil
+}
+
+func (c *testClient) StreamStates(ctx context.Context, opts ...grpc.CallOption) (rpc.TCAPFlow_StreamStatesClient, error) {
+	if !c.streams {
+		return nil, errors.New("unavailable")
+	}
+	return &testStream{client: c, sent: make(chan uint64, 100), hold: replayBatches}, nil
+}
+
+// testStream acknowledges the batches once hold of them were sent
+type testStream struct {
+	grpc.ClientStream
+	client *testClient
+	sent   chan uint64
+	held   []uint64
+	hold   int
+}
+
+func (s *testStream) Send(batch *rpc.StateBatch) error {
+	s.client.mu.Lock()
+	s.client.states = append(s.client.states, batch.States...)
+	s.client.mu.Unlock()
+	s.sent <- batch.Sequence
+	return nil
+}
+
+func (s *testStream) CloseSend() error {
+	close(s.sent)
+	return nil
+}
+
+func (s *testStream) Recv() (*rpc.BatchAck, error) {
+	for len(s.held) < s.hold {
+		sequence, ok := <-s.sent
+		if !ok {
+			break
+		}
+		s.held = append(s.held, sequence)
+	}
+	s.hold = 0
+	if len(s.held) == 0 {
+		sequence, ok := <-s.sent
+		if !ok {
+			return nil, io.EOF
+		}
+		s.held = append(s.held, sequence)
+	}
+	sequence := s.held[0]
+	s.held = s.held[1:]
+	return &rpc.BatchAck{Sequence: sequence}, nil
+}
+
+func TestLocalCorrelatorMatches(t *testing.T) {
+	metrics := NewMemoryMetrics()
+	c := NewLocalCorrelator(time.Second, 10*time.Second, metrics)
+	now := time.Unix(1000, 0)
+
+	begin := testState(TCbeginApp, hlr, vlr, []byte{1}, nil)
+	if send := c.Add(begin, now); len(send) != 0 {
+		t.Fatalf("sent %d messages for the TC-Begin", len(send))
+	}
+	send := c.Add(testState(TCcontinueApp, vlr, hlr, []byte{2}, []byte{1}), now.Add(10*time.Millisecond))
+	if len(send) != 1 || send[0] != begin || begin.Response == nil || begin.Response.Tag != TCcontinueApp {
+		t.Fatalf("sent %v", send)
+	}
+
+	// The rest of the dialogue is not sent
+	if send := c.Add(testState(TCendApp, vlr, hlr, nil, []byte{1}), now.Add(time.Second)); len(send) != 0 {
+		t.Errorf("sent %v for the TC-End", send)
+	}
+	if metrics.Counter("tcapflow-client.local.matched") != 1 || metrics.Counter("tcapflow-client.local.ignored") != 1 {
+		t.Errorf("matched %d ignored %d", metrics.Counter("tcapflow-client.local.matched"),
+			metrics.Counter("tcapflow-client.local.ignored"))
+	}
+
+	// A response without a TC-Begin is sent as it is
+	end := testState(TCendApp, vlr, hlr, nil, []byte{9})
+	if send := c.Add(end, now.Add(time.Second)); len(send) != 1 || send[0] != end {
+		t.Errorf("sent %v for the unmatched TC-End", send)
+	}
+}
+
+func TestLocalCorrelatorReleasesUnanswered(t *testing.T) {
+	c := NewLocalCorrelator(time.Second, 10*time.Second, NewMemoryMetrics())
+	now := time.Unix(1000, 0)
+
+	first := testState(TCbeginApp, hlr, vlr, []byte{1}, nil)
+	second := testState(TCbeginApp, hlr, vlr, []byte{2}, nil)
+	c.Add(first, now)
+	c.Add(second, now.Add(500*time.Millisecond))
+
+	// The TID is reused before the first TC-Begin was answered
+	reused := testState(TCbeginApp, hlr, vlr, []byte{1}, nil)
+	if send := c.Add(reused, now.Add(600*time.Millisecond)); len(send) != 1 || send[0] != first {
+		t.Fatalf("sent %v for the reused TID", send)
+	}
+	if send := c.Expire(now.Add(1500 * time.Millisecond)); len(send) != 1 || send[0] != second {
+		t.Fatalf("expired %v", send)
+	}
+	if send := c.Flush(); len(send) != 1 || send[0] != reused {
+		t.Fatalf("flushed %v", send)
+	}
+	if send := c.Flush(); len(send) != 0 {
+		t.Errorf("flushed %v again", send)
+	}
+}
+
+// The initiator addresses the responder's OTID after the TC-Continue
+func TestLocalCorrelatorIgnoresInitiator(t *testing.T) {
+	metrics := NewMemoryMetrics()
+	c := NewLocalCorrelator(time.Second, 10*time.Second, metrics)
+	now := time.Unix(1000, 0)
+
+	begin := testState(TCbeginApp, hlr, vlr, []byte{1}, nil)
+	c.Add(begin, now)
+	c.Add(testState(TCcontinueApp, vlr, hlr, []byte{2}, []byte{1}), now)
+	if string(begin.Response.Otid) != string([]byte{2}) || begin.Response.Calling != hlr {
+		t.Fatalf("summary %v", begin.Response)
+	}
+	if send := c.Add(testState(TCcontinueApp, hlr, vlr, []byte{1}, []byte{2}), now); len(send) != 0 {
+		t.Errorf("sent %v for the initiator's TC-Continue", send)
+	}
+	// The initiator ends the dialogue for both sides
+	if send := c.Add(testState(TCendApp, hlr, vlr, nil, []byte{2}), now); len(send) != 0 {
+		t.Errorf("sent %v for the initiator's TC-End", send)
+	}
+	if len(c.old) != 0 {
+		t.Errorf("%d ended dialogues left", len(c.old))
+	}
+	if metrics.Counter("tcapflow-client.local.ignored") != 2 {
+		t.Errorf("ignored %d", metrics.Counter("tcapflow-client.local.ignored"))
+	}
+}
+
+// Late messages of a continued dialogue are sent after ExpireEnded
+func TestLocalCorrelatorExpiresContinued(t *testing.T) {
+	c := NewLocalCorrelator(time.Second, 10*time.Second, NewMemoryMetrics())
+	now := time.Unix(1000, 0)
+
+	c.Add(testState(TCbeginApp, hlr, vlr, []byte{1}, nil), now)
+	c.Add(testState(TCcontinueApp, vlr, hlr, []byte{2}, []byte{1}), now)
+	late := testState(TCcontinueApp, hlr, vlr, []byte{1}, []byte{2})
+	if send := c.Add(late, now.Add(10*time.Second)); len(send) != 1 || send[0] != late {
+		t.Errorf("sent %v for the late TC-Continue", send)
+	}
+	if len(c.old) != 0 || len(c.oldOrder) != 0 {
+		t.Errorf("%d ended dialogues left", len(c.old))
+	}
+
+	// A reused TID forgets the earlier dialogue of both sides
+	c.Add(testState(TCbeginApp, hlr, vlr, []byte{3}, nil), now)
+	c.Add(testState(TCcontinueApp, vlr, hlr, []byte{4}, []byte{3}), now)
+	c.Add(testState(TCbeginApp, hlr, vlr, []byte{3}, nil), now)
+	if len(c.old) != 0 || len(c.begins) != 1 {
+		t.Errorf("%d ended dialogues and %d TC-Begins", len(c.old), len(c.begins))
+	}
+}
+
+func TestProtoConversions(t *testing.T) {
+	addr := SCCPAddress{Ssn: 6, Ton: 1, Npi: 4, Number: "4970000"}
+	if back := sccpAddress(SCCPAddressProto(addr)); back != addr {
+		t.Errorf("address %+v", back)
+	}
+	infos := []ROSInfo{{Type: ROSInvoke, InvokeId: 1, OpCode: 2}, {Type: ROSResult, InvokeId: 1, OpCode: -1}}
+	back := rosInfos(ROSInfoProto(infos))
+	if len(back) != 2 || back[0] != infos[0] || back[1] != infos[1] {
+		t.Errorf("infos %+v", back)
+	}
+	if key := buildKey(SCCPAddressProto(addr), []byte{1, 2}); key != DialogueKey(addr, []byte{1, 2}) {
+		t.Errorf("key %v", key)
+	}
+}
+
+func TestForwarderDropsOnFullQueue(t *testing.T) {
+	metrics := NewMemoryMetrics()
+	f := NewForwarder(&testClient{}, metrics, 1, 10, time.Second)
+	if !f.Queue(&rpc.StateInfo{}) || f.Queue(&rpc.StateInfo{}) {
+		t.Fatal("queued beyond the queue size")
+	}
+	if f.Dropped != 1 || metrics.Counter("tcapflow-client.dropped") != 1 {
+		t.Errorf("dropped %d", f.Dropped)
+	}
+}
+
+// Messages go to the spool while the server can not be reached
+func TestForwarderSpoolsWithoutServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spool, err := OpenSpool(dir, 1<<20, 1<<16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := NewMemoryMetrics()
+	f := NewForwarder(&testClient{}, metrics, 10, 2, 10*time.Millisecond)
+	f.Spool = spool
+	f.Start()
+	for i := 0; i < 5; i++ {
+		f.Queue(testState(TCbeginApp, hlr, vlr, []byte{byte(i)}, nil))
+	}
+	f.Close()
+
+	if n := metrics.Counter("tcapflow-client.spooled"); n != 5 {
+		t.Errorf("spooled %d", n)
+	}
+	spool, err = OpenSpool(dir, 1<<20, 1<<16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+	if spool.Len() != 5 {
+		t.Errorf("%d messages in the spool", spool.Len())
+	}
+}
+
+// Without batches each message is sent with AddState to the member of
+// its dialogue, also the initiator's after the responder continued
+func TestSendRoutesDialogues(t *testing.T) {
+	clients := make(map[string]*testClient)
+	cluster := NewCluster(NewClusterRouter(16, time.Minute), func(address string) (*clusterMember, error) {
+		clients[address] = &testClient{}
+		return &clusterMember{address: address, client: clients[address]}, nil
+	})
+	if err := cluster.Update([]string{"a:1", "b:1", "c:1"}); err != nil {
+		t.Fatal(err)
+	}
+	handler := &ClientFlowDataHandler{Metrics: NewMemoryMetrics(), Cluster: cluster, Keys: NewDialogueKeys(time.Minute), Peers: &PeerLabels{}}
+
+	for i := 0; i < 20; i++ {
+		own, peer := []byte{byte(i)}, []byte{byte(i), 0xff}
+		handler.send(testState(TCbeginApp, hlr, vlr, own, nil))
+		handler.send(testState(TCcontinueApp, vlr, hlr, peer, own))
+		handler.send(testState(TCcontinueApp, hlr, vlr, own, peer))
+		handler.send(testState(TCendApp, vlr, hlr, nil, own))
+	}
+	// The initiator continues a dialogue matched by the probe
+	for i := 20; i < 40; i++ {
+		own, peer := []byte{byte(i)}, []byte{byte(i), 0xff}
+		begin := testState(TCbeginApp, hlr, vlr, own, nil)
+		begin.Response = &rpc.ResponseSummary{Tag: TCcontinueApp, Calling: hlr, Otid: peer}
+		handler.send(begin)
+		handler.send(testState(TCcontinueApp, hlr, vlr, own, peer))
+		handler.send(testState(TCcontinueApp, vlr, hlr, peer, own))
+		handler.send(testState(TCendApp, vlr, hlr, nil, own))
+	}
+	total := 0
+	for address, client := range clients {
+		for i := 0; i < len(client.states); i += 4 {
+			begin, end := client.states[i], client.states[i+3]
+			if begin.Tcap.Tag != TCbeginApp || end.Tcap.Tag != TCendApp || string(begin.Tcap.Otid) != string(end.Tcap.Dtid) {
+				t.Errorf("%v got %v and %v", address, begin.Tcap, end.Tcap)
+			}
+			if end.Sequence != begin.Sequence+3 {
+				t.Errorf("%v sequences %d and %d", address, begin.Sequence, end.Sequence)
+			}
+		}
+		total += len(client.states)
+	}
+	if total != 160 {
+		t.Errorf("sent %d messages", total)
+	}
+}
+
+// The spool is replayed several batches at a time and before the
+// messages queued later
+func TestForwarderReplaysSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spool, err := OpenSpool(dir, 1<<20, 1<<16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		data, _ := proto.Marshal(testState(TCbeginApp, hlr, vlr, []byte{byte(i)}, nil))
+		spool.Append(data)
+	}
+	client := &testClient{streams: true}
+	f := NewForwarder(client, NewMemoryMetrics(), 10, 5, 10*time.Millisecond)
+	f.Spool = spool
+	f.Start()
+	for i := 50; i < 53; i++ {
+		f.Queue(testState(TCbeginApp, hlr, vlr, []byte{byte(i)}, nil))
+	}
+	f.Close()
+
+	if len(client.states) != 53 {
+		t.Fatalf("sent %d messages", len(client.states))
+	}
+	for i, state := range client.states {
+		if otid := fmt.Sprint(state.Tcap.Otid); otid != fmt.Sprint([]byte{byte(i)}) {
+			t.Fatalf("message %d has OTID %v", i, otid)
+		}
+	}
+	spool, err = OpenSpool(dir, 1<<20, 1<<16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+	if spool.Len() != 0 {
+		t.Errorf("%d messages left in the spool", spool.Len())
+	}
+}
+
+func TestForwarderResetsBackoff(t *testing.T) {
+	client := &testClient{}
+	f := NewForwarder(client, NewMemoryMetrics(), 10, 5, time.Second)
+	f.MinBackoff = time.Millisecond
+	f.backoff = f.MinBackoff
+	for i := 0; i < 3; i++ {
+		f.retryAt = time.Time{}
+		if f.connect() {
+			t.Fatal("connected")
+		}
+	}
+	if f.backoff != 8*time.Millisecond {
+		t.Errorf("backoff %v after three failures", f.backoff)
+	}
+	client.streams = true
+	f.retryAt = time.Time{}
+	if !f.connect() || f.backoff != f.MinBackoff {
+		t.Errorf("backoff %v after connecting", f.backoff)
+	}
+	f.stream.CloseSend()
+	f.giveUp()
+}
@@ -1,29 +1,53 @@
 package main
 
 import (
+	"bufio"
+	"encoding/gob"
 	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
 	"github.com/golang/protobuf/ptypes/empty"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 
 	"github.com/moiji-mobile/tcapflow"
 	"github.com/moiji-mobile/tcapflow/rpc"
-
-	"gopkg.in/alexcesaro/statsd.v2"
 )
 
 type TCAPDialogueStart struct {
-	CaptTime  time.Time
-	AddedTime time.Time
-	Ros       []*rpc.ROSInfo
-	Otid      []byte
+	CaptTime           time.Time
+	AddedTime          time.Time
+	Ros                []*rpc.ROSInfo
+	Otid               []byte
+	Calling            rpc.SCCPAddress
+	Called             rpc.SCCPAddress
+	ApplicationContext string
+	Timer              tcapflow.TimerProfile
+	Overdue            bool
+	Trace              *tcapflow.DialogueTrace
+	Probe              string
 }
 
 // The path from one node to the server might be more quick than
@@ -34,100 +58,478 @@ type TCAPEarlyStateInfo struct {
 	CaptTime  time.Time
 }
 
-// For dialogues we stopped to track but might add more messages
+// For dialogues we stopped to track but might add more messages. The
+// trace of a continued dialogue goes on until it ends.
 type TCAPOld struct {
 	EndedTime time.Time
+	LastCapt  time.Time
+	Trace     *tcapflow.DialogueTrace
 }
 
-type TCAPFlowServer struct {
+// gRPC calls AddState concurrently. All messages of one dialogue map to
+// the same key and the key selects the shard. The shard lock needs to be
+// held while touching any of its maps.
+type TCAPFlowShard struct {
+	sync.Mutex
 	Sessions     map[string]TCAPDialogueStart // TC-begin one waiting for a pick-up
 	EarlyPending map[string]TCAPEarlyStateInfo
 	Old          map[string]TCAPOld // TC-end or second TC-continue
 
-	Statsd *statsd.Client
+	// Insertion order for evicting the oldest entries
+	sessionOrder tcapflow.EvictionQueue
+	pendingOrder tcapflow.EvictionQueue
+	oldOrder     tcapflow.EvictionQueue
+}
+
+type TCAPFlowServer struct {
+	// Atomic counters go first to be 64-bit aligned
+	rpcCalls         uint64
+	rpcMissingFields uint64
+	ready            int32
+
+	Shards []*TCAPFlowShard
+
+	Metrics tcapflow.Metrics
+
+	// Upper bound of entries summed over all shards. Zero is unlimited.
+	MaxSessions     int
+	MaxEarlyPending int
+	MaxOld          int
 
 	Scale                 time.Duration
 	ExpireSessionDuration time.Duration
 	ExpirePendingDuration time.Duration
 	ExpireEndedDuration   time.Duration
+	Timers                *tcapflow.TimerProfiles
+
+	// Print every TC-Begin that was not answered
+	LogTimeouts bool
+
+	// Labelled metrics for Prometheus. Nil without a metrics listener.
+	Prometheus *tcapflow.PrometheusRegistry
+	Dialogues  *tcapflow.DialogueMetrics
+
+	// Export a trace per dialogue. Nil when disabled.
+	Tracer *tcapflow.OTLPExporter
+
+	// Find the TC-Begin of messages the initiator sends to the GT and
+	// OTID of the responder
+	Keys *tcapflow.DialogueKeys
+
+	// Messages, sequence gaps and clock offsets per probe. Probes not
+	// heard from for ProbeSilence are reported as silent.
+	Probes       *tcapflow.ProbeTracker
+	ProbeSilence time.Duration
+
+	// Subscribers of SubscribeCompletions
+	completions *completionHub
+
+	// Closed on shutdown to end the streams
+	stopping chan struct{}
+
+	// Process messages in capture time order across probes. Nil processes
+	// them as they arrive.
+	Reorder *tcapflow.ReorderBuffer
+
+	// Recognise messages seen at several probes. Nil processes each.
+	Transit *tcapflow.TransitTracker
 }
 
+// Outcome of the traces of dialogues evicted for -max-sessions
+const outcomeEvicted = "evicted"
+
 func buildKey(gt rpc.SCCPAddress, tid []byte) string {
 	return gt.Number + "-" + strconv.Itoa(int(gt.Ssn)) + "-" + hex.EncodeToString(tid)
 }
 
-func removeOldSessions(t *TCAPFlowServer) {
+func newTCAPFlowShard() *TCAPFlowShard {
+	return &TCAPFlowShard{
+		Sessions:     make(map[string]TCAPDialogueStart),
+		EarlyPending: make(map[string]TCAPEarlyStateInfo),
+		Old:          make(map[string]TCAPOld),
+	}
+}
+
+func (t *TCAPFlowServer) InitShards(count int) {
+	if count < 1 {
+		count = 1
+	}
+	t.Shards = make([]*TCAPFlowShard, count)
+	for i := range t.Shards {
+		t.Shards[i] = newTCAPFlowShard()
+	}
+}
+
+func (t *TCAPFlowServer) shardFor(key string) *TCAPFlowShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return t.Shards[h.Sum32()%uint32(len(t.Shards))]
+}
+
+// Sizes of the maps summed over all shards
+func (t *TCAPFlowServer) Counts() (sessions, earlyPending, old int) {
+	for _, shard := range t.Shards {
+		shard.Lock()
+		sessions += len(shard.Sessions)
+		earlyPending += len(shard.EarlyPending)
+		old += len(shard.Old)
+		shard.Unlock()
+	}
+	return
+}
+
+func sccpAddress(addr rpc.SCCPAddress) tcapflow.SCCPAddress {
+	return tcapflow.SCCPAddress{
+		Ssn:    uint8(addr.Ssn),
+		Ton:    uint8(addr.Ton),
+		Npi:    uint8(addr.Npi),
+		Number: addr.Number,
+	}
+}
+
+func rosInfos(infos []*rpc.ROSInfo) []tcapflow.ROSInfo {
+	result := make([]tcapflow.ROSInfo, 0, len(infos))
+	for _, info := range infos {
+		result = append(result, tcapflow.ROSInfo{
+			Type:     int(info.Type),
+			InvokeId: int(info.InvokeId),
+			OpCode:   int(info.OpCode),
+		})
+	}
+	return result
+}
+
+func expiredDialogue(start TCAPDialogueStart, age time.Duration) tcapflow.ExpiredDialogue {
+	return tcapflow.ExpiredDialogue{
+		StartTime:          start.CaptTime,
+		Calling:            sccpAddress(start.Calling),
+		Called:             sccpAddress(start.Called),
+		Otid:               start.Otid,
+		ApplicationContext: start.ApplicationContext,
+		Ros:                rosInfos(start.Ros),
+		Age:                age,
+	}
+}
+
+func reportOverdue(t *TCAPFlowServer, start TCAPDialogueStart, age time.Duration) {
+	overdue := expiredDialogue(start, age)
+	if t.LogTimeouts {
+		fmt.Printf("%v\n", overdue.OverdueString())
+	}
+
+	t.Dialogues.Overdue(overdue)
+	t.Metrics.Increment("tcapflow-server.overdueState")
+	for _, bucket := range overdue.OverdueBuckets() {
+		t.Metrics.Increment("tcapflow-server." + bucket)
+	}
+}
+
+// Subscribers of completed dialogues. A slow subscriber misses completions
+// rather than holding up the correlation.
+type completionHub struct {
+	// Completions not delivered. First to be 64-bit aligned.
+	dropped uint64
+
+	sync.Mutex
+	subscribers map[chan *rpc.Completion]struct{}
+	count       int32
+}
+
+func newCompletionHub() *completionHub {
+	return &completionHub{subscribers: make(map[chan *rpc.Completion]struct{})}
+}
+
+func (h *completionHub) subscribe(size int) chan *rpc.Completion {
+	c := make(chan *rpc.Completion, size)
+	h.Lock()
+	h.subscribers[c] = struct{}{}
+	atomic.StoreInt32(&h.count, int32(len(h.subscribers)))
+	h.Unlock()
+	return c
+}
+
+func (h *completionHub) unsubscribe(c chan *rpc.Completion) {
+	h.Lock()
+	delete(h.subscribers, c)
+	atomic.StoreInt32(&h.count, int32(len(h.subscribers)))
+	h.Unlock()
+}
+
+// Avoid building completions nobody receives
+func (h *completionHub) active() bool {
+	return atomic.LoadInt32(&h.count) > 0
+}
+
+func (h *completionHub) publish(completion *rpc.Completion) {
+	h.Lock()
+	defer h.Unlock()
+	for c := range h.subscribers {
+		select {
+		case c <- completion:
+		default:
+			atomic.AddUint64(&h.dropped, 1)
+		}
+	}
+}
+
+func toMilliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func publishCompletion(t *TCAPFlowServer, start TCAPDialogueStart, end time.Time, outcome string) {
+	if !t.completions.active() {
+		return
+	}
+	startTime, _ := ptypes.TimestampProto(start.CaptTime)
+	endTime, _ := ptypes.TimestampProto(end)
+	calling, called := start.Calling, start.Called
+	t.completions.publish(&rpc.Completion{
+		StartTime:          startTime,
+		EndTime:            endTime,
+		Calling:            &calling,
+		Called:             &called,
+		Otid:               start.Otid,
+		ApplicationContext: start.ApplicationContext,
+		Ros:                start.Ros,
+		LatencyMs:          toMilliseconds(end.Sub(start.CaptTime)),
+		Outcome:            outcome,
+	})
+}
+
+func reportExpired(t *TCAPFlowServer, start TCAPDialogueStart, age time.Duration) {
+	expired := expiredDialogue(start, age)
+	if t.LogTimeouts {
+		fmt.Printf("%v\n", expired)
+	}
+
+	t.Dialogues.Timeout(expired)
+	if start.Trace != nil {
+		t.Tracer.Export(start.Trace.Finish(start.CaptTime.Add(age), tcapflow.OutcomeTimeout)...)
+	}
+	publishCompletion(t, start, start.CaptTime.Add(age), tcapflow.OutcomeTimeout)
+	t.Metrics.Increment("tcapflow-server.expiredState")
+	for _, bucket := range expired.Buckets() {
+		t.Metrics.Increment("tcapflow-server." + bucket)
+	}
+}
+
+// Expire entries of a single shard. The shard needs to be locked. Keys
+// are spread evenly so each shard will see its share of traffic.
+func removeOldSessions(t *TCAPFlowServer, shard *TCAPFlowShard) {
 	now := time.Now()
 
 	// Expire older sessions
-	for key, value := range t.Sessions {
+	for key, value := range shard.Sessions {
 		diff := now.Sub(value.AddedTime)
-		if diff > t.ExpireSessionDuration {
-			t.Statsd.Increment("tcapflow-server.expiredState")
-			delete(t.Sessions, key)
+		if diff > value.Timer.Expire {
+			reportExpired(t, value, diff)
+			delete(shard.Sessions, key)
+		} else if !value.Overdue && diff > value.Timer.Overdue {
+			reportOverdue(t, value, diff)
+			value.Overdue = true
+			shard.Sessions[key] = value
 		}
 	}
 
 	// Expire old pending messages
-	for key, value := range t.EarlyPending {
+	for key, value := range shard.EarlyPending {
 		diff := now.Sub(value.AddedTime)
 		if diff > t.ExpirePendingDuration {
-			t.Statsd.Increment("tcapflow-server.expiredEarlyPending")
-			delete(t.EarlyPending, key)
+			t.Metrics.Increment("tcapflow-server.expiredEarlyPending")
+			delete(shard.EarlyPending, key)
 		}
 	}
 
 	// Expire dead messages
-	for key, value := range t.Old {
+	for key, value := range shard.Old {
 		diff := now.Sub(value.EndedTime)
 		if diff > t.ExpireEndedDuration {
-			t.Statsd.Increment("tcapflow-server.removedOldState")
-			delete(t.Old, key)
+			t.Metrics.Increment("tcapflow-server.removedOldState")
+			finishTrace(t, value, value.LastCapt, tcapflow.OutcomeContinue)
+			delete(shard.Old, key)
 		}
 	}
+
+	compactOrders(t, shard)
+}
+
+// Drop the stale entries of the eviction queues of a shard
+func compactOrders(t *TCAPFlowServer, shard *TCAPFlowShard) {
+	if t.MaxSessions > 0 {
+		shard.sessionOrder.Compact(len(shard.Sessions), isCurrentSession(shard))
+	}
+	if t.MaxEarlyPending > 0 {
+		shard.pendingOrder.Compact(len(shard.EarlyPending), isCurrentPending(shard))
+	}
+	if t.MaxOld > 0 {
+		shard.oldOrder.Compact(len(shard.Old), isCurrentOld(shard))
+	}
 }
 
-func addState(t *TCAPFlowServer, capt time.Time, calling rpc.SCCPAddress, otid []byte, infos []*rpc.ROSInfo) {
-	// Add the state
-	key := buildKey(calling, otid)
+// Sweep all shards for overdue and expired entries. Messages do not walk
+// the maps of their shard.
+func expireShards(t *TCAPFlowServer) {
+	for _, shard := range t.Shards {
+		shard.Lock()
+		removeOldSessions(t, shard)
+		shard.Unlock()
+	}
+}
+
+func perShard(t *TCAPFlowServer, max int) int {
+	return (max + len(t.Shards) - 1) / len(t.Shards)
+}
+
+func isCurrentSession(shard *TCAPFlowShard) tcapflow.EvictionCheck {
+	return func(key string, added time.Time) bool {
+		val, ok := shard.Sessions[key]
+		return ok && val.AddedTime.Equal(added)
+	}
+}
+
+func isCurrentPending(shard *TCAPFlowShard) tcapflow.EvictionCheck {
+	return func(key string, added time.Time) bool {
+		val, ok := shard.EarlyPending[key]
+		return ok && val.AddedTime.Equal(added)
+	}
+}
+
+func isCurrentOld(shard *TCAPFlowShard) tcapflow.EvictionCheck {
+	return func(key string, ended time.Time) bool {
+		val, ok := shard.Old[key]
+		return ok && val.EndedTime.Equal(ended)
+	}
+}
+
+// End the trace of a dialogue that is no longer tracked
+func finishTrace(t *TCAPFlowServer, old TCAPOld, end time.Time, outcome string) {
+	if old.Trace != nil {
+		t.Tracer.Export(old.Trace.Finish(end, outcome)...)
+	}
+}
+
+func evictSessions(t *TCAPFlowServer, shard *TCAPFlowShard) {
+	max := perShard(t, t.MaxSessions)
+	current := isCurrentSession(shard)
+	for len(shard.Sessions) > max {
+		key, ok := shard.sessionOrder.PopOldest(current)
+		if !ok {
+			break
+		}
+		if val := shard.Sessions[key]; val.Trace != nil {
+			end := val.CaptTime.Add(time.Since(val.AddedTime))
+			t.Tracer.Export(val.Trace.Finish(end, outcomeEvicted)...)
+		}
+		delete(shard.Sessions, key)
+		t.Metrics.Increment("tcapflow-server.evictedState")
+	}
+}
+
+func evictEarlyPending(t *TCAPFlowServer, shard *TCAPFlowShard) {
+	max := perShard(t, t.MaxEarlyPending)
+	current := isCurrentPending(shard)
+	for len(shard.EarlyPending) > max {
+		key, ok := shard.pendingOrder.PopOldest(current)
+		if !ok {
+			break
+		}
+		delete(shard.EarlyPending, key)
+		t.Metrics.Increment("tcapflow-server.evictedEarlyPending")
+	}
+}
+
+func evictOld(t *TCAPFlowServer, shard *TCAPFlowShard) {
+	max := perShard(t, t.MaxOld)
+	current := isCurrentOld(shard)
+	for len(shard.Old) > max {
+		key, ok := shard.oldOrder.PopOldest(current)
+		if !ok {
+			break
+		}
+		old := shard.Old[key]
+		finishTrace(t, old, old.LastCapt, tcapflow.OutcomeContinue)
+		delete(shard.Old, key)
+		t.Metrics.Increment("tcapflow-server.evictedOldState")
+	}
+}
+
+func newDialogueStart(t *TCAPFlowServer, added, capt time.Time, state rpc.StateInfo) TCAPDialogueStart {
 	elem := TCAPDialogueStart{
-		AddedTime: time.Now(),
-		CaptTime:  capt,
-		Ros:       infos,
-		Otid:      otid}
-	t.Sessions[key] = elem
-	t.Statsd.Increment("tcapflow-server.newState")
+		AddedTime:          added,
+		CaptTime:           capt,
+		Ros:                state.Ros,
+		Otid:               state.Tcap.Otid,
+		Calling:            *state.Calling,
+		Called:             *state.Called,
+		ApplicationContext: state.Tcap.ApplicationContext,
+		Timer:              t.Timers.Lookup(state.Tcap.ApplicationContext, rosInfos(state.Ros)),
+		Probe:              state.Probe}
+	if t.Tracer != nil {
+		elem.Trace = tcapflow.NewDialogueTrace(capt, sccpAddress(elem.Calling), sccpAddress(elem.Called),
+			elem.Otid, elem.ApplicationContext)
+		elem.Trace.AddComponents(rosInfos(elem.Ros), capt)
+	}
+	return elem
+}
+
+func addState(t *TCAPFlowServer, shard *TCAPFlowShard, key string, capt time.Time, state rpc.StateInfo) {
+	// Add the state
+	elem := newDialogueStart(t, time.Now(), capt, state)
+	shard.Sessions[key] = elem
+	t.Metrics.Increment("tcapflow-server.newState")
+	if t.MaxSessions > 0 {
+		shard.sessionOrder.Push(key, elem.AddedTime)
+		evictSessions(t, shard)
+	}
 
-	delete(t.Old, key)
+	if old, ok := shard.Old[key]; ok {
+		finishTrace(t, old, old.LastCapt, tcapflow.OutcomeContinue)
+		delete(shard.Old, key)
+	}
 
 	// Check if a pending end can be applied now
-	early, ok := t.EarlyPending[key]
+	early, ok := shard.EarlyPending[key]
 	if ok {
-		delete(t.EarlyPending, key)
+		delete(shard.EarlyPending, key)
 		state := early.State
 		time, _ := ptypes.Timestamp(state.Time)
-		removeState(t, time, state)
+		removeState(t, shard, key, time, state)
 	}
 
-	removeOldSessions(t)
+	compactOrders(t, shard)
 }
 
-func doRemoveState(t *TCAPFlowServer, key string, capt time.Time, called_gt rpc.SCCPAddress, dtid []byte, tag int32) bool {
-	val, ok := t.Sessions[key]
+func doRemoveState(t *TCAPFlowServer, shard *TCAPFlowShard, key string, capt time.Time, state rpc.StateInfo) bool {
+	tag, ros := state.Tcap.Tag, state.Ros
+	val, ok := shard.Sessions[key]
 
 	if !ok {
 		return false
 	}
 
 	diff := capt.Sub(val.CaptTime)
-	delete(t.Sessions, key)
-	t.Statsd.Increment("tcapflow-server.delState")
-	t.Statsd.Timing("tcapflow-server.latency", float64(diff/t.Scale))
+	delete(shard.Sessions, key)
+	t.Metrics.Increment("tcapflow-server.delState")
+	if val.Overdue {
+		t.Metrics.Increment("tcapflow-server.lateResponse")
+	}
+	t.Metrics.Timing("tcapflow-server.latency", float64(diff/t.Scale),
+		tcapflow.DialogueTags(sccpAddress(val.Called), rosInfos(val.Ros))...)
+	t.Dialogues.Completed(sccpAddress(val.Called), val.ApplicationContext, rosInfos(val.Ros),
+		tcapflow.OutcomeOf(int(tag)), diff)
+	if val.Trace != nil {
+		val.Trace.AddComponents(rosInfos(ros), capt)
+		if tag != tcapflow.TCcontinueApp {
+			t.Tracer.Export(val.Trace.Finish(capt, tcapflow.OutcomeOf(int(tag)))...)
+		}
+	}
+	publishCompletion(t, val, capt, tcapflow.OutcomeOf(int(tag)))
+	t.Probes.Dialogue(val.Probe, state.Probe, diff, capt)
 
 	// Special work needed?
-	_, ok = t.EarlyPending[key]
+	_, ok = shard.EarlyPending[key]
 	if ok {
-		delete(t.EarlyPending, key)
+		delete(shard.EarlyPending, key)
 	}
 
 	switch tag {
@@ -137,65 +539,317 @@ func doRemoveState(t *TCAPFlowServer, key string, capt time.Time, called_gt rpc.
 		// We are done for good!
 	case tcapflow.TCcontinueApp:
 		// Remember that more is to come
-		t.Old[key] = TCAPOld{EndedTime: time.Now()}
+		keepOld(t, shard, key, TCAPOld{EndedTime: time.Now(), LastCapt: capt, Trace: val.Trace})
 	}
 
-	removeOldSessions(t)
+	compactOrders(t, shard)
 	return true
 }
 
-func removeState(t *TCAPFlowServer, capt time.Time, state rpc.StateInfo) {
-	called := *state.Called
-	dtid := state.Tcap.Dtid
-	key := buildKey(called, dtid)
+func keepOld(t *TCAPFlowServer, shard *TCAPFlowShard, key string, old TCAPOld) {
+	shard.Old[key] = old
+	if t.MaxOld > 0 {
+		shard.oldOrder.Push(key, old.EndedTime)
+		evictOld(t, shard)
+	}
+}
 
+func removeState(t *TCAPFlowServer, shard *TCAPFlowShard, key string, capt time.Time, state rpc.StateInfo) {
 	// Is the state removed?
-	if !doRemoveState(t, key, capt, called, dtid, state.Tcap.Tag) {
+	if !doRemoveState(t, shard, key, capt, state) {
 		// Not removed but maybe is old and it is over now?
 		// Besides the point of both sides sending a TC-end and
 		// the second is pending again. But such is life.
-		_, isOld := t.Old[key]
+		old, isOld := shard.Old[key]
 		if isOld {
+			if old.Trace != nil {
+				old.Trace.AddComponents(rosInfos(state.Ros), capt)
+			}
 			switch state.Tcap.Tag {
 			case tcapflow.TCendApp, tcapflow.TCabortApp:
-				delete(t.Old, key)
+				finishTrace(t, old, capt, tcapflow.OutcomeOf(int(state.Tcap.Tag)))
+				delete(shard.Old, key)
+			default:
+				// Still going on
+				keepOld(t, shard, key, TCAPOld{EndedTime: time.Now(), LastCapt: capt, Trace: old.Trace})
 			}
 		} else {
 			// Check if it is already pending?
-			_, ok := t.EarlyPending[key]
+			_, ok := shard.EarlyPending[key]
 			if !ok {
 				// Let's remember it...
-				t.EarlyPending[key] = TCAPEarlyStateInfo{
+				early := TCAPEarlyStateInfo{
 					State:     state,
 					AddedTime: time.Now(),
 					CaptTime:  capt,
 				}
+				shard.EarlyPending[key] = early
+				if t.MaxEarlyPending > 0 {
+					shard.pendingOrder.Push(key, early.AddedTime)
+					evictEarlyPending(t, shard)
+				}
 			}
 		}
 	}
 }
 
+// An authenticated probe can not claim to be another
+func identify(ctx context.Context, in *rpc.StateInfo) {
+	if probe := tcapflow.ProbeFromContext(ctx); len(probe) > 0 {
+		in.Probe = probe
+	}
+}
+
 func (t *TCAPFlowServer) AddState(ctx context.Context, in *rpc.StateInfo) (*empty.Empty, error) {
+	atomic.AddUint64(&t.rpcCalls, 1)
+	identify(ctx, in)
+	t.addStateInfo(in)
+	return nil, nil
+}
+
+// Read batches until the client closes the stream and acknowledge each
+func (t *TCAPFlowServer) StreamStates(stream rpc.TCAPFlow_StreamStatesServer) error {
+	// Receive while waiting for the shutdown as well
+	batches := make(chan *rpc.StateBatch)
+	failed := make(chan error, 1)
+	go func() {
+		for {
+			batch, err := stream.Recv()
+			if err != nil {
+				failed <- err
+				return
+			}
+			select {
+			case batches <- batch:
+			case <-stream.Context().Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		var batch *rpc.StateBatch
+		select {
+		case batch = <-batches:
+		case err := <-failed:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		case <-t.stopping:
+			// The probe sends the batches that were not acked again
+			return status.Errorf(codes.Unavailable, "shutting down")
+		}
+
+		atomic.AddUint64(&t.rpcCalls, 1)
+		t.Metrics.Increment("tcapflow-server.batch")
+		accepted := uint32(0)
+		for _, state := range batch.States {
+			identify(stream.Context(), state)
+			if t.addStateInfo(state) {
+				accepted++
+			}
+		}
+		err := stream.Send(&rpc.BatchAck{Sequence: batch.Sequence, Accepted: accepted})
+		if err != nil {
+			return err
+		}
+	}
+}
 
+// Returns false when mandatory fields are missing
+func (t *TCAPFlowServer) addStateInfo(in *rpc.StateInfo) bool {
 	// Missing mandatory fields
-	if in.Calling == nil || in.Called == nil || in.Tcap == nil || in.Time == nil {
-		t.Statsd.Increment("tcapflow-server.rpcMissingFields")
-		return nil, nil
+	if in.Calling == nil || in.Called == nil || in.Tcap == nil || in.Time == nil ||
+		(in.Response != nil && in.Response.Time == nil) {
+		atomic.AddUint64(&t.rpcMissingFields, 1)
+		t.Metrics.Increment("tcapflow-server.rpcMissingFields")
+		return false
+	}
+	if len(in.Probe) > 0 && t.Probes.Message(in.Probe, in.Sequence, time.Now()) {
+		fmt.Printf("Probe %s is sending again\n", in.Probe)
+	}
+	if t.Transit != nil && len(in.Probe) > 0 {
+		in = withoutDuplicates(t, in)
+		if in == nil {
+			return true
+		}
+	}
+
+	if t.Reorder == nil {
+		processState(t, in)
+		return true
+	}
+	capt, _ := ptypes.Timestamp(in.Time)
+	late := t.Reorder.Add(in.Probe, capt, time.Now(), in)
+	if late > 0 {
+		t.Metrics.Timing("tcapflow-server.lateArrival", float64(late/time.Millisecond))
+		if t.Prometheus != nil {
+			t.Prometheus.Observe("tcapflow_server_late_arrival_seconds", nil, late.Seconds())
+		}
+	}
+	return true
+}
+
+// The same message seen at different probes has the same fingerprint. The
+// called GT is left out as it might be translated on the way. The fields
+// are length prefixed to keep them apart.
+func fingerprint(in *rpc.StateInfo) string {
+	key := make([]byte, 0, 64)
+	key = append(key, byte(in.Tcap.Tag), byte(len(in.Calling.Number)))
+	key = append(key, in.Calling.Number...)
+	key = append(key, byte(len(in.Tcap.Otid)))
+	key = append(key, in.Tcap.Otid...)
+	key = append(key, byte(len(in.Tcap.Dtid)))
+	key = append(key, in.Tcap.Dtid...)
+	for _, ros := range in.Ros {
+		key = append(key, byte(ros.Type), byte(ros.InvokeId), byte(ros.OpCode), byte(ros.OpCode>>8))
+	}
+	return string(key)
+}
+
+// Measure the transit delay of messages another probe reported already.
+// They are not processed again.
+func isDuplicate(t *TCAPFlowServer, in *rpc.StateInfo) bool {
+	capt, _ := ptypes.Timestamp(in.Time)
+	from, to, delay, duplicate := t.Transit.Message(in.Probe, fingerprint(in), capt, time.Now())
+	if !duplicate || len(from) == 0 {
+		return duplicate
+	}
+	t.Metrics.Timing("tcapflow-server.transit", float64(delay/time.Millisecond),
+		tcapflow.Tag{Key: "from", Value: from}, tcapflow.Tag{Key: "to", Value: to})
+	if t.Prometheus != nil {
+		t.Prometheus.Observe("tcapflow_server_transit_seconds", tcapflow.Labels{"from": from, "to": to}, delay.Seconds())
+	}
+	return true
+}
+
+// Drop what other probes reported already. Of a dialogue matched at the
+// probe the TC-Begin and response are checked each.
+func withoutDuplicates(t *TCAPFlowServer, in *rpc.StateInfo) *rpc.StateInfo {
+	if in.Response == nil || in.Tcap.Tag != tcapflow.TCbeginApp {
+		if isDuplicate(t, in) {
+			return nil
+		}
+		return in
+	}
+	response := responseOf(in)
+	beginDuplicate := isDuplicate(t, in)
+	responseDuplicate := isDuplicate(t, response)
+	switch {
+	case beginDuplicate && responseDuplicate:
+		return nil
+	case beginDuplicate:
+		return response
+	case responseDuplicate:
+		begin := *in
+		begin.Response = nil
+		return &begin
+	}
+	return in
+}
+
+// The response the probe summarised with its TC-Begin
+func responseOf(in *rpc.StateInfo) *rpc.StateInfo {
+	calling, called := *in.Called, *in.Calling
+	if in.Response.Calling != nil {
+		calling = *in.Response.Calling
+	}
+	return &rpc.StateInfo{
+		Time:    in.Response.Time,
+		Calling: &calling,
+		Called:  &called,
+		Tcap: &rpc.TCAPInfo{
+			Otid:               in.Response.Otid,
+			Dtid:               in.Tcap.Otid,
+			Tag:                in.Response.Tag,
+			ApplicationContext: in.Tcap.ApplicationContext,
+		},
+		Ros:      in.Response.Ros,
+		Probe:    in.Probe,
+		Sequence: in.Sequence,
+	}
+}
+
+// A reorder buffer processing the messages it releases in their shards
+func newReorderBuffer(t *TCAPFlowServer, maxDelay time.Duration, maxSize int) *tcapflow.ReorderBuffer {
+	return tcapflow.NewReorderBuffer(maxDelay, maxSize, func(state interface{}) (sync.Locker, func()) {
+		return prepareState(t, state.(*rpc.StateInfo))
+	})
+}
+
+// Release what the reorder buffer held for too long
+func flushReordered(t *TCAPFlowServer) {
+	interval := t.Reorder.MaxDelay / 10
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		t.Reorder.Flush(now)
 	}
+}
+
+// Match the message against the tracked dialogues
+func processState(t *TCAPFlowServer, in *rpc.StateInfo) {
+	shard, run := prepareState(t, in)
+	shard.Lock()
+	run()
+	shard.Unlock()
+}
 
+// The shard of the message's dialogue and the matching to do with its
+// lock held. The keys of continued dialogues change with each message so
+// this is called once per message in the order they are processed.
+func prepareState(t *TCAPFlowServer, in *rpc.StateInfo) (*TCAPFlowShard, func()) {
 	time, _ := ptypes.Timestamp(in.Time)
 
 	switch in.Tcap.Tag {
 	case tcapflow.TCbeginApp:
-		addState(t, time, *in.Calling, in.Tcap.Otid, in.Ros)
+		key := buildKey(*in.Calling, in.Tcap.Otid)
+		shard := t.shardFor(key)
+		if in.Response == nil {
+			return shard, func() {
+				addState(t, shard, key, time, *in)
+			}
+		}
+		// The probe matched the response to the TC-Begin. Its key is only
+		// looked up to follow the TID of the responder.
+		response := responseOf(in)
+		responseTime, _ := ptypes.Timestamp(response.Time)
+		responseKey(t, response, responseTime)
+		if response.Tcap.Tag == tcapflow.TCabortApp {
+			t.Metrics.Increment("tcapflow-server.tcAbort")
+		}
+		return shard, func() {
+			addState(t, shard, key, time, *in)
+			removeState(t, shard, key, responseTime, *response)
+		}
 	case tcapflow.TCabortApp:
-		t.Statsd.Increment("tcapflow-server.tcAbort")
+		t.Metrics.Increment("tcapflow-server.tcAbort")
 		fallthrough
 	case tcapflow.TCendApp, tcapflow.TCcontinueApp:
-		removeState(t, time, *in)
+		key := responseKey(t, in, time)
+		shard := t.shardFor(key)
+		return shard, func() {
+			removeState(t, shard, key, time, *in)
+		}
 	}
+	return t.shardFor(""), func() {}
+}
 
-	return nil, nil
+// The key of the TC-Begin a later message of the dialogue belongs to
+func responseKey(t *TCAPFlowServer, in *rpc.StateInfo, capt time.Time) string {
+	key := buildKey(*in.Called, in.Tcap.Dtid)
+	if t.Keys != nil {
+		own := ""
+		if len(in.Tcap.Otid) > 0 {
+			own = buildKey(*in.Calling, in.Tcap.Otid)
+		}
+		key = t.Keys.Key(int(in.Tcap.Tag), own, key, capt)
+	}
+	return key
 }
 
 func NewTCAPFlowServer() TCAPFlowServer {
@@ -204,42 +858,860 @@ func NewTCAPFlowServer() TCAPFlowServer {
 	flowServer.ExpirePendingDuration = 2 * time.Second
 	flowServer.ExpireEndedDuration = 10 * time.Second
 
-	flowServer.Sessions = make(map[string]TCAPDialogueStart)
-	flowServer.EarlyPending = make(map[string]TCAPEarlyStateInfo)
-	flowServer.Old = make(map[string]TCAPOld)
-	flowServer.Statsd, _ = statsd.New()
+	flowServer.Timers = tcapflow.DefaultTimerProfiles(flowServer.ExpireSessionDuration)
+	flowServer.InitShards(64)
+	flowServer.Metrics = tcapflow.NopMetrics{}
 
 	flowServer.Scale = 1
+	flowServer.Probes = tcapflow.NewProbeTracker(5 * time.Minute)
+	flowServer.ProbeSilence = 30 * time.Second
+	flowServer.Keys = tcapflow.NewDialogueKeys(10 * time.Minute)
+	flowServer.completions = newCompletionHub()
+	flowServer.stopping = make(chan struct{})
 
 	return flowServer
 }
 
+// The live state for the admin API
+type serverAdmin struct {
+	t *TCAPFlowServer
+}
+
+type serverStats struct {
+	Ready            bool   `json:"ready"`
+	Shards           int    `json:"shards"`
+	Sessions         int    `json:"sessions"`
+	EarlyPending     int    `json:"earlyPending"`
+	Old              int    `json:"old"`
+	RPCCalls         uint64 `json:"rpcCalls"`
+	RPCMissingFields uint64 `json:"rpcMissingFields"`
+
+	CompletionsDropped uint64 `json:"completionsDropped"`
+
+	Reordering   int                       `json:"reordering"`
+	LateArrivals uint64                    `json:"lateArrivals"`
+	Watermarks   []tcapflow.ProbeWatermark `json:"watermarks,omitempty"`
+
+	Probes       []tcapflow.ProbeStats  `json:"probes"`
+	ClockOffsets []tcapflow.ClockOffset `json:"clockOffsets,omitempty"`
+	Duplicates   uint64                 `json:"duplicates"`
+	Paths        []pathStats            `json:"paths,omitempty"`
+}
+
+// Transit delays of one path between probes in milliseconds
+type pathStats struct {
+	From        string  `json:"from"`
+	To          string  `json:"to"`
+	Count       uint64  `json:"count"`
+	P50         float64 `json:"p50Ms"`
+	P90         float64 `json:"p90Ms"`
+	P99         float64 `json:"p99Ms"`
+	Max         float64 `json:"maxMs"`
+	Uncorrected uint64  `json:"uncorrected"`
+
+	// To merge the paths of the cluster members
+	Histogram tcapflow.LatencyHistogram `json:"histogram"`
+}
+
+func newPathStats(from, to string, delay tcapflow.LatencyHistogram, uncorrected uint64) pathStats {
+	return pathStats{
+		From:        from,
+		To:          to,
+		Count:       delay.Total,
+		P50:         toMilliseconds(delay.Percentile(50)),
+		P90:         toMilliseconds(delay.Percentile(90)),
+		P99:         toMilliseconds(delay.Percentile(99)),
+		Max:         float64(delay.Max) / 1000,
+		Uncorrected: uncorrected,
+		Histogram:   delay,
+	}
+}
+
+// The statistics of each server of the cluster and their sum. Members
+// that could not be asked have the Error instead.
+type clusterStats struct {
+	Members []clusterMemberStats `json:"members"`
+	Total   serverStats          `json:"total"`
+}
+
+type clusterMemberStats struct {
+	Address string       `json:"address"`
+	Error   string       `json:"error,omitempty"`
+	Stats   *serverStats `json:"stats,omitempty"`
+}
+
+// Add up the statistics of the servers. The probes and paths are merged
+// by name, of the clock offsets the one with the most samples is kept.
+// Watermarks are per server and left out.
+func mergeStats(all []serverStats) serverStats {
+	total := serverStats{Ready: len(all) > 0}
+	probes := make(map[string]*tcapflow.ProbeStats)
+	offsets := make(map[[2]string]tcapflow.ClockOffset)
+	paths := make(map[[2]string]*tcapflow.PathDelay)
+	for _, stats := range all {
+		total.Ready = total.Ready && stats.Ready
+		total.Shards += stats.Shards
+		total.Sessions += stats.Sessions
+		total.EarlyPending += stats.EarlyPending
+		total.Old += stats.Old
+		total.RPCCalls += stats.RPCCalls
+		total.RPCMissingFields += stats.RPCMissingFields
+		total.CompletionsDropped += stats.CompletionsDropped
+		total.Reordering += stats.Reordering
+		total.LateArrivals += stats.LateArrivals
+		total.Duplicates += stats.Duplicates
+
+		for _, probe := range stats.Probes {
+			if merged, ok := probes[probe.Name]; ok {
+				merged.Merge(probe)
+			} else {
+				copied := probe
+				probes[probe.Name] = &copied
+			}
+		}
+		for _, offset := range stats.ClockOffsets {
+			pair := [2]string{offset.Reference, offset.Probe}
+			if offset.Samples > offsets[pair].Samples {
+				offsets[pair] = offset
+			}
+		}
+		for _, path := range stats.Paths {
+			pair := [2]string{path.From, path.To}
+			merged, ok := paths[pair]
+			if !ok {
+				merged = &tcapflow.PathDelay{From: path.From, To: path.To}
+				paths[pair] = merged
+			}
+			merged.Delay.Merge(path.Histogram)
+			merged.Uncorrected += path.Uncorrected
+		}
+	}
+
+	total.Probes = make([]tcapflow.ProbeStats, 0, len(probes))
+	for _, probe := range probes {
+		total.Probes = append(total.Probes, *probe)
+	}
+	sort.Slice(total.Probes, func(i, j int) bool { return total.Probes[i].Name < total.Probes[j].Name })
+	for _, offset := range offsets {
+		total.ClockOffsets = append(total.ClockOffsets, offset)
+	}
+	sort.Slice(total.ClockOffsets, func(i, j int) bool {
+		a, b := total.ClockOffsets[i], total.ClockOffsets[j]
+		if a.Reference != b.Reference {
+			return a.Reference < b.Reference
+		}
+		return a.Probe < b.Probe
+	})
+	for _, path := range paths {
+		total.Paths = append(total.Paths, newPathStats(path.From, path.To, path.Delay, path.Uncorrected))
+	}
+	sort.Slice(total.Paths, func(i, j int) bool {
+		a, b := total.Paths[i], total.Paths[j]
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		return a.To < b.To
+	})
+	return total
+}
+
+// Ask the peers for their /stats and merge them with ours
+func (a serverAdmin) ClusterStats(self string, peers []string) clusterStats {
+	cluster := clusterStats{Members: make([]clusterMemberStats, len(peers)+1)}
+	local := a.Stats().(serverStats)
+	cluster.Members[0] = clusterMemberStats{Address: self, Stats: &local}
+
+	client := http.Client{Timeout: 2 * time.Second}
+	var wg sync.WaitGroup
+	for i, peer := range peers {
+		wg.Add(1)
+		go func(member *clusterMemberStats, peer string) {
+			defer wg.Done()
+			member.Address = peer
+			resp, err := client.Get("http://" + peer + "/stats")
+			if err == nil {
+				defer resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					err = fmt.Errorf("%v", resp.Status)
+				}
+			}
+			if err == nil {
+				var stats serverStats
+				err = json.NewDecoder(resp.Body).Decode(&stats)
+				member.Stats = &stats
+			}
+			if err != nil {
+				member.Error = err.Error()
+				member.Stats = nil
+			}
+		}(&cluster.Members[i+1], peer)
+	}
+	wg.Wait()
+
+	var all []serverStats
+	for _, member := range cluster.Members {
+		if member.Stats != nil {
+			all = append(all, *member.Stats)
+		}
+	}
+	cluster.Total = mergeStats(all)
+	cluster.Total.Ready = cluster.Total.Ready && len(all) == len(cluster.Members)
+	return cluster
+}
+
+func (a serverAdmin) Ready() bool {
+	return atomic.LoadInt32(&a.t.ready) != 0
+}
+
+func (a serverAdmin) Dialogues(filter *tcapflow.DialogueFilter) []tcapflow.AdminDialogue {
+	oldest := tcapflow.OldestDialogues{Filter: filter}
+	now := time.Now()
+	for _, shard := range a.t.Shards {
+		shard.Lock()
+		for key, v := range shard.Sessions {
+			if age := now.Sub(v.AddedTime); oldest.Wants(age) {
+				oldest.Add(tcapflow.NewAdminDialogue("session", key, v.CaptTime, age,
+					sccpAddress(v.Calling), sccpAddress(v.Called), v.Otid, nil, v.ApplicationContext, rosInfos(v.Ros)))
+			}
+		}
+		for key, v := range shard.EarlyPending {
+			if age := now.Sub(v.AddedTime); oldest.Wants(age) {
+				state := v.State
+				oldest.Add(tcapflow.NewAdminDialogue("earlyPending", key, v.CaptTime, age,
+					sccpAddress(*state.Calling), sccpAddress(*state.Called), state.Tcap.Otid, state.Tcap.Dtid,
+					state.Tcap.ApplicationContext, rosInfos(state.Ros)))
+			}
+		}
+		for key, v := range shard.Old {
+			if age := now.Sub(v.EndedTime); oldest.Wants(age) {
+				oldest.Add(tcapflow.NewAdminDialogue("old", key, v.EndedTime, age,
+					tcapflow.SCCPAddress{}, tcapflow.SCCPAddress{}, nil, nil, "", nil))
+			}
+		}
+		shard.Unlock()
+	}
+	return oldest.Dialogues
+}
+
+func (a serverAdmin) Stats() interface{} {
+	stats := serverStats{
+		Ready:              a.Ready(),
+		Shards:             len(a.t.Shards),
+		RPCCalls:           atomic.LoadUint64(&a.t.rpcCalls),
+		RPCMissingFields:   atomic.LoadUint64(&a.t.rpcMissingFields),
+		CompletionsDropped: atomic.LoadUint64(&a.t.completions.dropped),
+	}
+	stats.Sessions, stats.EarlyPending, stats.Old = a.t.Counts()
+	if a.t.Reorder != nil {
+		stats.Reordering = a.t.Reorder.Len()
+		stats.LateArrivals = a.t.Reorder.Late()
+		stats.Watermarks = a.t.Reorder.Watermarks(time.Now())
+	}
+	stats.Probes = a.t.Probes.Stats()
+	stats.ClockOffsets = a.t.Probes.ClockOffsets()
+	if a.t.Transit != nil {
+		stats.Duplicates = a.t.Transit.Duplicates()
+		for _, path := range a.t.Transit.Paths() {
+			stats.Paths = append(stats.Paths, newPathStats(path.From, path.To, path.Delay, path.Uncorrected))
+		}
+	}
+	return stats
+}
+
+func (t *TCAPFlowServer) GetStats(ctx context.Context, in *empty.Empty) (*rpc.ServerStats, error) {
+	stats := serverAdmin{t}.Stats().(serverStats)
+	out := &rpc.ServerStats{
+		Shards:             uint32(stats.Shards),
+		Sessions:           uint64(stats.Sessions),
+		EarlyPending:       uint64(stats.EarlyPending),
+		Old:                uint64(stats.Old),
+		RpcCalls:           stats.RPCCalls,
+		RpcMissingFields:   stats.RPCMissingFields,
+		CompletionsDropped: stats.CompletionsDropped,
+		Reordering:         uint64(stats.Reordering),
+		LateArrivals:       stats.LateArrivals,
+		Duplicates:         stats.Duplicates,
+	}
+	for _, probe := range stats.Probes {
+		lastSeen, _ := ptypes.TimestampProto(probe.LastSeen)
+		out.Probes = append(out.Probes, &rpc.ProbeStats{
+			Name:         probe.Name,
+			Messages:     probe.Messages,
+			LastSeen:     lastSeen,
+			LastSequence: probe.LastSequence,
+			Gaps:         probe.Gaps,
+			Restarts:     probe.Restarts,
+			Silent:       probe.Silent,
+		})
+	}
+	for _, path := range stats.Paths {
+		out.Paths = append(out.Paths, &rpc.PathDelay{
+			From:        path.From,
+			To:          path.To,
+			Count:       path.Count,
+			P50Ms:       path.P50,
+			P90Ms:       path.P90,
+			P99Ms:       path.P99,
+			MaxMs:       path.Max,
+			Uncorrected: path.Uncorrected,
+		})
+	}
+	for _, offset := range stats.ClockOffsets {
+		out.ClockOffsets = append(out.ClockOffsets, &rpc.ClockOffset{
+			Probe:     offset.Probe,
+			Reference: offset.Reference,
+			OffsetMs:  offset.Offset,
+			Samples:   offset.Samples,
+		})
+	}
+	return out, nil
+}
+
+func addressProto(gt string, ssn, ton, npi uint8) *rpc.SCCPAddress {
+	return &rpc.SCCPAddress{Ssn: uint32(ssn), Ton: uint32(ton), Npi: uint32(npi), Number: gt}
+}
+
+func (t *TCAPFlowServer) ListDialogues(ctx context.Context, in *rpc.DialogueQuery) (*rpc.DialogueList, error) {
+	filter := tcapflow.DialogueFilter{
+		Tid:    strings.ToLower(in.Tid),
+		Gt:     in.Gt,
+		Ssn:    -1,
+		OpCode: -1,
+		MinAge: time.Duration(in.MinAgeMs) * time.Millisecond,
+		Limit:  int(in.Limit),
+	}
+	if _, err := hex.DecodeString(filter.Tid); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "tid: %v", err)
+	}
+	if in.Ssn > 0 {
+		filter.Ssn = int(in.Ssn)
+	}
+	if in.HasOpCode {
+		filter.OpCode = int(in.OpCode)
+	}
+	if filter.Limit == 0 {
+		filter.Limit = 100
+	}
+
+	out := &rpc.DialogueList{}
+	for _, d := range tcapflow.SortDialogues(serverAdmin{t}.Dialogues(&filter), filter.Limit) {
+		startTime, _ := ptypes.TimestampProto(d.StartTime)
+		otid, _ := hex.DecodeString(d.Otid)
+		dtid, _ := hex.DecodeString(d.Dtid)
+		dialogue := &rpc.Dialogue{
+			State:              d.State,
+			Key:                d.Key,
+			StartTime:          startTime,
+			AgeMs:              d.Age,
+			Otid:               otid,
+			Dtid:               dtid,
+			Calling:            addressProto(d.Calling.Gt, d.Calling.Ssn, d.Calling.Ton, d.Calling.Npi),
+			Called:             addressProto(d.Called.Gt, d.Called.Ssn, d.Called.Ton, d.Called.Npi),
+			ApplicationContext: d.ApplicationContext,
+		}
+		for _, op := range d.Operations {
+			dialogue.Operations = append(dialogue.Operations, int32(op))
+		}
+		out.Dialogues = append(out.Dialogues, dialogue)
+	}
+	return out, nil
+}
+
+// Send completions until the subscriber goes away
+func (t *TCAPFlowServer) SubscribeCompletions(in *empty.Empty, stream rpc.TCAPFlow_SubscribeCompletionsServer) error {
+	c := t.completions.subscribe(1000)
+	defer t.completions.unsubscribe(c)
+	for {
+		select {
+		case completion := <-c:
+			if err := stream.Send(completion); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-t.stopping:
+			return status.Errorf(codes.Unavailable, "shutting down")
+		}
+	}
+}
+
+// Report probes going silent and the per probe metrics
+func checkProbes(t *TCAPFlowServer, now time.Time) {
+	if t.ProbeSilence > 0 {
+		for _, probe := range t.Probes.Silent(now, t.ProbeSilence) {
+			fmt.Printf("Probe %s is silent for %v\n", probe, t.ProbeSilence)
+			t.Metrics.Increment("tcapflow-server.probeSilent")
+		}
+	}
+
+	silent := 0
+	for _, probe := range t.Probes.Stats() {
+		if probe.Silent {
+			silent++
+		}
+		if t.Prometheus != nil {
+			labels := tcapflow.Labels{"probe": probe.Name}
+			t.Prometheus.Set("tcapflow_server_probe_messages_total", labels, float64(probe.Messages))
+			t.Prometheus.Set("tcapflow_server_probe_gaps", labels, float64(probe.Gaps))
+			t.Prometheus.Set("tcapflow_server_probe_last_seen_seconds", labels, float64(probe.LastSeen.UnixNano())/1e9)
+		}
+	}
+	t.Metrics.Gauge("tcapflow-server.probesSilent", float64(silent))
+	if t.Prometheus != nil {
+		t.Prometheus.Set("tcapflow_server_probes_silent", nil, float64(silent))
+		for _, offset := range t.Probes.ClockOffsets() {
+			t.Prometheus.Set("tcapflow_server_probe_clock_offset_seconds",
+				tcapflow.Labels{"probe": offset.Probe, "reference": offset.Reference}, offset.Offset/1000)
+		}
+	}
+}
+
+func sendGauges(t *TCAPFlowServer) {
+	for now := range time.Tick(time.Second) {
+		expireShards(t)
+		checkProbes(t, now)
+		sessions, earlyPending, old := t.Counts()
+		t.Metrics.Gauge("tcapflow-server.sessions", float64(sessions))
+		t.Metrics.Gauge("tcapflow-server.earlyPending", float64(earlyPending))
+		t.Metrics.Gauge("tcapflow-server.old", float64(old))
+		if t.Reorder != nil {
+			t.Metrics.Gauge("tcapflow-server.reordering", float64(t.Reorder.Len()))
+			if t.Prometheus != nil {
+				t.Prometheus.Set("tcapflow_server_reordering", nil, float64(t.Reorder.Len()))
+			}
+		}
+		if t.Prometheus != nil {
+			t.Prometheus.Set("tcapflow_server_sessions", nil, float64(sessions))
+			t.Prometheus.Set("tcapflow_server_early_pending", nil, float64(earlyPending))
+			t.Prometheus.Set("tcapflow_server_old", nil, float64(old))
+		}
+	}
+}
+
+// Bump when the meaning of the snapshot changes
+const snapshotVersion = 1
+
+// The dialogues of the server written to disk to survive a restart.
+// Messages are kept as encoded StateInfo. Sessions keep the TC-Begin.
+type serverSnapshot struct {
+	Version      int
+	Written      time.Time
+	Sessions     []snapshotEntry
+	EarlyPending []snapshotEntry
+	Old          []snapshotEntry
+}
+
+// Added is the EndedTime for Old entries which have no State
+type snapshotEntry struct {
+	Key     string
+	Added   time.Time
+	Overdue bool
+	State   []byte
+}
+
+// Snapshot copies the dialogues of all shards ordered by when they were
+// added
+func (t *TCAPFlowServer) Snapshot() (serverSnapshot, error) {
+	snapshot := serverSnapshot{Version: snapshotVersion, Written: time.Now()}
+	for _, shard := range t.Shards {
+		if err := snapshotShard(&snapshot, shard); err != nil {
+			return snapshot, err
+		}
+	}
+	for _, entries := range [][]snapshotEntry{snapshot.Sessions, snapshot.EarlyPending, snapshot.Old} {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Added.Before(entries[j].Added) })
+	}
+	return snapshot, nil
+}
+
+// Add the dialogues of a shard to the snapshot
+func snapshotShard(snapshot *serverSnapshot, shard *TCAPFlowShard) error {
+	shard.Lock()
+	defer shard.Unlock()
+	for key, v := range shard.Sessions {
+		capt, _ := ptypes.TimestampProto(v.CaptTime)
+		calling, called := v.Calling, v.Called
+		begin := &rpc.StateInfo{
+			Time:    capt,
+			Calling: &calling,
+			Called:  &called,
+			Tcap: &rpc.TCAPInfo{
+				Otid:               v.Otid,
+				Tag:                tcapflow.TCbeginApp,
+				ApplicationContext: v.ApplicationContext,
+			},
+			Ros:   v.Ros,
+			Probe: v.Probe,
+		}
+		data, err := proto.Marshal(begin)
+		if err != nil {
+			return fmt.Errorf("dialogue %v: %v", key, err)
+		}
+		snapshot.Sessions = append(snapshot.Sessions, snapshotEntry{
+			Key: key, Added: v.AddedTime, Overdue: v.Overdue, State: data})
+	}
+	for key, v := range shard.EarlyPending {
+		data, err := proto.Marshal(&v.State)
+		if err != nil {
+			return fmt.Errorf("message %v: %v", key, err)
+		}
+		snapshot.EarlyPending = append(snapshot.EarlyPending, snapshotEntry{
+			Key: key, Added: v.AddedTime, State: data})
+	}
+	for key, v := range shard.Old {
+		snapshot.Old = append(snapshot.Old, snapshotEntry{Key: key, Added: v.EndedTime})
+	}
+	return nil
+}
+
+// WriteSnapshot replaces file with the current dialogues. A crash while
+// writing leaves the previous snapshot.
+func (t *TCAPFlowServer) WriteSnapshot(file string) (int, error) {
+	snapshot, err := t.Snapshot()
+	if err != nil {
+		return 0, err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+
+	w := bufio.NewWriter(f)
+	err = gob.NewEncoder(w).Encode(&snapshot)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), file)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(snapshot.Sessions) + len(snapshot.EarlyPending) + len(snapshot.Old), nil
+}
+
+// RestoreSnapshot adds the dialogues of file that did not expire while the
+// server was down. A missing file restores nothing.
+func (t *TCAPFlowServer) RestoreSnapshot(file string) (restored, expired int, err error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	var snapshot serverSnapshot
+	err = gob.NewDecoder(bufio.NewReader(f)).Decode(&snapshot)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%v: %v", file, err)
+	}
+	if snapshot.Version != snapshotVersion {
+		return 0, 0, fmt.Errorf("%v: version %v is not %v", file, snapshot.Version, snapshotVersion)
+	}
+
+	decode := func(entry snapshotEntry) (rpc.StateInfo, time.Time, error) {
+		var state rpc.StateInfo
+		err := proto.Unmarshal(entry.State, &state)
+		if err != nil {
+			return state, time.Time{}, fmt.Errorf("%v: %v: %v", file, entry.Key, err)
+		}
+		capt, err := ptypes.Timestamp(state.Time)
+		if err != nil || state.Calling == nil || state.Called == nil || state.Tcap == nil {
+			return state, time.Time{}, fmt.Errorf("%v: %v: incomplete message", file, entry.Key)
+		}
+		return state, capt, nil
+	}
+
+	now := time.Now()
+	for _, entry := range snapshot.Sessions {
+		state, capt, err := decode(entry)
+		if err != nil {
+			return restored, expired, err
+		}
+		elem := newDialogueStart(t, entry.Added, capt, state)
+		elem.Overdue = entry.Overdue
+		if now.Sub(elem.AddedTime) > elem.Timer.Expire {
+			expired++
+			continue
+		}
+		shard := t.shardFor(entry.Key)
+		shard.Lock()
+		shard.Sessions[entry.Key] = elem
+		if t.MaxSessions > 0 {
+			shard.sessionOrder.Push(entry.Key, elem.AddedTime)
+			evictSessions(t, shard)
+		}
+		shard.Unlock()
+		restored++
+	}
+	for _, entry := range snapshot.EarlyPending {
+		state, capt, err := decode(entry)
+		if err != nil {
+			return restored, expired, err
+		}
+		if now.Sub(entry.Added) > t.ExpirePendingDuration {
+			expired++
+			continue
+		}
+		shard := t.shardFor(entry.Key)
+		shard.Lock()
+		shard.EarlyPending[entry.Key] = TCAPEarlyStateInfo{State: state, AddedTime: entry.Added, CaptTime: capt}
+		if t.MaxEarlyPending > 0 {
+			shard.pendingOrder.Push(entry.Key, entry.Added)
+			evictEarlyPending(t, shard)
+		}
+		shard.Unlock()
+		restored++
+	}
+	for _, entry := range snapshot.Old {
+		if now.Sub(entry.Added) > t.ExpireEndedDuration {
+			expired++
+			continue
+		}
+		shard := t.shardFor(entry.Key)
+		shard.Lock()
+		shard.Old[entry.Key] = TCAPOld{EndedTime: entry.Added}
+		if t.MaxOld > 0 {
+			shard.oldOrder.Push(entry.Key, entry.Added)
+			evictOld(t, shard)
+		}
+		shard.Unlock()
+		restored++
+	}
+	return restored, expired, nil
+}
+
+func writeSnapshot(t *TCAPFlowServer, file string) {
+	start := time.Now()
+	entries, err := t.WriteSnapshot(file)
+	if err != nil {
+		fmt.Printf("ERROR: Failed to write snapshot: %v\n", err)
+		t.Metrics.Increment("tcapflow-server.snapshotError")
+		return
+	}
+	t.Metrics.Timing("tcapflow-server.snapshot", float64(time.Since(start)/t.Scale))
+	t.Metrics.Gauge("tcapflow-server.snapshotEntries", float64(entries))
+}
+
+func writeSnapshots(t *TCAPFlowServer, file string, interval time.Duration) {
+	for range time.Tick(interval) {
+		writeSnapshot(t, file)
+	}
+}
+
+// Stop taking messages, end the streams, wait up to timeout for the RPCs
+// to finish and process what is still held for reordering
+func shutdown(t *TCAPFlowServer, server *grpc.Server, timeout time.Duration) {
+	atomic.StoreInt32(&t.ready, 0)
+	close(t.stopping)
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		// Probes keep their streams open and resend what was not acked
+		server.Stop()
+		<-stopped
+	}
+	if t.Reorder != nil {
+		t.Reorder.Flush(time.Now().Add(t.Reorder.MaxDelay))
+	}
+}
+
 func main() {
 	flowServer := NewTCAPFlowServer()
 	statsdPrefix := flag.String("statsd-prefix", "", "Prefix for statsd messages")
+	metricsBackend := flag.String("metrics-backend", tcapflow.MetricsStatsd, "Metrics backend: statsd, dogstatsd, influx or none")
+	metricsRemote := flag.String("metrics-remote-address", "", "Hostname:port of the metrics backend (empty picks its default)")
+	metricsFlush := flag.Duration("metrics-flush-interval", time.Second, "Interval to send batched metrics")
 	serverAddr := flag.String("listen-address", "localhost:5345", "Hostname:port for RPC")
-	expireSession := flag.Duration("expire-session", flowServer.ExpireSessionDuration, "Time to keep unconfirmed TCAP dialogues")
+	expireSession := flag.Duration("expire-session", flowServer.ExpireSessionDuration, "Time to keep unconfirmed TCAP dialogues without a timer profile")
+	timerProfiles := flag.String("timer-profiles", "", "JSON file with per operation and application context timers")
 	expirePending := flag.Duration("expire-pending", flowServer.ExpirePendingDuration, "Time to buffer messages for out-of-order arrival")
+	reorderDelay := flag.Duration("reorder-delay", 0, "Longest time to hold messages to process them in capture time order across probes, e.g. 2s (0 disables it)")
+	maxReorder := flag.Int("max-reorder", 100000, "Messages to hold at most for reordering (0 is unlimited)")
 	expireEnded := flag.Duration("expired-ended", flowServer.ExpireEndedDuration, "Time to keep information of ended TCAP dialogues")
+	maxSessions := flag.Int("max-sessions", 0, "Evict the oldest unconfirmed TCAP dialogues beyond this number (0 is unlimited)")
+	maxPending := flag.Int("max-pending", 0, "Evict the oldest buffered out-of-order messages beyond this number (0 is unlimited)")
+	maxEnded := flag.Int("max-ended", 0, "Evict the oldest ended TCAP dialogues beyond this number (0 is unlimited)")
+	logTimeouts := flag.Bool("log-timeouts", false, "Print unanswered TCAP dialogues")
+	stateShards := flag.Int("state-shards", len(flowServer.Shards), "Number of independently locked state shards")
+	metricsAddr := flag.String("metrics-address", "", "Hostname:port to serve Prometheus /metrics on (empty disables it)")
+	metricsGtPrefix := flag.Int("metrics-gt-prefix", 5, "Digits of the peer GT used as metric label")
+	metricsPartners := flag.String("metrics-partners", "", "File with lines of '<gt prefix> <partner>' to label peers by name")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "OTLP/HTTP URL to export dialogue traces to, e.g. http://localhost:4318/v1/traces (empty disables it)")
+	otlpService := flag.String("otlp-service-name", "tcapflow-server", "Service name of the exported traces")
+	otlpInterval := flag.Duration("otlp-flush-interval", 5*time.Second, "Interval to send batched spans (0 only sends full batches)")
+	adminAddr := flag.String("admin-address", "", "Hostname:port to serve the admin API on (empty disables it)")
+	adminPprof := flag.Bool("admin-pprof", false, "Serve pprof below /debug/pprof/ on the -admin-address")
+	snapshotFile := flag.String("snapshot-file", "", "File to keep the open dialogues in across restarts (empty disables it)")
+	snapshotInterval := flag.Duration("snapshot-interval", time.Minute, "Interval to write the -snapshot-file (0 only writes it on shutdown)")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 5*time.Second, "Time to let RPCs finish on SIGTERM before the final snapshot")
+	clusterPeers := flag.String("cluster-peers", "", "Comma separated admin addresses of the other servers to merge into /cluster/stats")
+	probeSilence := flag.Duration("probe-silence", flowServer.ProbeSilence, "Report probes not sending for this time (0 disables it)")
+	transitWindow := flag.Duration("transit-window", 0, "Time to recognise the same message reported by another probe, e.g. 5s (0 disables it)")
+	clockWindow := flag.Duration("clock-window", flowServer.Probes.Window, "Window of the fastest dialogues to estimate probe clock offsets from")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate to serve TLS with (empty serves plaintext)")
+	tlsKey := flag.String("tls-key", "", "PEM key of the certificate")
+	tlsClientCA := flag.String("tls-client-ca", "", "PEM CA to verify probe certificates with. Probes must then authenticate")
+	authTokens := flag.String("auth-tokens", "", "File with lines of '<token> <probe>'. Probes must then authenticate (needs -tls-cert)")
 	flag.Parse()
 
 	flowServer.ExpireSessionDuration = *expireSession
+	flowServer.Timers = tcapflow.DefaultTimerProfiles(*expireSession)
+	if len(*timerProfiles) > 0 {
+		err := flowServer.Timers.LoadTimerProfiles(*timerProfiles)
+		if err != nil {
+			fmt.Printf("ERROR: %v\n", err)
+			return
+		}
+	}
 	flowServer.ExpirePendingDuration = *expirePending
 	flowServer.ExpireEndedDuration = *expireEnded
+	flowServer.LogTimeouts = *logTimeouts
+	flowServer.MaxSessions = *maxSessions
+	flowServer.MaxEarlyPending = *maxPending
+	flowServer.MaxOld = *maxEnded
+	flowServer.InitShards(*stateShards)
+	flowServer.ProbeSilence = *probeSilence
+	if *reorderDelay > 0 {
+		flowServer.Reorder = newReorderBuffer(&flowServer, *reorderDelay, *maxReorder)
+	}
+	flowServer.Probes.Window = *clockWindow
+	if *transitWindow > 0 {
+		flowServer.Transit = tcapflow.NewTransitTracker(*transitWindow, flowServer.Probes)
+	}
+
+	if len(*metricsAddr) > 0 {
+		peers := &tcapflow.PeerLabels{PrefixLength: *metricsGtPrefix}
+		if len(*metricsPartners) > 0 {
+			err := peers.LoadPartners(*metricsPartners)
+			if err != nil {
+				fmt.Printf("ERROR: %v\n", err)
+				return
+			}
+		}
+		flowServer.Prometheus = tcapflow.NewPrometheusRegistry()
+		flowServer.Prometheus.NewGauge("tcapflow_server_sessions", "TC-Begins waiting for a response.")
+		flowServer.Prometheus.NewGauge("tcapflow_server_early_pending", "Responses waiting for their TC-Begin.")
+		flowServer.Prometheus.NewGauge("tcapflow_server_old", "Ended dialogues kept for late messages.")
+		flowServer.Prometheus.NewHistogram("tcapflow_server_transit_seconds", "Delay of messages seen at one probe and then another.", tcapflow.LatencyBuckets)
+		flowServer.Prometheus.NewGauge("tcapflow_server_reordering", "Messages held to process them in capture time order.")
+		flowServer.Prometheus.NewHistogram("tcapflow_server_late_arrival_seconds", "How much older a message was than the ones already processed.", tcapflow.LatencyBuckets)
+		flowServer.Prometheus.NewCounter("tcapflow_server_probe_messages_total", "Messages received per probe.")
+		flowServer.Prometheus.NewGauge("tcapflow_server_probe_gaps", "Messages of a probe missing in its sequence.")
+		flowServer.Prometheus.NewGauge("tcapflow_server_probe_last_seen_seconds", "Time of the last message of a probe.")
+		flowServer.Prometheus.NewGauge("tcapflow_server_probes_silent", "Probes not heard from for -probe-silence.")
+		flowServer.Prometheus.NewGauge("tcapflow_server_probe_clock_offset_seconds", "Clock of the probe minus the clock of the reference probe.")
+		flowServer.Dialogues = tcapflow.NewDialogueMetrics(flowServer.Prometheus, "tcapflow_server", peers)
+		tcapflow.ServePrometheus(*metricsAddr, flowServer.Prometheus)
+	}
+
+	if len(*otlpEndpoint) > 0 {
+		flowServer.Tracer = tcapflow.NewOTLPExporter(*otlpEndpoint, *otlpService, *otlpInterval)
+		defer flowServer.Tracer.Close()
+	}
+
+	if len(*adminAddr) > 0 {
+		admin := serverAdmin{&flowServer}
+		mux := tcapflow.NewAdminMux(admin, admin.Ready)
+		if *adminPprof {
+			tcapflow.HandlePprof(mux)
+		}
+		if len(*clusterPeers) > 0 {
+			peers := strings.Split(*clusterPeers, ",")
+			tcapflow.HandleAdminJSON(mux, "/cluster/stats", func() interface{} {
+				return admin.ClusterStats(*adminAddr, peers)
+			})
+		}
+		tcapflow.ServeAdmin(*adminAddr, mux)
+	}
 
 	lis, err := net.Listen("tcp", *serverAddr)
 	if err != nil {
 		fmt.Printf("failed to listen: %v", err)
 		return
 	}
-	flowServer.Statsd, err = statsd.New(statsd.Prefix(*statsdPrefix))
+	flowServer.Metrics, err = tcapflow.NewMetrics(*metricsBackend, *metricsRemote, *statsdPrefix, *metricsFlush)
 	if err != nil {
-		fmt.Printf("ERROR: Failed to create statsd client\n")
+		fmt.Printf("ERROR: Failed to create metrics client: %v\n", err)
+		return
+	}
+	defer flowServer.Metrics.Close()
+	go sendGauges(&flowServer)
+	if flowServer.Reorder != nil {
+		go flushReordered(&flowServer)
+	}
+
+	var options []grpc.ServerOption
+	if len(*tlsCert) > 0 {
+		config, err := tcapflow.ServerTLSConfig(*tlsCert, *tlsKey, *tlsClientCA)
+		if err != nil {
+			fmt.Printf("ERROR: %v\n", err)
+			return
+		}
+		options = append(options, grpc.Creds(credentials.NewTLS(config)))
+	} else if len(*tlsClientCA) > 0 {
+		fmt.Printf("ERROR: -tls-client-ca needs -tls-cert\n")
+		return
+	} else if len(*authTokens) > 0 {
+		fmt.Printf("ERROR: -auth-tokens needs -tls-cert as probes would send their tokens in plaintext\n")
 		return
 	}
-	defer flowServer.Statsd.Close()
+	if len(*tlsClientCA) > 0 || len(*authTokens) > 0 {
+		auth := &tcapflow.Authenticator{}
+		if len(*authTokens) > 0 {
+			err = auth.LoadTokens(*authTokens)
+			if err != nil {
+				fmt.Printf("ERROR: %v\n", err)
+				return
+			}
+		}
+		options = append(options, grpc.UnaryInterceptor(auth.UnaryInterceptor),
+			grpc.StreamInterceptor(auth.StreamInterceptor))
+	}
+
+	if len(*snapshotFile) > 0 {
+		restored, expired, err := flowServer.RestoreSnapshot(*snapshotFile)
+		if err != nil {
+			fmt.Printf("ERROR: Failed to restore snapshot: %v\n", err)
+			return
+		}
+		fmt.Printf("Restored %v dialogue entries, %v expired while down\n", restored, expired)
+		if *snapshotInterval > 0 {
+			go writeSnapshots(&flowServer, *snapshotFile, *snapshotInterval)
+		}
+	}
 
-	grpcServer := grpc.NewServer()
+	grpcServer := grpc.NewServer(options...)
 	rpc.RegisterTCAPFlowServer(grpcServer, &flowServer)
-	grpcServer.Serve(lis)
+	atomic.StoreInt32(&flowServer.ready, 1)
+	go func() {
+		err := grpcServer.Serve(lis)
+		if err != nil {
+			fmt.Printf("ERROR: %v\n", err)
+			os.Exit(1)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	fmt.Printf("Shutting down\n")
+	shutdown(&flowServer, grpcServer, *shutdownTimeout)
+	if len(*snapshotFile) > 0 {
+		writeSnapshot(&flowServer, *snapshotFile)
+	}
 }
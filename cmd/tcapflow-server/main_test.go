@@ -1,95 +1,131 @@
 package main
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
-	"golang.org/x/net/context"
+	"github.com/golang/protobuf/ptypes/empty"
 	"github.com/golang/protobuf/ptypes/timestamp"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 
 	"github.com/moiji-mobile/tcapflow"
 	"github.com/moiji-mobile/tcapflow/rpc"
 )
 
+func sessions(s *TCAPFlowServer) int {
+	n, _, _ := s.Counts()
+	return n
+}
+
+func earlyPending(s *TCAPFlowServer) int {
+	_, n, _ := s.Counts()
+	return n
+}
+
+func old(s *TCAPFlowServer) int {
+	_, _, n := s.Counts()
+	return n
+}
 
 func buildTcBegin() rpc.StateInfo {
-	t := &timestamp.Timestamp {0, 0}
+	t := &timestamp.Timestamp{Seconds: 0, Nanos: 0}
 	return rpc.StateInfo{
-			Time: t,
-			Calling: &rpc.SCCPAddress{
-					Ssn: 1,
-					Ton: 23,
-					Npi: 23,
-					Number: "vlr"},
-			Called: &rpc.SCCPAddress{
-					Ssn: 2,
-					Ton: 23,
-					Npi: 23,
-					Number: "hlr"},
-			Tcap: &rpc.TCAPInfo{
-					Otid: []byte{1, 2, 3, 4},
-					Tag: tcapflow.TCbeginApp,
-			}}
+		Time: t,
+		Calling: &rpc.SCCPAddress{
+			Ssn:    1,
+			Ton:    23,
+			Npi:    23,
+			Number: "vlr"},
+		Called: &rpc.SCCPAddress{
+			Ssn:    2,
+			Ton:    23,
+			Npi:    23,
+			Number: "hlr"},
+		Tcap: &rpc.TCAPInfo{
+			Otid: []byte{1, 2, 3, 4},
+			Tag:  tcapflow.TCbeginApp,
+		}}
 }
 
 func buildTcEnd() rpc.StateInfo {
-	t := &timestamp.Timestamp {1, 0}
+	t := &timestamp.Timestamp{Seconds: 1, Nanos: 0}
 	return rpc.StateInfo{
-			Time: t,
-			Calling: &rpc.SCCPAddress{
-					Ssn: 2,
-					Ton: 23,
-					Npi: 23,
-					Number: "hlr"},
-			Called: &rpc.SCCPAddress{
-					Ssn: 1,
-					Ton: 23,
-					Npi: 23,
-					Number: "vlr"},
-			Tcap: &rpc.TCAPInfo{
-					Dtid: []byte{1, 2, 3, 4},
-					Tag: tcapflow.TCendApp,
-			}}
+		Time: t,
+		Calling: &rpc.SCCPAddress{
+			Ssn:    2,
+			Ton:    23,
+			Npi:    23,
+			Number: "hlr"},
+		Called: &rpc.SCCPAddress{
+			Ssn:    1,
+			Ton:    23,
+			Npi:    23,
+			Number: "vlr"},
+		Tcap: &rpc.TCAPInfo{
+			Dtid: []byte{1, 2, 3, 4},
+			Tag:  tcapflow.TCendApp,
+		}}
 }
 
 func buildTcContinue() rpc.StateInfo {
-	t := &timestamp.Timestamp {1, 0}
+	t := &timestamp.Timestamp{Seconds: 1, Nanos: 0}
 	return rpc.StateInfo{
-			Time: t,
-			Calling: &rpc.SCCPAddress{
-					Ssn: 2,
-					Ton: 23,
-					Npi: 23,
-					Number: "hlr"},
-			Called: &rpc.SCCPAddress{
-					Ssn: 1,
-					Ton: 23,
-					Npi: 23,
-					Number: "vlr"},
-			Tcap: &rpc.TCAPInfo{
-					Dtid: []byte{1, 2, 3, 4},
-					Otid: []byte{4, 3, 2, 1},
-					Tag: tcapflow.TCcontinueApp,
-			}}
+		Time: t,
+		Calling: &rpc.SCCPAddress{
+			Ssn:    2,
+			Ton:    23,
+			Npi:    23,
+			Number: "hlr"},
+		Called: &rpc.SCCPAddress{
+			Ssn:    1,
+			Ton:    23,
+			Npi:    23,
+			Number: "vlr"},
+		Tcap: &rpc.TCAPInfo{
+			Dtid: []byte{1, 2, 3, 4},
+			Otid: []byte{4, 3, 2, 1},
+			Tag:  tcapflow.TCcontinueApp,
+		}}
 }
 
 func buildTcAbort() rpc.StateInfo {
-	t := &timestamp.Timestamp {1, 0}
+	t := &timestamp.Timestamp{Seconds: 1, Nanos: 0}
 	return rpc.StateInfo{
-			Time: t,
-			Calling: &rpc.SCCPAddress{
-					Ssn: 2,
-					Ton: 23,
-					Npi: 23,
-					Number: "hlr"},
-			Called: &rpc.SCCPAddress{
-					Ssn: 1,
-					Ton: 23,
-					Npi: 23,
-					Number: "vlr"},
-			Tcap: &rpc.TCAPInfo{
-					Dtid: []byte{1, 2, 3, 4},
-					Tag: tcapflow.TCabortApp,
-			}}
+		Time: t,
+		Calling: &rpc.SCCPAddress{
+			Ssn:    2,
+			Ton:    23,
+			Npi:    23,
+			Number: "hlr"},
+		Called: &rpc.SCCPAddress{
+			Ssn:    1,
+			Ton:    23,
+			Npi:    23,
+			Number: "vlr"},
+		Tcap: &rpc.TCAPInfo{
+			Dtid: []byte{1, 2, 3, 4},
+			Tag:  tcapflow.TCabortApp,
+		}}
 }
 
 func TestTcBeginTcEnd(t *testing.T) {
@@ -99,20 +135,20 @@ func TestTcBeginTcEnd(t *testing.T) {
 
 	// TC-begin first
 	s.AddState(context.Background(), &b)
-	if len(s.Sessions) != 1 {
-		t.Fatalf("Should have one session %v\n", len(s.Sessions))
+	if sessions(&s) != 1 {
+		t.Fatalf("Should have one session %v\n", sessions(&s))
 	}
-	if len(s.EarlyPending) != 0 || len(s.Old) != 0 {
-		t.Fatalf("Should have no data %v %v\n", len(s.EarlyPending), len(s.Old))
+	if earlyPending(&s) != 0 || old(&s) != 0 {
+		t.Fatalf("Should have no data %v %v\n", earlyPending(&s), old(&s))
 	}
 
 	// TC-end to finish it
 	s.AddState(context.Background(), &e)
-	if len(s.Sessions) != 0 {
-		t.Fatalf("Should have one session %v\n", len(s.Sessions))
+	if sessions(&s) != 0 {
+		t.Fatalf("Should have one session %v\n", sessions(&s))
 	}
-	if len(s.EarlyPending) != 0 || len(s.Old) != 0 {
-		t.Fatalf("Should have no data %v %v\n", len(s.EarlyPending), len(s.Old))
+	if earlyPending(&s) != 0 || old(&s) != 0 {
+		t.Fatalf("Should have no data %v %v\n", earlyPending(&s), old(&s))
 	}
 }
 
@@ -123,23 +159,23 @@ func TestTcBeginTcContinue(t *testing.T) {
 
 	// TC-begin first
 	s.AddState(context.Background(), &b)
-	if len(s.Sessions) != 1 {
-		t.Fatalf("Should have one session %v\n", len(s.Sessions))
+	if sessions(&s) != 1 {
+		t.Fatalf("Should have one session %v\n", sessions(&s))
 	}
-	if len(s.EarlyPending) != 0 || len(s.Old) != 0 {
-		t.Fatalf("Should have no data %v %v\n", len(s.EarlyPending), len(s.Old))
+	if earlyPending(&s) != 0 || old(&s) != 0 {
+		t.Fatalf("Should have no data %v %v\n", earlyPending(&s), old(&s))
 	}
 
 	// TC-continue to finish it
 	s.AddState(context.Background(), &c)
-	if len(s.Sessions) != 0 {
-		t.Fatalf("Should have one session %v\n", len(s.Sessions))
+	if sessions(&s) != 0 {
+		t.Fatalf("Should have one session %v\n", sessions(&s))
 	}
-	if len(s.EarlyPending) != 0 {
-		t.Fatalf("Should have no data %v\n", len(s.EarlyPending))
+	if earlyPending(&s) != 0 {
+		t.Fatalf("Should have no data %v\n", earlyPending(&s))
 	}
-	if len(s.Old) != 1 {
-		t.Fatalf("Should remember one old %v\n", len(s.Old))
+	if old(&s) != 1 {
+		t.Fatalf("Should remember one old %v\n", old(&s))
 	}
 }
 
@@ -151,32 +187,32 @@ func TestTcBeginTcContinueTcEnd(t *testing.T) {
 
 	// TC-begin first
 	s.AddState(context.Background(), &b)
-	if len(s.Sessions) != 1 {
-		t.Fatalf("Should have one session %v\n", len(s.Sessions))
+	if sessions(&s) != 1 {
+		t.Fatalf("Should have one session %v\n", sessions(&s))
 	}
-	if len(s.EarlyPending) != 0 || len(s.Old) != 0 {
-		t.Fatalf("Should have no data %v %v\n", len(s.EarlyPending), len(s.Old))
+	if earlyPending(&s) != 0 || old(&s) != 0 {
+		t.Fatalf("Should have no data %v %v\n", earlyPending(&s), old(&s))
 	}
 
 	// TC-continue to finish it
 	s.AddState(context.Background(), &c)
-	if len(s.Sessions) != 0 {
-		t.Fatalf("Should have one session %v\n", len(s.Sessions))
+	if sessions(&s) != 0 {
+		t.Fatalf("Should have one session %v\n", sessions(&s))
 	}
-	if len(s.EarlyPending) != 0 {
-		t.Fatalf("Should have no data %v\n", len(s.EarlyPending))
+	if earlyPending(&s) != 0 {
+		t.Fatalf("Should have no data %v\n", earlyPending(&s))
 	}
-	if len(s.Old) != 1 {
-		t.Fatalf("Should remember one old %v\n", len(s.Old))
+	if old(&s) != 1 {
+		t.Fatalf("Should remember one old %v\n", old(&s))
 	}
 
 	// TC-end now it ends..
 	s.AddState(context.Background(), &e)
-	if len(s.Sessions) != 0 {
-		t.Fatalf("Should have one session %v\n", len(s.Sessions))
+	if sessions(&s) != 0 {
+		t.Fatalf("Should have one session %v\n", sessions(&s))
 	}
-	if len(s.EarlyPending) != 0 || len(s.Old) != 0 {
-		t.Fatalf("Should have no data %v %v\n", len(s.EarlyPending), len(s.Old))
+	if earlyPending(&s) != 0 || old(&s) != 0 {
+		t.Fatalf("Should have no data %v %v\n", earlyPending(&s), old(&s))
 	}
 }
 
@@ -188,42 +224,42 @@ func TestTcBeginTcContinueTcEndTcEnd(t *testing.T) {
 
 	// TC-begin first
 	s.AddState(context.Background(), &b)
-	if len(s.Sessions) != 1 {
-		t.Fatalf("Should have one session %v\n", len(s.Sessions))
+	if sessions(&s) != 1 {
+		t.Fatalf("Should have one session %v\n", sessions(&s))
 	}
-	if len(s.EarlyPending) != 0 || len(s.Old) != 0 {
-		t.Fatalf("Should have no data %v %v\n", len(s.EarlyPending), len(s.Old))
+	if earlyPending(&s) != 0 || old(&s) != 0 {
+		t.Fatalf("Should have no data %v %v\n", earlyPending(&s), old(&s))
 	}
 
 	// TC-continue to finish it
 	s.AddState(context.Background(), &c)
-	if len(s.Sessions) != 0 {
-		t.Fatalf("Should have one session %v\n", len(s.Sessions))
+	if sessions(&s) != 0 {
+		t.Fatalf("Should have one session %v\n", sessions(&s))
 	}
-	if len(s.EarlyPending) != 0 {
-		t.Fatalf("Should have no data %v\n", len(s.EarlyPending))
+	if earlyPending(&s) != 0 {
+		t.Fatalf("Should have no data %v\n", earlyPending(&s))
 	}
-	if len(s.Old) != 1 {
-		t.Fatalf("Should remember one old %v\n", len(s.Old))
+	if old(&s) != 1 {
+		t.Fatalf("Should remember one old %v\n", old(&s))
 	}
 
 	// TC-end now it ends..
 	s.AddState(context.Background(), &e)
-	if len(s.Sessions) != 0 {
-		t.Fatalf("Should have one session %v\n", len(s.Sessions))
+	if sessions(&s) != 0 {
+		t.Fatalf("Should have one session %v\n", sessions(&s))
 	}
-	if len(s.EarlyPending) != 0 || len(s.Old) != 0 {
-		t.Fatalf("Should have no data %v %v\n", len(s.EarlyPending), len(s.Old))
+	if earlyPending(&s) != 0 || old(&s) != 0 {
+		t.Fatalf("Should have no data %v %v\n", earlyPending(&s), old(&s))
 	}
 
 	// Fake end.. should be coming from the other direction but good enough
 	// to check the behavior of the code
 	s.AddState(context.Background(), &e)
-	if len(s.Sessions) != 0 {
-		t.Fatalf("Should have one session %v\n", len(s.Sessions))
+	if sessions(&s) != 0 {
+		t.Fatalf("Should have one session %v\n", sessions(&s))
 	}
-	if len(s.EarlyPending) != 1 || len(s.Old) != 0 {
-		t.Fatalf("Should have no data %v %v\n", len(s.EarlyPending), len(s.Old))
+	if earlyPending(&s) != 1 || old(&s) != 0 {
+		t.Fatalf("Should have no data %v %v\n", earlyPending(&s), old(&s))
 	}
 }
 
@@ -234,29 +270,29 @@ func TestTcBeginTcContinueTcContinue(t *testing.T) {
 
 	// TC-begin first
 	s.AddState(context.Background(), &b)
-	if len(s.Sessions) != 1 {
-		t.Fatalf("Should have one session %v\n", len(s.Sessions))
+	if sessions(&s) != 1 {
+		t.Fatalf("Should have one session %v\n", sessions(&s))
 	}
-	if len(s.EarlyPending) != 0 || len(s.Old) != 0 {
-		t.Fatalf("Should have no data %v %v\n", len(s.EarlyPending), len(s.Old))
+	if earlyPending(&s) != 0 || old(&s) != 0 {
+		t.Fatalf("Should have no data %v %v\n", earlyPending(&s), old(&s))
 	}
 
 	// TC-continue to finish it
 	s.AddState(context.Background(), &c)
-	if len(s.Sessions) != 0 {
-		t.Fatalf("Should have one session %v\n", len(s.Sessions))
+	if sessions(&s) != 0 {
+		t.Fatalf("Should have one session %v\n", sessions(&s))
 	}
-	if len(s.EarlyPending) != 0 || len(s.Old) != 1 {
-		t.Fatalf("Should have no data %v %v\n", len(s.EarlyPending), len(s.Old))
+	if earlyPending(&s) != 0 || old(&s) != 1 {
+		t.Fatalf("Should have no data %v %v\n", earlyPending(&s), old(&s))
 	}
 
 	// TC-continue should not add...
 	s.AddState(context.Background(), &c)
-	if len(s.Sessions) != 0 {
-		t.Fatalf("Should have one session %v\n", len(s.Sessions))
+	if sessions(&s) != 0 {
+		t.Fatalf("Should have one session %v\n", sessions(&s))
 	}
-	if len(s.EarlyPending) != 0 || len(s.Old) != 1 {
-		t.Fatalf("Should have no data %v %v\n", len(s.EarlyPending), len(s.Old))
+	if earlyPending(&s) != 0 || old(&s) != 1 {
+		t.Fatalf("Should have no data %v %v\n", earlyPending(&s), old(&s))
 	}
 }
 
@@ -268,20 +304,20 @@ func TestTcContinueTcBegin(t *testing.T) {
 
 	// TC-end arrived first
 	s.AddState(context.Background(), &c)
-	if len(s.Sessions) != 0 {
-		t.Fatalf("Should have one session %v\n", len(s.Sessions))
+	if sessions(&s) != 0 {
+		t.Fatalf("Should have one session %v\n", sessions(&s))
 	}
-	if len(s.EarlyPending) != 1 || len(s.Old) != 0 {
-		t.Fatalf("Should have no data %v %v\n", len(s.EarlyPending), len(s.Old))
+	if earlyPending(&s) != 1 || old(&s) != 0 {
+		t.Fatalf("Should have no data %v %v\n", earlyPending(&s), old(&s))
 	}
 
 	// TC-begin now
 	s.AddState(context.Background(), &b)
-	if len(s.Sessions) != 0 {
-		t.Fatalf("Should have one session %v\n", len(s.Sessions))
+	if sessions(&s) != 0 {
+		t.Fatalf("Should have one session %v\n", sessions(&s))
 	}
-	if len(s.EarlyPending) != 0 || len(s.Old) != 1 {
-		t.Fatalf("Should have no data %v %v\n", len(s.EarlyPending), len(s.Old))
+	if earlyPending(&s) != 0 || old(&s) != 1 {
+		t.Fatalf("Should have no data %v %v\n", earlyPending(&s), old(&s))
 	}
 }
 
@@ -293,20 +329,20 @@ func TestTcEndTcBegin(t *testing.T) {
 
 	// TC-end arrived first
 	s.AddState(context.Background(), &e)
-	if len(s.Sessions) != 0 {
-		t.Fatalf("Should have one session %v\n", len(s.Sessions))
+	if sessions(&s) != 0 {
+		t.Fatalf("Should have one session %v\n", sessions(&s))
 	}
-	if len(s.EarlyPending) != 1 || len(s.Old) != 0 {
-		t.Fatalf("Should have no data %v %v\n", len(s.EarlyPending), len(s.Old))
+	if earlyPending(&s) != 1 || old(&s) != 0 {
+		t.Fatalf("Should have no data %v %v\n", earlyPending(&s), old(&s))
 	}
 
 	// TC-begin now
 	s.AddState(context.Background(), &b)
-	if len(s.Sessions) != 0 {
-		t.Fatalf("Should have one session %v\n", len(s.Sessions))
+	if sessions(&s) != 0 {
+		t.Fatalf("Should have one session %v\n", sessions(&s))
 	}
-	if len(s.EarlyPending) != 0 || len(s.Old) != 0 {
-		t.Fatalf("Should have no data %v %v\n", len(s.EarlyPending), len(s.Old))
+	if earlyPending(&s) != 0 || old(&s) != 0 {
+		t.Fatalf("Should have no data %v %v\n", earlyPending(&s), old(&s))
 	}
 
 }
@@ -319,20 +355,20 @@ func TestTcAbortTcBegin(t *testing.T) {
 
 	// TC-end arrived first
 	s.AddState(context.Background(), &a)
-	if len(s.Sessions) != 0 {
-		t.Fatalf("Should have one session %v\n", len(s.Sessions))
+	if sessions(&s) != 0 {
+		t.Fatalf("Should have one session %v\n", sessions(&s))
 	}
-	if len(s.EarlyPending) != 1 || len(s.Old) != 0 {
-		t.Fatalf("Should have no data %v %v\n", len(s.EarlyPending), len(s.Old))
+	if earlyPending(&s) != 1 || old(&s) != 0 {
+		t.Fatalf("Should have no data %v %v\n", earlyPending(&s), old(&s))
 	}
 
 	// TC-begin now
 	s.AddState(context.Background(), &b)
-	if len(s.Sessions) != 0 {
-		t.Fatalf("Should have one session %v\n", len(s.Sessions))
+	if sessions(&s) != 0 {
+		t.Fatalf("Should have one session %v\n", sessions(&s))
 	}
-	if len(s.EarlyPending) != 0 || len(s.Old) != 0 {
-		t.Fatalf("Should have no data %v %v\n", len(s.EarlyPending), len(s.Old))
+	if earlyPending(&s) != 0 || old(&s) != 0 {
+		t.Fatalf("Should have no data %v %v\n", earlyPending(&s), old(&s))
 	}
 }
 
@@ -343,20 +379,20 @@ func TestTcBeginTcAbort(t *testing.T) {
 
 	// TC-begin first
 	s.AddState(context.Background(), &b)
-	if len(s.Sessions) != 1 {
-		t.Fatalf("Should have one session %v\n", len(s.Sessions))
+	if sessions(&s) != 1 {
+		t.Fatalf("Should have one session %v\n", sessions(&s))
 	}
-	if len(s.EarlyPending) != 0 || len(s.Old) != 0 {
-		t.Fatalf("Should have no data %v %v\n", len(s.EarlyPending), len(s.Old))
+	if earlyPending(&s) != 0 || old(&s) != 0 {
+		t.Fatalf("Should have no data %v %v\n", earlyPending(&s), old(&s))
 	}
 
 	// TC-end to finish it
 	s.AddState(context.Background(), &a)
-	if len(s.Sessions) != 0 {
-		t.Fatalf("Should have one session %v\n", len(s.Sessions))
+	if sessions(&s) != 0 {
+		t.Fatalf("Should have one session %v\n", sessions(&s))
 	}
-	if len(s.EarlyPending) != 0 || len(s.Old) != 0 {
-		t.Fatalf("Should have no data %v %v\n", len(s.EarlyPending), len(s.Old))
+	if earlyPending(&s) != 0 || old(&s) != 0 {
+		t.Fatalf("Should have no data %v %v\n", earlyPending(&s), old(&s))
 	}
 }
 
@@ -366,20 +402,20 @@ func TestTcBeginTcBegin(t *testing.T) {
 
 	// TC-begin first
 	s.AddState(context.Background(), &b)
-	if len(s.Sessions) != 1 {
-		t.Fatalf("Should have one session %v\n", len(s.Sessions))
+	if sessions(&s) != 1 {
+		t.Fatalf("Should have one session %v\n", sessions(&s))
 	}
-	if len(s.EarlyPending) != 0 || len(s.Old) != 0 {
-		t.Fatalf("Should have no data %v %v\n", len(s.EarlyPending), len(s.Old))
+	if earlyPending(&s) != 0 || old(&s) != 0 {
+		t.Fatalf("Should have no data %v %v\n", earlyPending(&s), old(&s))
 	}
 
 	// TC-begin first
 	s.AddState(context.Background(), &b)
-	if len(s.Sessions) != 1 {
-		t.Fatalf("Should have one session %v\n", len(s.Sessions))
+	if sessions(&s) != 1 {
+		t.Fatalf("Should have one session %v\n", sessions(&s))
 	}
-	if len(s.EarlyPending) != 0 || len(s.Old) != 0 {
-		t.Fatalf("Should have no data %v %v\n", len(s.EarlyPending), len(s.Old))
+	if earlyPending(&s) != 0 || old(&s) != 0 {
+		t.Fatalf("Should have no data %v %v\n", earlyPending(&s), old(&s))
 	}
 }
 
@@ -390,28 +426,963 @@ func TestTcBeginTcContinueTcBegin(t *testing.T) {
 
 	// TC-begin first
 	s.AddState(context.Background(), &b)
-	if len(s.Sessions) != 1 {
-		t.Fatalf("Should have one session %v\n", len(s.Sessions))
+	if sessions(&s) != 1 {
+		t.Fatalf("Should have one session %v\n", sessions(&s))
 	}
-	if len(s.EarlyPending) != 0 || len(s.Old) != 0 {
-		t.Fatalf("Should have no data %v %v\n", len(s.EarlyPending), len(s.Old))
+	if earlyPending(&s) != 0 || old(&s) != 0 {
+		t.Fatalf("Should have no data %v %v\n", earlyPending(&s), old(&s))
 	}
 
 	// TC-continue now to wrap it up
 	s.AddState(context.Background(), &c)
-	if len(s.Sessions) != 0 {
-		t.Fatalf("Should have no session %v\n", len(s.Sessions))
+	if sessions(&s) != 0 {
+		t.Fatalf("Should have no session %v\n", sessions(&s))
 	}
-	if len(s.EarlyPending) != 0 || len(s.Old) != 1 {
-		t.Fatalf("Should have no data %v %v\n", len(s.EarlyPending), len(s.Old))
+	if earlyPending(&s) != 0 || old(&s) != 1 {
+		t.Fatalf("Should have no data %v %v\n", earlyPending(&s), old(&s))
 	}
 
 	// TC-begin first
 	s.AddState(context.Background(), &b)
-	if len(s.Sessions) != 1 {
-		t.Fatalf("Should have one session %v\n", len(s.Sessions))
+	if sessions(&s) != 1 {
+		t.Fatalf("Should have one session %v\n", sessions(&s))
+	}
+	if earlyPending(&s) != 0 || old(&s) != 0 {
+		t.Fatalf("Should have no data %v %v\n", earlyPending(&s), old(&s))
+	}
+}
+
+// Give every sender its own VLR and every dialogue its own TID
+func forDialogue(state rpc.StateInfo, vlr string, tid []byte) rpc.StateInfo {
+	calling := *state.Calling
+	called := *state.Called
+	tcap := *state.Tcap
+	if tcap.Tag == tcapflow.TCbeginApp {
+		calling.Number = vlr
+		tcap.Otid = tid
+	} else {
+		called.Number = vlr
+		tcap.Dtid = tid
+	}
+	state.Calling = &calling
+	state.Called = &called
+	state.Tcap = &tcap
+	return state
+}
+
+func TestConcurrentSenders(t *testing.T) {
+	s := NewTCAPFlowServer()
+	var wg sync.WaitGroup
+
+	// Every sender has its own dialogues and sends both directions
+	for sender := 0; sender < 8; sender++ {
+		wg.Add(1)
+		go func(sender int) {
+			defer wg.Done()
+			vlr := "vlr" + strconv.Itoa(sender)
+			for i := 0; i < 500; i++ {
+				tid := []byte{byte(i >> 8), byte(i), 0, 0}
+				b := forDialogue(buildTcBegin(), vlr, tid)
+				e := forDialogue(buildTcEnd(), vlr, tid)
+				s.AddState(context.Background(), &b)
+				s.AddState(context.Background(), &e)
+			}
+		}(sender)
+	}
+	wg.Wait()
+
+	if sessions(&s) != 0 {
+		t.Fatalf("Should have no session %v\n", sessions(&s))
+	}
+	if earlyPending(&s) != 0 || old(&s) != 0 {
+		t.Fatalf("Should have no data %v %v\n", earlyPending(&s), old(&s))
+	}
+}
+
+func TestConcurrentSendersSplitDirections(t *testing.T) {
+	s := NewTCAPFlowServer()
+	var wg sync.WaitGroup
+
+	// One probe sees the TC-begin and another one the TC-continue. Some
+	// of the responses will arrive first and end up pending.
+	for sender := 0; sender < 4; sender++ {
+		vlr := "vlr" + strconv.Itoa(sender)
+		for _, build := range []func() rpc.StateInfo{buildTcBegin, buildTcContinue} {
+			wg.Add(1)
+			go func(build func() rpc.StateInfo) {
+				defer wg.Done()
+				for i := 0; i < 500; i++ {
+					tid := []byte{byte(i >> 8), byte(i), 0, 0}
+					state := forDialogue(build(), vlr, tid)
+					s.AddState(context.Background(), &state)
+				}
+			}(build)
+		}
+	}
+	wg.Wait()
+
+	if sessions(&s) != 0 {
+		t.Fatalf("Should have no session %v\n", sessions(&s))
+	}
+	if earlyPending(&s) != 0 || old(&s) != 4*500 {
+		t.Fatalf("Should remember all old %v %v\n", earlyPending(&s), old(&s))
+	}
+}
+
+func TestSessionCapEvictsOldest(t *testing.T) {
+	s := NewTCAPFlowServer()
+	s.InitShards(1)
+	s.MaxSessions = 10
+
+	// TC-begin flood without any response
+	for i := 0; i < 100; i++ {
+		b := forDialogue(buildTcBegin(), "vlr", []byte{byte(i), 0, 0, 0})
+		s.AddState(context.Background(), &b)
+	}
+	if sessions(&s) != 10 {
+		t.Fatalf("Should be capped %v\n", sessions(&s))
+	}
+
+	// The oldest one is gone and the newest one can be matched
+	e := forDialogue(buildTcEnd(), "vlr", []byte{0, 0, 0, 0})
+	s.AddState(context.Background(), &e)
+	if sessions(&s) != 10 || earlyPending(&s) != 1 {
+		t.Fatalf("Should not match evicted %v %v\n", sessions(&s), earlyPending(&s))
+	}
+	e = forDialogue(buildTcEnd(), "vlr", []byte{99, 0, 0, 0})
+	s.AddState(context.Background(), &e)
+	if sessions(&s) != 9 {
+		t.Fatalf("Should match newest %v\n", sessions(&s))
+	}
+}
+
+func TestTimerProfileKeepsUSSD(t *testing.T) {
+	s := NewTCAPFlowServer()
+	s.InitShards(1)
+	s.Timers = tcapflow.DefaultTimerProfiles(0)
+
+	// processUnstructuredSS-Request has a long timer
+	u := forDialogue(buildTcBegin(), "vlr", []byte{1, 0, 0, 0})
+	u.Ros = []*rpc.ROSInfo{{Type: tcapflow.ROSInvoke, InvokeId: 1, OpCode: 59}}
+	s.AddState(context.Background(), &u)
+
+	// Without a profile the default of zero applies
+	b := forDialogue(buildTcBegin(), "vlr", []byte{2, 0, 0, 0})
+	s.AddState(context.Background(), &b)
+	if sessions(&s) != 2 {
+		t.Fatalf("Should only expire when sweeping %v\n", sessions(&s))
+	}
+	expireShards(&s)
+	if sessions(&s) != 1 {
+		t.Fatalf("Should only keep USSD %v\n", sessions(&s))
+	}
+
+	e := forDialogue(buildTcEnd(), "vlr", []byte{1, 0, 0, 0})
+	s.AddState(context.Background(), &e)
+	if sessions(&s) != 0 || earlyPending(&s) != 0 {
+		t.Fatalf("Should match USSD %v %v\n", sessions(&s), earlyPending(&s))
+	}
+}
+
+func TestPrometheusLabelsOutcome(t *testing.T) {
+	s := NewTCAPFlowServer()
+	s.InitShards(1)
+	s.Prometheus = tcapflow.NewPrometheusRegistry()
+	s.Dialogues = tcapflow.NewDialogueMetrics(s.Prometheus, "tcapflow_server", &tcapflow.PeerLabels{PrefixLength: 2})
+
+	b := buildTcBegin()
+	b.Ros = []*rpc.ROSInfo{{Type: tcapflow.ROSInvoke, InvokeId: 1, OpCode: 56}}
+	s.AddState(context.Background(), &b)
+	e := buildTcEnd()
+	s.AddState(context.Background(), &e)
+
+	var buf bytes.Buffer
+	s.Prometheus.WriteTo(&buf)
+	line := `tcapflow_server_dialogues_total{application_context="none",operation="56",outcome="end",peer="hl",ssn="2"} 1`
+	if !strings.Contains(buf.String(), line) {
+		t.Fatalf("Should count the dialogue\n%v\n", buf.String())
+	}
+	line = `tcapflow_server_response_latency_seconds_bucket{application_context="none",operation="56",outcome="end",peer="hl",ssn="2",le="1"} 1`
+	if !strings.Contains(buf.String(), line) {
+		t.Fatalf("Should observe the latency\n%v\n", buf.String())
+	}
+}
+
+func TestMemoryMetricsRecordsLatency(t *testing.T) {
+	s := NewTCAPFlowServer()
+	s.InitShards(1)
+	metrics := tcapflow.NewMemoryMetrics()
+	s.Metrics = metrics
+
+	b := buildTcBegin()
+	b.Ros = []*rpc.ROSInfo{{Type: tcapflow.ROSInvoke, InvokeId: 1, OpCode: 56}}
+	s.AddState(context.Background(), &b)
+	e := buildTcEnd()
+	s.AddState(context.Background(), &e)
+
+	if metrics.Counter("tcapflow-server.newState") != 1 || metrics.Counter("tcapflow-server.delState") != 1 {
+		t.Fatalf("Should count the dialogue %v\n", metrics.Counters)
+	}
+	latency := metrics.Timings["tcapflow-server.latency"]
+	if len(latency) != 1 || latency[0] != 1e9 {
+		t.Fatalf("Should time the response %v\n", latency)
+	}
+}
+
+func TestTraceExportedOnEnd(t *testing.T) {
+	var mu sync.Mutex
+	var posted []string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		posted = append(posted, string(body))
+		mu.Unlock()
+	}))
+	defer collector.Close()
+
+	s := NewTCAPFlowServer()
+	s.InitShards(1)
+	s.Tracer = tcapflow.NewOTLPExporter(collector.URL+"/v1/traces", "test", time.Hour)
+
+	b := buildTcBegin()
+	b.Ros = []*rpc.ROSInfo{{Type: tcapflow.ROSInvoke, InvokeId: 1, OpCode: 56}}
+	s.AddState(context.Background(), &b)
+	e := buildTcEnd()
+	e.Ros = []*rpc.ROSInfo{{Type: tcapflow.ROSResult, InvokeId: 1}}
+	s.AddState(context.Background(), &e)
+	s.Tracer.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(posted) != 1 {
+		t.Fatalf("Should post one batch %v\n", posted)
+	}
+	for _, part := range []string{`"name":"TCAP dialogue"`, `"name":"Invoke 56"`, `"stringValue":"returnResult"`, `"stringValue":"end"`} {
+		if !strings.Contains(posted[0], part) {
+			t.Fatalf("Should contain %v\n%v\n", part, posted[0])
+		}
+	}
+}
+
+// A collector that keeps the bodies posted to it
+func newCollector() (*httptest.Server, func() string) {
+	var mu sync.Mutex
+	var posted []string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		posted = append(posted, string(body))
+		mu.Unlock()
+	}))
+	return collector, func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return strings.Join(posted, "\n")
+	}
+}
+
+func TestTraceEndsWithContinuedDialogue(t *testing.T) {
+	collector, posted := newCollector()
+	defer collector.Close()
+
+	s := NewTCAPFlowServer()
+	s.InitShards(4)
+	s.Tracer = tcapflow.NewOTLPExporter(collector.URL+"/v1/traces", "test", 0)
+	s.Tracer.BatchSize = 1
+
+	b := buildTcBegin()
+	b.Ros = []*rpc.ROSInfo{{Type: tcapflow.ROSInvoke, InvokeId: 1, OpCode: 59}}
+	s.AddState(context.Background(), &b)
+	c := buildTcContinue()
+	c.Ros = []*rpc.ROSInfo{{Type: tcapflow.ROSInvoke, InvokeId: 2, OpCode: 60}}
+	s.AddState(context.Background(), &c)
+
+	// The initiator addresses the responder's OTID
+	i := buildTcContinue()
+	i.Calling, i.Called = c.Called, c.Calling
+	i.Tcap = &rpc.TCAPInfo{Otid: []byte{1, 2, 3, 4}, Dtid: []byte{4, 3, 2, 1}, Tag: tcapflow.TCcontinueApp}
+	i.Ros = []*rpc.ROSInfo{{Type: tcapflow.ROSResult, InvokeId: 2}}
+	s.AddState(context.Background(), &i)
+	if old(&s) != 1 || earlyPending(&s) != 0 {
+		t.Fatalf("Should continue the dialogue %v %v\n", old(&s), earlyPending(&s))
+	}
+	time.Sleep(50 * time.Millisecond)
+	if p := posted(); p != "" {
+		t.Fatalf("Should not export before the end %v\n", p)
+	}
+
+	e := buildTcEnd()
+	e.Calling, e.Called = i.Calling, i.Called
+	e.Tcap = &rpc.TCAPInfo{Dtid: []byte{4, 3, 2, 1}, Tag: tcapflow.TCendApp}
+	e.Ros = []*rpc.ROSInfo{{Type: tcapflow.ROSResult, InvokeId: 1}}
+	s.AddState(context.Background(), &e)
+	if old(&s) != 0 || earlyPending(&s) != 0 {
+		t.Fatalf("Should end the dialogue %v %v\n", old(&s), earlyPending(&s))
+	}
+	s.Tracer.Close()
+
+	p := posted()
+	for _, part := range []string{`"name":"Invoke 59"`, `"name":"Invoke 60"`, `"stringValue":"end"`} {
+		if !strings.Contains(p, part) {
+			t.Fatalf("Should contain %v\n%v\n", part, p)
+		}
+	}
+	if strings.Contains(p, `"stringValue":"none"`) {
+		t.Fatalf("Should answer all invokes\n%v\n", p)
+	}
+}
+
+func TestTraceOfEvictedAndIdleDialogues(t *testing.T) {
+	collector, posted := newCollector()
+	defer collector.Close()
+
+	s := NewTCAPFlowServer()
+	s.InitShards(1)
+	s.MaxSessions = 1
+	s.ExpireEndedDuration = time.Millisecond
+	s.Tracer = tcapflow.NewOTLPExporter(collector.URL+"/v1/traces", "test", time.Hour)
+
+	for i := 0; i < 2; i++ {
+		b := forDialogue(buildTcBegin(), "vlr", []byte{byte(i), 0, 0, 0})
+		s.AddState(context.Background(), &b)
+	}
+	c := forDialogue(buildTcContinue(), "vlr", []byte{1, 0, 0, 0})
+	s.AddState(context.Background(), &c)
+	time.Sleep(5 * time.Millisecond)
+	expireShards(&s)
+	if sessions(&s) != 0 || old(&s) != 0 {
+		t.Fatalf("Should have expired all %v %v\n", sessions(&s), old(&s))
+	}
+	s.Tracer.Close()
+
+	p := posted()
+	for _, part := range []string{`"stringValue":"evicted"`, `"stringValue":"continue"`} {
+		if !strings.Contains(p, part) {
+			t.Fatalf("Should contain %v\n%v\n", part, p)
+		}
+	}
+}
+
+func TestAdminListsDialogues(t *testing.T) {
+	s := NewTCAPFlowServer()
+	s.InitShards(4)
+	admin := serverAdmin{&s}
+	mux := tcapflow.NewAdminMux(admin, admin.Ready)
+
+	b := forDialogue(buildTcBegin(), "vlr", []byte{1, 0, 0, 0})
+	b.Ros = []*rpc.ROSInfo{{Type: tcapflow.ROSInvoke, InvokeId: 1, OpCode: 56}}
+	s.AddState(context.Background(), &b)
+	b = forDialogue(buildTcBegin(), "msc", []byte{2, 0, 0, 0})
+	s.AddState(context.Background(), &b)
+	e := forDialogue(buildTcEnd(), "vlr", []byte{3, 0, 0, 0})
+	s.AddState(context.Background(), &e)
+
+	get := func(query string) []tcapflow.AdminDialogue {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", "/dialogues?"+query, nil))
+		var dialogues []tcapflow.AdminDialogue
+		if err := json.Unmarshal(rec.Body.Bytes(), &dialogues); err != nil {
+			t.Fatalf("Should return JSON %v %v\n", err, rec.Body.String())
+		}
+		return dialogues
+	}
+
+	if d := get(""); len(d) != 3 {
+		t.Fatalf("Should list all dialogues %v\n", d)
+	}
+	if d := get("tid=01000000"); len(d) != 1 || d[0].State != "session" || d[0].Calling.Gt != "vlr" {
+		t.Fatalf("Should find by TID %v\n", d)
+	}
+	if d := get("tid=03000000"); len(d) != 1 || d[0].State != "earlyPending" {
+		t.Fatalf("Should find pending by TID %v\n", d)
+	}
+	if d := get("gt=ms"); len(d) != 1 || d[0].Otid != "02000000" {
+		t.Fatalf("Should find by GT prefix %v\n", d)
+	}
+	if d := get("opcode=56&ssn=2"); len(d) != 1 || d[0].Otid != "01000000" {
+		t.Fatalf("Should find by opcode %v\n", d)
+	}
+	if d := get("min-age=1h"); len(d) != 0 {
+		t.Fatalf("Should filter by age %v\n", d)
+	}
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Should not be ready %v\n", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/stats", nil))
+	if !strings.Contains(rec.Body.String(), `"rpcCalls": 3`) {
+		t.Fatalf("Should count the calls %v\n", rec.Body.String())
+	}
+}
+
+func TestStreamStatesAcksBatches(t *testing.T) {
+	s := NewTCAPFlowServer()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcServer := grpc.NewServer()
+	rpc.RegisterTCAPFlowServer(grpcServer, &s)
+	go grpcServer.Serve(lis)
+	defer grpcServer.Stop()
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stream, err := rpc.NewTCAPFlowClient(conn).StreamStates(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := buildTcBegin()
+	e := buildTcEnd()
+	stream.Send(&rpc.StateBatch{Sequence: 7, States: []*rpc.StateInfo{&b, {}}})
+	ack, err := stream.Recv()
+	if err != nil || ack.Sequence != 7 || ack.Accepted != 1 || sessions(&s) != 1 {
+		t.Fatalf("Should ack the begin %v %v %v\n", ack, err, sessions(&s))
+	}
+
+	stream.Send(&rpc.StateBatch{Sequence: 8, States: []*rpc.StateInfo{&e}})
+	stream.CloseSend()
+	ack, err = stream.Recv()
+	if err != nil || ack.Sequence != 8 || ack.Accepted != 1 || sessions(&s) != 0 {
+		t.Fatalf("Should ack the end %v %v %v\n", ack, err, sessions(&s))
+	}
+	if _, err = stream.Recv(); err != io.EOF {
+		t.Fatalf("Should end the stream %v\n", err)
+	}
+}
+
+// Credentials of a self-signed certificate for 127.0.0.1 and a client
+// trusting it
+func testTLS(t *testing.T) (server, client credentials.TransportCredentials) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server = credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}})
+	client = credentials.NewTLS(&tls.Config{RootCAs: pool})
+	return server, client
+}
+
+func TestAuthRejectsUnknownProbes(t *testing.T) {
+	s := NewTCAPFlowServer()
+	auth := &tcapflow.Authenticator{Tokens: map[string]string{"secret": "probe-1"}}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCreds, clientCreds := testTLS(t)
+	grpcServer := grpc.NewServer(grpc.Creds(serverCreds), grpc.UnaryInterceptor(auth.UnaryInterceptor),
+		grpc.StreamInterceptor(auth.StreamInterceptor))
+	rpc.RegisterTCAPFlowServer(grpcServer, &s)
+	go grpcServer.Serve(lis)
+	defer grpcServer.Stop()
+
+	b := buildTcBegin()
+	for _, token := range []string{"", "wrong", "secret"} {
+		options := []grpc.DialOption{grpc.WithTransportCredentials(clientCreds)}
+		if len(token) > 0 {
+			options = append(options, grpc.WithPerRPCCredentials(tcapflow.TokenCredentials{Token: token}))
+		}
+		conn, err := grpc.Dial(lis.Addr().String(), options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = rpc.NewTCAPFlowClient(conn).AddState(context.Background(), &b)
+		conn.Close()
+		if (err == nil) != (token == "secret") {
+			t.Fatalf("Unexpected result for token %q: %v\n", token, err)
+		}
+	}
+
+	stats := serverAdmin{&s}.Stats().(serverStats)
+	if sessions(&s) != 1 || len(stats.Probes) != 1 || stats.Probes[0].Name != "probe-1" || stats.Probes[0].Messages != 1 {
+		t.Fatalf("Should count the probe %v %v\n", sessions(&s), stats.Probes)
+	}
+}
+
+func TestQueryAndSubscribe(t *testing.T) {
+	s := NewTCAPFlowServer()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcServer := grpc.NewServer()
+	rpc.RegisterTCAPFlowServer(grpcServer, &s)
+	go grpcServer.Serve(lis)
+	defer grpcServer.Stop()
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := rpc.NewTCAPFlowClient(conn)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	completions, err := client.SubscribeCompletions(ctx, &empty.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && !s.completions.active(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	b := buildTcBegin()
+	b.Ros = []*rpc.ROSInfo{{Type: tcapflow.ROSInvoke, InvokeId: 1, OpCode: 2}}
+	e := buildTcEnd()
+	client.AddState(ctx, &b)
+
+	stats, err := client.GetStats(ctx, &empty.Empty{})
+	if err != nil || stats.Sessions != 1 || stats.RpcCalls != 1 || stats.Shards != 64 {
+		t.Fatalf("Unexpected stats %v %v\n", stats, err)
+	}
+	list, err := client.ListDialogues(ctx, &rpc.DialogueQuery{Gt: "vlr"})
+	if err != nil || len(list.Dialogues) != 1 || list.Dialogues[0].State != "session" ||
+		!bytes.Equal(list.Dialogues[0].Otid, b.Tcap.Otid) || list.Dialogues[0].Calling.Ssn != 1 {
+		t.Fatalf("Should list the begin %v %v\n", list, err)
+	}
+	list, err = client.ListDialogues(ctx, &rpc.DialogueQuery{Gt: "msc"})
+	if err != nil || len(list.Dialogues) != 0 {
+		t.Fatalf("Should filter the begin %v %v\n", list, err)
+	}
+	// Operation code zero is a filter of its own
+	for op, want := range map[int32]int{0: 0, 2: 1} {
+		list, err = client.ListDialogues(ctx, &rpc.DialogueQuery{OpCode: op, HasOpCode: true})
+		if err != nil || len(list.Dialogues) != want {
+			t.Fatalf("Should find %d dialogues of op %d %v %v\n", want, op, list, err)
+		}
+	}
+	if _, err = client.ListDialogues(ctx, &rpc.DialogueQuery{Tid: "xyz"}); err == nil {
+		t.Fatalf("Should reject the tid\n")
+	}
+
+	client.AddState(ctx, &e)
+	completion, err := completions.Recv()
+	if err != nil || completion.Outcome != tcapflow.OutcomeEnd || completion.LatencyMs != 1000 ||
+		completion.Called.Number != "hlr" || !bytes.Equal(completion.Otid, b.Tcap.Otid) {
+		t.Fatalf("Should receive the completion %v %v\n", completion, err)
+	}
+}
+
+func TestProbeStatsAndClockOffset(t *testing.T) {
+	s := NewTCAPFlowServer()
+	send := func(state rpc.StateInfo, probe string, sequence uint64, at time.Duration) {
+		state.Probe = probe
+		state.Sequence = sequence
+		state.Time = &timestamp.Timestamp{Seconds: int64(at / time.Second), Nanos: int32(at % time.Second)}
+		s.addStateInfo(&state)
+	}
+
+	// Begun at a and answered at b a second later and the other way
+	// around in 200ms. The clock of b is 400ms ahead.
+	send(buildTcBegin(), "a", 1, 0)
+	send(buildTcEnd(), "b", 1, time.Second)
+	send(buildTcBegin(), "b", 2, 10*time.Second)
+	send(buildTcEnd(), "a", 3, 10*time.Second+200*time.Millisecond)
+
+	stats := serverAdmin{&s}.Stats().(serverStats)
+	if len(stats.Probes) != 2 || stats.Probes[0].Name != "a" || stats.Probes[0].Messages != 2 ||
+		stats.Probes[0].Gaps != 1 || stats.Probes[1].Gaps != 0 || stats.Probes[1].LastSequence != 2 {
+		t.Fatalf("Unexpected probes %v\n", stats.Probes)
+	}
+	if len(stats.ClockOffsets) != 1 || stats.ClockOffsets[0].Probe != "b" ||
+		stats.ClockOffsets[0].Reference != "a" || stats.ClockOffsets[0].Offset != 400 {
+		t.Fatalf("Unexpected offsets %v\n", stats.ClockOffsets)
+	}
+
+	// A lower sequence is from a restarted probe
+	send(buildTcBegin(), "a", 2, 11*time.Second)
+	if probes := s.Probes.Stats(); probes[0].Gaps != 1 || probes[0].Restarts != 1 || probes[0].LastSequence != 2 {
+		t.Fatalf("Unexpected probe a %v\n", probes[0])
+	}
+
+	checkProbes(&s, time.Now().Add(time.Minute))
+	probes, _ := s.GetStats(context.Background(), &empty.Empty{})
+	if len(probes.Probes) != 2 || !probes.Probes[0].Silent || !probes.Probes[1].Silent {
+		t.Fatalf("Should mark the probes silent %v\n", probes.Probes)
+	}
+	send(buildTcEnd(), "b", 3, 12*time.Second)
+	if probes := s.Probes.Stats(); !probes[0].Silent || probes[1].Silent {
+		t.Fatalf("Should only mark a silent %v\n", probes)
+	}
+}
+
+func TestReorderAcrossProbes(t *testing.T) {
+	s := NewTCAPFlowServer()
+	s.Reorder = newReorderBuffer(&s, time.Second, 0)
+	send := func(state rpc.StateInfo, probe string, at time.Duration) {
+		state.Probe = probe
+		state.Time = &timestamp.Timestamp{Seconds: int64(at / time.Second), Nanos: int32(at % time.Second)}
+		s.addStateInfo(&state)
+	}
+	other := func() rpc.StateInfo {
+		b := buildTcBegin()
+		b.Tcap.Otid = []byte{9, 9, 9, 9}
+		return b
+	}
+
+	// The end arrives first from a faster probe
+	send(other(), "a", 0)
+	send(buildTcEnd(), "b", time.Second)
+	if s.Reorder.Len() != 1 || earlyPending(&s) != 0 {
+		t.Fatalf("Should hold the end %v %v\n", s.Reorder.Len(), earlyPending(&s))
+	}
+	send(buildTcBegin(), "a", 500*time.Millisecond)
+	if sessions(&s) != 2 || s.Reorder.Len() != 1 {
+		t.Fatalf("Should release the begin %v %v\n", sessions(&s), s.Reorder.Len())
+	}
+	send(other(), "a", 2*time.Second)
+	if sessions(&s) != 1 || earlyPending(&s) != 0 || s.Reorder.Len() != 1 {
+		t.Fatalf("Should match the end %v %v %v\n", sessions(&s), earlyPending(&s), s.Reorder.Len())
+	}
+
+	// Behind what was released already
+	send(buildTcEnd(), "b", 200*time.Millisecond)
+	if s.Reorder.Late() != 1 || s.Reorder.Len() != 1 {
+		t.Fatalf("Should count the late message %v %v\n", s.Reorder.Late(), s.Reorder.Len())
+	}
+
+	// Held too long
+	s.Reorder.Flush(time.Now().Add(time.Second))
+	if s.Reorder.Len() != 0 {
+		t.Fatalf("Should release after the delay %v\n", s.Reorder.Len())
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	if s := NewTCAPFlowServer(); s.Transit != nil {
+		t.Fatalf("Should only track transit delays with -transit-window\n")
+	}
+	a, b := buildTcBegin(), buildTcBegin()
+	b.Probe = "other"
+	b.Called = &rpc.SCCPAddress{Number: "translated"}
+	if fingerprint(&a) != fingerprint(&b) {
+		t.Fatalf("Should ignore the probe and called GT\n")
+	}
+	b.Calling = &rpc.SCCPAddress{Number: "vlr\x01"}
+	b.Tcap = &rpc.TCAPInfo{Otid: []byte{2, 3, 4}, Tag: a.Tcap.Tag}
+	if fingerprint(&a) == fingerprint(&b) {
+		t.Fatalf("Should keep the calling GT and OTID apart\n")
+	}
+	b = buildTcBegin()
+	b.Ros = []*rpc.ROSInfo{{Type: tcapflow.ROSInvoke, InvokeId: 1, OpCode: 2}}
+	if fingerprint(&a) == fingerprint(&b) {
+		t.Fatalf("Should tell the components apart\n")
+	}
+}
+
+// Recognise messages reported by several probes
+func withTransit(s *TCAPFlowServer) {
+	s.Transit = tcapflow.NewTransitTracker(5*time.Second, s.Probes)
+}
+
+func TestTransitDelayAcrossProbes(t *testing.T) {
+	s := NewTCAPFlowServer()
+	withTransit(&s)
+	send := func(state rpc.StateInfo, probe string, at time.Duration) {
+		state.Probe = probe
+		state.Time = &timestamp.Timestamp{Seconds: int64(at / time.Second), Nanos: int32(at % time.Second)}
+		s.addStateInfo(&state)
+	}
+
+	// The clock of b is 400ms ahead of a
+	s.Probes.Dialogue("a", "b", time.Second, time.Now())
+	s.Probes.Dialogue("b", "a", 200*time.Millisecond, time.Now())
+
+	// Seen at a and 50ms later at b
+	send(buildTcBegin(), "a", 20*time.Second)
+	send(buildTcBegin(), "b", 20*time.Second+450*time.Millisecond)
+	if sessions(&s) != 1 {
+		t.Fatalf("Should keep one session %v\n", sessions(&s))
+	}
+
+	// Reported by b first
+	other := buildTcBegin()
+	other.Tcap.Otid = []byte{9, 9, 9, 9}
+	send(other, "b", 30*time.Second+450*time.Millisecond)
+	send(other, "a", 30*time.Second)
+	if sessions(&s) != 2 {
+		t.Fatalf("Should keep two sessions %v\n", sessions(&s))
+	}
+
+	stats := serverAdmin{&s}.Stats().(serverStats)
+	if stats.Duplicates != 2 || len(stats.Paths) != 1 || stats.Paths[0].From != "a" || stats.Paths[0].To != "b" ||
+		stats.Paths[0].Count != 2 || stats.Paths[0].Max != 50 || stats.Paths[0].Uncorrected != 0 {
+		t.Fatalf("Unexpected paths %v %v\n", stats.Duplicates, stats.Paths)
+	}
+
+	// Only the first report is processed
+	send(buildTcEnd(), "b", 21*time.Second)
+	send(buildTcEnd(), "a", 21*time.Second)
+	if sessions(&s) != 1 || earlyPending(&s) != 0 {
+		t.Fatalf("Should end the dialogue once %v %v\n", sessions(&s), earlyPending(&s))
+	}
+}
+
+func TestClusterRoutingAndStats(t *testing.T) {
+	// The client routes both directions of a dialogue to the same server
+	begin, end := buildTcBegin(), buildTcEnd()
+	key := func(keys *tcapflow.DialogueKeys, state rpc.StateInfo) string {
+		calling := tcapflow.SCCPAddress{Number: state.Calling.Number, Ssn: uint8(state.Calling.Ssn)}
+		called := tcapflow.SCCPAddress{Number: state.Called.Number, Ssn: uint8(state.Called.Ssn)}
+		return keys.Key(int(state.Tcap.Tag), tcapflow.DialogueKey(calling, state.Tcap.Otid),
+			tcapflow.DialogueKey(called, state.Tcap.Dtid), time.Now())
+	}
+	keys := tcapflow.NewDialogueKeys(time.Minute)
+	ring := tcapflow.NewHashRing([]string{"x:5345", "y:5345", "z:5345"}, 128)
+	beginHash := tcapflow.DialogueKeyHash(key(keys, begin))
+	endHash := tcapflow.DialogueKeyHash(key(keys, end))
+	if beginHash != endHash || ring.Lookup(beginHash) != ring.Lookup(endHash) {
+		t.Fatalf("Should route the dialogue to one server %v %v\n", beginHash, endHash)
+	}
+
+	send := func(s *TCAPFlowServer, state rpc.StateInfo, probe string, sequence uint64, at time.Duration) {
+		state.Probe = probe
+		state.Sequence = sequence
+		state.Time = &timestamp.Timestamp{Seconds: int64(at / time.Second), Nanos: int32(at % time.Second)}
+		s.addStateInfo(&state)
+	}
+	a, b := NewTCAPFlowServer(), NewTCAPFlowServer()
+	withTransit(&a)
+	withTransit(&b)
+	send(&a, buildTcBegin(), "p1", 1, 20*time.Second)
+	send(&a, buildTcBegin(), "p2", 1, 20*time.Second+10*time.Millisecond)
+	other := buildTcBegin()
+	other.Tcap.Otid = []byte{9, 9, 9, 9}
+	send(&b, other, "p1", 1, 30*time.Second)
+	send(&b, other, "p2", 1, 30*time.Second+30*time.Millisecond)
+	send(&b, buildTcBegin(), "p1", 3, 40*time.Second)
+
+	peer := httptest.NewServer(tcapflow.NewAdminMux(serverAdmin{&b}, serverAdmin{&b}.Ready))
+	defer peer.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	cluster := serverAdmin{&a}.ClusterStats("a", []string{strings.TrimPrefix(peer.URL, "http://"), strings.TrimPrefix(down.URL, "http://")})
+	if len(cluster.Members) != 3 || cluster.Members[0].Address != "a" || cluster.Members[1].Stats == nil ||
+		cluster.Members[2].Stats != nil || len(cluster.Members[2].Error) == 0 {
+		t.Fatalf("Unexpected members %+v\n", cluster.Members)
+	}
+	total := cluster.Total
+	if total.Ready || total.Sessions != 3 || total.Duplicates != 2 || len(total.Probes) != 2 {
+		t.Fatalf("Unexpected total %+v\n", total)
+	}
+	if total.Probes[0].Name != "p1" || total.Probes[0].Messages != 3 || total.Probes[0].Gaps != 1 ||
+		total.Probes[0].LastSequence != 0 || total.Probes[1].Messages != 2 {
+		t.Fatalf("Unexpected probes %+v\n", total.Probes)
+	}
+	if len(total.Paths) != 1 || total.Paths[0].Count != 2 || total.Paths[0].Max != 30 || total.Paths[0].Uncorrected != 2 {
+		t.Fatalf("Unexpected paths %+v\n", total.Paths)
+	}
+}
+
+// Open streams do not hold up the shutdown
+func TestShutdownEndsStreams(t *testing.T) {
+	s := NewTCAPFlowServer()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcServer := grpc.NewServer()
+	rpc.RegisterTCAPFlowServer(grpcServer, &s)
+	go grpcServer.Serve(lis)
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := rpc.NewTCAPFlowClient(conn)
+	stream, err := client.StreamStates(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := buildTcBegin()
+	stream.Send(&rpc.StateBatch{Sequence: 1, States: []*rpc.StateInfo{&b}})
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	completions, err := client.SubscribeCompletions(context.Background(), &empty.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && !s.completions.active(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	start := time.Now()
+	shutdown(&s, grpcServer, 5*time.Second)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Should end the streams right away %v\n", elapsed)
+	}
+	if _, err := stream.Recv(); err == nil {
+		t.Fatalf("Should end the stream of states\n")
+	}
+	if _, err := completions.Recv(); err == nil {
+		t.Fatalf("Should end the stream of completions\n")
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tcapflow-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "state")
+
+	s := NewTCAPFlowServer()
+	for _, state := range []rpc.StateInfo{
+		forDialogue(buildTcBegin(), "vlr1", []byte{1}),
+		forDialogue(buildTcEnd(), "vlr2", []byte{2}),
+		forDialogue(buildTcBegin(), "vlr3", []byte{3}),
+		forDialogue(buildTcContinue(), "vlr3", []byte{3}),
+	} {
+		state := state
+		s.addStateInfo(&state)
+	}
+	entries, err := s.WriteSnapshot(file)
+	if err != nil || entries != 3 {
+		t.Fatalf("Failed to write snapshot %v %v\n", entries, err)
+	}
+
+	r := NewTCAPFlowServer()
+	restored, expired, err := r.RestoreSnapshot(file)
+	if err != nil || restored != 3 || expired != 0 {
+		t.Fatalf("Failed to restore %v %v %v\n", restored, expired, err)
+	}
+	if sessions(&r) != 1 || earlyPending(&r) != 1 || old(&r) != 1 {
+		t.Fatalf("Unexpected state %v %v %v\n", sessions(&r), earlyPending(&r), old(&r))
+	}
+
+	// The restored dialogues complete
+	end := forDialogue(buildTcEnd(), "vlr1", []byte{1})
+	r.addStateInfo(&end)
+	begin := forDialogue(buildTcBegin(), "vlr2", []byte{2})
+	r.addStateInfo(&begin)
+	if sessions(&r) != 0 || earlyPending(&r) != 0 {
+		t.Fatalf("Should complete the dialogues %v %v\n", sessions(&r), earlyPending(&r))
+	}
+
+	// Entries that expired while down are dropped
+	e := NewTCAPFlowServer()
+	e.ExpirePendingDuration = time.Nanosecond
+	restored, expired, err = e.RestoreSnapshot(file)
+	if err != nil || restored != 2 || expired != 1 || earlyPending(&e) != 0 {
+		t.Fatalf("Should drop the expired %v %v %v\n", restored, expired, err)
+	}
+
+	restored, _, err = e.RestoreSnapshot(filepath.Join(dir, "missing"))
+	if err != nil || restored != 0 {
+		t.Fatalf("A missing snapshot is no error %v %v\n", restored, err)
+	}
+}
+
+func TestLocallyMatchedDialogues(t *testing.T) {
+	summary := func(begin, response rpc.StateInfo) rpc.StateInfo {
+		begin.Response = &rpc.ResponseSummary{
+			Time:    &timestamp.Timestamp{Seconds: 0, Nanos: 250000000},
+			Tag:     response.Tcap.Tag,
+			Ros:     response.Ros,
+			Calling: response.Calling,
+			Otid:    response.Tcap.Otid,
+		}
+		return begin
+	}
+
+	s := NewTCAPFlowServer()
+	withTransit(&s)
+	completions := s.completions.subscribe(10)
+	ended := summary(buildTcBegin(), buildTcEnd())
+	s.addStateInfo(&ended)
+	if sessions(&s) != 0 || earlyPending(&s) != 0 || old(&s) != 0 {
+		t.Fatalf("Should complete the dialogue %v %v %v\n", sessions(&s), earlyPending(&s), old(&s))
+	}
+	completion := <-completions
+	if completion.LatencyMs != 250 || completion.Outcome != tcapflow.OutcomeOf(tcapflow.TCendApp) {
+		t.Fatalf("Unexpected completion %v\n", completion)
+	}
+
+	// A continued dialogue ignores its later messages
+	continued := summary(forDialogue(buildTcBegin(), "vlr2", []byte{2}), forDialogue(buildTcContinue(), "vlr2", []byte{2}))
+	s.addStateInfo(&continued)
+	if sessions(&s) != 0 || old(&s) != 1 {
+		t.Fatalf("Should remember the continued dialogue %v %v\n", sessions(&s), old(&s))
+	}
+	end := forDialogue(buildTcEnd(), "vlr2", []byte{2})
+	s.addStateInfo(&end)
+	if old(&s) != 0 || earlyPending(&s) != 0 {
+		t.Fatalf("Should end the continued dialogue %v %v\n", old(&s), earlyPending(&s))
+	}
+
+	// Another probe reported the TC-Begin already
+	begin := forDialogue(buildTcBegin(), "vlr3", []byte{3})
+	begin.Probe = "a"
+	s.addStateInfo(&begin)
+	matched := summary(forDialogue(buildTcBegin(), "vlr3", []byte{3}), forDialogue(buildTcEnd(), "vlr3", []byte{3}))
+	matched.Probe = "b"
+	s.addStateInfo(&matched)
+	if sessions(&s) != 0 || earlyPending(&s) != 0 || s.Transit.Duplicates() != 1 {
+		t.Fatalf("Should process the response only %v %v %v\n", sessions(&s), earlyPending(&s), s.Transit.Duplicates())
+	}
+
+	// Another probe reported the whole TC-Begin and TC-Continue
+	begin = forDialogue(buildTcBegin(), "vlr4", []byte{4})
+	begin.Probe = "a"
+	response := forDialogue(buildTcContinue(), "vlr4", []byte{4})
+	response.Probe = "a"
+	s.addStateInfo(&begin)
+	s.addStateInfo(&response)
+	matched = summary(forDialogue(buildTcBegin(), "vlr4", []byte{4}), forDialogue(buildTcContinue(), "vlr4", []byte{4}))
+	matched.Probe = "b"
+	s.addStateInfo(&matched)
+	if sessions(&s) != 0 || old(&s) != 1 || s.Transit.Duplicates() != 3 {
+		t.Fatalf("Should drop the TC-Begin and response %v %v %v\n", sessions(&s), old(&s), s.Transit.Duplicates())
+	}
+}
+
+func TestSweepWithoutTraffic(t *testing.T) {
+	s := NewTCAPFlowServer()
+	s.InitShards(4)
+	metrics := tcapflow.NewMemoryMetrics()
+	s.Metrics = metrics
+	s.Timers = &tcapflow.TimerProfiles{
+		Default: tcapflow.TimerProfile{Overdue: 10 * time.Millisecond, Expire: 30 * time.Millisecond},
+	}
+
+	b := buildTcBegin()
+	s.AddState(context.Background(), &b)
+	time.Sleep(20 * time.Millisecond)
+	expireShards(&s)
+	if metrics.Counter("tcapflow-server.overdueState") != 1 || sessions(&s) != 1 {
+		t.Fatalf("Should be overdue %v\n", metrics.Counters)
 	}
-	if len(s.EarlyPending) != 0 || len(s.Old) != 0 {
-		t.Fatalf("Should have no data %v %v\n", len(s.EarlyPending), len(s.Old))
+	time.Sleep(20 * time.Millisecond)
+	expireShards(&s)
+	if metrics.Counter("tcapflow-server.expiredState") != 1 || sessions(&s) != 0 {
+		t.Fatalf("Should be expired %v\n", metrics.Counters)
 	}
 }
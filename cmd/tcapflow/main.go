@@ -2,94 +2,754 @@ package main
 
 import (
 	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/google/gopacket"
-	"gopkg.in/alexcesaro/statsd.v2"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	. "github.com/moiji-mobile/tcapflow"
 )
 
 type TCAPDialogueStart struct {
-	StartTime time.Time
-	Ros       []ROSInfo
-	Otid      []byte
+	StartTime          time.Time
+	CaptTime           time.Time
+	Ros                []ROSInfo
+	Otid               []byte
+	Calling            SCCPAddress
+	Called             SCCPAddress
+	ApplicationContext string
+	Timer              TimerProfile
+	Overdue            bool
+	Trace              *DialogueTrace
 }
 
 type TCAPFlowDataHandler struct {
 	Sessions       map[string]TCAPDialogueStart
 	Scale          time.Duration
-	Statsd         *statsd.Client
+	Metrics        Metrics
 	ExpireDuration time.Duration
+	Timers         *TimerProfiles
+
+	// Print the unanswered dialogues like tcapflow-server -log-timeouts
+	LogTimeouts bool
+
+	// Capture time of the latest message. Dialogues expire by it so a
+	// capture file is expired like the live traffic it was taken from.
+	now time.Time
+
+	// Evict the oldest sessions beyond this size. Zero is unlimited.
+	MaxSessions  int
+	sessionOrder EvictionQueue
+
+	// Number of sessions of all pipeline shards
+	SessionCount *int64
+	lastGauge    time.Time
+
+	// Labelled metrics for Prometheus. Nil without a metrics listener.
+	Prometheus *PrometheusRegistry
+	Dialogues  *DialogueMetrics
+
+	// Latency percentiles per operation and peer. Nil when disabled.
+	Summary *Summary
+	Peers   *PeerLabels
+
+	// Transaction detail records and traces. Dialogues that continue
+	// after the first response are followed in Details until they end.
+	TDR     *TDRWriter
+	Tracer  *OTLPExporter
+	Details map[string]*TCAPDialogueDetail
+
+	// Print one JSON object per message instead of the text lines
+	JSONOutput bool
+
+	// Counters of the top view. The text lines are not printed then.
+	Top   *Top
+	Quiet bool
+
+	// Guards the maps and counters against the admin API
+	mu          *sync.Mutex
+	messages    uint64
+	parseErrors uint64
+}
+
+// The responder's messages are found by the key of the TC-Begin and the
+// initiator's by the responder GT and its TID. The pipeline sends both to
+// the shard of the TC-Begin. Expire is the timer of the operation and
+// applies to the time since the last message.
+type TCAPDialogueDetail struct {
+	Record   TDR
+	Trace    *DialogueTrace
+	LastSeen time.Time
+	Expire   time.Duration
+	Keys     [2]string
 }
 
 func buildKey(gt SCCPAddress, tid []byte) string {
-	return gt.Number + "-" + strconv.Itoa(int(gt.Ssn)) + "-" + hex.EncodeToString(tid)
+	return DialogueKey(gt, tid)
 }
 
-func addState(t *TCAPFlowDataHandler, called_gt, calling_gt SCCPAddress, otid []byte, infos []ROSInfo) {
+func addState(t *TCAPFlowDataHandler, called_gt, calling_gt SCCPAddress, otid []byte, ac string, infos []ROSInfo, capt time.Time) {
 	key := buildKey(calling_gt, otid)
 	elem := TCAPDialogueStart{
-		StartTime: time.Now(),
-		Ros:       infos,
-		Otid:      otid}
+		StartTime:          time.Now(),
+		CaptTime:           capt,
+		Ros:                infos,
+		Otid:               otid,
+		Calling:            calling_gt,
+		Called:             called_gt,
+		ApplicationContext: ac,
+		Timer:              t.Timers.Lookup(ac, infos)}
+	if t.Tracer != nil {
+		elem.Trace = NewDialogueTrace(capt, calling_gt, called_gt, otid, ac)
+		elem.Trace.AddComponents(infos, capt)
+	}
 	t.Sessions[key] = elem
-	t.Statsd.Increment("tcapflow.newState")
+	t.Metrics.Increment("tcapflow.newState")
+
+	if t.MaxSessions > 0 {
+		t.sessionOrder.Push(key, elem.StartTime)
+		evictSessions(t)
+	}
+}
+
+func isCurrentSession(t *TCAPFlowDataHandler) EvictionCheck {
+	return func(key string, added time.Time) bool {
+		val, ok := t.Sessions[key]
+		return ok && val.StartTime.Equal(added)
+	}
+}
+
+func evictSessions(t *TCAPFlowDataHandler) {
+	current := isCurrentSession(t)
+	for len(t.Sessions) > t.MaxSessions {
+		key, ok := t.sessionOrder.PopOldest(current)
+		if !ok {
+			break
+		}
+		delete(t.Sessions, key)
+		t.Metrics.Increment("tcapflow.evictedState")
+	}
+}
+
+func expiredDialogue(start TCAPDialogueStart, age time.Duration) ExpiredDialogue {
+	return ExpiredDialogue{
+		StartTime:          start.CaptTime,
+		Calling:            start.Calling,
+		Called:             start.Called,
+		Otid:               start.Otid,
+		ApplicationContext: start.ApplicationContext,
+		Ros:                start.Ros,
+		Age:                age,
+	}
+}
+
+func reportExpired(t *TCAPFlowDataHandler, start TCAPDialogueStart, age time.Duration) {
+	expired := expiredDialogue(start, age)
+	if t.LogTimeouts {
+		if t.JSONOutput {
+			printJSON(expired.JSON("timeout"))
+		} else {
+			t.printf("%v\n", expired)
+		}
+	}
+
+	t.Dialogues.Timeout(expired)
+	if t.TDR != nil {
+		record := startRecord(start)
+		record.Outcome = OutcomeTimeout
+		writeRecord(t, &record)
+	}
+	if start.Trace != nil {
+		t.Tracer.Export(start.Trace.Finish(start.CaptTime.Add(age), OutcomeTimeout)...)
+	}
+	if t.Summary != nil {
+		t.Summary.Timeout(OperationLabel(start.Ros), t.Peers.Label(start.Called.Number))
+	}
+	if t.Top != nil {
+		t.Top.Timeout()
+	}
+	t.Metrics.Increment("tcapflow.expiredState")
+	for _, bucket := range expired.Buckets() {
+		t.Metrics.Increment("tcapflow." + bucket)
+	}
 }
 
-func removeState(t *TCAPFlowDataHandler, called_gt, calling_gt SCCPAddress, dtid []byte, infos []ROSInfo) {
+// The capture stopped before the dialogue was answered or timed out
+func reportOpen(t *TCAPFlowDataHandler, start TCAPDialogueStart, age time.Duration) {
+	if t.TDR != nil {
+		record := startRecord(start)
+		record.Outcome = OutcomeOpen
+		writeRecord(t, &record)
+	}
+	if start.Trace != nil {
+		t.Tracer.Export(start.Trace.Finish(start.CaptTime.Add(age), OutcomeOpen)...)
+	}
+	t.Metrics.Increment("tcapflow.openAtEnd")
+}
+
+func reportOverdue(t *TCAPFlowDataHandler, start TCAPDialogueStart, age time.Duration) {
+	overdue := expiredDialogue(start, age)
+	if t.LogTimeouts {
+		if t.JSONOutput {
+			printJSON(overdue.JSON("overdue"))
+		} else {
+			t.printf("%v\n", overdue.OverdueString())
+		}
+	}
+
+	t.Dialogues.Overdue(overdue)
+	t.Metrics.Increment("tcapflow.overdueState")
+	for _, bucket := range overdue.OverdueBuckets() {
+		t.Metrics.Increment("tcapflow." + bucket)
+	}
+}
+
+func removeState(t *TCAPFlowDataHandler, called_gt, calling_gt SCCPAddress, dtid []byte, tag int, infos []ROSInfo, capt time.Time) (TCAPDialogueStart, bool) {
 	key := buildKey(called_gt, dtid)
 	val, ok := t.Sessions[key]
-	now := time.Now()
 
 	if ok {
-		diff := now.Sub(val.StartTime)
+		// Capture times keep the latency right when reading a file
+		diff := capt.Sub(val.CaptTime)
 		delete(t.Sessions, key)
-		t.Statsd.Increment("tcapflow.delState")
-		t.Statsd.Timing("tcapflow.latency", float64(diff/t.Scale))
+		t.Metrics.Increment("tcapflow.delState")
+		if val.Overdue {
+			t.Metrics.Increment("tcapflow.lateResponse")
+		}
+		t.Metrics.Timing("tcapflow.latency", float64(diff/t.Scale), DialogueTags(val.Called, val.Ros)...)
+		t.Dialogues.Completed(val.Called, val.ApplicationContext, val.Ros, OutcomeOf(tag), diff)
+		if t.Summary != nil {
+			t.Summary.Completed(OperationLabel(val.Ros), t.Peers.Label(val.Called.Number), diff, tag == TCabortApp)
+		}
+		if t.Top != nil {
+			t.Top.Completed(diff, tag == TCabortApp)
+		}
+	}
+	return val, ok
+}
+
+func startRecord(start TCAPDialogueStart) TDR {
+	record := TDR{
+		StartTime:          start.CaptTime,
+		Calling:            start.Calling,
+		Called:             start.Called,
+		Otid:               start.Otid,
+		ApplicationContext: start.ApplicationContext,
+		Messages:           1,
+	}
+	record.AddComponents(start.Ros)
+	return record
+}
+
+func writeRecord(t *TCAPFlowDataHandler, record *TDR) {
+	err := t.TDR.Write(record)
+	if err != nil {
+		fmt.Printf("ERROR: TDR: %v\n", err)
+		t.Metrics.Increment("tcapflow.tdrError")
+	}
+}
+
+// The record is written and the trace exported once the dialogue ends
+func finishDetail(t *TCAPFlowDataHandler, detail *TCAPDialogueDetail) {
+	delete(t.Details, detail.Keys[0])
+	delete(t.Details, detail.Keys[1])
+	if t.TDR != nil {
+		writeRecord(t, &detail.Record)
+	}
+	if detail.Trace != nil {
+		t.Tracer.Export(detail.Trace.Finish(detail.Record.EndTime, detail.Record.Outcome)...)
+	}
+}
+
+// Account a TC-Continue, TC-End or TC-Abort to the dialogue detail.
+func updateDetail(t *TCAPFlowDataHandler, tag int, start TCAPDialogueStart, first bool, called_gt, calling_gt SCCPAddress, otid, dtid []byte, infos []ROSInfo, capt time.Time) {
+	var detail *TCAPDialogueDetail
+	if first {
+		detail = &TCAPDialogueDetail{Record: startRecord(start), Trace: start.Trace, Expire: start.Timer.Expire}
+		detail.Record.Latency = capt.Sub(start.CaptTime)
+		detail.Record.Dtid = otid
+		detail.Keys = [2]string{buildKey(start.Calling, start.Otid), buildKey(calling_gt, otid)}
+	} else {
+		detail = t.Details[buildKey(called_gt, dtid)]
+		if detail == nil {
+			return
+		}
 	}
 
+	detail.Record.Messages++
+	detail.Record.AddComponents(infos)
+	if detail.Trace != nil {
+		detail.Trace.AddComponents(infos, capt)
+	}
+	detail.Record.EndTime = capt
+	detail.Record.Outcome = OutcomeOf(tag)
+	detail.LastSeen = capt
+
+	if tag == TCcontinueApp {
+		t.Details[detail.Keys[0]] = detail
+		t.Details[detail.Keys[1]] = detail
+		return
+	}
+	finishDetail(t, detail)
+}
+
+func expireSessions(t *TCAPFlowDataHandler) {
+	now := t.now
+
 	// Expire older sessions. With seconds we run into problems...
 	// maybe only run once every X runs..
 	for key, value := range t.Sessions {
-		diff := now.Sub(value.StartTime)
-		if diff > t.ExpireDuration {
-			t.Statsd.Increment("tcapflow.expiredState")
+		diff := now.Sub(value.CaptTime)
+		if diff > value.Timer.Expire {
+			reportExpired(t, value, diff)
 			delete(t.Sessions, key)
+		} else if !value.Overdue && diff > value.Timer.Overdue {
+			reportOverdue(t, value, diff)
+			value.Overdue = true
+			t.Sessions[key] = value
 		}
 	}
+
+	if t.MaxSessions > 0 {
+		t.sessionOrder.Compact(len(t.Sessions), isCurrentSession(t))
+	}
+
+	// Continued dialogues without an end are written as they are
+	for key, detail := range t.Details {
+		if key == detail.Keys[0] && now.Sub(detail.LastSeen) > detail.Expire {
+			finishDetail(t, detail)
+		}
+	}
+}
+
+// Write the object and newline at once as shards print concurrently
+func printJSON(data []byte, err error) {
+	if err != nil {
+		fmt.Printf("ERROR: JSON: %v\n", err)
+		return
+	}
+	os.Stdout.Write(append(data, '\n'))
+}
+
+// The text lines are left out in JSON mode and by the top view
+func (t *TCAPFlowDataHandler) printf(format string, a ...interface{}) {
+	if !t.JSONOutput && !t.Quiet {
+		fmt.Printf(format, a...)
+	}
 }
 
 func (t *TCAPFlowDataHandler) OnData(called_gt SCCPAddress, calling_gt SCCPAddress, data []uint8, packet gopacket.Packet) {
-	tag, otid, dtid, _, comp, _ := DecodeTCAP(data)
+	t.OnMessage(&Message{Called: called_gt, Calling: calling_gt}, data, packet)
+}
+
+func (t *TCAPFlowDataHandler) OnMessage(msg *Message, data []uint8, packet gopacket.Packet) {
+	if t.JSONOutput {
+		printJSON(EncodeMessageJSON(msg, data, packet))
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.messages++
+
+	if capt := packet.Metadata().Timestamp; capt.After(t.now) {
+		t.now = capt
+	}
+
+	called_gt := msg.Called
+	calling_gt := msg.Calling
+	tag, otid, dtid, dialogue, comp, _ := DecodeTCAP(data)
 	infos, _ := DecodeROS(comp.Bytes)
+	ac, _ := DecodeApplicationContext(dialogue)
+	if t.Top != nil {
+		t.Top.Message(tag, calling_gt, called_gt, infos)
+	}
+
+	sessions := len(t.Sessions)
+	defer func() {
+		atomic.AddInt64(t.SessionCount, int64(len(t.Sessions)-sessions))
+	}()
 
 	switch tag {
 	case TCbeginApp:
-		fmt.Printf("BEGIN OTID(%v) %v->%v STATES(%v)", otid.Bytes, calling_gt.Number, called_gt.Number, len(t.Sessions))
-		addState(t, called_gt, calling_gt, otid.Bytes, infos)
-		fmt.Printf("\n")
+		t.printf("BEGIN OTID(%v) %v->%v STATES(%v)", otid.Bytes, calling_gt.Number, called_gt.Number, len(t.Sessions))
+		addState(t, called_gt, calling_gt, otid.Bytes, ac.String(), infos, packet.Metadata().Timestamp)
+		t.printf("\n")
 	case TCabortApp:
-		fmt.Printf("ABORT ")
-		t.Statsd.Increment("tcapflow.abort")
+		t.printf("ABORT ")
+		t.Metrics.Increment("tcapflow.abort")
 		fallthrough
 	case TCendApp, TCcontinueApp:
-		fmt.Printf("%s DTID(%v) %v<-%v STATES(%v)", TCprocName(tag), dtid.Bytes, called_gt.Number, calling_gt.Number, len(t.Sessions))
-		removeState(t, called_gt, calling_gt, dtid.Bytes, infos)
-		fmt.Printf("\n")
+		t.printf("%s DTID(%v) %v<-%v STATES(%v)", TCprocName(tag), dtid.Bytes, called_gt.Number, calling_gt.Number, len(t.Sessions))
+		start, first := removeState(t, called_gt, calling_gt, dtid.Bytes, tag, infos, packet.Metadata().Timestamp)
+		if t.Details != nil {
+			updateDetail(t, tag, start, first, called_gt, calling_gt, otid.Bytes, dtid.Bytes, infos, packet.Metadata().Timestamp)
+		}
+		t.printf("\n")
 	}
 
+	// TC-Begins alone have to make the others overdue as well
+	expireSessions(t)
+}
+
+// Tick expires the dialogues by the wall clock. A quiet live capture has
+// no packets to move the time on.
+func (t *TCAPFlowDataHandler) Tick(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if now.After(t.now) {
+		t.now = now
+	}
+	sessions := len(t.Sessions)
+	expireSessions(t)
+	atomic.AddInt64(t.SessionCount, int64(len(t.Sessions)-sessions))
+}
+
+// Finish reports the dialogues still unanswered at the end of the capture.
+// Those older than their timer timed out, the others are counted as open.
+// It writes the records of the continued dialogues and returns the number
+// of open ones.
+func (t *TCAPFlowDataHandler) Finish() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	open := 0
+	atomic.AddInt64(t.SessionCount, -int64(len(t.Sessions)))
+	for key, value := range t.Sessions {
+		age := t.now.Sub(value.CaptTime)
+		if age >= value.Timer.Expire {
+			reportExpired(t, value, age)
+		} else {
+			reportOpen(t, value, age)
+			open++
+		}
+		delete(t.Sessions, key)
+	}
+	for key, detail := range t.Details {
+		if key == detail.Keys[0] {
+			finishDetail(t, detail)
+		}
+	}
+	return open
 }
 
 func (t *TCAPFlowDataHandler) ParseError(data []uint8, r interface{}) {
-	fmt.Printf("ParseError: SCTP(%v) %v\n", hex.EncodeToString(data), r)
-	t.Statsd.Increment("tcapflow.parseError")
+	if t.JSONOutput {
+		printJSON(json.Marshal(map[string]string{
+			"event": "parseError",
+			"data":  hex.EncodeToString(data),
+			"error": fmt.Sprint(r),
+		}))
+	} else {
+		t.printf("ParseError: SCTP(%v) %v\n", hex.EncodeToString(data), r)
+	}
+	t.mu.Lock()
+	t.parseErrors++
+	t.mu.Unlock()
+	t.Metrics.Increment("tcapflow.parseError")
+	if t.Prometheus != nil {
+		t.Prometheus.Add("tcapflow_parse_errors_total", nil, 1)
+	}
+}
+
+func (t *TCAPFlowDataHandler) OnIPReassembled() {
+	t.Metrics.Increment("tcapflow.ipReassembled")
+}
+
+func (t *TCAPFlowDataHandler) OnIPFragmentsExpired(count int) {
+	t.Metrics.Count("tcapflow.ipFragmentsExpired", int64(count))
+}
+
+// Data returned by the network, counted by its return cause
+func (t *TCAPFlowDataHandler) OnSCCPService(msg *Message, cause uint8) {
+	t.Metrics.Increment("tcapflow.sccpService", Tag{Key: "type", Value: SCCPTypeName(msg.SCCPType)}, Tag{Key: "cause", Value: strconv.Itoa(int(cause))})
 }
 
 func (t *TCAPFlowDataHandler) AfterOnePacket() {
-	t.Statsd.Flush()
+	now := time.Now()
+	if now.Sub(t.lastGauge) >= time.Second {
+		t.lastGauge = now
+		sessions := atomic.LoadInt64(t.SessionCount)
+		t.Metrics.Gauge("tcapflow.sessions", float64(sessions))
+		if t.Prometheus != nil {
+			t.Prometheus.Set("tcapflow_sessions", nil, float64(sessions))
+		}
+	}
+}
+
+// The live state of all shards for the admin API
+type flowAdmin struct {
+	sync.Mutex
+	handlers []*TCAPFlowDataHandler
+	pipeline *PipelineStats
+	ready    bool
+}
+
+type flowShardStats struct {
+	Sessions    int    `json:"sessions"`
+	Continued   int    `json:"continued"`
+	Messages    uint64 `json:"messages"`
+	ParseErrors uint64 `json:"parseErrors"`
+}
+
+type flowStats struct {
+	Ready    bool             `json:"ready"`
+	Shards   []flowShardStats `json:"shards"`
+	Pipeline *PipelineStats   `json:"pipeline,omitempty"`
+}
+
+func (a *flowAdmin) add(t *TCAPFlowDataHandler) {
+	a.Lock()
+	a.handlers = append(a.handlers, t)
+	a.Unlock()
+}
+
+func (a *flowAdmin) setPipeline(stats PipelineStats) {
+	a.Lock()
+	a.pipeline = &stats
+	a.Unlock()
+}
+
+func (a *flowAdmin) setReady() {
+	a.Lock()
+	a.ready = true
+	a.Unlock()
+}
+
+func (a *flowAdmin) Ready() bool {
+	a.Lock()
+	defer a.Unlock()
+	return a.ready
+}
+
+func (a *flowAdmin) shards() []*TCAPFlowDataHandler {
+	a.Lock()
+	defer a.Unlock()
+	return a.handlers
+}
+
+func (a *flowAdmin) Dialogues(filter *DialogueFilter) []AdminDialogue {
+	oldest := OldestDialogues{Filter: filter}
+	now := time.Now()
+	for _, t := range a.shards() {
+		t.mu.Lock()
+		for key, start := range t.Sessions {
+			if age := now.Sub(start.StartTime); oldest.Wants(age) {
+				oldest.Add(NewAdminDialogue("session", key, start.CaptTime, age,
+					start.Calling, start.Called, start.Otid, nil, start.ApplicationContext, start.Ros))
+			}
+		}
+		for key, detail := range t.Details {
+			r := &detail.Record
+			age := now.Sub(r.StartTime)
+			if key != detail.Keys[0] || !oldest.Wants(age) {
+				continue
+			}
+			d := NewAdminDialogue("continued", key, r.StartTime, age,
+				r.Calling, r.Called, r.Otid, r.Dtid, r.ApplicationContext, nil)
+			d.Operations = r.Operations
+			oldest.Add(d)
+		}
+		t.mu.Unlock()
+	}
+	return oldest.Dialogues
+}
+
+func (a *flowAdmin) Stats() interface{} {
+	stats := flowStats{Ready: a.Ready()}
+	for _, t := range a.shards() {
+		t.mu.Lock()
+		stats.Shards = append(stats.Shards, flowShardStats{
+			Sessions:    len(t.Sessions),
+			Continued:   len(t.Details) / 2,
+			Messages:    t.messages,
+			ParseErrors: t.parseErrors,
+		})
+		t.mu.Unlock()
+	}
+	a.Lock()
+	stats.Pipeline = a.pipeline
+	a.Unlock()
+	return stats
+}
+
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+func terminalHeight() int {
+	size, err := stty("size")
+	if err == nil {
+		var rows, cols int
+		if _, err = fmt.Sscan(size, &rows, &cols); err == nil && rows > 0 {
+			return rows
+		}
+	}
+	return 24
+}
+
+// The open dialogues with a GT containing the filter, oldest first
+func oldestDialogues(admin *flowAdmin, filter string) []AdminDialogue {
+	var result []AdminDialogue
+	for _, d := range admin.Dialogues(&DialogueFilter{Ssn: -1, OpCode: -1}) {
+		if strings.Contains(d.Calling.Gt, filter) || strings.Contains(d.Called.Gt, filter) {
+			result = append(result, d)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Age > result[j].Age
+	})
+	return result
+}
+
+// Run the capture and redraw the view until 'q' is pressed. The terminal
+// is put into cbreak mode to read single keys.
+func runTop(top *Top, admin *flowAdmin, interval time.Duration, capture func(), stop chan struct{}) {
+	if saved, err := stty("-g"); err == nil {
+		stty("cbreak", "-echo")
+		defer stty(saved)
+	}
+	fmt.Print("\x1b[?25l")
+	defer fmt.Print("\x1b[?25h\n")
+
+	keys := make(chan byte)
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if _, err := os.Stdin.Read(buf); err != nil {
+				close(keys)
+				return
+			}
+			keys <- buf[0]
+		}
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	captured := make(chan struct{})
+	go func() {
+		capture()
+		close(captured)
+	}()
+	defer func() {
+		close(stop)
+		if captured != nil {
+			<-captured
+		}
+	}()
+
+	sorts := []string{TopSortRate, TopSortTotal, TopSortName}
+	view := TopView{Sort: sorts[0]}
+	view.Update(top.Snapshot(time.Now()))
+	status := "capturing"
+	editing := false
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		line := status
+		if editing {
+			line = "filter: " + view.Filter + "_"
+		}
+		view.Render(os.Stdout, oldestDialogues(admin, view.Filter), terminalHeight(), line)
+
+		select {
+		case <-ticker.C:
+			view.Update(top.Snapshot(time.Now()))
+		case <-captured:
+			status = "capture finished"
+			captured = nil
+		case <-signals:
+			return
+		case key, ok := <-keys:
+			if !ok {
+				keys = nil
+				continue
+			}
+			switch {
+			case editing && (key == '\r' || key == '\n'):
+				editing = false
+			case editing && key == 0x1b:
+				editing = false
+				view.Filter = ""
+			case editing && (key == 0x7f || key == 0x08):
+				if len(view.Filter) > 0 {
+					view.Filter = view.Filter[:len(view.Filter)-1]
+				}
+			case editing:
+				view.Filter += string(key)
+			case key == '/':
+				editing = true
+				view.Filter = ""
+			case key == 's':
+				for i, sortBy := range sorts {
+					if sortBy == view.Sort {
+						view.Sort = sorts[(i+1)%len(sorts)]
+						break
+					}
+				}
+			case key == 'q':
+				return
+			}
+		}
+	}
+}
+
+// Expire the dialogues of a live capture while no packets arrive
+func tickSessions(admin *flowAdmin, stop chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			for _, handler := range admin.shards() {
+				handler.Tick(now)
+			}
+		}
+	}
+}
+
+func sendPipelineStats(metrics Metrics, stage string, stats PipelineStageStats) {
+	metrics.Count("tcapflow.pipeline."+stage+".processed", int64(stats.Processed))
+	metrics.Count("tcapflow.pipeline."+stage+".dropped", int64(stats.Dropped))
+	metrics.Count("tcapflow.pipeline."+stage+".blocked", int64(stats.Blocked))
+	metrics.Gauge("tcapflow.pipeline."+stage+".queueLength", float64(stats.QueueLength))
+}
+
+// Write a summary every interval and a last one once done is closed
+func reportSummaries(summary *Summary, interval time.Duration, out io.Writer, format string, done, finished chan struct{}) {
+	defer close(finished)
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case now := <-tick:
+			summary.Rotate(now).Write(out, format)
+		case <-done:
+			summary.Rotate(time.Now()).Write(out, format)
+			return
+		}
+	}
 }
 
 func main() {
@@ -97,22 +757,239 @@ func main() {
 	flowHandler := TCAPFlowDataHandler{}
 	flowHandler.Sessions = make(map[string]TCAPDialogueStart)
 	flowHandler.Scale = time.Millisecond
+	flowHandler.SessionCount = new(int64)
+	flowHandler.mu = new(sync.Mutex)
+	admin := &flowAdmin{}
+
+	// "tcapflow top [flags]" shows a live view instead of the text lines
+	topMode := len(os.Args) > 1 && os.Args[1] == "top"
+	if topMode {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
 
 	// flags...
 	pcapFile := flag.String("pcap-file", "", "Filename for PCAP")
 	pcapDevice := flag.String("pcap-device", "any", "Device to sniff")
 	pcapFilter := flag.String("pcap-filter", "sctp", "Filter for live sniffing")
-	expireDuration := flag.Duration("expire-state", 10*time.Second, "Remove state")
+	expireDuration := flag.Duration("expire-state", 10*time.Second, "Remove state of operations without a timer profile")
+	timerProfiles := flag.String("timer-profiles", "", "JSON file with per operation and application context timers")
+	logTimeouts := flag.Bool("log-timeouts", false, "Print unanswered TCAP dialogues")
+	maxSessions := flag.Int("max-sessions", 0, "Evict the oldest sessions beyond this number (0 is unlimited)")
 	statsdPrefix := flag.String("statsd-prefix", "", "Prefix for statsd messages")
+	metricsBackend := flag.String("metrics-backend", MetricsStatsd, "Metrics backend: statsd, dogstatsd, influx or none")
+	metricsRemote := flag.String("metrics-remote-address", "", "Hostname:port of the metrics backend (empty picks its default)")
+	metricsFlush := flag.Duration("metrics-flush-interval", time.Second, "Interval to send batched metrics")
+	workers := flag.Int("workers", 1, "Number of decode workers")
+	shards := flag.Int("shards", 1, "Number of dialogue state shards")
+	queueSize := flag.Int("queue-size", 1024, "Queue size per worker and shard")
+	dropWhenFull := flag.Bool("drop-when-full", false, "Drop instead of waiting when a queue is full")
+	metricsAddr := flag.String("metrics-address", "", "Hostname:port to serve Prometheus /metrics on (empty disables it)")
+	metricsGtPrefix := flag.Int("metrics-gt-prefix", 5, "Digits of the peer GT used as metric label")
+	metricsPartners := flag.String("metrics-partners", "", "File with lines of '<gt prefix> <partner>' to label peers by name")
+	summaryFormat := flag.String("summary-format", "", "Print latency summaries as 'table' or 'json' (empty disables them)")
+	summaryInterval := flag.Duration("summary-interval", 0, "Interval between summaries (0 only prints one at the end)")
+	summaryFile := flag.String("summary-file", "", "Append summaries to this file instead of stdout")
+	probeName := flag.String("probe-name", "", "Name of this probe in summaries")
+	mergeSummaries := flag.String("merge-summaries", "", "Comma separated JSON summary files to merge and print")
+	output := flag.String("output", "text", "Print 'text' lines per dialogue event or one 'json' object per message")
+	tdrPath := flag.String("tdr-path", "", "Write transaction detail records to files starting with this path")
+	tdrFormat := flag.String("tdr-format", "json", "Format of the records: 'json' (JSON Lines) or 'csv'")
+	tdrRotateInterval := flag.Duration("tdr-rotate-interval", time.Hour, "Start a new record file after this time (0 disables it)")
+	tdrRotateSize := flag.Int64("tdr-rotate-size", 0, "Start a new record file after this many bytes (0 disables it)")
+	tdrCompress := flag.Bool("tdr-gzip", false, "Compress closed record files")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "OTLP/HTTP URL to export dialogue traces to, e.g. http://localhost:4318/v1/traces (empty disables it)")
+	otlpService := flag.String("otlp-service-name", "tcapflow", "Service name of the exported traces")
+	otlpInterval := flag.Duration("otlp-flush-interval", 5*time.Second, "Interval to send batched spans")
+	adminAddr := flag.String("admin-address", "", "Hostname:port to serve the admin API on (empty disables it)")
+	adminPprof := flag.Bool("admin-pprof", false, "Serve pprof below /debug/pprof/ on the -admin-address")
+	realTime := flag.Bool("real-time", topMode, "Read the pcap file at the speed it was captured")
+	topInterval := flag.Duration("top-interval", time.Second, "Refresh interval of the top view")
 	flag.Parse()
 
+	if len(*mergeSummaries) > 0 {
+		merged, err := ReadSummaries(strings.Split(*mergeSummaries, ","))
+		if err != nil {
+			fmt.Printf("ERROR: %v\n", err)
+			return
+		}
+		merged.Write(os.Stdout, *summaryFormat)
+		return
+	}
+
+	if *output != "text" && *output != "json" {
+		fmt.Printf("ERROR: Unknown output %q\n", *output)
+		return
+	}
+	flowHandler.JSONOutput = *output == "json" && !topMode
+	if topMode {
+		flowHandler.Top = NewTop()
+		flowHandler.Quiet = true
+	}
 	flowHandler.ExpireDuration = *expireDuration
-	flowHandler.Statsd, err = statsd.New(statsd.Prefix(*statsdPrefix))
+	flowHandler.Timers = DefaultTimerProfiles(*expireDuration)
+	if len(*timerProfiles) > 0 {
+		err = flowHandler.Timers.LoadTimerProfiles(*timerProfiles)
+		if err != nil {
+			fmt.Printf("ERROR: %v\n", err)
+			return
+		}
+	}
+	flowHandler.LogTimeouts = *logTimeouts
+	flowHandler.MaxSessions = *maxSessions
+	flowHandler.Metrics, err = NewMetrics(*metricsBackend, *metricsRemote, *statsdPrefix, *metricsFlush)
 	if err != nil {
-		fmt.Printf("ERROR: Failed to create statsd client\n")
+		fmt.Printf("ERROR: Failed to create metrics client: %v\n", err)
 		return
 	}
-	defer flowHandler.Statsd.Close()
+	defer flowHandler.Metrics.Close()
 
-	RunLoop(*pcapFile, *pcapDevice, *pcapFilter, &flowHandler)
+	flowHandler.Peers = &PeerLabels{PrefixLength: *metricsGtPrefix}
+	if len(*metricsPartners) > 0 {
+		err = flowHandler.Peers.LoadPartners(*metricsPartners)
+		if err != nil {
+			fmt.Printf("ERROR: %v\n", err)
+			return
+		}
+	}
+
+	if len(*metricsAddr) > 0 {
+		flowHandler.Prometheus = NewPrometheusRegistry()
+		flowHandler.Prometheus.NewCounter("tcapflow_parse_errors_total", "Messages that failed to parse.")
+		flowHandler.Prometheus.NewGauge("tcapflow_sessions", "TC-Begins waiting for a response.")
+		flowHandler.Dialogues = NewDialogueMetrics(flowHandler.Prometheus, "tcapflow", flowHandler.Peers)
+		ServePrometheus(*metricsAddr, flowHandler.Prometheus)
+	}
+
+	if len(*tdrPath) > 0 {
+		flowHandler.TDR, err = NewTDRWriter(*tdrPath, *tdrFormat)
+		if err != nil {
+			fmt.Printf("ERROR: %v\n", err)
+			return
+		}
+		flowHandler.TDR.RotateInterval = *tdrRotateInterval
+		flowHandler.TDR.RotateSize = *tdrRotateSize
+		flowHandler.TDR.Compress = *tdrCompress
+		flowHandler.Details = make(map[string]*TCAPDialogueDetail)
+		defer flowHandler.TDR.Close()
+	}
+
+	if len(*otlpEndpoint) > 0 {
+		flowHandler.Tracer = NewOTLPExporter(*otlpEndpoint, *otlpService, *otlpInterval)
+		flowHandler.Details = make(map[string]*TCAPDialogueDetail)
+		defer flowHandler.Tracer.Close()
+	}
+
+	if len(*summaryFormat) > 0 {
+		out := io.Writer(os.Stdout)
+		if len(*summaryFile) > 0 {
+			f, err := os.OpenFile(*summaryFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				fmt.Printf("ERROR: %v\n", err)
+				return
+			}
+			defer f.Close()
+			out = f
+		}
+		flowHandler.Summary = NewSummary(*probeName, time.Now())
+		done := make(chan struct{})
+		finished := make(chan struct{})
+		go reportSummaries(flowHandler.Summary, *summaryInterval, out, *summaryFormat, done, finished)
+		defer func() {
+			close(done)
+			<-finished
+		}()
+	}
+
+	if len(*adminAddr) > 0 {
+		mux := NewAdminMux(admin, admin.Ready)
+		if *adminPprof {
+			HandlePprof(mux)
+		}
+		ServeAdmin(*adminAddr, mux)
+	}
+
+	// Dialogues still open are reported once the capture stops
+	stop := make(chan struct{})
+	live := len(*pcapFile) == 0
+	if live {
+		go tickSessions(admin, stop)
+	}
+	finish := func() {
+		open := 0
+		for _, handler := range admin.shards() {
+			if live {
+				handler.Tick(time.Now())
+			}
+			open += handler.Finish()
+		}
+		if open == 0 || flowHandler.Top != nil {
+			return
+		}
+		if flowHandler.JSONOutput {
+			printJSON(json.Marshal(map[string]interface{}{"event": "openAtEnd", "dialogues": open}))
+		} else {
+			fmt.Printf("OPEN(%v) dialogues unanswered within their timer at the end\n", open)
+		}
+	}
+	capture := func() {
+		if *workers <= 1 && *shards <= 1 {
+			admin.add(&flowHandler)
+			admin.setReady()
+			config := LoopConfig{
+				RealTime: *realTime,
+				Stop:     stop,
+				Stats: func(stats PipelineStageStats) {
+					sendPipelineStats(flowHandler.Metrics, "capture", stats)
+					admin.setPipeline(PipelineStats{Capture: stats})
+				},
+			}
+			RunLoopWith(*pcapFile, *pcapDevice, *pcapFilter, config, &flowHandler)
+			finish()
+			return
+		}
+
+		config := PipelineConfig{
+			Workers:      *workers,
+			Shards:       *shards,
+			QueueSize:    *queueSize,
+			DropWhenFull: *dropWhenFull,
+			RealTime:     *realTime,
+			Stop:         stop,
+			Stats: func(stats PipelineStats) {
+				sendPipelineStats(flowHandler.Metrics, "capture", stats.Capture)
+				sendPipelineStats(flowHandler.Metrics, "decode", stats.Decode)
+				sendPipelineStats(flowHandler.Metrics, "shards", stats.Shards)
+				admin.setPipeline(stats)
+			},
+		}
+		admin.setReady()
+		RunPipeline(*pcapFile, *pcapDevice, *pcapFilter, config, func(shard int) DataHandler {
+			handler := flowHandler
+			handler.Sessions = make(map[string]TCAPDialogueStart)
+			handler.mu = new(sync.Mutex)
+			if handler.Details != nil {
+				handler.Details = make(map[string]*TCAPDialogueDetail)
+			}
+			if handler.MaxSessions > 0 {
+				handler.MaxSessions = (handler.MaxSessions + *shards - 1) / *shards
+			}
+			admin.add(&handler)
+			return &handler
+		})
+		finish()
+	}
+
+	if flowHandler.Top != nil {
+		runTop(flowHandler.Top, admin, *topInterval, capture, stop)
+	} else {
+		// A second signal kills right away
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-signals
+			signal.Stop(signals)
+			close(stop)
+		}()
+		capture()
+	}
 }
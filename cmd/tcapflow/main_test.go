@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+
+	. "github.com/moiji-mobile/tcapflow"
+)
+
+var (
+	vlr = SCCPAddress{Number: "4912345", Ssn: 7}
+	hlr = SCCPAddress{Number: "4970000", Ssn: 6}
+)
+
+func newTestHandler() *TCAPFlowDataHandler {
+	return &TCAPFlowDataHandler{
+		Sessions:       make(map[string]TCAPDialogueStart),
+		Scale:          time.Millisecond,
+		Metrics:        NewMemoryMetrics(),
+		ExpireDuration: 10 * time.Second,
+		Timers:         DefaultTimerProfiles(10 * time.Second),
+		SessionCount:   new(int64),
+		Peers:          &PeerLabels{},
+		mu:             new(sync.Mutex),
+	}
+}
+
+func tlv(tag byte, value []byte) []byte {
+	return append([]byte{tag, byte(len(value))}, value...)
+}
+
+// A TCAP message with an Invoke of op or a ReturnResultLast without one
+func tcapMessage(tag int, otid, dtid []byte, op int) []byte {
+	var body []byte
+	if otid != nil {
+		body = append(body, tlv(0x48, otid)...)
+	}
+	if dtid != nil {
+		body = append(body, tlv(0x49, dtid)...)
+	}
+	component := tlv(0xa2, []byte{2, 1, 1})
+	if op >= 0 {
+		component = tlv(0xa1, []byte{2, 1, 1, 2, 1, byte(op)})
+	}
+	body = append(body, tlv(0x6c, component)...)
+	return tlv(byte(0x60|tag), body)
+}
+
+func packetAt(capt time.Time) gopacket.Packet {
+	packet := gopacket.NewPacket(nil, gopacket.DecodePayload, gopacket.Default)
+	packet.Metadata().Timestamp = capt
+	return packet
+}
+
+func feed(t *TCAPFlowDataHandler, called, calling SCCPAddress, data []byte, capt time.Time) {
+	t.OnMessage(&Message{Called: called, Calling: calling}, data, packetAt(capt))
+}
+
+// Collect what f writes to stdout
+func stdout(test *testing.T, f func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		test.Fatal(err)
+	}
+	saved := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = saved }()
+
+	out := make(chan string)
+	go func() {
+		data, _ := ioutil.ReadAll(r)
+		out <- string(data)
+	}()
+	f()
+	w.Close()
+	return <-out
+}
+
+func TestReportExpiredLogTimeouts(test *testing.T) {
+	start := TCAPDialogueStart{
+		StartTime: time.Unix(1000, 0),
+		CaptTime:  time.Unix(1000, 0),
+		Otid:      []byte{1, 2},
+		Calling:   vlr,
+		Called:    hlr,
+		Ros:       []ROSInfo{{Type: ROSInvoke, OpCode: 2}},
+	}
+
+	for _, c := range []struct {
+		logTimeouts bool
+		json        bool
+		want        string
+	}{
+		{false, false, ""},
+		{false, true, ""},
+		{true, false, "TIMEOUT OTID(0102) 4912345/7->4970000/6 AC() OPS([2]) AGE(10s)\n"},
+		{true, true, `"event":"timeout"`},
+	} {
+		t := newTestHandler()
+		t.LogTimeouts = c.logTimeouts
+		t.JSONOutput = c.json
+		out := stdout(test, func() { reportExpired(t, start, 10*time.Second) })
+		if c.want == "" && out != "" || !strings.Contains(out, c.want) {
+			test.Errorf("logTimeouts=%v json=%v printed %q, want %q", c.logTimeouts, c.json, out, c.want)
+		}
+		if n := t.Metrics.(*MemoryMetrics).Counter("tcapflow.timeout.op.2"); n != 1 {
+			test.Errorf("timeout counted %d times", n)
+		}
+	}
+}
+
+func TestReportOverdueLogTimeouts(test *testing.T) {
+	start := TCAPDialogueStart{Otid: []byte{1}, Calling: vlr, Called: hlr}
+	t := newTestHandler()
+	if out := stdout(test, func() { reportOverdue(t, start, time.Second) }); out != "" {
+		test.Errorf("printed %q without -log-timeouts", out)
+	}
+	t.LogTimeouts = true
+	if out := stdout(test, func() { reportOverdue(t, start, time.Second) }); !strings.HasPrefix(out, "OVERDUE OTID(01)") {
+		test.Errorf("printed %q", out)
+	}
+	if n := t.Metrics.(*MemoryMetrics).Counter("tcapflow.overdueState"); n != 2 {
+		test.Errorf("overdue counted %d times", n)
+	}
+}
+
+func TestAnsweredDialogue(test *testing.T) {
+	t := newTestHandler()
+	t.Quiet = true
+	begin := time.Unix(1000, 0)
+	feed(t, hlr, vlr, tcapMessage(TCbeginApp, []byte{1, 2, 3, 4}, nil, 2), begin)
+	if len(t.Sessions) != 1 {
+		test.Fatalf("%d sessions after the TC-Begin", len(t.Sessions))
+	}
+	feed(t, vlr, hlr, tcapMessage(TCendApp, nil, []byte{1, 2, 3, 4}, -1), begin.Add(20*time.Millisecond))
+	if len(t.Sessions) != 0 {
+		test.Errorf("%d sessions after the TC-End", len(t.Sessions))
+	}
+	if n := t.Metrics.(*MemoryMetrics).Counter("tcapflow.delState"); n != 1 {
+		test.Errorf("delState %d", n)
+	}
+}
+
+func TestBeginsMakeOthersOverdue(test *testing.T) {
+	t := newTestHandler()
+	t.Quiet = true
+	t.Timers = &TimerProfiles{Default: TimerProfile{Overdue: 10 * time.Millisecond, Expire: time.Hour}}
+	feed(t, hlr, vlr, tcapMessage(TCbeginApp, []byte{1}, nil, 2), time.Unix(1000, 0))
+	feed(t, hlr, vlr, tcapMessage(TCbeginApp, []byte{2}, nil, 2), time.Unix(1000, 0).Add(20*time.Millisecond))
+	if n := t.Metrics.(*MemoryMetrics).Counter("tcapflow.overdueState"); n != 1 {
+		test.Errorf("overdue %d times", n)
+	}
+	if len(t.Sessions) != 2 {
+		test.Errorf("%d sessions", len(t.Sessions))
+	}
+}
+
+// A capture file is expired by the time of its packets however fast it
+// is read.
+func TestExpireByCaptureTime(test *testing.T) {
+	t := newTestHandler()
+	t.Quiet = true
+	t.Summary = NewSummary("", time.Unix(0, 0))
+	t.Timers = &TimerProfiles{Default: TimerProfile{Overdue: 5 * time.Second, Expire: 10 * time.Second}}
+
+	start := time.Unix(1000, 0)
+	feed(t, hlr, vlr, tcapMessage(TCbeginApp, []byte{1}, nil, 2), start)
+	feed(t, hlr, vlr, tcapMessage(TCbeginApp, []byte{2}, nil, 2), start.Add(9*time.Second))
+	if len(t.Sessions) != 2 {
+		test.Fatalf("%d sessions before the expiry", len(t.Sessions))
+	}
+	feed(t, hlr, vlr, tcapMessage(TCbeginApp, []byte{3}, nil, 2), start.Add(11*time.Second))
+	if len(t.Sessions) != 2 {
+		test.Fatalf("%d sessions after the expiry", len(t.Sessions))
+	}
+	feed(t, vlr, hlr, tcapMessage(TCendApp, nil, []byte{3}, -1), start.Add(12*time.Second))
+
+	// Still open at the end of the file but not timed out
+	if open := t.Finish(); open != 1 {
+		test.Errorf("%d open after Finish", open)
+	}
+	if len(t.Sessions) != 0 || *t.SessionCount != 0 {
+		test.Errorf("%d sessions, count %d after Finish", len(t.Sessions), *t.SessionCount)
+	}
+	entries := t.Summary.Rotate(start).Entries
+	if len(entries) != 1 || entries[0].Timeouts != 1 || entries[0].Latency.Total != 1 {
+		test.Fatalf("summary %+v", entries)
+	}
+	metrics := t.Metrics.(*MemoryMetrics)
+	if metrics.Counter("tcapflow.expiredState") != 1 || metrics.Counter("tcapflow.openAtEnd") != 1 {
+		test.Errorf("expired %d open %d", metrics.Counter("tcapflow.expiredState"), metrics.Counter("tcapflow.openAtEnd"))
+	}
+	if n := t.Metrics.(*MemoryMetrics).Counter("tcapflow.overdueState"); n != 1 {
+		test.Errorf("overdue %d times", n)
+	}
+}
+
+// Without packets a live capture expires by the wall clock
+func TestTickExpires(test *testing.T) {
+	t := newTestHandler()
+	t.Quiet = true
+	t.Timers = &TimerProfiles{Default: TimerProfile{Overdue: 5 * time.Second, Expire: 10 * time.Second}}
+
+	start := time.Unix(1000, 0)
+	feed(t, hlr, vlr, tcapMessage(TCbeginApp, []byte{1}, nil, 2), start)
+	feed(t, hlr, vlr, tcapMessage(TCbeginApp, []byte{2}, nil, 2), start.Add(5*time.Second))
+	*t.SessionCount = 2
+	t.Tick(start.Add(time.Second))
+	if len(t.Sessions) != 2 {
+		test.Fatalf("%d sessions after a tick in the past", len(t.Sessions))
+	}
+	t.Tick(start.Add(11 * time.Second))
+	if len(t.Sessions) != 1 || *t.SessionCount != 1 {
+		test.Fatalf("%d sessions, count %d after the expiry", len(t.Sessions), *t.SessionCount)
+	}
+	if t.Finish() != 1 || t.Metrics.(*MemoryMetrics).Counter("tcapflow.expiredState") != 1 {
+		test.Errorf("expired %d", t.Metrics.(*MemoryMetrics).Counter("tcapflow.expiredState"))
+	}
+}
+
+func readRecords(test *testing.T, dir string) []map[string]interface{} {
+	files, _ := filepath.Glob(filepath.Join(dir, "tdr-*"))
+	var records []map[string]interface{}
+	for _, name := range files {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			test.Fatal(err)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var record map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				test.Fatal(err)
+			}
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+func TestRecordsOfContinuedDialogues(test *testing.T) {
+	dir, err := ioutil.TempDir("", "tdr")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	t := newTestHandler()
+	t.Quiet = true
+	t.TDR, _ = NewTDRWriter(filepath.Join(dir, "tdr"), "json")
+	t.Details = make(map[string]*TCAPDialogueDetail)
+	t.Timers = &TimerProfiles{
+		Default:    TimerProfile{Overdue: time.Second, Expire: time.Second},
+		Operations: map[int]TimerProfile{59: {Overdue: time.Minute, Expire: time.Minute}},
+	}
+	relocated := SCCPAddress{Number: "4970001", Ssn: 6}
+	start := time.Unix(1000, 0)
+	a, b := []byte{0xa}, []byte{0xb}
+
+	// Ended by the initiator addressing the responder's new GT
+	feed(t, hlr, vlr, tcapMessage(TCbeginApp, a, nil, 59), start)
+	feed(t, vlr, relocated, tcapMessage(TCcontinueApp, b, a, 60), start.Add(time.Second))
+	feed(t, relocated, vlr, tcapMessage(TCcontinueApp, a, b, -1), start.Add(30*time.Second))
+	feed(t, relocated, vlr, tcapMessage(TCendApp, nil, b, -1), start.Add(40*time.Second))
+
+	// Idle for longer than the timer of its operation
+	c, d := []byte{0xc}, []byte{0xd}
+	feed(t, hlr, vlr, tcapMessage(TCbeginApp, c, nil, 2), start.Add(40*time.Second))
+	feed(t, vlr, hlr, tcapMessage(TCcontinueApp, d, c, -1), start.Add(41*time.Second))
+	feed(t, hlr, vlr, tcapMessage(TCbeginApp, []byte{0xe}, nil, 2), start.Add(43*time.Second))
+	if len(t.Details) != 0 {
+		test.Errorf("%d details left", len(t.Details))
+	}
+
+	// Open when the capture ends
+	feed(t, hlr, vlr, tcapMessage(TCbeginApp, []byte{0xf}, nil, 59), start.Add(50*time.Second))
+	feed(t, vlr, hlr, tcapMessage(TCcontinueApp, []byte{0xf0}, []byte{0xf}, -1), start.Add(51*time.Second))
+	t.Finish()
+	t.TDR.Close()
+
+	records := readRecords(test, dir)
+	outcomes := make(map[string]map[string]interface{})
+	for _, record := range records {
+		outcomes[record["otid"].(string)] = record
+	}
+	if len(records) != 4 {
+		test.Fatalf("records %v", records)
+	}
+	if r := outcomes["0a"]; r["messages"] != 4.0 || r["outcome"] != OutcomeEnd || r["dtid"] != "0b" {
+		test.Errorf("continued dialogue %v", r)
+	}
+	if r := outcomes["0c"]; r["messages"] != 2.0 || r["outcome"] != OutcomeContinue {
+		test.Errorf("idle dialogue %v", r)
+	}
+	if r := outcomes["0e"]; r["outcome"] != OutcomeTimeout {
+		test.Errorf("unanswered dialogue %v", r)
+	}
+	if r := outcomes["0f"]; r["messages"] != 2.0 {
+		test.Errorf("open dialogue %v", r)
+	}
+}
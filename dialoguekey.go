@@ -0,0 +1,109 @@
+package tcapflow
+
+import (
+	"encoding/hex"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DialogueKey identifies one side of a dialogue by its GT, SSN and TID
+func DialogueKey(gt SCCPAddress, tid []byte) string {
+	return gt.Number + "-" + strconv.Itoa(int(gt.Ssn)) + "-" + hex.EncodeToString(tid)
+}
+
+// DialogueKeyHash spreads dialogue keys across shards or servers
+func DialogueKeyHash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// DialogueKeys finds the TC-Begin a message belongs to. The responder
+// answers to the calling GT and OTID of the TC-Begin. The initiator
+// addresses the responder by the GT and OTID of its first TC-Continue
+// instead, so these are remembered until the dialogue ends or has been
+// idle for Expire. It is safe for concurrent use.
+type DialogueKeys struct {
+	Expire time.Duration
+
+	sync.Mutex
+	aliases   map[string]string // Responder side to the key of the TC-Begin
+	dialogues map[string]*keyedDialogue
+	swept     time.Time
+}
+
+type keyedDialogue struct {
+	responder string
+	lastSeen  time.Time
+}
+
+func NewDialogueKeys(expire time.Duration) *DialogueKeys {
+	return &DialogueKeys{
+		Expire:    expire,
+		aliases:   make(map[string]string),
+		dialogues: make(map[string]*keyedDialogue),
+	}
+}
+
+// Key returns the key of the dialogue of a message. own is the sender's
+// side made of the calling GT and OTID and peer the addressed side made
+// of the called GT and DTID. Both are built by DialogueKey. own is empty
+// when the sender's OTID is unknown.
+func (d *DialogueKeys) Key(tag int, own, peer string, now time.Time) string {
+	if tag == TCbeginApp {
+		return own
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	key := peer
+	if alias, ok := d.aliases[peer]; ok {
+		key = alias
+	}
+
+	dialogue := d.dialogues[key]
+	switch tag {
+	case TCcontinueApp:
+		if dialogue == nil {
+			dialogue = &keyedDialogue{}
+			d.dialogues[key] = dialogue
+		}
+		// The responder answers or changed its GT
+		if own != "" && own != key && own != dialogue.responder {
+			delete(d.aliases, dialogue.responder)
+			dialogue.responder = own
+			d.aliases[own] = key
+		}
+		dialogue.lastSeen = now
+	case TCendApp, TCabortApp:
+		if dialogue != nil {
+			delete(d.aliases, dialogue.responder)
+			delete(d.dialogues, key)
+		}
+	}
+	d.expire(now)
+	return key
+}
+
+// The lock needs to be held
+func (d *DialogueKeys) expire(now time.Time) {
+	if d.Expire <= 0 || now.Sub(d.swept) < d.Expire {
+		return
+	}
+	d.swept = now
+	for key, dialogue := range d.dialogues {
+		if now.Sub(dialogue.lastSeen) > d.Expire {
+			delete(d.aliases, dialogue.responder)
+			delete(d.dialogues, key)
+		}
+	}
+}
+
+// Len returns the number of continued dialogues
+func (d *DialogueKeys) Len() int {
+	d.Lock()
+	defer d.Unlock()
+	return len(d.dialogues)
+}
@@ -0,0 +1,68 @@
+package tcapflow
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDialogueKeysFollowBothSides(t *testing.T) {
+	initiator := SCCPAddress{Number: "4912345", Ssn: 7}
+	responder := SCCPAddress{Number: "4970000", Ssn: 6}
+	relocated := SCCPAddress{Number: "4970001", Ssn: 6}
+	a, b := []byte{0xa}, []byte{0xb}
+	begin := DialogueKey(initiator, a)
+
+	keys := NewDialogueKeys(time.Minute)
+	now := time.Unix(1000, 0)
+	for i, msg := range []struct {
+		tag             int
+		calling, called SCCPAddress
+		otid, dtid      []byte
+	}{
+		{TCbeginApp, initiator, responder, a, nil},
+		// The responder answers from another GT
+		{TCcontinueApp, relocated, initiator, b, a},
+		{TCcontinueApp, initiator, relocated, a, b},
+		{TCcontinueApp, relocated, initiator, b, a},
+		{TCendApp, initiator, relocated, nil, b},
+	} {
+		key := keys.Key(msg.tag, DialogueKey(msg.calling, msg.otid), DialogueKey(msg.called, msg.dtid), now)
+		if key != begin {
+			t.Errorf("message %d has key %q, want %q", i, key, begin)
+		}
+	}
+	if keys.Len() != 0 || len(keys.aliases) != 0 {
+		t.Errorf("%d dialogues, %d aliases after the end", keys.Len(), len(keys.aliases))
+	}
+
+	// A response without its OTID is no alias
+	keys.Key(TCcontinueApp, "", begin, now)
+	if len(keys.aliases) != 0 {
+		t.Errorf("aliases %v", keys.aliases)
+	}
+
+	// Unknown initiator messages keep their own key
+	key := keys.Key(TCendApp, "", DialogueKey(relocated, b), now)
+	if key != DialogueKey(relocated, b) {
+		t.Errorf("got %q", key)
+	}
+}
+
+func TestDialogueKeysExpire(t *testing.T) {
+	keys := NewDialogueKeys(time.Minute)
+	now := time.Unix(1000, 0)
+	keys.Key(TCcontinueApp, "b1", "a1", now)
+	keys.Key(TCcontinueApp, "b2", "a2", now.Add(50*time.Second))
+	if keys.Len() != 2 {
+		t.Fatalf("%d dialogues", keys.Len())
+	}
+	if key := keys.Key(TCcontinueApp, "a2", "b2", now.Add(70*time.Second)); key != "a2" {
+		t.Errorf("got %q", key)
+	}
+	if keys.Len() != 1 {
+		t.Errorf("%d dialogues after the first expired", keys.Len())
+	}
+	if key := keys.Key(TCcontinueApp, "a1", "b1", now.Add(71*time.Second)); key != "b1" {
+		t.Errorf("expired alias gave %q", key)
+	}
+}
@@ -0,0 +1,115 @@
+package tcapflow
+
+import (
+	"strconv"
+	"time"
+)
+
+// Outcomes of a dialogue as seen by the first response
+const (
+	OutcomeEnd      = "end"
+	OutcomeContinue = "continue"
+	OutcomeAbort    = "abort"
+	OutcomeTimeout  = "timeout"
+
+	// Still unanswered within its timer when the capture stopped
+	OutcomeOpen = "open"
+)
+
+func OutcomeOf(tag int) string {
+	switch tag {
+	case TCendApp:
+		return OutcomeEnd
+	case TCcontinueApp:
+		return OutcomeContinue
+	case TCabortApp:
+		return OutcomeAbort
+	}
+	return "unknown"
+}
+
+// DialogueMetrics keeps labelled dialogue counters and latency histograms
+// in a Prometheus registry. All methods can be called on nil to make the
+// listener optional.
+type DialogueMetrics struct {
+	Registry *PrometheusRegistry
+	Peers    *PeerLabels
+
+	dialogues string
+	latency   string
+	overdue   string
+}
+
+// NewDialogueMetrics declares the metrics with the namespace, e.g.
+// "tcapflow" or "tcapflow_server".
+func NewDialogueMetrics(registry *PrometheusRegistry, namespace string, peers *PeerLabels) *DialogueMetrics {
+	m := &DialogueMetrics{
+		Registry:  registry,
+		Peers:     peers,
+		dialogues: namespace + "_dialogues_total",
+		latency:   namespace + "_response_latency_seconds",
+		overdue:   namespace + "_overdue_total",
+	}
+	registry.NewCounter(m.dialogues, "TCAP dialogues by outcome of the first response.")
+	registry.NewHistogram(m.latency, "Time from TC-Begin to the first response.", LatencyBuckets)
+	registry.NewCounter(m.overdue, "TCAP dialogues that exceeded the expected response time.")
+	return m
+}
+
+// Code of the first invoke in the message
+func OperationLabel(infos []ROSInfo) string {
+	for _, info := range infos {
+		if info.Type == ROSInvoke {
+			return strconv.Itoa(info.OpCode)
+		}
+	}
+	return "none"
+}
+
+// DialogueLabels describes a dialogue by its TC-Begin. The called party is
+// the peer that answers.
+func (m *DialogueMetrics) DialogueLabels(called SCCPAddress, ac string, infos []ROSInfo) Labels {
+	if ac == "" {
+		ac = "none"
+	}
+	return Labels{
+		"operation":           OperationLabel(infos),
+		"application_context": ac,
+		"ssn":                 strconv.Itoa(int(called.Ssn)),
+		"peer":                m.Peers.Label(called.Number),
+	}
+}
+
+func (m *DialogueMetrics) Completed(called SCCPAddress, ac string, infos []ROSInfo, outcome string, latency time.Duration) {
+	if m == nil {
+		return
+	}
+	labels := m.DialogueLabels(called, ac, infos)
+	labels["outcome"] = outcome
+	m.Registry.Add(m.dialogues, labels, 1)
+	m.Registry.Observe(m.latency, labels, latency.Seconds())
+}
+
+func (m *DialogueMetrics) Timeout(expired ExpiredDialogue) {
+	if m == nil {
+		return
+	}
+	labels := m.DialogueLabels(expired.Called, expired.ApplicationContext, expired.Ros)
+	labels["outcome"] = OutcomeTimeout
+	m.Registry.Add(m.dialogues, labels, 1)
+}
+
+func (m *DialogueMetrics) Overdue(overdue ExpiredDialogue) {
+	if m == nil {
+		return
+	}
+	m.Registry.Add(m.overdue, m.DialogueLabels(overdue.Called, overdue.ApplicationContext, overdue.Ros), 1)
+}
+
+// Tags of the latency timing for the tagged backends
+func DialogueTags(called SCCPAddress, infos []ROSInfo) []Tag {
+	return []Tag{
+		{Key: "operation", Value: OperationLabel(infos)},
+		{Key: "ssn", Value: strconv.Itoa(int(called.Ssn))},
+	}
+}
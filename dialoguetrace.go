@@ -0,0 +1,100 @@
+package tcapflow
+
+import (
+	"encoding/hex"
+	"strconv"
+	"time"
+)
+
+// DialogueTrace collects the spans of one TCAP dialogue. The root span goes
+// from the TC-Begin to the end of the dialogue and each Invoke gets a child
+// span that is closed by the Result, Error or Reject with the same invoke id.
+type DialogueTrace struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Start   time.Time
+	Root    []Attribute
+
+	pending map[int]*Span
+	done    []Span
+}
+
+func NewDialogueTrace(start time.Time, calling, called SCCPAddress, otid []byte, ac string) *DialogueTrace {
+	return &DialogueTrace{
+		TraceID: NewTraceID(),
+		SpanID:  NewSpanID(),
+		Start:   start,
+		Root: []Attribute{
+			{"tcap.calling.gt", calling.Number},
+			{"tcap.calling.ssn", int(calling.Ssn)},
+			{"tcap.called.gt", called.Number},
+			{"tcap.called.ssn", int(called.Ssn)},
+			{"tcap.otid", hex.EncodeToString(otid)},
+			{"tcap.application_context", ac},
+		},
+		pending: make(map[int]*Span),
+	}
+}
+
+func (d *DialogueTrace) closeInvoke(span *Span, end time.Time, result string, errorCode int) {
+	span.End = end
+	span.Attributes = append(span.Attributes, Attribute{"tcap.result", result})
+	switch result {
+	case "returnError", "reject":
+		span.Error = true
+		span.Attributes = append(span.Attributes, Attribute{"tcap.error_code", errorCode})
+	case "none":
+		span.Error = true
+	}
+	d.done = append(d.done, *span)
+}
+
+// AddComponents opens and closes the child spans for the components of a
+// message seen at the given time.
+func (d *DialogueTrace) AddComponents(infos []ROSInfo, at time.Time) {
+	for _, info := range infos {
+		switch info.Type {
+		case ROSInvoke:
+			d.pending[info.InvokeId] = &Span{
+				TraceID:  d.TraceID,
+				SpanID:   NewSpanID(),
+				ParentID: d.SpanID,
+				Name:     "Invoke " + strconv.Itoa(info.OpCode),
+				Start:    at,
+				Attributes: []Attribute{
+					{"tcap.invoke_id", info.InvokeId},
+					{"tcap.operation", info.OpCode},
+				},
+			}
+		case ROSResult, ROSError, ROSReject:
+			span, ok := d.pending[info.InvokeId]
+			if !ok {
+				continue
+			}
+			delete(d.pending, info.InvokeId)
+			d.closeInvoke(span, at, rosTypeName(info.Type), info.ErrorCode)
+		}
+	}
+}
+
+// Finish closes the dialogue with the outcome and returns all spans. Invokes
+// without an answer end with the dialogue.
+func (d *DialogueTrace) Finish(end time.Time, outcome string) []Span {
+	for id, span := range d.pending {
+		delete(d.pending, id)
+		d.closeInvoke(span, end, "none", 0)
+	}
+
+	root := Span{
+		TraceID:    d.TraceID,
+		SpanID:     d.SpanID,
+		Name:       "TCAP dialogue",
+		Start:      d.Start,
+		End:        end,
+		Attributes: append(d.Root, Attribute{"tcap.outcome", outcome}),
+		Error:      outcome == OutcomeAbort || outcome == OutcomeTimeout,
+	}
+	spans := append([]Span{root}, d.done...)
+	d.done = nil
+	return spans
+}
@@ -0,0 +1,56 @@
+package tcapflow
+
+import (
+	"testing"
+	"time"
+)
+
+func spanAttribute(span Span, key string) interface{} {
+	for _, attr := range span.Attributes {
+		if attr.Key == key {
+			return attr.Value
+		}
+	}
+	return nil
+}
+
+func TestDialogueTrace(t *testing.T) {
+	start := time.Unix(1000, 0)
+	trace := NewDialogueTrace(start, SCCPAddress{Number: "4912345", Ssn: 7}, SCCPAddress{Number: "4970000", Ssn: 6}, []byte{0xca, 0xfe}, "0.4.0.0.1.0.1.3")
+	trace.AddComponents([]ROSInfo{{Type: ROSInvoke, InvokeId: 1, OpCode: 2}, {Type: ROSInvoke, InvokeId: 2, OpCode: 7}}, start)
+	trace.AddComponents([]ROSInfo{{Type: ROSError, InvokeId: 2, ErrorCode: 34}, {Type: ROSResult, InvokeId: 9}}, start.Add(time.Second))
+	spans := trace.Finish(start.Add(2*time.Second), OutcomeEnd)
+
+	if len(spans) != 3 {
+		t.Fatalf("%d spans", len(spans))
+	}
+	root := spans[0]
+	if root.Name != "TCAP dialogue" || root.ParentID != ([8]byte{}) || root.Error || !root.End.Equal(start.Add(2*time.Second)) {
+		t.Errorf("root %+v", root)
+	}
+	if spanAttribute(root, "tcap.otid") != "cafe" || spanAttribute(root, "tcap.outcome") != OutcomeEnd || spanAttribute(root, "tcap.called.ssn") != 6 {
+		t.Errorf("root attributes %v", root.Attributes)
+	}
+
+	byName := make(map[string]Span)
+	for _, span := range spans[1:] {
+		if span.TraceID != root.TraceID || span.ParentID != root.SpanID {
+			t.Errorf("span %v not in the dialogue", span.Name)
+		}
+		byName[span.Name] = span
+	}
+	failed := byName["Invoke 7"]
+	if !failed.Error || spanAttribute(failed, "tcap.result") != "returnError" || spanAttribute(failed, "tcap.error_code") != 34 || !failed.End.Equal(start.Add(time.Second)) {
+		t.Errorf("failed invoke %+v", failed)
+	}
+	unanswered := byName["Invoke 2"]
+	if !unanswered.Error || spanAttribute(unanswered, "tcap.result") != "none" || !unanswered.End.Equal(root.End) {
+		t.Errorf("unanswered invoke %+v", unanswered)
+	}
+
+	// A timeout marks the dialogue as failed
+	trace = NewDialogueTrace(start, SCCPAddress{}, SCCPAddress{}, nil, "")
+	if spans := trace.Finish(start, OutcomeTimeout); len(spans) != 1 || !spans[0].Error {
+		t.Errorf("timed out %+v", spans)
+	}
+}
@@ -0,0 +1,54 @@
+package tcapflow
+
+import (
+	"time"
+)
+
+type evictionEntry struct {
+	key   string
+	added time.Time
+}
+
+// EvictionQueue remembers in which order keys were added to a map so the
+// oldest entry can be removed once the map is full. Removing a key from
+// the map does not need to update the queue. Entries that no longer match
+// the map are skipped and dropped lazily.
+type EvictionQueue struct {
+	entries []evictionEntry
+}
+
+// Tell if key is still in the map and was added at that time
+type EvictionCheck func(key string, added time.Time) bool
+
+func (q *EvictionQueue) Push(key string, added time.Time) {
+	q.entries = append(q.entries, evictionEntry{key: key, added: added})
+}
+
+// PopOldest returns the oldest key that is still in the map.
+func (q *EvictionQueue) PopOldest(current EvictionCheck) (string, bool) {
+	for len(q.entries) > 0 {
+		entry := q.entries[0]
+		q.entries[0] = evictionEntry{}
+		q.entries = q.entries[1:]
+		if current(entry.key, entry.added) {
+			return entry.key, true
+		}
+	}
+	return "", false
+}
+
+// Compact drops stale entries once they outnumber the live ones. Call it
+// after entries have been removed from the map.
+func (q *EvictionQueue) Compact(size int, current EvictionCheck) {
+	if len(q.entries) <= 2*size+64 {
+		return
+	}
+
+	entries := make([]evictionEntry, 0, size)
+	for _, entry := range q.entries {
+		if current(entry.key, entry.added) {
+			entries = append(entries, entry)
+		}
+	}
+	q.entries = entries
+}
@@ -0,0 +1,66 @@
+package tcapflow
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEvictionQueueSkipsStaleEntries(t *testing.T) {
+	live := make(map[string]time.Time)
+	current := func(key string, added time.Time) bool {
+		at, ok := live[key]
+		return ok && at.Equal(added)
+	}
+	var q EvictionQueue
+	now := time.Unix(1000, 0)
+	for i, key := range []string{"a", "b", "c", "b"} {
+		added := now.Add(time.Duration(i) * time.Second)
+		live[key] = added
+		q.Push(key, added)
+	}
+	delete(live, "a")
+
+	// a was removed and the first b replaced
+	if key, ok := q.PopOldest(current); !ok || key != "c" {
+		t.Errorf("oldest %q %v", key, ok)
+	}
+	delete(live, "c")
+	if key, ok := q.PopOldest(current); !ok || key != "b" {
+		t.Errorf("oldest %q %v", key, ok)
+	}
+	delete(live, "b")
+	if key, ok := q.PopOldest(current); ok {
+		t.Errorf("popped %q from an empty map", key)
+	}
+}
+
+func TestEvictionQueueCompact(t *testing.T) {
+	live := make(map[string]time.Time)
+	current := func(key string, added time.Time) bool {
+		at, ok := live[key]
+		return ok && at.Equal(added)
+	}
+	var q EvictionQueue
+	now := time.Unix(1000, 0)
+	for i := 0; i < 200; i++ {
+		key := string(rune('a' + i%10))
+		added := now.Add(time.Duration(i) * time.Second)
+		live[key] = added
+		q.Push(key, added)
+	}
+
+	q.Compact(len(live), current)
+	if len(q.entries) != 10 {
+		t.Fatalf("%d entries after compacting", len(q.entries))
+	}
+	if key, _ := q.PopOldest(current); key != "a" {
+		t.Errorf("oldest %q", key)
+	}
+
+	// Few stale entries are left alone
+	q.Push("a", now)
+	q.Compact(len(live), current)
+	if len(q.entries) != 10 {
+		t.Errorf("%d entries", len(q.entries))
+	}
+}
@@ -0,0 +1,110 @@
+package tcapflow
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// ExpiredDialogue describes a TC-Begin that did not see any response
+// before its state was expired or it became overdue.
+type ExpiredDialogue struct {
+	StartTime          time.Time
+	Calling            SCCPAddress
+	Called             SCCPAddress
+	Otid               []byte
+	ApplicationContext string
+	Ros                []ROSInfo
+	Age                time.Duration
+}
+
+// Operation codes of the invokes of the TC-Begin
+func (e ExpiredDialogue) OpCodes() []int {
+	ops := make([]int, 0, len(e.Ros))
+	for _, info := range e.Ros {
+		if info.Type == ROSInvoke {
+			ops = append(ops, info.OpCode)
+		}
+	}
+	return ops
+}
+
+func (e ExpiredDialogue) format(kind string) string {
+	return fmt.Sprintf("%s OTID(%v) %v/%v->%v/%v AC(%v) OPS(%v) AGE(%v)",
+		kind, hex.EncodeToString(e.Otid), e.Calling.Number, e.Calling.Ssn,
+		e.Called.Number, e.Called.Ssn, e.ApplicationContext, e.OpCodes(), e.Age)
+}
+
+func (e ExpiredDialogue) String() string {
+	return e.format("TIMEOUT")
+}
+
+func (e ExpiredDialogue) OverdueString() string {
+	return e.format("OVERDUE")
+}
+
+type expiredJSON struct {
+	Event              string      `json:"event"`
+	StartTime          time.Time   `json:"startTime"`
+	Calling            addressJSON `json:"calling"`
+	Called             addressJSON `json:"called"`
+	Otid               string      `json:"otid"`
+	ApplicationContext string      `json:"applicationContext,omitempty"`
+	Operations         []int       `json:"operations"`
+	AgeMs              float64     `json:"ageMs"`
+}
+
+// JSON describes the dialogue as an event of kind "timeout" or "overdue"
+func (e ExpiredDialogue) JSON(kind string) ([]byte, error) {
+	return json.Marshal(expiredJSON{
+		Event:              kind,
+		StartTime:          e.StartTime,
+		Calling:            addressToJSON(e.Calling),
+		Called:             addressToJSON(e.Called),
+		Otid:               hex.EncodeToString(e.Otid),
+		ApplicationContext: e.ApplicationContext,
+		Operations:         e.OpCodes(),
+		AgeMs:              milliseconds(e.Age),
+	})
+}
+
+// The called party is the one that did not answer.
+func (e ExpiredDialogue) buckets(kind string) []string {
+	buckets := []string{
+		kind + ".calledGt." + MetricName(e.Called.Number),
+		kind + ".calledSsn." + strconv.Itoa(int(e.Called.Ssn)),
+	}
+	for _, op := range e.OpCodes() {
+		buckets = append(buckets, kind+".op."+strconv.Itoa(op))
+	}
+	return buckets
+}
+
+// Buckets to count the timeout in
+func (e ExpiredDialogue) Buckets() []string {
+	return e.buckets("timeout")
+}
+
+// Buckets to count a dialogue exceeding its expected response time
+func (e ExpiredDialogue) OverdueBuckets() []string {
+	return e.buckets("overdue")
+}
+
+// MetricName replaces everything but letters, digits, '-' and '_' so the
+// string can be used as part of a metric name.
+func MetricName(name string) string {
+	out := []byte(name)
+	for i, c := range out {
+		switch {
+		case c >= '0' && c <= '9', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '-', c == '_':
+		default:
+			out[i] = '_'
+		}
+	}
+	if len(out) == 0 {
+		return "unknown"
+	}
+	return string(out)
+}
@@ -0,0 +1,85 @@
+package tcapflow
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testExpired() ExpiredDialogue {
+	return ExpiredDialogue{
+		StartTime:          time.Unix(1000, 0).UTC(),
+		Calling:            SCCPAddress{Number: "4912345", Ssn: 7},
+		Called:             SCCPAddress{Number: "+49 700", Ssn: 6},
+		Otid:               []byte{0xca, 0xfe},
+		ApplicationContext: "0.4.0.0.1.0.1.3",
+		Ros: []ROSInfo{
+			{Type: ROSInvoke, OpCode: 2},
+			{Type: ROSResult, OpCode: 3},
+			{Type: ROSInvoke, OpCode: 7},
+		},
+		Age: 1500 * time.Millisecond,
+	}
+}
+
+func TestExpiredDialogueString(t *testing.T) {
+	e := testExpired()
+	want := "TIMEOUT OTID(cafe) 4912345/7->+49 700/6 AC(0.4.0.0.1.0.1.3) OPS([2 7]) AGE(1.5s)"
+	if s := e.String(); s != want {
+		t.Errorf("String() = %q, want %q", s, want)
+	}
+	want = "OVERDUE" + want[len("TIMEOUT"):]
+	if s := e.OverdueString(); s != want {
+		t.Errorf("OverdueString() = %q, want %q", s, want)
+	}
+}
+
+func TestExpiredDialogueJSON(t *testing.T) {
+	data, err := testExpired().JSON("timeout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event struct {
+		Event      string  `json:"event"`
+		Otid       string  `json:"otid"`
+		Operations []int   `json:"operations"`
+		AgeMs      float64 `json:"ageMs"`
+		Called     struct {
+			Gt string `json:"gt"`
+		} `json:"called"`
+	}
+	if err := json.Unmarshal(data, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Event != "timeout" || event.Otid != "cafe" || event.AgeMs != 1500 || event.Called.Gt != "+49 700" {
+		t.Errorf("unexpected event %s", data)
+	}
+	if !reflect.DeepEqual(event.Operations, []int{2, 7}) {
+		t.Errorf("operations %v", event.Operations)
+	}
+}
+
+func TestExpiredDialogueBuckets(t *testing.T) {
+	e := testExpired()
+	want := []string{"timeout.calledGt._49_700", "timeout.calledSsn.6", "timeout.op.2", "timeout.op.7"}
+	if b := e.Buckets(); !reflect.DeepEqual(b, want) {
+		t.Errorf("Buckets() = %v, want %v", b, want)
+	}
+	if b := e.OverdueBuckets(); b[0] != "overdue.calledGt._49_700" {
+		t.Errorf("OverdueBuckets() = %v", b)
+	}
+}
+
+func TestMetricName(t *testing.T) {
+	for in, want := range map[string]string{
+		"":           "unknown",
+		"4912345":    "4912345",
+		"a.b c":      "a_b_c",
+		"ok-_Name09": "ok-_Name09",
+	} {
+		if got := MetricName(in); got != want {
+			t.Errorf("MetricName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package tcapflow
+
+import (
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/ip4defrag"
+	"github.com/google/gopacket/layers"
+)
+
+// SIGTRAN carried through tunnels with a small MTU will see SCTP packets
+// split at the IP layer. gopacket will not decode the SCTP of such a
+// fragment so the datagram needs to be put together first.
+type ipv4FragmentKey struct {
+	net gopacket.Flow
+	id  uint16
+}
+
+type ipv6FragmentKey struct {
+	net gopacket.Flow
+	id  uint32
+}
+
+type ipv6Fragments struct {
+	fragments map[uint16][]byte // offset in bytes to payload
+	total     int               // known once the last fragment arrived
+	seen      time.Time
+}
+
+type IPDefragmenter struct {
+	ipv4        *ip4defrag.IPv4Defragmenter
+	ipv4Pending map[ipv4FragmentKey]time.Time
+	ipv6        map[ipv6FragmentKey]*ipv6Fragments
+
+	// Incomplete datagrams are dropped after this time
+	ExpireDuration time.Duration
+	lastExpire     time.Time
+}
+
+func NewIPDefragmenter() *IPDefragmenter {
+	return &IPDefragmenter{
+		ipv4:           ip4defrag.NewIPv4Defragmenter(),
+		ipv4Pending:    make(map[ipv4FragmentKey]time.Time),
+		ipv6:           make(map[ipv6FragmentKey]*ipv6Fragments),
+		ExpireDuration: 30 * time.Second,
+	}
+}
+
+func isIPv4Fragment(ip *layers.IPv4) bool {
+	return ip.Flags&layers.IPv4MoreFragments != 0 || ip.FragOffset != 0
+}
+
+func (d *IPDefragmenter) defragIPv4(ip *layers.IPv4, now time.Time) (gopacket.SerializableLayer, []byte) {
+	key := ipv4FragmentKey{net: ip.NetworkFlow(), id: ip.Id}
+	out, err := d.ipv4.DefragIPv4WithTimestamp(ip, now)
+	if err != nil || out == nil {
+		if err != nil {
+			delete(d.ipv4Pending, key)
+		} else {
+			d.ipv4Pending[key] = now
+		}
+		return nil, nil
+	}
+
+	delete(d.ipv4Pending, key)
+	return out, out.Payload
+}
+
+func (d *IPDefragmenter) defragIPv6(ip *layers.IPv6, frag *layers.IPv6Fragment, now time.Time) (gopacket.SerializableLayer, []byte) {
+	key := ipv6FragmentKey{net: ip.NetworkFlow(), id: frag.Identification}
+	frags, ok := d.ipv6[key]
+	if !ok {
+		frags = &ipv6Fragments{fragments: make(map[uint16][]byte)}
+		d.ipv6[key] = frags
+	}
+	frags.seen = now
+
+	offset := frag.FragmentOffset * 8
+	payload := make([]byte, len(frag.Payload))
+	copy(payload, frag.Payload)
+	frags.fragments[offset] = payload
+	if !frag.MoreFragments {
+		frags.total = int(offset) + len(payload)
+	}
+	if frags.total == 0 {
+		return nil, nil
+	}
+
+	// Check that we have everything without a hole
+	final := make([]byte, 0, frags.total)
+	for len(final) < frags.total {
+		data, ok := frags.fragments[uint16(len(final))]
+		if !ok || len(data) == 0 {
+			return nil, nil
+		}
+		final = append(final, data...)
+	}
+	delete(d.ipv6, key)
+
+	out := &layers.IPv6{
+		Version:      ip.Version,
+		TrafficClass: ip.TrafficClass,
+		FlowLabel:    ip.FlowLabel,
+		NextHeader:   frag.NextHeader,
+		HopLimit:     ip.HopLimit,
+		SrcIP:        ip.SrcIP,
+		DstIP:        ip.DstIP,
+	}
+	return out, final
+}
+
+// Find the first fragmented IP layer and try to complete it.
+func (d *IPDefragmenter) defragOnce(packet gopacket.Packet) (gopacket.SerializableLayer, []byte, bool) {
+	now := packet.Metadata().Timestamp
+	var lastIPv6 *layers.IPv6
+
+	for _, l := range packet.Layers() {
+		switch ip := l.(type) {
+		case *layers.IPv4:
+			if isIPv4Fragment(ip) {
+				out, payload := d.defragIPv4(ip, now)
+				return out, payload, true
+			}
+		case *layers.IPv6:
+			lastIPv6 = ip
+		case *layers.IPv6Fragment:
+			if lastIPv6 == nil {
+				return nil, nil, true
+			}
+			out, payload := d.defragIPv6(lastIPv6, ip, now)
+			return out, payload, true
+		}
+	}
+	return nil, nil, false
+}
+
+// IPDefragHandler is implemented by handlers that want to count IP
+// reassembly. The IPDefragmenter calls it for each reassembled packet and
+// for the fragments it gave up on.
+type IPDefragHandler interface {
+	DataHandler
+	OnIPReassembled()
+	OnIPFragmentsExpired(count int)
+}
+
+// Defrag returns the packet with all IP fragments put together, nil
+// while fragments are still missing or the packet itself if it was
+// not fragmented at all.
+func (d *IPDefragmenter) Defrag(handler DataHandler, packet gopacket.Packet) gopacket.Packet {
+	d.expire(handler, packet.Metadata().Timestamp)
+
+	// Tunnels might fragment both the outer and the inner packet
+	for {
+		out, payload, fragmented := d.defragOnce(packet)
+		if !fragmented {
+			return packet
+		}
+		if out == nil {
+			return nil
+		}
+
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true}
+		err := gopacket.SerializeLayers(buf, opts, out, gopacket.Payload(payload))
+		if err != nil {
+			return nil
+		}
+		if h, ok := handler.(IPDefragHandler); ok {
+			h.OnIPReassembled()
+		}
+
+		layerType := layers.LayerTypeIPv4
+		if _, ok := out.(*layers.IPv6); ok {
+			layerType = layers.LayerTypeIPv6
+		}
+		reassembled := gopacket.NewPacket(buf.Bytes(), layerType, gopacket.Default)
+		md := reassembled.Metadata()
+		md.CaptureInfo = packet.Metadata().CaptureInfo
+		md.CaptureLength = len(buf.Bytes())
+		md.Length = len(buf.Bytes())
+		packet = reassembled
+	}
+}
+
+func (d *IPDefragmenter) expire(handler DataHandler, now time.Time) {
+	if now.Sub(d.lastExpire) < time.Second {
+		return
+	}
+	d.lastExpire = now
+
+	expired := 0
+	cutoff := now.Add(-d.ExpireDuration)
+	for key, seen := range d.ipv4Pending {
+		if seen.Before(cutoff) {
+			expired += 1
+			delete(d.ipv4Pending, key)
+		}
+	}
+	d.ipv4.DiscardOlderThan(cutoff)
+
+	for key, frags := range d.ipv6 {
+		if frags.seen.Before(cutoff) {
+			expired += 1
+			delete(d.ipv6, key)
+		}
+	}
+
+	if h, ok := handler.(IPDefragHandler); ok && expired > 0 {
+		h.OnIPFragmentsExpired(expired)
+	}
+}
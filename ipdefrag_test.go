@@ -0,0 +1,132 @@
+package tcapflow
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// An SCTP packet with one unfragmented DATA chunk of 100 bytes
+func testSCTPDatagram() []byte {
+	header := []byte{0x0b, 0x59, 0x0b, 0x59, 0, 0, 0, 0, 0, 0, 0, 0}
+	payload := bytes.Repeat([]byte{0x5a}, 100)
+	chunk := []byte{0, 3, 0, byte(16 + len(payload)), 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 3}
+	return append(append(header, chunk...), payload...)
+}
+
+func testIPv4Fragment(id uint16, offset uint16, more bool, data []byte, at time.Time) gopacket.Packet {
+	ip := &layers.IPv4{Version: 4, TTL: 64, Id: id, Protocol: layers.IPProtocolSCTP,
+		SrcIP: []byte{10, 0, 0, 1}, DstIP: []byte{10, 0, 0, 2}, FragOffset: offset / 8}
+	if more {
+		ip.Flags = layers.IPv4MoreFragments
+	}
+	buf := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, ip, gopacket.Payload(data))
+	packet := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+	packet.Metadata().Timestamp = at
+	return packet
+}
+
+func testIPv6Fragment(id uint32, offset uint16, more bool, data []byte, at time.Time) gopacket.Packet {
+	ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolIPv6Fragment,
+		SrcIP: make([]byte, 16), DstIP: make([]byte, 16)}
+	header := []byte{byte(layers.IPProtocolSCTP), 0, byte(offset >> 8), byte(offset), byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)}
+	if more {
+		header[3] |= 1
+	}
+	buf := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, ip, gopacket.Payload(append(header, data...)))
+	packet := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv6, gopacket.Default)
+	packet.Metadata().Timestamp = at
+	return packet
+}
+
+func sctpPayload(t *testing.T, packet gopacket.Packet) []byte {
+	for _, l := range packet.Layers() {
+		if data, ok := l.(*layers.SCTPData); ok {
+			return data.Payload
+		}
+	}
+	t.Fatalf("no SCTP DATA in %v", packet)
+	return nil
+}
+
+func TestIPDefragmenter(t *testing.T) {
+	data := testSCTPDatagram()
+	now := time.Unix(1000, 0)
+
+	for name, fragments := range map[string][]gopacket.Packet{
+		"IPv4": {
+			testIPv4Fragment(7, 64, false, data[64:], now),
+			testIPv4Fragment(7, 0, true, data[:64], now),
+		},
+		"IPv6": {
+			testIPv6Fragment(9, 0, true, data[:64], now),
+			testIPv6Fragment(9, 64, false, data[64:], now),
+		},
+	} {
+		handler := &recordingHandler{}
+		d := NewIPDefragmenter()
+		if d.Defrag(handler, fragments[0]) != nil {
+			t.Errorf("%v: complete after the first fragment", name)
+		}
+		packet := d.Defrag(handler, fragments[1])
+		if packet == nil {
+			t.Errorf("%v: not reassembled", name)
+			continue
+		}
+		if payload := sctpPayload(t, packet); !bytes.Equal(payload, data[28:]) {
+			t.Errorf("%v: payload %x", name, payload)
+		}
+		if handler.reassembled != 1 || !packet.Metadata().Timestamp.Equal(now) {
+			t.Errorf("%v: %d reassembled at %v", name, handler.reassembled, packet.Metadata().Timestamp)
+		}
+	}
+}
+
+func TestIPDefragmenterPassesWholePackets(t *testing.T) {
+	d := NewIPDefragmenter()
+	packet := testIPv4Fragment(1, 0, false, testSCTPDatagram(), time.Unix(1000, 0))
+	if d.Defrag(&recordingHandler{}, packet) != packet {
+		t.Error("unfragmented packet not passed through")
+	}
+}
+
+func TestIPDefragmenterExpires(t *testing.T) {
+	data := testSCTPDatagram()
+	now := time.Unix(1000, 0)
+	handler := &recordingHandler{}
+	d := NewIPDefragmenter()
+	d.Defrag(handler, testIPv4Fragment(8, 0, true, data[:64], now))
+	d.Defrag(handler, testIPv6Fragment(8, 0, true, data[:64], now))
+	d.Defrag(handler, testIPv4Fragment(9, 0, true, data[:64], now.Add(time.Minute)))
+	if handler.expired != 2 {
+		t.Errorf("%d expired", handler.expired)
+	}
+	if d.Defrag(handler, testIPv4Fragment(8, 64, false, data[64:], now.Add(time.Minute))) != nil {
+		t.Error("completed an expired datagram")
+	}
+}
+
+// dataOnlyHandler does not count IP reassembly
+type dataOnlyHandler struct{}
+
+func (dataOnlyHandler) OnData(called_gt SCCPAddress, calling_gt SCCPAddress, data []uint8, packet gopacket.Packet) {
+}
+func (dataOnlyHandler) AfterOnePacket()                                {}
+func (dataOnlyHandler) ParseError(data []uint8, recovered interface{}) {}
+
+func TestIPDefragmenterPlainHandler(t *testing.T) {
+	data := testSCTPDatagram()
+	now := time.Unix(1000, 0)
+	d := NewIPDefragmenter()
+	d.Defrag(dataOnlyHandler{}, testIPv4Fragment(7, 0, true, data[:64], now))
+	if d.Defrag(dataOnlyHandler{}, testIPv4Fragment(7, 64, false, data[64:], now)) == nil {
+		t.Error("not reassembled")
+	}
+	d.Defrag(dataOnlyHandler{}, testIPv4Fragment(8, 0, true, data[:64], now))
+	d.Defrag(dataOnlyHandler{}, testIPv4Fragment(9, 0, true, data[:64], now.Add(time.Minute)))
+}
@@ -22,15 +22,20 @@ type M2PA struct {
 }
 
 func HandleM2PA(handler DataHandler, data []uint8, packet gopacket.Packet) {
+	handleM2PA(handler, &Message{}, data, packet)
+}
+
+func handleM2PA(handler DataHandler, msg *Message, data []uint8, packet gopacket.Packet) {
 	m2pa := M2PA{}
 	buf := bytes.NewReader(data)
 	err := binary.Read(buf, binary.BigEndian, &m2pa)
 	if err != nil {
-		fmt.Printf("Failed M2PA: %v\n", err)
+		handler.ParseError(data, fmt.Errorf("M2PA: %v", err))
 		return
 	}
 	if m2pa.MessageClass == 11 && m2pa.MessageType == 1 {
-		handleMTP(handler, data[17:], packet)
+		msg.AdaptationLayer = "M2PA"
+		handleMTP(handler, msg, data[17:], packet)
 		return
 	}
 }
@@ -7,5 +7,5 @@ import (
 )
 
 func HandleM2UA(handler DataHandler, data *layers.SCTPData, packet gopacket.Packet) {
-	fmt.Printf("M2UA not implemented\n")
+	handler.ParseError(data.Payload, fmt.Errorf("M2UA not implemented"))
 }
@@ -22,11 +22,15 @@ type M3UAHeader struct {
 }
 
 func HandleM3UA(handler DataHandler, data []uint8, packet gopacket.Packet) {
+	handleM3UA(handler, &Message{}, data, packet)
+}
+
+func handleM3UA(handler DataHandler, msg *Message, data []uint8, packet gopacket.Packet) {
 	m3ua := M3UA{}
 	buf := bytes.NewReader(data)
 	err := binary.Read(buf, binary.BigEndian, &m3ua)
 	if err != nil {
-		fmt.Printf("Failed M3UA: %v\n", err)
+		handler.ParseError(data, fmt.Errorf("M3UA: %v", err))
 		return
 	}
 
@@ -47,7 +51,13 @@ func HandleM3UA(handler DataHandler, data []uint8, packet gopacket.Packet) {
 			break
 		}
 		if hdr.Tag == 528 {
-			handleSCCP(handler, payload[12:], packet)
+			msg.AdaptationLayer = "M3UA"
+			msg.OPC = binary.BigEndian.Uint32(payload[0:4])
+			msg.DPC = binary.BigEndian.Uint32(payload[4:8])
+			msg.SI = payload[8]
+			msg.NI = payload[9]
+			msg.SLS = payload[11]
+			handleSCCP(handler, msg, payload[12:], packet)
 		}
 		if hdr.Length%4 > 0 {
 			padding := int(4 - (hdr.Length % 4))
@@ -0,0 +1,45 @@
+package tcapflow
+
+import (
+	"github.com/google/gopacket"
+)
+
+// Message describes the layers below TCAP of one decoded MSU.
+type Message struct {
+	Frame uint64 // Number of the packet in the capture starting at 1
+
+	// SCTP
+	Stream          uint16
+	StreamSequence  uint16
+	PayloadProtocol uint32
+
+	// "M3UA" or "M2PA"
+	AdaptationLayer string
+
+	// MTP3 routing label. M3UA carries the same in its protocol data.
+	OPC uint32
+	DPC uint32
+	SI  uint8
+	NI  uint8
+	SLS uint8
+
+	SCCPType      uint8
+	ProtocolClass uint8
+	Called        SCCPAddress
+	Calling       SCCPAddress
+}
+
+// MessageHandler is implemented by handlers that want to know the lower
+// layers of a message. OnMessage is called instead of OnData.
+type MessageHandler interface {
+	DataHandler
+	OnMessage(msg *Message, data []uint8, packet gopacket.Packet)
+}
+
+func deliver(handler DataHandler, msg *Message, data []uint8, packet gopacket.Packet) {
+	if h, ok := handler.(MessageHandler); ok {
+		h.OnMessage(msg, data, packet)
+		return
+	}
+	handler.OnData(msg.Called, msg.Calling, data, packet)
+}
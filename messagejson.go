@@ -0,0 +1,171 @@
+package tcapflow
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+type addressJSON struct {
+	Gt        string `json:"gt"`
+	Ssn       uint8  `json:"ssn"`
+	Ton       uint8  `json:"ton"`
+	Npi       uint8  `json:"npi"`
+	PointCode uint32 `json:"pc"`
+}
+
+type componentJSON struct {
+	Type      string `json:"type"`
+	InvokeId  int    `json:"invokeId"`
+	OpCode    *int   `json:"opCode,omitempty"`
+	ErrorCode *int   `json:"errorCode,omitempty"`
+}
+
+type messageJSON struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	Frame uint64    `json:"frame"`
+
+	IP struct {
+		Src string `json:"src"`
+		Dst string `json:"dst"`
+	} `json:"ip"`
+	SCTP struct {
+		SrcPort         uint16 `json:"srcPort"`
+		DstPort         uint16 `json:"dstPort"`
+		VerificationTag uint32 `json:"verificationTag"`
+		Stream          uint16 `json:"stream"`
+		StreamSequence  uint16 `json:"streamSequence"`
+		PPID            uint32 `json:"ppid"`
+	} `json:"sctp"`
+
+	AdaptationLayer string `json:"adaptationLayer"`
+	MTP3            struct {
+		OPC uint32 `json:"opc"`
+		DPC uint32 `json:"dpc"`
+		SI  uint8  `json:"si"`
+		NI  uint8  `json:"ni"`
+		SLS uint8  `json:"sls"`
+	} `json:"mtp3"`
+	SCCP struct {
+		Type          string      `json:"type"`
+		ProtocolClass uint8       `json:"protocolClass"`
+		Called        addressJSON `json:"called"`
+		Calling       addressJSON `json:"calling"`
+	} `json:"sccp"`
+	TCAP struct {
+		Type               string `json:"type"`
+		Otid               string `json:"otid,omitempty"`
+		Dtid               string `json:"dtid,omitempty"`
+		ApplicationContext string `json:"applicationContext,omitempty"`
+	} `json:"tcap"`
+	Components []componentJSON `json:"components"`
+	Error      string          `json:"error,omitempty"`
+}
+
+// SCCPTypeName names the connectionless message types, others in hex
+func SCCPTypeName(t uint8) string {
+	switch t {
+	case sccpUDT:
+		return "UDT"
+	case sccpUDTS:
+		return "UDTS"
+	case sccpXUDT:
+		return "XUDT"
+	case sccpXUDTS:
+		return "XUDTS"
+	case sccpLUDT:
+		return "LUDT"
+	case sccpLUDTS:
+		return "LUDTS"
+	}
+	return hex.EncodeToString([]byte{t})
+}
+
+func rosTypeName(t int) string {
+	switch t {
+	case ROSInvoke:
+		return "invoke"
+	case ROSResult:
+		return "returnResult"
+	case ROSError:
+		return "returnError"
+	case ROSReject:
+		return "reject"
+	}
+	return "unknown"
+}
+
+func addressToJSON(addr SCCPAddress) addressJSON {
+	return addressJSON{
+		Gt:        addr.Number,
+		Ssn:       addr.Ssn,
+		Ton:       addr.Ton,
+		Npi:       addr.Npi,
+		PointCode: addr.PointCode,
+	}
+}
+
+// EncodeMessageJSON describes a message with all its layers as a single
+// JSON object. Decoding errors of TCAP are put into the "error" field.
+func EncodeMessageJSON(msg *Message, data []uint8, packet gopacket.Packet) ([]byte, error) {
+	out := messageJSON{Event: "message", Frame: msg.Frame}
+	out.Time = packet.Metadata().Timestamp
+
+	if net := packet.NetworkLayer(); net != nil {
+		src, dst := net.NetworkFlow().Endpoints()
+		out.IP.Src = src.String()
+		out.IP.Dst = dst.String()
+	}
+	if sctp, ok := packet.Layer(layers.LayerTypeSCTP).(*layers.SCTP); ok {
+		out.SCTP.SrcPort = uint16(sctp.SrcPort)
+		out.SCTP.DstPort = uint16(sctp.DstPort)
+		out.SCTP.VerificationTag = sctp.VerificationTag
+	}
+	out.SCTP.Stream = msg.Stream
+	out.SCTP.StreamSequence = msg.StreamSequence
+	out.SCTP.PPID = msg.PayloadProtocol
+
+	out.AdaptationLayer = msg.AdaptationLayer
+	out.MTP3.OPC = msg.OPC
+	out.MTP3.DPC = msg.DPC
+	out.MTP3.SI = msg.SI
+	out.MTP3.NI = msg.NI
+	out.MTP3.SLS = msg.SLS
+
+	out.SCCP.Type = SCCPTypeName(msg.SCCPType)
+	out.SCCP.ProtocolClass = msg.ProtocolClass
+	out.SCCP.Called = addressToJSON(msg.Called)
+	out.SCCP.Calling = addressToJSON(msg.Calling)
+
+	tag, otid, dtid, dialogue, comp, err := DecodeTCAP(data)
+	out.TCAP.Type = TCprocName(tag)
+	out.TCAP.Otid = hex.EncodeToString(otid.Bytes)
+	out.TCAP.Dtid = hex.EncodeToString(dtid.Bytes)
+	if err != nil {
+		out.Error = err.Error()
+	}
+	if ac, err := DecodeApplicationContext(dialogue); err == nil && len(ac) > 0 {
+		out.TCAP.ApplicationContext = ac.String()
+	}
+
+	infos, _ := DecodeROS(comp.Bytes)
+	out.Components = make([]componentJSON, 0, len(infos))
+	for _, info := range infos {
+		c := componentJSON{Type: rosTypeName(info.Type), InvokeId: info.InvokeId}
+		switch info.Type {
+		case ROSInvoke:
+			op := info.OpCode
+			c.OpCode = &op
+		case ROSError, ROSReject:
+			code := info.ErrorCode
+			c.ErrorCode = &code
+		}
+		out.Components = append(out.Components, c)
+	}
+
+	return json.Marshal(out)
+}
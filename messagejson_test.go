@@ -0,0 +1,64 @@
+package tcapflow
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestEncodeMessageJSON(t *testing.T) {
+	tcap := testTCAP(TCbeginApp, []byte{0xca, 0xfe}, nil, append(testInvoke(2), testResultLast()...))
+	frame := testFrame(1, 2, 1, 3, testM3UA(testXUDT(testGT("4970000"), testGT("4912345"), tcap, nil)))
+	packet := gopacket.NewPacket(frame, layers.LinkTypeEthernet, gopacket.Default)
+	packet.Metadata().Timestamp = time.Unix(1000, 0).UTC()
+
+	handler := &messageRecorder{}
+	handlePacket(handler, NewSCTPReassembler(), packet, 7)
+	if len(handler.lower) != 1 {
+		t.Fatalf("%d messages, %d errors", len(handler.lower), handler.errors)
+	}
+	data, err := EncodeMessageJSON(&handler.lower[0], handler.messages[0].data, packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out messageJSON
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Event != "message" || out.Frame != 7 || !out.Time.Equal(time.Unix(1000, 0)) {
+		t.Errorf("header %s", data)
+	}
+	if out.IP.Src != "10.0.0.1" || out.IP.Dst != "10.0.0.2" || out.SCTP.SrcPort != 2905 || out.SCTP.PPID != 3 {
+		t.Errorf("transport %s", data)
+	}
+	if out.AdaptationLayer != "M3UA" || out.MTP3.OPC != 1 || out.MTP3.DPC != 2 || out.MTP3.SI != 3 {
+		t.Errorf("MTP3 %s", data)
+	}
+	if out.SCCP.Type != "XUDT" || out.SCCP.Called.Gt != "4970000" || out.SCCP.Calling.Gt != "4912345" || out.SCCP.Called.PointCode != 2 {
+		t.Errorf("SCCP %s", data)
+	}
+	if out.TCAP.Type != "BEGIN" || out.TCAP.Otid != "cafe" || out.TCAP.Dtid != "" || out.Error != "" {
+		t.Errorf("TCAP %s", data)
+	}
+	if len(out.Components) != 2 || out.Components[0].Type != "invoke" || *out.Components[0].OpCode != 2 ||
+		out.Components[1].Type != "returnResult" || out.Components[1].OpCode != nil {
+		t.Errorf("components %s", data)
+	}
+}
+
+func TestEncodeMessageJSONError(t *testing.T) {
+	packet := gopacket.NewPacket(nil, gopacket.DecodePayload, gopacket.Default)
+	data, err := EncodeMessageJSON(&Message{SCCPType: 0x42}, []byte{0x62, 0x05, 0x48}, packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out messageJSON
+	json.Unmarshal(data, &out)
+	if out.Error == "" || out.SCCP.Type != "42" || out.Components == nil {
+		t.Errorf("broken TCAP %s", data)
+	}
+}
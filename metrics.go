@@ -0,0 +1,382 @@
+package tcapflow
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/alexcesaro/statsd.v2"
+)
+
+// Tag adds a dimension to a metric. Backends without tags ignore them.
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// Metrics is where the handlers send their counters, gauges and timings.
+// Implementations are safe for concurrent use and send batches in the
+// background. Flush forces pending data out.
+type Metrics interface {
+	Increment(bucket string, tags ...Tag)
+	Count(bucket string, n int64, tags ...Tag)
+	Gauge(bucket string, value float64, tags ...Tag)
+	Timing(bucket string, value float64, tags ...Tag)
+	Flush()
+	Close()
+}
+
+// Names for NewMetrics
+const (
+	MetricsStatsd    = "statsd"
+	MetricsDogStatsd = "dogstatsd"
+	MetricsInflux    = "influx"
+	MetricsNone      = "none"
+)
+
+// NewMetrics creates the backend by name. An empty address picks the
+// default port of the backend on localhost. Prefix is put in front of
+// every bucket name.
+func NewMetrics(backend, address, prefix string, flush time.Duration) (Metrics, error) {
+	// Nothing would be sent and the timings pile up
+	if flush <= 0 && backend != MetricsNone {
+		return nil, fmt.Errorf("metrics flush interval %v is not positive", flush)
+	}
+	switch backend {
+	case MetricsStatsd:
+		if address == "" {
+			address = "localhost:8125"
+		}
+		return NewStatsdMetrics(address, prefix, flush)
+	case MetricsDogStatsd:
+		if address == "" {
+			address = "localhost:8125"
+		}
+		return newLineMetrics(address, prefix, flush, dogStatsdFormat{})
+	case MetricsInflux:
+		if address == "" {
+			address = "localhost:8089"
+		}
+		return newLineMetrics(address, prefix, flush, influxFormat{})
+	case MetricsNone:
+		return NopMetrics{}, nil
+	}
+	return nil, fmt.Errorf("unknown metrics backend %q", backend)
+}
+
+// StatsdMetrics sends plain statsd without tags.
+type StatsdMetrics struct {
+	client *statsd.Client
+}
+
+func NewStatsdMetrics(address, prefix string, flush time.Duration) (*StatsdMetrics, error) {
+	client, err := statsd.New(statsd.Address(address), statsd.Prefix(prefix), statsd.FlushPeriod(flush))
+	if err != nil {
+		return nil, err
+	}
+	return &StatsdMetrics{client: client}, nil
+}
+
+func (s *StatsdMetrics) Increment(bucket string, tags ...Tag) {
+	s.client.Increment(bucket)
+}
+
+func (s *StatsdMetrics) Count(bucket string, n int64, tags ...Tag) {
+	s.client.Count(bucket, n)
+}
+
+func (s *StatsdMetrics) Gauge(bucket string, value float64, tags ...Tag) {
+	s.client.Gauge(bucket, value)
+}
+
+func (s *StatsdMetrics) Timing(bucket string, value float64, tags ...Tag) {
+	s.client.Timing(bucket, value)
+}
+
+func (s *StatsdMetrics) Flush() {
+	s.client.Flush()
+}
+
+func (s *StatsdMetrics) Close() {
+	s.client.Close()
+}
+
+// Formats of the UDP line backends
+type lineFormat interface {
+	count(name string, tags []Tag, n int64) string
+	gauge(name string, tags []Tag, value float64) string
+	timing(name string, tags []Tag, value float64, at time.Time) string
+}
+
+// DogStatsD adds tags as "|#key:value,..."
+type dogStatsdFormat struct{}
+
+func dogStatsdTags(tags []Tag) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	clean := strings.NewReplacer("|", "_", ",", "_", "#", "_", ":", "_")
+	parts := make([]string, len(tags))
+	for i, tag := range tags {
+		parts[i] = clean.Replace(tag.Key) + ":" + clean.Replace(tag.Value)
+	}
+	return "|#" + strings.Join(parts, ",")
+}
+
+func (dogStatsdFormat) count(name string, tags []Tag, n int64) string {
+	return name + ":" + strconv.FormatInt(n, 10) + "|c" + dogStatsdTags(tags)
+}
+
+func (dogStatsdFormat) gauge(name string, tags []Tag, value float64) string {
+	return name + ":" + formatFloat(value) + "|g" + dogStatsdTags(tags)
+}
+
+func (dogStatsdFormat) timing(name string, tags []Tag, value float64, at time.Time) string {
+	return name + ":" + formatFloat(value) + "|ms" + dogStatsdTags(tags)
+}
+
+// InfluxDB line protocol. Tags are sorted as recommended by InfluxDB.
+type influxFormat struct{}
+
+var influxEscape = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+
+func influxSeries(name string, tags []Tag) string {
+	sorted := make([]Tag, len(tags))
+	copy(sorted, tags)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Key < sorted[j].Key })
+
+	series := influxEscape.Replace(name)
+	for _, tag := range sorted {
+		series += "," + influxEscape.Replace(tag.Key) + "=" + influxEscape.Replace(tag.Value)
+	}
+	return series
+}
+
+func (influxFormat) count(name string, tags []Tag, n int64) string {
+	return influxSeries(name, tags) + " count=" + strconv.FormatInt(n, 10) + "i"
+}
+
+func (influxFormat) gauge(name string, tags []Tag, value float64) string {
+	return influxSeries(name, tags) + " gauge=" + formatFloat(value)
+}
+
+// Points with the same series and time replace each other. Each timing
+// keeps the time it was taken.
+func (influxFormat) timing(name string, tags []Tag, value float64, at time.Time) string {
+	return influxSeries(name, tags) + " timing=" + formatFloat(value) + " " + strconv.FormatInt(at.UnixNano(), 10)
+}
+
+type lineSeries struct {
+	name string
+	tags []Tag
+}
+
+func seriesKey(name string, tags []Tag) string {
+	key := name
+	for _, tag := range tags {
+		key += "\x00" + tag.Key + "\x00" + tag.Value
+	}
+	return key
+}
+
+// Keep UDP datagrams below a common MTU
+const maxLinePacket = 1432
+
+// lineMetrics sums up counters and keeps the last gauge until the next
+// flush. Timings are queued one by one.
+type lineMetrics struct {
+	sync.Mutex
+	conn   net.Conn
+	prefix string
+	format lineFormat
+
+	series   map[string]lineSeries
+	counters map[string]int64
+	gauges   map[string]float64
+	timings  []string
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newLineMetrics(address, prefix string, flush time.Duration, format lineFormat) (*lineMetrics, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	m := &lineMetrics{
+		conn:     conn,
+		prefix:   prefix,
+		format:   format,
+		series:   make(map[string]lineSeries),
+		counters: make(map[string]int64),
+		gauges:   make(map[string]float64),
+		done:     make(chan struct{}),
+	}
+	m.wg.Add(1)
+	go m.flushLoop(flush)
+	return m, nil
+}
+
+func (m *lineMetrics) flushLoop(interval time.Duration) {
+	defer m.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.Flush()
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// The lock needs to be held
+func (m *lineMetrics) key(bucket string, tags []Tag) string {
+	key := seriesKey(bucket, tags)
+	if _, ok := m.series[key]; !ok {
+		m.series[key] = lineSeries{name: m.prefix + bucket, tags: append([]Tag(nil), tags...)}
+	}
+	return key
+}
+
+func (m *lineMetrics) Increment(bucket string, tags ...Tag) {
+	m.Count(bucket, 1, tags...)
+}
+
+func (m *lineMetrics) Count(bucket string, n int64, tags ...Tag) {
+	m.Lock()
+	defer m.Unlock()
+	m.counters[m.key(bucket, tags)] += n
+}
+
+func (m *lineMetrics) Gauge(bucket string, value float64, tags ...Tag) {
+	m.Lock()
+	defer m.Unlock()
+	m.gauges[m.key(bucket, tags)] = value
+}
+
+func (m *lineMetrics) Timing(bucket string, value float64, tags ...Tag) {
+	line := m.format.timing(m.prefix+bucket, tags, value, time.Now())
+	m.Lock()
+	defer m.Unlock()
+	m.timings = append(m.timings, line)
+}
+
+func (m *lineMetrics) Flush() {
+	m.Lock()
+	lines := m.timings
+	for key, n := range m.counters {
+		series := m.series[key]
+		lines = append(lines, m.format.count(series.name, series.tags, n))
+	}
+	for key, value := range m.gauges {
+		series := m.series[key]
+		lines = append(lines, m.format.gauge(series.name, series.tags, value))
+	}
+	m.timings = nil
+	m.series = make(map[string]lineSeries)
+	m.counters = make(map[string]int64)
+	m.gauges = make(map[string]float64)
+	m.Unlock()
+
+	// Several lines per datagram
+	packet := make([]byte, 0, maxLinePacket)
+	for _, line := range lines {
+		if len(packet) > 0 && len(packet)+1+len(line) > maxLinePacket {
+			m.conn.Write(packet)
+			packet = packet[:0]
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	if len(packet) > 0 {
+		m.conn.Write(packet)
+	}
+}
+
+func (m *lineMetrics) Close() {
+	close(m.done)
+	m.wg.Wait()
+	m.Flush()
+	m.conn.Close()
+}
+
+// MemoryMetrics records everything in memory for tests. Counters, gauges
+// and timings are keyed by the bucket. Counters are also kept per tag set
+// in Tagged with keys like "bucket,key=value".
+type MemoryMetrics struct {
+	sync.Mutex
+	Counters map[string]int64
+	Tagged   map[string]int64
+	Gauges   map[string]float64
+	Timings  map[string][]float64
+}
+
+func NewMemoryMetrics() *MemoryMetrics {
+	return &MemoryMetrics{
+		Counters: make(map[string]int64),
+		Tagged:   make(map[string]int64),
+		Gauges:   make(map[string]float64),
+		Timings:  make(map[string][]float64),
+	}
+}
+
+func (m *MemoryMetrics) Increment(bucket string, tags ...Tag) {
+	m.Count(bucket, 1, tags...)
+}
+
+func (m *MemoryMetrics) Count(bucket string, n int64, tags ...Tag) {
+	m.Lock()
+	defer m.Unlock()
+	m.Counters[bucket] += n
+	if len(tags) > 0 {
+		key := bucket
+		for _, tag := range tags {
+			key += "," + tag.Key + "=" + tag.Value
+		}
+		m.Tagged[key] += n
+	}
+}
+
+func (m *MemoryMetrics) Gauge(bucket string, value float64, tags ...Tag) {
+	m.Lock()
+	defer m.Unlock()
+	m.Gauges[bucket] = value
+}
+
+func (m *MemoryMetrics) Timing(bucket string, value float64, tags ...Tag) {
+	m.Lock()
+	defer m.Unlock()
+	m.Timings[bucket] = append(m.Timings[bucket], value)
+}
+
+// Counter returns the sum over all tags
+func (m *MemoryMetrics) Counter(bucket string) int64 {
+	m.Lock()
+	defer m.Unlock()
+	return m.Counters[bucket]
+}
+
+func (m *MemoryMetrics) Flush() {}
+func (m *MemoryMetrics) Close() {}
+
+// NopMetrics discards everything
+type NopMetrics struct{}
+
+func (NopMetrics) Increment(bucket string, tags ...Tag)             {}
+func (NopMetrics) Count(bucket string, n int64, tags ...Tag)        {}
+func (NopMetrics) Gauge(bucket string, value float64, tags ...Tag)  {}
+func (NopMetrics) Timing(bucket string, value float64, tags ...Tag) {}
+func (NopMetrics) Flush()                                           {}
+func (NopMetrics) Close()                                           {}
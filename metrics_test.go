@@ -0,0 +1,84 @@
+package tcapflow
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Send a few metrics to a local socket and return the lines received
+func sendLines(t *testing.T, backend string) []string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	m, err := NewMetrics(backend, conn.LocalAddr().String(), "pre", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Increment("a.b", Tag{"op", "2"})
+	m.Count("a.b", 2, Tag{"op", "2"})
+	m.Gauge("g", 3.5)
+	m.Timing("lat", 12, Tag{"ssn", "6"}, Tag{"op", "x y"})
+	m.Close()
+
+	buf := make([]byte, 2000)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(buf[:n]), "\n")
+	sort.Strings(lines)
+	return lines
+}
+
+func TestDogStatsdLines(t *testing.T) {
+	lines := sendLines(t, MetricsDogStatsd)
+	want := []string{"pre.a.b:3|c|#op:2", "pre.g:3.5|g", "pre.lat:12|ms|#ssn:6,op:x y"}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", lines, want)
+	}
+}
+
+func TestInfluxLines(t *testing.T) {
+	lines := sendLines(t, MetricsInflux)
+	if len(lines) != 3 {
+		t.Fatalf("got %q", lines)
+	}
+	if lines[0] != "pre.a.b,op=2 count=3i" || lines[1] != "pre.g gauge=3.5" {
+		t.Errorf("got %q", lines)
+	}
+	// Sorted tags and the time of the timing
+	if !strings.HasPrefix(lines[2], `pre.lat,op=x\ y,ssn=6 timing=12 `) {
+		t.Errorf("got %q", lines[2])
+	}
+}
+
+func TestMetricsFlushInterval(t *testing.T) {
+	for _, backend := range []string{MetricsStatsd, MetricsDogStatsd, MetricsInflux} {
+		if _, err := NewMetrics(backend, "127.0.0.1:1", "", 0); err == nil {
+			t.Errorf("%v accepted a flush interval of 0", backend)
+		}
+	}
+	if _, err := NewMetrics(MetricsNone, "", "", 0); err != nil {
+		t.Errorf("none: %v", err)
+	}
+	if _, err := NewMetrics("graphite", "", "", time.Second); err == nil {
+		t.Errorf("accepted an unknown backend")
+	}
+}
+
+func TestMemoryMetrics(t *testing.T) {
+	m := NewMemoryMetrics()
+	m.Increment("a", Tag{"op", "2"})
+	m.Count("a", 2, Tag{"op", "3"})
+	m.Timing("lat", 5)
+	if m.Counter("a") != 3 || m.Tagged["a,op=3"] != 2 || len(m.Timings["lat"]) != 1 {
+		t.Errorf("got %v %v %v", m.Counters, m.Tagged, m.Timings)
+	}
+}
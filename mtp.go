@@ -13,15 +13,22 @@ type MTPL3 struct {
 	Routing [4]uint8
 }
 
-func handleMTP(handler DataHandler, data []uint8, packet gopacket.Packet) {
+func handleMTP(handler DataHandler, msg *Message, data []uint8, packet gopacket.Packet) {
 	mtpl3 := MTPL3{}
 	buf := bytes.NewReader(data)
 	err := binary.Read(buf, binary.BigEndian, &mtpl3)
 	if err != nil {
-		fmt.Printf("Failed MTP: %v\n", err)
+		handler.ParseError(data, fmt.Errorf("MTP: %v", err))
 		return
 	}
 	if (mtpl3.Service & 0x0f) == 0x03 {
-		handleSCCP(handler, data[5:], packet)
+		// ITU routing label with 14 bit point codes
+		label := binary.LittleEndian.Uint32(mtpl3.Routing[:])
+		msg.DPC = label & 0x3fff
+		msg.OPC = (label >> 14) & 0x3fff
+		msg.SLS = uint8(label >> 28)
+		msg.SI = mtpl3.Service & 0x0f
+		msg.NI = mtpl3.Service >> 6
+		handleSCCP(handler, msg, data[5:], packet)
 	}
 }
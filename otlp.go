@@ -0,0 +1,256 @@
+package tcapflow
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Attribute of a span. Value is a string or an int.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+type Span struct {
+	TraceID    [16]byte
+	SpanID     [8]byte
+	ParentID   [8]byte // Zero for the root span
+	Name       string
+	Start      time.Time
+	End        time.Time
+	Attributes []Attribute
+	Error      bool
+}
+
+func NewTraceID() (id [16]byte) {
+	rand.Read(id[:])
+	return
+}
+
+func NewSpanID() (id [8]byte) {
+	rand.Read(id[:])
+	return
+}
+
+// OTLP/JSON encoding of the trace service request
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            struct {
+		Code int `json:"code"`
+	} `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusOk         = 1
+	otlpStatusError      = 2
+)
+
+func otlpAttributes(attrs []Attribute) []otlpAttribute {
+	out := make([]otlpAttribute, 0, len(attrs))
+	for _, attr := range attrs {
+		var value string
+		a := otlpAttribute{Key: attr.Key}
+		switch v := attr.Value.(type) {
+		case int:
+			value = strconv.Itoa(v)
+			a.Value.IntValue = &value
+		default:
+			value = fmt.Sprint(v)
+			a.Value.StringValue = &value
+		}
+		out = append(out, a)
+	}
+	return out
+}
+
+func otlpEncode(service string, spans []Span) ([]byte, error) {
+	scope := otlpScopeSpans{}
+	scope.Scope.Name = "github.com/moiji-mobile/tcapflow"
+	for _, span := range spans {
+		s := otlpSpan{
+			TraceID:           hex.EncodeToString(span.TraceID[:]),
+			SpanID:            hex.EncodeToString(span.SpanID[:]),
+			Name:              span.Name,
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(span.Attributes),
+		}
+		if span.ParentID != ([8]byte{}) {
+			s.ParentSpanID = hex.EncodeToString(span.ParentID[:])
+		}
+		s.Status.Code = otlpStatusOk
+		if span.Error {
+			s.Status.Code = otlpStatusError
+		}
+		scope.Spans = append(scope.Spans, s)
+	}
+
+	resource := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scope}}
+	resource.Resource.Attributes = otlpAttributes([]Attribute{{Key: "service.name", Value: service}})
+	return json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{resource}})
+}
+
+// OTLPExporter posts spans as OTLP/HTTP JSON to a collector, e.g.
+// http://localhost:4318/v1/traces. Spans are batched and sent in the
+// background. When the collector is too slow spans are dropped. A zero
+// interval only sends full batches and the rest on Close.
+type OTLPExporter struct {
+	Endpoint    string
+	ServiceName string
+	MaxPending  int
+	BatchSize   int
+	Client      *http.Client
+
+	// Spans that could not be sent
+	Dropped uint64
+
+	mu      sync.Mutex
+	pending []Span
+	wakeup  chan struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func NewOTLPExporter(endpoint, service string, interval time.Duration) *OTLPExporter {
+	e := &OTLPExporter{
+		Endpoint:    endpoint,
+		ServiceName: service,
+		MaxPending:  100000,
+		BatchSize:   512,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		wakeup:      make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+	e.wg.Add(1)
+	go e.run(interval)
+	return e
+}
+
+func (e *OTLPExporter) Export(spans ...Span) {
+	e.mu.Lock()
+	room := e.MaxPending - len(e.pending)
+	if room < len(spans) {
+		atomic.AddUint64(&e.Dropped, uint64(len(spans)-room))
+		if room < 0 {
+			room = 0
+		}
+		spans = spans[:room]
+	}
+	e.pending = append(e.pending, spans...)
+	full := len(e.pending) >= e.BatchSize
+	e.mu.Unlock()
+
+	if full {
+		select {
+		case e.wakeup <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (e *OTLPExporter) run(interval time.Duration) {
+	defer e.wg.Done()
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-tick:
+		case <-e.wakeup:
+		case <-e.done:
+			e.send()
+			return
+		}
+		e.send()
+	}
+}
+
+func (e *OTLPExporter) send() {
+	for {
+		e.mu.Lock()
+		batch := e.pending
+		if len(batch) > e.BatchSize {
+			batch = batch[:e.BatchSize]
+		}
+		e.pending = e.pending[len(batch):]
+		e.mu.Unlock()
+		if len(batch) == 0 {
+			return
+		}
+		err := e.post(batch)
+		if err != nil {
+			fmt.Printf("ERROR: OTLP export: %v\n", err)
+			atomic.AddUint64(&e.Dropped, uint64(len(batch)))
+		}
+	}
+}
+
+func (e *OTLPExporter) post(spans []Span) error {
+	body, err := otlpEncode(e.ServiceName, spans)
+	if err != nil {
+		return err
+	}
+	resp, err := e.Client.Post(e.Endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%v: %v", e.Endpoint, resp.Status)
+	}
+	return nil
+}
+
+// Close sends the pending spans
+func (e *OTLPExporter) Close() {
+	close(e.done)
+	e.wg.Wait()
+}
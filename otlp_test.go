@@ -0,0 +1,142 @@
+package tcapflow
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOTLPEncode(t *testing.T) {
+	span := Span{
+		TraceID:    [16]byte{1},
+		SpanID:     [8]byte{2},
+		Name:       "TCAP dialogue",
+		Start:      time.Unix(1, 0),
+		End:        time.Unix(2, 0),
+		Attributes: []Attribute{{"tcap.otid", "cafe"}, {"tcap.operation", 2}},
+		Error:      true,
+	}
+	child := span
+	child.ParentID, child.SpanID, child.Error = span.SpanID, [8]byte{3}, false
+	data, err := otlpEncode("test", []Span{span, child})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var request otlpRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		t.Fatal(err)
+	}
+	resource := request.ResourceSpans[0]
+	if *resource.Resource.Attributes[0].Value.StringValue != "test" {
+		t.Errorf("resource %s", data)
+	}
+	spans := resource.ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("spans %s", data)
+	}
+	s := spans[0]
+	if s.TraceID != "01000000000000000000000000000000" || s.SpanID != "0200000000000000" || s.ParentSpanID != "" ||
+		s.StartTimeUnixNano != "1000000000" || s.EndTimeUnixNano != "2000000000" || s.Status.Code != otlpStatusError {
+		t.Errorf("root span %+v", s)
+	}
+	if *s.Attributes[0].Value.StringValue != "cafe" || *s.Attributes[1].Value.IntValue != "2" {
+		t.Errorf("attributes %s", data)
+	}
+	if spans[1].ParentSpanID != "0200000000000000" || spans[1].Status.Code != otlpStatusOk {
+		t.Errorf("child span %+v", spans[1])
+	}
+}
+
+// A collector that counts the spans posted to it
+type testCollector struct {
+	*httptest.Server
+	mu     sync.Mutex
+	posts  int
+	spans  int
+	status int
+}
+
+func newTestCollector() *testCollector {
+	c := &testCollector{status: http.StatusOK}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var request otlpRequest
+		json.Unmarshal(body, &request)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.posts++
+		c.spans += len(request.ResourceSpans[0].ScopeSpans[0].Spans)
+		w.WriteHeader(c.status)
+	}))
+	return c
+}
+
+func (c *testCollector) counts() (posts, spans int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.posts, c.spans
+}
+
+func TestOTLPExporterBatches(t *testing.T) {
+	collector := newTestCollector()
+	defer collector.Close()
+
+	// Without an interval only full batches are sent before Close
+	e := NewOTLPExporter(collector.URL, "test", 0)
+	e.BatchSize = 2
+	e.Export(Span{Name: "a"})
+	time.Sleep(20 * time.Millisecond)
+	if posts, _ := collector.counts(); posts != 0 {
+		t.Errorf("%d posts before the batch was full", posts)
+	}
+	e.Export(Span{Name: "b"}, Span{Name: "c"})
+	for i := 0; i < 100; i++ {
+		if posts, _ := collector.counts(); posts > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	e.Close()
+	if posts, spans := collector.counts(); posts != 2 || spans != 3 {
+		t.Errorf("%d posts of %d spans", posts, spans)
+	}
+}
+
+func TestOTLPExporterInterval(t *testing.T) {
+	collector := newTestCollector()
+	defer collector.Close()
+
+	e := NewOTLPExporter(collector.URL, "test", 10*time.Millisecond)
+	defer e.Close()
+	e.Export(Span{Name: "a"})
+	for i := 0; i < 100; i++ {
+		if _, spans := collector.counts(); spans == 1 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("span not sent within the interval")
+}
+
+func TestOTLPExporterDrops(t *testing.T) {
+	collector := newTestCollector()
+	defer collector.Close()
+	collector.status = http.StatusServiceUnavailable
+
+	e := NewOTLPExporter(collector.URL, "test", time.Hour)
+	e.MaxPending = 2
+	e.Export(Span{Name: "a"}, Span{Name: "b"}, Span{Name: "c"})
+	if n := atomic.LoadUint64(&e.Dropped); n != 1 {
+		t.Errorf("%d dropped when full", n)
+	}
+	e.Close()
+	if n := atomic.LoadUint64(&e.Dropped); n != 3 {
+		t.Errorf("%d dropped after the collector failed", n)
+	}
+}
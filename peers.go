@@ -0,0 +1,71 @@
+package tcapflow
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type peerPartner struct {
+	prefix string
+	name   string
+}
+
+// PeerLabels turns a global title into a label of low cardinality. Known
+// partners are named by the longest matching prefix, other numbers are
+// cut to PrefixLength digits.
+type PeerLabels struct {
+	PrefixLength int
+	partners     []peerPartner
+}
+
+func (p *PeerLabels) AddPartner(prefix, name string) {
+	p.partners = append(p.partners, peerPartner{prefix: prefix, name: name})
+}
+
+func (p *PeerLabels) Label(number string) string {
+	best := -1
+	for i, partner := range p.partners {
+		if strings.HasPrefix(number, partner.prefix) &&
+			(best < 0 || len(partner.prefix) > len(p.partners[best].prefix)) {
+			best = i
+		}
+	}
+	if best >= 0 {
+		return p.partners[best].name
+	}
+	if number == "" {
+		return "unknown"
+	}
+	if p.PrefixLength > 0 && len(number) > p.PrefixLength {
+		return number[:p.PrefixLength]
+	}
+	return number
+}
+
+// LoadPartners reads lines of "<gt prefix> <name>". Empty lines and lines
+// starting with '#' are skipped.
+func (p *PeerLabels) LoadPartners(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("%v:%v: expected prefix and name", file, lineNo)
+		}
+		p.AddPartner(fields[0], fields[1])
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,387 @@
+package tcapflow
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+)
+
+// The pipeline splits the work of RunLoop into three stages. A single
+// capture goroutine reads packets and spreads them across decode workers
+// by a hash of the IP addresses. This keeps IP and SCTP reassembly of an
+// association on one worker. The workers parse up to TCAP and hand each
+// message to a dialogue shard selected by a hash of the dialogue key. All
+// messages of a dialogue end up in the same shard and each shard has a
+// handler of its own so the handlers do not need any locking.
+type PipelineConfig struct {
+	Workers   int
+	Shards    int
+	QueueSize int
+
+	// Drop packets/messages when a queue is full instead of waiting
+	DropWhenFull bool
+
+	// Read a capture file at the speed it was captured
+	RealTime bool
+
+	// Stop reading once this is closed
+	Stop <-chan struct{}
+
+	// Forget continued dialogues idle for this long. The shard of the
+	// initiator's messages is only known while they are remembered.
+	DialogueExpire time.Duration
+
+	// Periodic report of the per stage counters
+	StatsInterval time.Duration
+	Stats         func(stats PipelineStats)
+}
+
+type PipelineStageStats struct {
+	Processed   uint64 // Entries handed to the stage
+	Dropped     uint64 // Entries dropped due to a full queue
+	Blocked     uint64 // Times the previous stage had to wait
+	QueueLength int    // Entries queued right now
+}
+
+// Counters are since the last report.
+type PipelineStats struct {
+	Capture PipelineStageStats
+	Decode  PipelineStageStats
+	Shards  PipelineStageStats
+}
+
+type pipelineStage struct {
+	processed uint64
+	dropped   uint64
+	blocked   uint64
+}
+
+func (s *pipelineStage) snapshot(queueLength int) PipelineStageStats {
+	return PipelineStageStats{
+		Processed:   atomic.SwapUint64(&s.processed, 0),
+		Dropped:     atomic.SwapUint64(&s.dropped, 0),
+		Blocked:     atomic.SwapUint64(&s.blocked, 0),
+		QueueLength: queueLength,
+	}
+}
+
+const (
+	shardData = iota
+	shardParseError
+	shardIPReassembled
+	shardIPFragmentsExpired
+	shardSCCPService
+)
+
+type shardMessage struct {
+	kind      int
+	called    SCCPAddress
+	calling   SCCPAddress
+	msg       *Message
+	data      []uint8
+	packet    gopacket.Packet
+	recovered interface{}
+	count     int
+}
+
+type pipeline struct {
+	config PipelineConfig
+	handle *pcap.Handle
+
+	// The kernel drops packets when the capture stage is too slow
+	captureDropped captureDrops
+
+	workers []chan framedPacket
+	shards  []chan shardMessage
+	keys    *DialogueKeys
+
+	capture pipelineStage
+	decode  pipelineStage
+	shard   pipelineStage
+}
+
+type framedPacket struct {
+	packet gopacket.Packet
+	frame  uint64
+}
+
+// The DataHandler of a decode worker. It forwards everything to a shard.
+type shardRouter struct {
+	p      *pipeline
+	worker int
+}
+
+// All messages of a dialogue go to the shard of its TC-Begin
+func (p *pipeline) shardOf(called_gt SCCPAddress, calling_gt SCCPAddress, data []uint8, packet gopacket.Packet) int {
+	tag, otid, dtid, _, _, _ := DecodeTCAP(data)
+	key := p.keys.Key(tag, DialogueKey(calling_gt, otid.Bytes), DialogueKey(called_gt, dtid.Bytes), packet.Metadata().Timestamp)
+	return int(DialogueKeyHash(key) % uint32(len(p.shards)))
+}
+
+func (r *shardRouter) OnData(called_gt SCCPAddress, calling_gt SCCPAddress, data []uint8, packet gopacket.Packet) {
+	shard := r.p.shardOf(called_gt, calling_gt, data, packet)
+	r.p.toShard(shard, shardMessage{
+		kind:    shardData,
+		called:  called_gt,
+		calling: calling_gt,
+		data:    data,
+		packet:  packet,
+	})
+}
+
+// The decoder may reuse msg once this returns
+func (r *shardRouter) OnMessage(msg *Message, data []uint8, packet gopacket.Packet) {
+	shard := r.p.shardOf(msg.Called, msg.Calling, data, packet)
+	copied := *msg
+	r.p.toShard(shard, shardMessage{
+		kind:    shardData,
+		called:  msg.Called,
+		calling: msg.Calling,
+		msg:     &copied,
+		data:    data,
+		packet:  packet,
+	})
+}
+
+func (r *shardRouter) AfterOnePacket() {
+}
+
+// Events not belonging to a dialogue go to a shard picked by the worker.
+func (r *shardRouter) ParseError(data []uint8, recovered interface{}) {
+	r.p.toShard(r.worker%len(r.p.shards), shardMessage{
+		kind:      shardParseError,
+		data:      data,
+		recovered: recovered,
+	})
+}
+
+func (r *shardRouter) OnIPReassembled() {
+	r.p.toShard(r.worker%len(r.p.shards), shardMessage{kind: shardIPReassembled})
+}
+
+func (r *shardRouter) OnIPFragmentsExpired(count int) {
+	r.p.toShard(r.worker%len(r.p.shards), shardMessage{
+		kind:  shardIPFragmentsExpired,
+		count: count,
+	})
+}
+
+func (r *shardRouter) OnSCCPService(msg *Message, cause uint8) {
+	copied := *msg
+	r.p.toShard(r.worker%len(r.p.shards), shardMessage{
+		kind:  shardSCCPService,
+		msg:   &copied,
+		count: int(cause),
+	})
+}
+
+func (p *pipeline) toWorker(worker int, packet framedPacket) {
+	ch := p.workers[worker]
+	select {
+	case ch <- packet:
+		atomic.AddUint64(&p.decode.processed, 1)
+		return
+	default:
+	}
+
+	if p.config.DropWhenFull {
+		atomic.AddUint64(&p.decode.dropped, 1)
+		return
+	}
+	atomic.AddUint64(&p.decode.blocked, 1)
+	ch <- packet
+	atomic.AddUint64(&p.decode.processed, 1)
+}
+
+func (p *pipeline) toShard(shard int, msg shardMessage) {
+	ch := p.shards[shard]
+	select {
+	case ch <- msg:
+		atomic.AddUint64(&p.shard.processed, 1)
+		return
+	default:
+	}
+
+	if p.config.DropWhenFull {
+		atomic.AddUint64(&p.shard.dropped, 1)
+		return
+	}
+	atomic.AddUint64(&p.shard.blocked, 1)
+	ch <- msg
+	atomic.AddUint64(&p.shard.processed, 1)
+}
+
+func (p *pipeline) runWorker(worker int) {
+	router := &shardRouter{p: p, worker: worker}
+	defrag := NewIPDefragmenter()
+	sctp := NewSCTPReassembler()
+
+	for framed := range p.workers[worker] {
+		packet := defrag.Defrag(router, framed.packet)
+		if packet != nil {
+			handlePacket(router, sctp, packet, framed.frame)
+		}
+	}
+}
+
+func (p *pipeline) runShard(shard int, handler DataHandler) {
+	for msg := range p.shards[shard] {
+		switch msg.kind {
+		case shardData:
+			if msg.msg != nil {
+				deliver(handler, msg.msg, msg.data, msg.packet)
+			} else {
+				handler.OnData(msg.called, msg.calling, msg.data, msg.packet)
+			}
+		case shardParseError:
+			handler.ParseError(msg.data, msg.recovered)
+		case shardIPReassembled:
+			if h, ok := handler.(IPDefragHandler); ok {
+				h.OnIPReassembled()
+			}
+		case shardIPFragmentsExpired:
+			if h, ok := handler.(IPDefragHandler); ok {
+				h.OnIPFragmentsExpired(msg.count)
+			}
+		case shardSCCPService:
+			if h, ok := handler.(SCCPServiceHandler); ok {
+				h.OnSCCPService(msg.msg, uint8(msg.count))
+			}
+		}
+		handler.AfterOnePacket()
+	}
+}
+
+func (p *pipeline) stats() PipelineStats {
+	queued := 0
+	for _, ch := range p.workers {
+		queued += len(ch)
+	}
+	stats := PipelineStats{
+		Capture: p.capture.snapshot(0),
+		Decode:  p.decode.snapshot(queued),
+	}
+	stats.Capture.Dropped = p.captureDropped.since(p.handle)
+
+	queued = 0
+	for _, ch := range p.shards {
+		queued += len(ch)
+	}
+	stats.Shards = p.shard.snapshot(queued)
+	return stats
+}
+
+func (p *pipeline) reportStats(done chan struct{}, finished chan struct{}) {
+	ticker := time.NewTicker(p.config.StatsInterval)
+	defer ticker.Stop()
+	defer close(finished)
+	for {
+		select {
+		case <-ticker.C:
+			p.config.Stats(p.stats())
+		case <-done:
+			p.config.Stats(p.stats())
+			return
+		}
+	}
+}
+
+// RunPipeline is like RunLoop but spreads the work across several
+// goroutines. newHandler is called once per shard.
+func RunPipeline(pcapFile string, pcapDevice string, pcapFilter string, config PipelineConfig, newHandler func(shard int) DataHandler) {
+	if config.Workers < 1 {
+		config.Workers = 1
+	}
+	if config.Shards < 1 {
+		config.Shards = 1
+	}
+	if config.QueueSize < 1 {
+		config.QueueSize = 1
+	}
+	if config.StatsInterval <= 0 {
+		config.StatsInterval = 10 * time.Second
+	}
+	if config.DialogueExpire <= 0 {
+		config.DialogueExpire = 10 * time.Minute
+	}
+
+	handle, err := openHandle(pcapFile, pcapDevice, pcapFilter)
+	if err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+		return
+	}
+	defer handle.Close()
+
+	p := &pipeline{config: config, handle: handle, keys: NewDialogueKeys(config.DialogueExpire)}
+	for i := 0; i < config.Shards; i++ {
+		p.shards = append(p.shards, make(chan shardMessage, config.QueueSize))
+	}
+	for i := 0; i < config.Workers; i++ {
+		p.workers = append(p.workers, make(chan framedPacket, config.QueueSize))
+	}
+
+	var shardsDone, workersDone sync.WaitGroup
+	for i := 0; i < config.Shards; i++ {
+		shardsDone.Add(1)
+		go func(shard int, handler DataHandler) {
+			defer shardsDone.Done()
+			p.runShard(shard, handler)
+		}(i, newHandler(i))
+	}
+	for i := 0; i < config.Workers; i++ {
+		workersDone.Add(1)
+		go func(worker int) {
+			defer workersDone.Done()
+			p.runWorker(worker)
+		}(i)
+	}
+
+	statsDone := make(chan struct{})
+	statsFinished := make(chan struct{})
+	if config.Stats != nil {
+		go p.reportStats(statsDone, statsFinished)
+	} else {
+		close(statsFinished)
+	}
+
+	// Only decode enough to find the IP addresses here. The rest of the
+	// decoding happens lazily in the worker.
+	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+	packetSource.Lazy = true
+	pace := pacer{enabled: config.RealTime && len(pcapFile) > 0}
+	frame := uint64(0)
+	for !stopped(config.Stop) {
+		packet, err := packetSource.NextPacket()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			continue
+		}
+		pace.wait(packet)
+		atomic.AddUint64(&p.capture.processed, 1)
+		frame++
+
+		worker := 0
+		if net := packet.NetworkLayer(); net != nil {
+			worker = int(net.NetworkFlow().FastHash() % uint64(len(p.workers)))
+		}
+		p.toWorker(worker, framedPacket{packet: packet, frame: frame})
+	}
+
+	for _, ch := range p.workers {
+		close(ch)
+	}
+	workersDone.Wait()
+	for _, ch := range p.shards {
+		close(ch)
+	}
+	shardsDone.Wait()
+
+	close(statsDone)
+	<-statsFinished
+}
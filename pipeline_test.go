@@ -0,0 +1,136 @@
+package tcapflow
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	testInitiator = "4912345"
+	testResponder = "4970000"
+)
+
+func tid(prefix byte, i int) []byte {
+	return []byte{prefix, byte(i >> 16), byte(i >> 8), byte(i)}
+}
+
+// Dialogues with a TC-Continue from each side before the initiator ends
+// them. The initiator addresses the responder by its own TID.
+func writeContinuedDialogues(t *testing.T, name string, count int) {
+	c := newTestCapture(t, name)
+	defer c.close()
+	at := time.Unix(1000, 0)
+	for i := 0; i < count; i++ {
+		a, b := tid(0xa, i), tid(0xb, i)
+		c.add(at, testResponder, testInitiator, testTCAP(TCbeginApp, a, nil, testInvoke(59)))
+		c.add(at.Add(time.Millisecond), testInitiator, testResponder, testTCAP(TCcontinueApp, b, a, testInvoke(60)))
+		c.add(at.Add(2*time.Millisecond), testResponder, testInitiator, testTCAP(TCcontinueApp, a, b, testResultLast()))
+		c.add(at.Add(3*time.Millisecond), testResponder, testInitiator, testTCAP(TCendApp, nil, b, testResultLast()))
+		at = at.Add(time.Millisecond)
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "tcapflow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestRunLoop(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "dialogues.pcap")
+	writeContinuedDialogues(t, name, 10)
+
+	handler := &recordingHandler{}
+	var reports []PipelineStageStats
+	config := LoopConfig{Stats: func(stats PipelineStageStats) { reports = append(reports, stats) }}
+	RunLoopWith(name, "", "", config, handler)
+	if len(reports) != 1 || reports[0].Processed != 40 || reports[0].Dropped != 0 {
+		t.Errorf("capture stats %+v", reports)
+	}
+	if len(handler.messages) != 40 || handler.errors != 0 || handler.packets != 40 {
+		t.Fatalf("%d messages, %d errors, %d packets", len(handler.messages), handler.errors, handler.packets)
+	}
+	first := handler.messages[0]
+	if first.calling.Number != testInitiator || first.called.Number != testResponder || !first.at.Equal(time.Unix(1000, 0)) {
+		t.Errorf("first message %+v", first)
+	}
+
+	stop := make(chan struct{})
+	close(stop)
+	handler = &recordingHandler{}
+	RunLoopWith(name, "", "", LoopConfig{Stop: stop}, handler)
+	if len(handler.messages) != 0 {
+		t.Errorf("read %d messages after the stop", len(handler.messages))
+	}
+}
+
+func TestPipelineKeepsDialoguesOnOneShard(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "dialogues.pcap")
+	const dialogues = 200
+	writeContinuedDialogues(t, name, dialogues)
+
+	var handlers []*recordingHandler
+	var reports []PipelineStats
+	config := PipelineConfig{
+		Workers:   3,
+		Shards:    8,
+		QueueSize: 4,
+		Stats:     func(stats PipelineStats) { reports = append(reports, stats) },
+	}
+	RunPipeline(name, "", "", config, func(shard int) DataHandler {
+		handler := &recordingHandler{shard: shard}
+		handlers = append(handlers, handler)
+		return handler
+	})
+
+	// Shard of each TID of both sides
+	shards := make(map[string]int)
+	total := 0
+	for _, handler := range handlers {
+		for _, msg := range handler.messages {
+			tag, otid, dtid, _, _, _ := DecodeTCAP(msg.data)
+			for _, tid := range [][]byte{otid.Bytes, dtid.Bytes} {
+				if len(tid) == 0 {
+					continue
+				}
+				if shard, ok := shards[string(tid)]; ok && shard != handler.shard {
+					t.Fatalf("%v of TID %x on shard %d and %d", TCprocName(tag), tid, shard, handler.shard)
+				}
+				shards[string(tid)] = handler.shard
+			}
+		}
+		total += len(handler.messages)
+	}
+	if total != 4*dialogues {
+		t.Errorf("%d messages", total)
+	}
+
+	used := 0
+	for _, handler := range handlers {
+		if len(handler.messages) > 0 {
+			used++
+		}
+	}
+	if used < 2 {
+		t.Errorf("only %d shards were used", used)
+	}
+	if len(reports) == 0 {
+		t.Fatal("no stats")
+	}
+	processed := uint64(0)
+	for _, stats := range reports {
+		processed += stats.Capture.Processed
+	}
+	if processed != 4*dialogues {
+		t.Errorf("captured %d packets", processed)
+	}
+}
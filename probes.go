@@ -0,0 +1,231 @@
+package tcapflow
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// ProbeStats are the counters of one probe sending to the server. Gaps
+// are sequence numbers not received, Restarts how often the sequence
+// started over.
+type ProbeStats struct {
+	Name         string    `json:"name"`
+	Messages     uint64    `json:"messages"`
+	FirstSeen    time.Time `json:"firstSeen"`
+	LastSeen     time.Time `json:"lastSeen"`
+	LastSequence uint64    `json:"lastSequence"`
+	Gaps         uint64    `json:"gaps"`
+	Restarts     uint64    `json:"restarts"`
+	Silent       bool      `json:"silent"`
+}
+
+// ClockOffset is the clock of Probe minus the clock of Reference
+type ClockOffset struct {
+	Probe     string  `json:"probe"`
+	Reference string  `json:"reference"`
+	Offset    float64 `json:"offsetMs"`
+	Samples   uint64  `json:"samples"`
+}
+
+// The minimum over the current and the previous window
+type windowMin struct {
+	start     time.Time
+	cur, prev time.Duration
+	curOk     bool
+	prevOk    bool
+	samples   uint64
+}
+
+func (w *windowMin) add(value time.Duration, now time.Time, window time.Duration) {
+	if now.Sub(w.start) > window {
+		w.prev, w.prevOk = w.cur, w.curOk
+		w.curOk = false
+		w.start = now
+	}
+	if !w.curOk || value < w.cur {
+		w.cur, w.curOk = value, true
+	}
+	w.samples++
+}
+
+func (w *windowMin) min() (time.Duration, bool) {
+	switch {
+	case w.curOk && w.prevOk && w.prev < w.cur:
+		return w.prev, true
+	case w.curOk:
+		return w.cur, true
+	}
+	return w.prev, w.prevOk
+}
+
+type probePair struct {
+	begin, end string
+}
+
+// ProbeTracker keeps the ProbeStats of all probes and estimates their
+// clock offsets. A dialogue begun at probe A and ended at probe B takes
+// at least the transit time plus the offset of B to A. The fastest
+// dialogues of both directions cancel out the transit time assuming it
+// is about the same each way.
+type ProbeTracker struct {
+	// Keep the fastest dialogues of this and the previous window
+	Window time.Duration
+
+	sync.Mutex
+	probes map[string]*ProbeStats
+	pairs  map[probePair]*windowMin
+}
+
+func NewProbeTracker(window time.Duration) *ProbeTracker {
+	return &ProbeTracker{
+		Window: window,
+		probes: make(map[string]*ProbeStats),
+		pairs:  make(map[probePair]*windowMin),
+	}
+}
+
+// Message counts a message of probe. A sequence of zero is from a probe
+// not numbering its messages. A probe sends its messages in order on one
+// stream so a lower sequence is from a restarted probe, whether or not
+// it started at one. Returns true when the probe was silent.
+func (p *ProbeTracker) Message(probe string, sequence uint64, now time.Time) bool {
+	p.Lock()
+	defer p.Unlock()
+	s, ok := p.probes[probe]
+	if !ok {
+		s = &ProbeStats{Name: probe, FirstSeen: now}
+		p.probes[probe] = s
+	}
+	s.Messages++
+	s.LastSeen = now
+	wasSilent := s.Silent
+	s.Silent = false
+
+	switch {
+	case sequence == 0:
+	case sequence > s.LastSequence:
+		if s.LastSequence > 0 {
+			s.Gaps += sequence - s.LastSequence - 1
+		}
+		s.LastSequence = sequence
+	case sequence < s.LastSequence:
+		s.Restarts++
+		s.LastSequence = sequence
+	}
+	return wasSilent
+}
+
+// Dialogue adds the latency of a dialogue begun and ended at different
+// probes at capture time now.
+func (p *ProbeTracker) Dialogue(begin, end string, latency time.Duration, now time.Time) {
+	if begin == end || len(begin) == 0 || len(end) == 0 {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	pair := probePair{begin, end}
+	w, ok := p.pairs[pair]
+	if !ok {
+		w = &windowMin{start: now}
+		p.pairs[pair] = w
+	}
+	w.add(latency, now, p.Window)
+}
+
+// Silent marks and returns the probes not seen for after
+func (p *ProbeTracker) Silent(now time.Time, after time.Duration) []string {
+	p.Lock()
+	defer p.Unlock()
+	var silent []string
+	for name, s := range p.probes {
+		if !s.Silent && now.Sub(s.LastSeen) > after {
+			s.Silent = true
+			silent = append(silent, name)
+		}
+	}
+	sort.Strings(silent)
+	return silent
+}
+
+// Stats returns the probes ordered by name
+func (p *ProbeTracker) Stats() []ProbeStats {
+	p.Lock()
+	defer p.Unlock()
+	stats := make([]ProbeStats, 0, len(p.probes))
+	for _, s := range p.probes {
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
+
+// The clock of probe minus the clock of reference. The lock needs to be
+// held.
+func (p *ProbeTracker) offset(probe, reference string) (time.Duration, uint64, bool) {
+	forward, ok1 := p.pairs[probePair{reference, probe}]
+	backward, ok2 := p.pairs[probePair{probe, reference}]
+	if !ok1 || !ok2 {
+		return 0, 0, false
+	}
+	there, ok1 := forward.min()
+	back, ok2 := backward.min()
+	if !ok1 || !ok2 {
+		return 0, 0, false
+	}
+	return (there - back) / 2, forward.samples + backward.samples, true
+}
+
+// Offset returns the clock of probe minus the clock of reference if known
+func (p *ProbeTracker) Offset(probe, reference string) (time.Duration, bool) {
+	p.Lock()
+	defer p.Unlock()
+	offset, _, ok := p.offset(probe, reference)
+	return offset, ok
+}
+
+// ClockOffsets returns an offset for each pair of probes with dialogues in
+// both directions. The reference is the probe with the lower name.
+func (p *ProbeTracker) ClockOffsets() []ClockOffset {
+	p.Lock()
+	defer p.Unlock()
+	var offsets []ClockOffset
+	for pair := range p.pairs {
+		if pair.begin > pair.end {
+			continue
+		}
+		offset, samples, ok := p.offset(pair.end, pair.begin)
+		if !ok {
+			continue
+		}
+		offsets = append(offsets, ClockOffset{
+			Probe:     pair.end,
+			Reference: pair.begin,
+			Offset:    milliseconds(offset),
+			Samples:   samples,
+		})
+	}
+	sort.Slice(offsets, func(i, j int) bool {
+		if offsets[i].Reference != offsets[j].Reference {
+			return offsets[i].Reference < offsets[j].Reference
+		}
+		return offsets[i].Probe < offsets[j].Probe
+	})
+	return offsets
+}
+
+// Merge adds the counters of the same probe reported by another server.
+// LastSequence is cleared as the probe numbers its messages per server.
+func (s *ProbeStats) Merge(other ProbeStats) {
+	s.Messages += other.Messages
+	if other.FirstSeen.Before(s.FirstSeen) {
+		s.FirstSeen = other.FirstSeen
+	}
+	if other.LastSeen.After(s.LastSeen) {
+		s.LastSeen = other.LastSeen
+	}
+	s.LastSequence = 0
+	s.Gaps += other.Gaps
+	s.Restarts += other.Restarts
+	s.Silent = s.Silent && other.Silent
+}
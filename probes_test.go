@@ -0,0 +1,95 @@
+package tcapflow
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProbeTrackerSequences(t *testing.T) {
+	p := NewProbeTracker(time.Minute)
+	now := time.Unix(1000, 0)
+	for _, sequence := range []uint64{1, 2, 5, 3, 4, 1, 2} {
+		p.Message("a", sequence, now)
+	}
+	p.Message("b", 0, now)
+
+	stats := p.Stats()
+	if len(stats) != 2 || stats[0].Name != "a" || stats[1].Name != "b" {
+		t.Fatalf("stats %+v", stats)
+	}
+	a := stats[0]
+	if a.Messages != 7 || a.Gaps != 2 || a.Restarts != 2 || a.LastSequence != 2 {
+		t.Errorf("probe a %+v", a)
+	}
+	if b := stats[1]; b.Messages != 1 || b.Gaps != 0 || b.LastSequence != 0 {
+		t.Errorf("probe b %+v", b)
+	}
+}
+
+func TestProbeTrackerSilent(t *testing.T) {
+	p := NewProbeTracker(time.Minute)
+	now := time.Unix(1000, 0)
+	p.Message("a", 0, now)
+	p.Message("b", 0, now.Add(20*time.Second))
+	if silent := p.Silent(now.Add(40*time.Second), 30*time.Second); len(silent) != 1 || silent[0] != "a" {
+		t.Errorf("silent %v", silent)
+	}
+	if silent := p.Silent(now.Add(41*time.Second), 30*time.Second); len(silent) != 0 {
+		t.Errorf("reported again %v", silent)
+	}
+	if !p.Message("a", 0, now.Add(50*time.Second)) {
+		t.Error("not sending again")
+	}
+}
+
+func TestProbeTrackerClockOffset(t *testing.T) {
+	p := NewProbeTracker(time.Minute)
+	now := time.Unix(1000, 0)
+
+	// b is 10ms ahead and the transit takes 5ms each way
+	p.Dialogue("a", "b", 15*time.Millisecond, now)
+	p.Dialogue("a", "b", 40*time.Millisecond, now)
+	if _, ok := p.Offset("b", "a"); ok {
+		t.Error("offset known from one direction")
+	}
+	p.Dialogue("b", "a", -5*time.Millisecond, now)
+	p.Dialogue("a", "a", time.Second, now)
+
+	if offset, ok := p.Offset("b", "a"); !ok || offset != 10*time.Millisecond {
+		t.Errorf("offset %v %v", offset, ok)
+	}
+	if offset, _ := p.Offset("a", "b"); offset != -10*time.Millisecond {
+		t.Errorf("reverse offset %v", offset)
+	}
+	offsets := p.ClockOffsets()
+	if len(offsets) != 1 || offsets[0].Probe != "b" || offsets[0].Reference != "a" || offsets[0].Offset != 10 || offsets[0].Samples != 3 {
+		t.Errorf("offsets %+v", offsets)
+	}
+}
+
+func TestProbeTrackerWindow(t *testing.T) {
+	p := NewProbeTracker(time.Minute)
+	now := time.Unix(1000, 0)
+	p.Dialogue("a", "b", 10*time.Millisecond, now)
+	p.Dialogue("b", "a", 10*time.Millisecond, now)
+
+	// The fastest dialogue is kept for the window after its own
+	p.Dialogue("a", "b", 30*time.Millisecond, now.Add(61*time.Second))
+	if offset, _ := p.Offset("b", "a"); offset != 0 {
+		t.Errorf("offset %v within two windows", offset)
+	}
+	p.Dialogue("a", "b", 30*time.Millisecond, now.Add(122*time.Second))
+	if offset, _ := p.Offset("b", "a"); offset != 10*time.Millisecond {
+		t.Errorf("offset %v after two windows", offset)
+	}
+}
+
+func TestProbeStatsMerge(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s := ProbeStats{Name: "a", Messages: 2, FirstSeen: now, LastSeen: now, LastSequence: 2, Gaps: 1, Silent: true}
+	s.Merge(ProbeStats{Name: "a", Messages: 3, FirstSeen: now.Add(-time.Second), LastSeen: now.Add(time.Second), LastSequence: 3, Gaps: 2, Restarts: 1})
+	if s.Messages != 5 || !s.FirstSeen.Equal(now.Add(-time.Second)) || !s.LastSeen.Equal(now.Add(time.Second)) ||
+		s.LastSequence != 0 || s.Gaps != 3 || s.Restarts != 1 || s.Silent {
+		t.Errorf("merged %+v", s)
+	}
+}
@@ -0,0 +1,220 @@
+package tcapflow
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A small registry for the Prometheus text exposition format. Metrics
+// are declared once and then updated with a set of labels.
+type Labels map[string]string
+
+const (
+	promCounter   = "counter"
+	promGauge     = "gauge"
+	promHistogram = "histogram"
+)
+
+// Upper bounds in seconds for response latencies
+var LatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300, 600}
+
+type promSeries struct {
+	labels Labels
+	value  float64
+
+	// Histograms only
+	buckets []uint64
+	count   uint64
+}
+
+type promMetric struct {
+	name    string
+	help    string
+	kind    string
+	buckets []float64
+	series  map[string]*promSeries
+}
+
+type PrometheusRegistry struct {
+	sync.Mutex
+	metrics map[string]*promMetric
+}
+
+func NewPrometheusRegistry() *PrometheusRegistry {
+	return &PrometheusRegistry{
+		metrics: make(map[string]*promMetric),
+	}
+}
+
+func (r *PrometheusRegistry) declare(name, help, kind string, buckets []float64) {
+	r.Lock()
+	defer r.Unlock()
+	r.metrics[name] = &promMetric{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		buckets: buckets,
+		series:  make(map[string]*promSeries),
+	}
+}
+
+func (r *PrometheusRegistry) NewCounter(name, help string) {
+	r.declare(name, help, promCounter, nil)
+}
+
+func (r *PrometheusRegistry) NewGauge(name, help string) {
+	r.declare(name, help, promGauge, nil)
+}
+
+func (r *PrometheusRegistry) NewHistogram(name, help string, buckets []float64) {
+	r.declare(name, help, promHistogram, buckets)
+}
+
+func escapeLabel(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	return strings.Replace(value, "\n", `\n`, -1)
+}
+
+func formatLabels(labels Labels, extra ...string) string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys)+len(extra)/2)
+	for _, key := range keys {
+		parts = append(parts, key+`="`+escapeLabel(labels[key])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		parts = append(parts, extra[i]+`="`+extra[i+1]+`"`)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// The registry lock needs to be held
+func (r *PrometheusRegistry) series(name string, labels Labels) *promSeries {
+	metric, ok := r.metrics[name]
+	if !ok {
+		return nil
+	}
+	key := formatLabels(labels)
+	series, ok := metric.series[key]
+	if !ok {
+		copied := make(Labels, len(labels))
+		for k, v := range labels {
+			copied[k] = v
+		}
+		series = &promSeries{labels: copied}
+		if metric.kind == promHistogram {
+			series.buckets = make([]uint64, len(metric.buckets))
+		}
+		metric.series[key] = series
+	}
+	return series
+}
+
+// Add increments a counter (or gauge)
+func (r *PrometheusRegistry) Add(name string, labels Labels, value float64) {
+	r.Lock()
+	defer r.Unlock()
+	if series := r.series(name, labels); series != nil {
+		series.value += value
+	}
+}
+
+func (r *PrometheusRegistry) Set(name string, labels Labels, value float64) {
+	r.Lock()
+	defer r.Unlock()
+	if series := r.series(name, labels); series != nil {
+		series.value = value
+	}
+}
+
+func (r *PrometheusRegistry) Observe(name string, labels Labels, value float64) {
+	r.Lock()
+	defer r.Unlock()
+	series := r.series(name, labels)
+	if series == nil {
+		return
+	}
+	metric := r.metrics[name]
+	for i, bound := range metric.buckets {
+		if value <= bound {
+			series.buckets[i]++
+		}
+	}
+	series.count++
+	series.value += value
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Write all metrics in the text exposition format
+func (r *PrometheusRegistry) WriteTo(buf *bytes.Buffer) {
+	r.Lock()
+	defer r.Unlock()
+
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		metric := r.metrics[name]
+		fmt.Fprintf(buf, "# HELP %s %s\n", name, metric.help)
+		fmt.Fprintf(buf, "# TYPE %s %s\n", name, metric.kind)
+
+		keys := make([]string, 0, len(metric.series))
+		for key := range metric.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			series := metric.series[key]
+			if metric.kind != promHistogram {
+				fmt.Fprintf(buf, "%s%s %s\n", name, key, formatFloat(series.value))
+				continue
+			}
+			for i, bound := range metric.buckets {
+				fmt.Fprintf(buf, "%s_bucket%s %d\n", name,
+					formatLabels(series.labels, "le", formatFloat(bound)), series.buckets[i])
+			}
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", name, formatLabels(series.labels, "le", "+Inf"), series.count)
+			fmt.Fprintf(buf, "%s_sum%s %s\n", name, key, formatFloat(series.value))
+			fmt.Fprintf(buf, "%s_count%s %d\n", name, key, series.count)
+		}
+	}
+}
+
+func (r *PrometheusRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var buf bytes.Buffer
+	r.WriteTo(&buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+// ServePrometheus exposes the registry on /metrics of address.
+func ServePrometheus(address string, r *PrometheusRegistry) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r)
+	go func() {
+		err := http.ListenAndServe(address, mux)
+		if err != nil {
+			fmt.Printf("ERROR: metrics listener: %v\n", err)
+		}
+	}()
+}
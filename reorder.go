@@ -0,0 +1,227 @@
+package tcapflow
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+	"time"
+)
+
+type reorderItem struct {
+	capt     time.Time
+	arrived  time.Time
+	order    uint64
+	value    interface{}
+	released bool
+}
+
+// Ordered by capture time and then by arrival
+type reorderHeap []*reorderItem
+
+func (h reorderHeap) Len() int { return len(h) }
+func (h reorderHeap) Less(i, j int) bool {
+	if h[i].capt.Equal(h[j].capt) {
+		return h[i].order < h[j].order
+	}
+	return h[i].capt.Before(h[j].capt)
+}
+func (h reorderHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *reorderHeap) Push(x interface{}) { *h = append(*h, x.(*reorderItem)) }
+func (h *reorderHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+type probeWatermark struct {
+	watermark   time.Time // Latest capture time
+	lastArrival time.Time
+}
+
+// ReorderBuffer releases messages in capture time order. Each probe sends
+// its messages about in capture order so the latest capture time of a
+// probe is its watermark. A message is released once the watermarks of
+// all probes passed it. Probes that sent nothing for MaxDelay are idle
+// and do not hold back the others. No message is held longer than
+// MaxDelay or beyond MaxSize messages.
+type ReorderBuffer struct {
+	MaxDelay time.Duration
+	MaxSize  int
+
+	// Process is called with the buffer locked for each released value in
+	// the order of release. It returns the lock of the state the value
+	// changes and run to change it. The lock is taken before the buffer is
+	// unlocked and held while run is called. Values sharing a lock are
+	// processed in release order, also when added concurrently, and the
+	// others do not wait for them.
+	Process func(value interface{}) (lock sync.Locker, run func())
+
+	sync.Mutex
+	items    reorderHeap
+	arrivals []*reorderItem // In arrival order to find the overdue
+	probes   map[string]*probeWatermark
+	released time.Time // Capture time of the latest released message
+	order    uint64
+	late     uint64
+}
+
+func NewReorderBuffer(maxDelay time.Duration, maxSize int, process func(value interface{}) (sync.Locker, func())) *ReorderBuffer {
+	return &ReorderBuffer{
+		MaxDelay: maxDelay,
+		MaxSize:  maxSize,
+		Process:  process,
+		probes:   make(map[string]*probeWatermark),
+	}
+}
+
+// The lowest watermark of the active probes. The lock needs to be held.
+func (b *ReorderBuffer) watermark(now time.Time) (time.Time, bool) {
+	var low time.Time
+	found := false
+	for _, probe := range b.probes {
+		if now.Sub(probe.lastArrival) >= b.MaxDelay {
+			continue
+		}
+		if !found || probe.watermark.Before(low) {
+			low = probe.watermark
+			found = true
+		}
+	}
+	return low, found
+}
+
+// Pop what can be released in capture time order. The lock needs to be
+// held.
+func (b *ReorderBuffer) release(now time.Time) []interface{} {
+	// Everything captured up to an overdue message may go
+	var forced time.Time
+	for len(b.arrivals) > 0 {
+		item := b.arrivals[0]
+		if !item.released && now.Sub(item.arrived) < b.MaxDelay {
+			break
+		}
+		if !item.released && item.capt.After(forced) {
+			forced = item.capt
+		}
+		b.arrivals[0] = nil
+		b.arrivals = b.arrivals[1:]
+	}
+
+	watermark, active := b.watermark(now)
+	var ready []interface{}
+	for len(b.items) > 0 {
+		item := b.items[0]
+		release := !active || !item.capt.After(watermark) || !item.capt.After(forced) ||
+			(b.MaxSize > 0 && len(b.items) > b.MaxSize)
+		if !release {
+			break
+		}
+		heap.Pop(&b.items)
+		item.released = true
+		if item.capt.After(b.released) {
+			b.released = item.capt
+		}
+		ready = append(ready, item.value)
+	}
+	return ready
+}
+
+// Process the released values and then unlock. Their locks are taken
+// before the buffer is unlocked so a later release of the same lock waits
+// for this one to be processed.
+func (b *ReorderBuffer) process(ready []interface{}) {
+	held := make(map[sync.Locker]bool)
+	runs := make([]func(), 0, len(ready))
+	for _, value := range ready {
+		lock, run := b.Process(value)
+		if !held[lock] {
+			lock.Lock()
+			held[lock] = true
+		}
+		runs = append(runs, run)
+	}
+	b.Unlock()
+
+	for _, run := range runs {
+		run()
+	}
+	for lock := range held {
+		lock.Unlock()
+	}
+}
+
+// Add buffers value captured at capt by probe and processes the values
+// that are due now, oldest first. A value captured before already
+// released ones is late. It is processed right away and Add returns how
+// late it is.
+func (b *ReorderBuffer) Add(probe string, capt, now time.Time, value interface{}) time.Duration {
+	b.Lock()
+
+	p, ok := b.probes[probe]
+	if !ok {
+		p = &probeWatermark{watermark: capt}
+		b.probes[probe] = p
+	}
+	p.lastArrival = now
+	if capt.After(p.watermark) {
+		p.watermark = capt
+	}
+
+	if capt.Before(b.released) {
+		b.late++
+		late := b.released.Sub(capt)
+		b.process(append([]interface{}{value}, b.release(now)...))
+		return late
+	}
+
+	b.order++
+	item := &reorderItem{capt: capt, arrived: now, order: b.order, value: value}
+	heap.Push(&b.items, item)
+	b.arrivals = append(b.arrivals, item)
+	b.process(b.release(now))
+	return 0
+}
+
+// Flush processes the values that are due by now
+func (b *ReorderBuffer) Flush(now time.Time) {
+	b.Lock()
+	b.process(b.release(now))
+}
+
+// Len is the number of buffered messages
+func (b *ReorderBuffer) Len() int {
+	b.Lock()
+	defer b.Unlock()
+	return len(b.items)
+}
+
+// Late is the number of messages that arrived after later ones were
+// released
+func (b *ReorderBuffer) Late() uint64 {
+	b.Lock()
+	defer b.Unlock()
+	return b.late
+}
+
+type ProbeWatermark struct {
+	Probe     string    `json:"probe"`
+	Watermark time.Time `json:"watermark"`
+	Idle      bool      `json:"idle"`
+}
+
+// Watermarks returns the watermark of each probe ordered by name
+func (b *ReorderBuffer) Watermarks(now time.Time) []ProbeWatermark {
+	b.Lock()
+	defer b.Unlock()
+	watermarks := make([]ProbeWatermark, 0, len(b.probes))
+	for name, probe := range b.probes {
+		watermarks = append(watermarks, ProbeWatermark{
+			Probe:     name,
+			Watermark: probe.watermark,
+			Idle:      now.Sub(probe.lastArrival) >= b.MaxDelay,
+		})
+	}
+	sort.Slice(watermarks, func(i, j int) bool { return watermarks[i].Probe < watermarks[j].Probe })
+	return watermarks
+}
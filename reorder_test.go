@@ -0,0 +1,169 @@
+package tcapflow
+
+import (
+	"reflect"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A buffer keeping what it processed under a single lock
+type testReorder struct {
+	*ReorderBuffer
+	sync.Mutex
+	processed []interface{}
+}
+
+func newTestReorder(maxDelay time.Duration, maxSize int) *testReorder {
+	r := &testReorder{}
+	r.ReorderBuffer = NewReorderBuffer(maxDelay, maxSize, func(value interface{}) (sync.Locker, func()) {
+		return &r.Mutex, func() { r.processed = append(r.processed, value) }
+	})
+	return r
+}
+
+// Take what was processed since the last call
+func (r *testReorder) take() []interface{} {
+	processed := r.processed
+	r.processed = nil
+	return processed
+}
+
+func TestReorderBufferWaitsForAllProbes(t *testing.T) {
+	b := newTestReorder(time.Second, 0)
+	capt := time.Unix(1000, 0)
+	now := time.Unix(2000, 0)
+	at := func(ms int) time.Time { return capt.Add(time.Duration(ms) * time.Millisecond) }
+
+	b.Add("a", at(10), now, "a10")
+	if ready := b.take(); len(ready) != 1 {
+		t.Fatalf("a single probe released %v", ready)
+	}
+	b.Add("b", at(5), now, "b5")
+	b.Add("a", at(30), now, "a30")
+	if ready := b.take(); !reflect.DeepEqual(ready, []interface{}{"b5"}) {
+		t.Errorf("released %v", ready)
+	}
+	b.Add("b", at(20), now, "b20")
+	if ready := b.take(); !reflect.DeepEqual(ready, []interface{}{"b20"}) || b.Len() != 1 {
+		t.Errorf("released %v, %d held", ready, b.Len())
+	}
+	b.Add("b", at(40), now, "b40")
+	if ready := b.take(); !reflect.DeepEqual(ready, []interface{}{"a30"}) {
+		t.Errorf("released %v", ready)
+	}
+
+	// b is held back by a until it is idle
+	b.Flush(now.Add(500 * time.Millisecond))
+	if ready := b.take(); len(ready) != 0 {
+		t.Errorf("flushed %v", ready)
+	}
+	b.Flush(now.Add(time.Second))
+	if ready := b.take(); !reflect.DeepEqual(ready, []interface{}{"b40"}) {
+		t.Errorf("flushed %v", ready)
+	}
+
+	watermarks := b.Watermarks(now.Add(time.Second))
+	if len(watermarks) != 2 || !watermarks[0].Idle || !watermarks[1].Watermark.Equal(at(40)) {
+		t.Errorf("watermarks %+v", watermarks)
+	}
+}
+
+func TestReorderBufferLateMessages(t *testing.T) {
+	b := newTestReorder(time.Second, 0)
+	capt := time.Unix(1000, 0)
+	now := time.Unix(2000, 0)
+	b.Add("a", capt.Add(time.Second), now, "first")
+	b.take()
+	late := b.Add("a", capt, now, "late")
+	if ready := b.take(); !reflect.DeepEqual(ready, []interface{}{"late"}) || late != time.Second || b.Late() != 1 {
+		t.Errorf("released %v %v late, %d late", ready, late, b.Late())
+	}
+}
+
+func TestReorderBufferMaxSize(t *testing.T) {
+	b := newTestReorder(time.Hour, 2)
+	capt := time.Unix(1000, 0)
+	now := time.Unix(2000, 0)
+
+	// a holds back everything b sends after it
+	b.Add("a", capt, now, 0)
+	for i := 1; i < 5; i++ {
+		b.Add("b", capt.Add(time.Duration(i)*time.Millisecond), now, i)
+	}
+	if released := b.take(); !reflect.DeepEqual(released, []interface{}{0, 1, 2}) || b.Len() != 2 {
+		t.Errorf("released %v, %d held", released, b.Len())
+	}
+}
+
+// Messages added concurrently are processed in capture time order
+func TestReorderBufferConcurrentProducers(t *testing.T) {
+	capt := time.Unix(1000, 0)
+	now := time.Unix(2000, 0)
+	var processed []time.Time
+	var lock sync.Mutex
+	b := NewReorderBuffer(time.Hour, 0, func(value interface{}) (sync.Locker, func()) {
+		return &lock, func() {
+			processed = append(processed, value.(time.Time))
+			// Give the other producers a chance to overtake
+			runtime.Gosched()
+		}
+	})
+
+	// Known to the buffer before they send concurrently
+	probes := []string{"a", "b", "c", "d"}
+	for _, probe := range probes {
+		b.Add(probe, capt.Add(-time.Second), now, capt.Add(-time.Second))
+	}
+
+	var wg sync.WaitGroup
+	for n, probe := range probes {
+		wg.Add(1)
+		go func(n int, probe string) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				at := capt.Add(time.Duration(i*len(probes)+n) * time.Millisecond)
+				b.Add(probe, at, now, at)
+			}
+		}(n, probe)
+	}
+	wg.Wait()
+	b.Flush(now.Add(time.Hour))
+
+	if len(processed) != 2004 || b.Late() != 0 {
+		t.Fatalf("processed %d, %d late", len(processed), b.Late())
+	}
+	for i := 1; i < len(processed); i++ {
+		if processed[i].Before(processed[i-1]) {
+			t.Fatalf("processed %v after %v", processed[i], processed[i-1])
+		}
+	}
+}
+
+// Values of another lock do not wait for those being processed
+func TestReorderBufferLocksPerValue(t *testing.T) {
+	capt := time.Unix(1000, 0)
+	now := time.Unix(2000, 0)
+	var a, b sync.Mutex
+	bDone := make(chan struct{})
+	buffer := NewReorderBuffer(time.Hour, 0, func(value interface{}) (sync.Locker, func()) {
+		if value == "a" {
+			return &a, func() { <-bDone }
+		}
+		return &b, func() { close(bDone) }
+	})
+
+	aDone := make(chan struct{})
+	go func() {
+		buffer.Add("probe", capt, now, "a")
+		close(aDone)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	buffer.Add("probe", capt.Add(time.Millisecond), now, "b")
+	select {
+	case <-aDone:
+	case <-time.After(time.Second):
+		t.Fatal("a waits for b")
+	}
+}
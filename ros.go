@@ -5,14 +5,21 @@ import (
 )
 
 const (
-	ROSInvoke = 1
-	ROSResult = 2
+	ROSInvoke        = 1
+	ROSResult        = 2
+	ROSError         = 3
+	ROSReject        = 4
+	rosResultNotLast = 7
 )
 
 type ROSInfo struct {
 	Type     int
 	InvokeId int
 	OpCode   int
+
+	// Local error code of a ReturnError or the problem of a Reject.
+	// Global error codes are -1.
+	ErrorCode int
 }
 
 func decodeInvoke(data []byte) (info ROSInfo, err error) {
@@ -34,6 +41,45 @@ func decodeResult(data []byte) (info ROSInfo, err error) {
 	return
 }
 
+func decodeError(data []byte) (info ROSInfo, err error) {
+	info.Type = ROSError
+	info.OpCode = -1
+
+	data, err = asn1.Unmarshal(data, &info.InvokeId)
+	if err != nil {
+		return
+	}
+	_, err = asn1.Unmarshal(data, &info.ErrorCode)
+	if err != nil {
+		info.ErrorCode = -1
+		err = nil
+	}
+	return
+}
+
+func decodeReject(data []byte) (info ROSInfo, err error) {
+	info.Type = ROSReject
+	info.OpCode = -1
+
+	// The invoke id might be NULL
+	var invokeId, problem asn1.RawValue
+	data, err = asn1.Unmarshal(data, &invokeId)
+	if err != nil {
+		return
+	}
+	if invokeId.Tag == asn1.TagInteger {
+		asn1.Unmarshal(invokeId.FullBytes, &info.InvokeId)
+	}
+	_, err = asn1.Unmarshal(data, &problem)
+	if err != nil {
+		return
+	}
+	for _, b := range problem.Bytes {
+		info.ErrorCode = info.ErrorCode<<8 | int(b)
+	}
+	return
+}
+
 func DecodeROS(data []byte) (infos []ROSInfo, err error) {
 	for len(data) > 0 {
 		var tmp asn1.RawValue
@@ -49,11 +95,21 @@ func DecodeROS(data []byte) (infos []ROSInfo, err error) {
 			if err == nil {
 				infos = append(infos, info)
 			}
-		case ROSResult:
+		case ROSResult, rosResultNotLast:
 			info, err := decodeResult(tmp.Bytes)
 			if err == nil {
 				infos = append(infos, info)
 			}
+		case ROSError:
+			info, err := decodeError(tmp.Bytes)
+			if err == nil {
+				infos = append(infos, info)
+			}
+		case ROSReject:
+			info, err := decodeReject(tmp.Bytes)
+			if err == nil {
+				infos = append(infos, info)
+			}
 		}
 	}
 	return
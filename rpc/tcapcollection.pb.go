@@ -12,6 +12,17 @@ It has these top-level messages:
 	SCCPAddress
 	TCAPInfo
 	ROSInfo
+	StateBatch
+	BatchAck
+	ProbeStats
+	ClockOffset
+	ServerStats
+	DialogueQuery
+	Dialogue
+	DialogueList
+	Completion
+	PathDelay
+	ResponseSummary
 */
 package rpc
 
@@ -43,6 +54,11 @@ type StateInfo struct {
 	Called  *SCCPAddress                `protobuf:"bytes,3,opt,name=called" json:"called,omitempty"`
 	Tcap    *TCAPInfo                   `protobuf:"bytes,4,opt,name=tcap" json:"tcap,omitempty"`
 	Ros     []*ROSInfo                  `protobuf:"bytes,5,rep,name=ros" json:"ros,omitempty"`
+	// Name of the probe and the number of the message at that probe
+	Probe    string `protobuf:"bytes,6,opt,name=probe" json:"probe,omitempty"`
+	Sequence uint64 `protobuf:"varint,7,opt,name=sequence" json:"sequence,omitempty"`
+	// Set when the probe matched the first response itself
+	Response *ResponseSummary `protobuf:"bytes,8,opt,name=response" json:"response,omitempty"`
 }
 
 func (m *StateInfo) Reset()                    { *m = StateInfo{} }
@@ -85,6 +101,27 @@ func (m *StateInfo) GetRos() []*ROSInfo {
 	return nil
 }
 
+func (m *StateInfo) GetProbe() string {
+	if m != nil {
+		return m.Probe
+	}
+	return ""
+}
+
+func (m *StateInfo) GetSequence() uint64 {
+	if m != nil {
+		return m.Sequence
+	}
+	return 0
+}
+
+func (m *StateInfo) GetResponse() *ResponseSummary {
+	if m != nil {
+		return m.Response
+	}
+	return nil
+}
+
 type SCCPAddress struct {
 	Ssn    uint32 `protobuf:"varint,1,opt,name=ssn" json:"ssn,omitempty"`
 	Ton    uint32 `protobuf:"varint,2,opt,name=ton" json:"ton,omitempty"`
@@ -126,9 +163,10 @@ func (m *SCCPAddress) GetNumber() string {
 }
 
 type TCAPInfo struct {
-	Otid []byte `protobuf:"bytes,1,opt,name=otid,proto3" json:"otid,omitempty"`
-	Dtid []byte `protobuf:"bytes,2,opt,name=dtid,proto3" json:"dtid,omitempty"`
-	Tag  int32  `protobuf:"varint,3,opt,name=tag" json:"tag,omitempty"`
+	Otid               []byte `protobuf:"bytes,1,opt,name=otid,proto3" json:"otid,omitempty"`
+	Dtid               []byte `protobuf:"bytes,2,opt,name=dtid,proto3" json:"dtid,omitempty"`
+	Tag                int32  `protobuf:"varint,3,opt,name=tag" json:"tag,omitempty"`
+	ApplicationContext string `protobuf:"bytes,4,opt,name=applicationContext" json:"applicationContext,omitempty"`
 }
 
 func (m *TCAPInfo) Reset()                    { *m = TCAPInfo{} }
@@ -157,6 +195,13 @@ func (m *TCAPInfo) GetTag() int32 {
 	return 0
 }
 
+func (m *TCAPInfo) GetApplicationContext() string {
+	if m != nil {
+		return m.ApplicationContext
+	}
+	return ""
+}
+
 type ROSInfo struct {
 	Type     int32 `protobuf:"varint,1,opt,name=type" json:"type,omitempty"`
 	InvokeId int32 `protobuf:"varint,2,opt,name=invokeId" json:"invokeId,omitempty"`
@@ -189,11 +234,656 @@ func (m *ROSInfo) GetOpCode() int32 {
 	return 0
 }
 
+type StateBatch struct {
+	Sequence uint64       `protobuf:"varint,1,opt,name=sequence" json:"sequence,omitempty"`
+	States   []*StateInfo `protobuf:"bytes,2,rep,name=states" json:"states,omitempty"`
+}
+
+func (m *StateBatch) Reset()                    { *m = StateBatch{} }
+func (m *StateBatch) String() string            { return proto.CompactTextString(m) }
+func (*StateBatch) ProtoMessage()               {}
+func (*StateBatch) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{4} }
+
+func (m *StateBatch) GetSequence() uint64 {
+	if m != nil {
+		return m.Sequence
+	}
+	return 0
+}
+
+func (m *StateBatch) GetStates() []*StateInfo {
+	if m != nil {
+		return m.States
+	}
+	return nil
+}
+
+type BatchAck struct {
+	Sequence uint64 `protobuf:"varint,1,opt,name=sequence" json:"sequence,omitempty"`
+	Accepted uint32 `protobuf:"varint,2,opt,name=accepted" json:"accepted,omitempty"`
+}
+
+func (m *BatchAck) Reset()                    { *m = BatchAck{} }
+func (m *BatchAck) String() string            { return proto.CompactTextString(m) }
+func (*BatchAck) ProtoMessage()               {}
+func (*BatchAck) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{5} }
+
+func (m *BatchAck) GetSequence() uint64 {
+	if m != nil {
+		return m.Sequence
+	}
+	return 0
+}
+
+func (m *BatchAck) GetAccepted() uint32 {
+	if m != nil {
+		return m.Accepted
+	}
+	return 0
+}
+
+type ProbeStats struct {
+	Name         string                      `protobuf:"bytes,1,opt,name=name" json:"name,omitempty"`
+	Messages     uint64                      `protobuf:"varint,2,opt,name=messages" json:"messages,omitempty"`
+	LastSeen     *google_protobuf1.Timestamp `protobuf:"bytes,3,opt,name=lastSeen" json:"lastSeen,omitempty"`
+	LastSequence uint64                      `protobuf:"varint,4,opt,name=lastSequence" json:"lastSequence,omitempty"`
+	Gaps         uint64                      `protobuf:"varint,5,opt,name=gaps" json:"gaps,omitempty"`
+	Restarts     uint64                      `protobuf:"varint,7,opt,name=restarts" json:"restarts,omitempty"`
+	Silent       bool                        `protobuf:"varint,8,opt,name=silent" json:"silent,omitempty"`
+}
+
+func (m *ProbeStats) Reset()                    { *m = ProbeStats{} }
+func (m *ProbeStats) String() string            { return proto.CompactTextString(m) }
+func (*ProbeStats) ProtoMessage()               {}
+func (*ProbeStats) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{6} }
+
+func (m *ProbeStats) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *ProbeStats) GetMessages() uint64 {
+	if m != nil {
+		return m.Messages
+	}
+	return 0
+}
+
+func (m *ProbeStats) GetLastSeen() *google_protobuf1.Timestamp {
+	if m != nil {
+		return m.LastSeen
+	}
+	return nil
+}
+
+func (m *ProbeStats) GetLastSequence() uint64 {
+	if m != nil {
+		return m.LastSequence
+	}
+	return 0
+}
+
+func (m *ProbeStats) GetGaps() uint64 {
+	if m != nil {
+		return m.Gaps
+	}
+	return 0
+}
+
+func (m *ProbeStats) GetRestarts() uint64 {
+	if m != nil {
+		return m.Restarts
+	}
+	return 0
+}
+
+func (m *ProbeStats) GetSilent() bool {
+	if m != nil {
+		return m.Silent
+	}
+	return false
+}
+// The clock of probe minus the clock of reference
+type ClockOffset struct {
+	Probe     string  `protobuf:"bytes,1,opt,name=probe" json:"probe,omitempty"`
+	Reference string  `protobuf:"bytes,2,opt,name=reference" json:"reference,omitempty"`
+	OffsetMs  float64 `protobuf:"fixed64,3,opt,name=offsetMs" json:"offsetMs,omitempty"`
+	Samples   uint64  `protobuf:"varint,4,opt,name=samples" json:"samples,omitempty"`
+}
+
+func (m *ClockOffset) Reset()                    { *m = ClockOffset{} }
+func (m *ClockOffset) String() string            { return proto.CompactTextString(m) }
+func (*ClockOffset) ProtoMessage()               {}
+func (*ClockOffset) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{7} }
+
+func (m *ClockOffset) GetProbe() string {
+	if m != nil {
+		return m.Probe
+	}
+	return ""
+}
+
+func (m *ClockOffset) GetReference() string {
+	if m != nil {
+		return m.Reference
+	}
+	return ""
+}
+
+func (m *ClockOffset) GetOffsetMs() float64 {
+	if m != nil {
+		return m.OffsetMs
+	}
+	return 0
+}
+
+func (m *ClockOffset) GetSamples() uint64 {
+	if m != nil {
+		return m.Samples
+	}
+	return 0
+}
+
+type ServerStats struct {
+	Shards             uint32         `protobuf:"varint,1,opt,name=shards" json:"shards,omitempty"`
+	Sessions           uint64         `protobuf:"varint,2,opt,name=sessions" json:"sessions,omitempty"`
+	EarlyPending       uint64         `protobuf:"varint,3,opt,name=earlyPending" json:"earlyPending,omitempty"`
+	Old                uint64         `protobuf:"varint,4,opt,name=old" json:"old,omitempty"`
+	RpcCalls           uint64         `protobuf:"varint,5,opt,name=rpcCalls" json:"rpcCalls,omitempty"`
+	RpcMissingFields   uint64         `protobuf:"varint,6,opt,name=rpcMissingFields" json:"rpcMissingFields,omitempty"`
+	Probes             []*ProbeStats  `protobuf:"bytes,7,rep,name=probes" json:"probes,omitempty"`
+	CompletionsDropped uint64         `protobuf:"varint,8,opt,name=completionsDropped" json:"completionsDropped,omitempty"`
+	ClockOffsets       []*ClockOffset `protobuf:"bytes,9,rep,name=clockOffsets" json:"clockOffsets,omitempty"`
+	Reordering         uint64         `protobuf:"varint,10,opt,name=reordering" json:"reordering,omitempty"`
+	LateArrivals       uint64         `protobuf:"varint,11,opt,name=lateArrivals" json:"lateArrivals,omitempty"`
+	Paths              []*PathDelay   `protobuf:"bytes,12,rep,name=paths" json:"paths,omitempty"`
+	Duplicates         uint64         `protobuf:"varint,13,opt,name=duplicates" json:"duplicates,omitempty"`
+}
+
+func (m *ServerStats) Reset()                    { *m = ServerStats{} }
+func (m *ServerStats) String() string            { return proto.CompactTextString(m) }
+func (*ServerStats) ProtoMessage()               {}
+func (*ServerStats) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{8} }
+
+func (m *ServerStats) GetShards() uint32 {
+	if m != nil {
+		return m.Shards
+	}
+	return 0
+}
+
+func (m *ServerStats) GetSessions() uint64 {
+	if m != nil {
+		return m.Sessions
+	}
+	return 0
+}
+
+func (m *ServerStats) GetEarlyPending() uint64 {
+	if m != nil {
+		return m.EarlyPending
+	}
+	return 0
+}
+
+func (m *ServerStats) GetOld() uint64 {
+	if m != nil {
+		return m.Old
+	}
+	return 0
+}
+
+func (m *ServerStats) GetRpcCalls() uint64 {
+	if m != nil {
+		return m.RpcCalls
+	}
+	return 0
+}
+
+func (m *ServerStats) GetRpcMissingFields() uint64 {
+	if m != nil {
+		return m.RpcMissingFields
+	}
+	return 0
+}
+
+func (m *ServerStats) GetProbes() []*ProbeStats {
+	if m != nil {
+		return m.Probes
+	}
+	return nil
+}
+
+func (m *ServerStats) GetCompletionsDropped() uint64 {
+	if m != nil {
+		return m.CompletionsDropped
+	}
+	return 0
+}
+
+func (m *ServerStats) GetClockOffsets() []*ClockOffset {
+	if m != nil {
+		return m.ClockOffsets
+	}
+	return nil
+}
+
+func (m *ServerStats) GetReordering() uint64 {
+	if m != nil {
+		return m.Reordering
+	}
+	return 0
+}
+
+func (m *ServerStats) GetLateArrivals() uint64 {
+	if m != nil {
+		return m.LateArrivals
+	}
+	return 0
+}
+
+func (m *ServerStats) GetPaths() []*PathDelay {
+	if m != nil {
+		return m.Paths
+	}
+	return nil
+}
+
+func (m *ServerStats) GetDuplicates() uint64 {
+	if m != nil {
+		return m.Duplicates
+	}
+	return 0
+}
+type DialogueQuery struct {
+	Tid       string `protobuf:"bytes,1,opt,name=tid" json:"tid,omitempty"`
+	Gt        string `protobuf:"bytes,2,opt,name=gt" json:"gt,omitempty"`
+	Ssn       uint32 `protobuf:"varint,3,opt,name=ssn" json:"ssn,omitempty"`
+	OpCode    int32  `protobuf:"varint,4,opt,name=opCode" json:"opCode,omitempty"`
+	MinAgeMs  uint32 `protobuf:"varint,5,opt,name=minAgeMs" json:"minAgeMs,omitempty"`
+	Limit     uint32 `protobuf:"varint,6,opt,name=limit" json:"limit,omitempty"`
+	HasOpCode bool   `protobuf:"varint,7,opt,name=hasOpCode" json:"hasOpCode,omitempty"`
+}
+
+func (m *DialogueQuery) Reset()                    { *m = DialogueQuery{} }
+func (m *DialogueQuery) String() string            { return proto.CompactTextString(m) }
+func (*DialogueQuery) ProtoMessage()               {}
+func (*DialogueQuery) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{9} }
+
+func (m *DialogueQuery) GetTid() string {
+	if m != nil {
+		return m.Tid
+	}
+	return ""
+}
+
+func (m *DialogueQuery) GetGt() string {
+	if m != nil {
+		return m.Gt
+	}
+	return ""
+}
+
+func (m *DialogueQuery) GetSsn() uint32 {
+	if m != nil {
+		return m.Ssn
+	}
+	return 0
+}
+
+func (m *DialogueQuery) GetOpCode() int32 {
+	if m != nil {
+		return m.OpCode
+	}
+	return 0
+}
+
+func (m *DialogueQuery) GetMinAgeMs() uint32 {
+	if m != nil {
+		return m.MinAgeMs
+	}
+	return 0
+}
+
+func (m *DialogueQuery) GetLimit() uint32 {
+	if m != nil {
+		return m.Limit
+	}
+	return 0
+}
+
+func (m *DialogueQuery) GetHasOpCode() bool {
+	if m != nil {
+		return m.HasOpCode
+	}
+	return false
+}
+
+type Dialogue struct {
+	State              string                      `protobuf:"bytes,1,opt,name=state" json:"state,omitempty"`
+	Key                string                      `protobuf:"bytes,2,opt,name=key" json:"key,omitempty"`
+	StartTime          *google_protobuf1.Timestamp `protobuf:"bytes,3,opt,name=startTime" json:"startTime,omitempty"`
+	AgeMs              float64                     `protobuf:"fixed64,4,opt,name=ageMs" json:"ageMs,omitempty"`
+	Otid               []byte                      `protobuf:"bytes,5,opt,name=otid" json:"otid,omitempty"`
+	Dtid               []byte                      `protobuf:"bytes,6,opt,name=dtid" json:"dtid,omitempty"`
+	Calling            *SCCPAddress                `protobuf:"bytes,7,opt,name=calling" json:"calling,omitempty"`
+	Called             *SCCPAddress                `protobuf:"bytes,8,opt,name=called" json:"called,omitempty"`
+	ApplicationContext string                      `protobuf:"bytes,9,opt,name=applicationContext" json:"applicationContext,omitempty"`
+	Operations         []int32                     `protobuf:"varint,10,rep,packed,name=operations" json:"operations,omitempty"`
+}
+
+func (m *Dialogue) Reset()                    { *m = Dialogue{} }
+func (m *Dialogue) String() string            { return proto.CompactTextString(m) }
+func (*Dialogue) ProtoMessage()               {}
+func (*Dialogue) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{10} }
+
+func (m *Dialogue) GetState() string {
+	if m != nil {
+		return m.State
+	}
+	return ""
+}
+
+func (m *Dialogue) GetKey() string {
+	if m != nil {
+		return m.Key
+	}
+	return ""
+}
+
+func (m *Dialogue) GetStartTime() *google_protobuf1.Timestamp {
+	if m != nil {
+		return m.StartTime
+	}
+	return nil
+}
+
+func (m *Dialogue) GetAgeMs() float64 {
+	if m != nil {
+		return m.AgeMs
+	}
+	return 0
+}
+
+func (m *Dialogue) GetOtid() []byte {
+	if m != nil {
+		return m.Otid
+	}
+	return nil
+}
+
+func (m *Dialogue) GetDtid() []byte {
+	if m != nil {
+		return m.Dtid
+	}
+	return nil
+}
+
+func (m *Dialogue) GetCalling() *SCCPAddress {
+	if m != nil {
+		return m.Calling
+	}
+	return nil
+}
+
+func (m *Dialogue) GetCalled() *SCCPAddress {
+	if m != nil {
+		return m.Called
+	}
+	return nil
+}
+
+func (m *Dialogue) GetApplicationContext() string {
+	if m != nil {
+		return m.ApplicationContext
+	}
+	return ""
+}
+
+func (m *Dialogue) GetOperations() []int32 {
+	if m != nil {
+		return m.Operations
+	}
+	return nil
+}
+
+type DialogueList struct {
+	Dialogues []*Dialogue `protobuf:"bytes,1,rep,name=dialogues" json:"dialogues,omitempty"`
+}
+
+func (m *DialogueList) Reset()                    { *m = DialogueList{} }
+func (m *DialogueList) String() string            { return proto.CompactTextString(m) }
+func (*DialogueList) ProtoMessage()               {}
+func (*DialogueList) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{11} }
+
+func (m *DialogueList) GetDialogues() []*Dialogue {
+	if m != nil {
+		return m.Dialogues
+	}
+	return nil
+}
+
+type Completion struct {
+	StartTime          *google_protobuf1.Timestamp `protobuf:"bytes,1,opt,name=startTime" json:"startTime,omitempty"`
+	EndTime            *google_protobuf1.Timestamp `protobuf:"bytes,2,opt,name=endTime" json:"endTime,omitempty"`
+	Calling            *SCCPAddress                `protobuf:"bytes,3,opt,name=calling" json:"calling,omitempty"`
+	Called             *SCCPAddress                `protobuf:"bytes,4,opt,name=called" json:"called,omitempty"`
+	Otid               []byte                      `protobuf:"bytes,5,opt,name=otid" json:"otid,omitempty"`
+	ApplicationContext string                      `protobuf:"bytes,6,opt,name=applicationContext" json:"applicationContext,omitempty"`
+	Ros                []*ROSInfo                  `protobuf:"bytes,7,rep,name=ros" json:"ros,omitempty"`
+	LatencyMs          float64                     `protobuf:"fixed64,8,opt,name=latencyMs" json:"latencyMs,omitempty"`
+	Outcome            string                      `protobuf:"bytes,9,opt,name=outcome" json:"outcome,omitempty"`
+}
+
+func (m *Completion) Reset()                    { *m = Completion{} }
+func (m *Completion) String() string            { return proto.CompactTextString(m) }
+func (*Completion) ProtoMessage()               {}
+func (*Completion) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{12} }
+
+func (m *Completion) GetStartTime() *google_protobuf1.Timestamp {
+	if m != nil {
+		return m.StartTime
+	}
+	return nil
+}
+
+func (m *Completion) GetEndTime() *google_protobuf1.Timestamp {
+	if m != nil {
+		return m.EndTime
+	}
+	return nil
+}
+
+func (m *Completion) GetCalling() *SCCPAddress {
+	if m != nil {
+		return m.Calling
+	}
+	return nil
+}
+
+func (m *Completion) GetCalled() *SCCPAddress {
+	if m != nil {
+		return m.Called
+	}
+	return nil
+}
+
+func (m *Completion) GetOtid() []byte {
+	if m != nil {
+		return m.Otid
+	}
+	return nil
+}
+
+func (m *Completion) GetApplicationContext() string {
+	if m != nil {
+		return m.ApplicationContext
+	}
+	return ""
+}
+
+func (m *Completion) GetRos() []*ROSInfo {
+	if m != nil {
+		return m.Ros
+	}
+	return nil
+}
+
+func (m *Completion) GetLatencyMs() float64 {
+	if m != nil {
+		return m.LatencyMs
+	}
+	return 0
+}
+
+func (m *Completion) GetOutcome() string {
+	if m != nil {
+		return m.Outcome
+	}
+	return ""
+}
+
+// Delay of messages seen at probe from and then at probe to
+type PathDelay struct {
+	From        string  `protobuf:"bytes,1,opt,name=from" json:"from,omitempty"`
+	To          string  `protobuf:"bytes,2,opt,name=to" json:"to,omitempty"`
+	Count       uint64  `protobuf:"varint,3,opt,name=count" json:"count,omitempty"`
+	P50Ms       float64 `protobuf:"fixed64,4,opt,name=p50Ms" json:"p50Ms,omitempty"`
+	P90Ms       float64 `protobuf:"fixed64,5,opt,name=p90Ms" json:"p90Ms,omitempty"`
+	P99Ms       float64 `protobuf:"fixed64,6,opt,name=p99Ms" json:"p99Ms,omitempty"`
+	MaxMs       float64 `protobuf:"fixed64,7,opt,name=maxMs" json:"maxMs,omitempty"`
+	Uncorrected uint64  `protobuf:"varint,8,opt,name=uncorrected" json:"uncorrected,omitempty"`
+}
+
+func (m *PathDelay) Reset()                    { *m = PathDelay{} }
+func (m *PathDelay) String() string            { return proto.CompactTextString(m) }
+func (*PathDelay) ProtoMessage()               {}
+func (*PathDelay) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{13} }
+
+func (m *PathDelay) GetFrom() string {
+	if m != nil {
+		return m.From
+	}
+	return ""
+}
+
+func (m *PathDelay) GetTo() string {
+	if m != nil {
+		return m.To
+	}
+	return ""
+}
+
+func (m *PathDelay) GetCount() uint64 {
+	if m != nil {
+		return m.Count
+	}
+	return 0
+}
+
+func (m *PathDelay) GetP50Ms() float64 {
+	if m != nil {
+		return m.P50Ms
+	}
+	return 0
+}
+
+func (m *PathDelay) GetP90Ms() float64 {
+	if m != nil {
+		return m.P90Ms
+	}
+	return 0
+}
+
+func (m *PathDelay) GetP99Ms() float64 {
+	if m != nil {
+		return m.P99Ms
+	}
+	return 0
+}
+
+func (m *PathDelay) GetMaxMs() float64 {
+	if m != nil {
+		return m.MaxMs
+	}
+	return 0
+}
+
+func (m *PathDelay) GetUncorrected() uint64 {
+	if m != nil {
+		return m.Uncorrected
+	}
+	return 0
+}
+
+// The first response to a TC-Begin matched at the probe. Calling is the
+// responder as it might answer from another GT than was called.
+type ResponseSummary struct {
+	Time    *google_protobuf1.Timestamp `protobuf:"bytes,1,opt,name=time" json:"time,omitempty"`
+	Tag     int32                       `protobuf:"varint,2,opt,name=tag" json:"tag,omitempty"`
+	Ros     []*ROSInfo                  `protobuf:"bytes,3,rep,name=ros" json:"ros,omitempty"`
+	Calling *SCCPAddress                `protobuf:"bytes,4,opt,name=calling" json:"calling,omitempty"`
+	Otid    []byte                      `protobuf:"bytes,5,opt,name=otid,proto3" json:"otid,omitempty"`
+}
+
+func (m *ResponseSummary) Reset()                    { *m = ResponseSummary{} }
+func (m *ResponseSummary) String() string            { return proto.CompactTextString(m) }
+func (*ResponseSummary) ProtoMessage()               {}
+func (*ResponseSummary) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{14} }
+
+func (m *ResponseSummary) GetTime() *google_protobuf1.Timestamp {
+	if m != nil {
+		return m.Time
+	}
+	return nil
+}
+
+func (m *ResponseSummary) GetTag() int32 {
+	if m != nil {
+		return m.Tag
+	}
+	return 0
+}
+
+func (m *ResponseSummary) GetRos() []*ROSInfo {
+	if m != nil {
+		return m.Ros
+	}
+	return nil
+}
+
+func (m *ResponseSummary) GetCalling() *SCCPAddress {
+	if m != nil {
+		return m.Calling
+	}
+	return nil
+}
+
+func (m *ResponseSummary) GetOtid() []byte {
+	if m != nil {
+		return m.Otid
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterType((*StateInfo)(nil), "rpc.StateInfo")
 	proto.RegisterType((*SCCPAddress)(nil), "rpc.SCCPAddress")
 	proto.RegisterType((*TCAPInfo)(nil), "rpc.TCAPInfo")
 	proto.RegisterType((*ROSInfo)(nil), "rpc.ROSInfo")
+	proto.RegisterType((*StateBatch)(nil), "rpc.StateBatch")
+	proto.RegisterType((*BatchAck)(nil), "rpc.BatchAck")
+	proto.RegisterType((*ProbeStats)(nil), "rpc.ProbeStats")
+	proto.RegisterType((*ClockOffset)(nil), "rpc.ClockOffset")
+	proto.RegisterType((*ServerStats)(nil), "rpc.ServerStats")
+	proto.RegisterType((*DialogueQuery)(nil), "rpc.DialogueQuery")
+	proto.RegisterType((*Dialogue)(nil), "rpc.Dialogue")
+	proto.RegisterType((*DialogueList)(nil), "rpc.DialogueList")
+	proto.RegisterType((*Completion)(nil), "rpc.Completion")
+	proto.RegisterType((*PathDelay)(nil), "rpc.PathDelay")
+	proto.RegisterType((*ResponseSummary)(nil), "rpc.ResponseSummary")
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -208,6 +898,13 @@ const _ = grpc.SupportPackageIsVersion4
 
 type TCAPFlowClient interface {
 	AddState(ctx context.Context, in *StateInfo, opts ...grpc.CallOption) (*google_protobuf.Empty, error)
+	// Each batch is acknowledged with its sequence number
+	StreamStates(ctx context.Context, opts ...grpc.CallOption) (TCAPFlow_StreamStatesClient, error)
+	GetStats(ctx context.Context, in *google_protobuf.Empty, opts ...grpc.CallOption) (*ServerStats, error)
+	// Dialogues tracked by the server, oldest first
+	ListDialogues(ctx context.Context, in *DialogueQuery, opts ...grpc.CallOption) (*DialogueList, error)
+	// Each dialogue as it is answered or times out
+	SubscribeCompletions(ctx context.Context, in *google_protobuf.Empty, opts ...grpc.CallOption) (TCAPFlow_SubscribeCompletionsClient, error)
 }
 
 type tCAPFlowClient struct {
@@ -227,10 +924,98 @@ func (c *tCAPFlowClient) AddState(ctx context.Context, in *StateInfo, opts ...gr
 	return out, nil
 }
 
+func (c *tCAPFlowClient) StreamStates(ctx context.Context, opts ...grpc.CallOption) (TCAPFlow_StreamStatesClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_TCAPFlow_serviceDesc.Streams[0], c.cc, "/rpc.TCAPFlow/StreamStates", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &tCAPFlowStreamStatesClient{stream}
+	return x, nil
+}
+
+type TCAPFlow_StreamStatesClient interface {
+	Send(*StateBatch) error
+	Recv() (*BatchAck, error)
+	grpc.ClientStream
+}
+
+type tCAPFlowStreamStatesClient struct {
+	grpc.ClientStream
+}
+
+func (x *tCAPFlowStreamStatesClient) Send(m *StateBatch) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *tCAPFlowStreamStatesClient) Recv() (*BatchAck, error) {
+	m := new(BatchAck)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *tCAPFlowClient) GetStats(ctx context.Context, in *google_protobuf.Empty, opts ...grpc.CallOption) (*ServerStats, error) {
+	out := new(ServerStats)
+	err := grpc.Invoke(ctx, "/rpc.TCAPFlow/GetStats", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *tCAPFlowClient) ListDialogues(ctx context.Context, in *DialogueQuery, opts ...grpc.CallOption) (*DialogueList, error) {
+	out := new(DialogueList)
+	err := grpc.Invoke(ctx, "/rpc.TCAPFlow/ListDialogues", in, out, c.cc, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *tCAPFlowClient) SubscribeCompletions(ctx context.Context, in *google_protobuf.Empty, opts ...grpc.CallOption) (TCAPFlow_SubscribeCompletionsClient, error) {
+	stream, err := grpc.NewClientStream(ctx, &_TCAPFlow_serviceDesc.Streams[1], c.cc, "/rpc.TCAPFlow/SubscribeCompletions", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &tCAPFlowSubscribeCompletionsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type TCAPFlow_SubscribeCompletionsClient interface {
+	Recv() (*Completion, error)
+	grpc.ClientStream
+}
+
+type tCAPFlowSubscribeCompletionsClient struct {
+	grpc.ClientStream
+}
+
+func (x *tCAPFlowSubscribeCompletionsClient) Recv() (*Completion, error) {
+	m := new(Completion)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // Server API for TCAPFlow service
 
 type TCAPFlowServer interface {
 	AddState(context.Context, *StateInfo) (*google_protobuf.Empty, error)
+	// Each batch is acknowledged with its sequence number
+	StreamStates(TCAPFlow_StreamStatesServer) error
+	GetStats(context.Context, *google_protobuf.Empty) (*ServerStats, error)
+	// Dialogues tracked by the server, oldest first
+	ListDialogues(context.Context, *DialogueQuery) (*DialogueList, error)
+	// Each dialogue as it is answered or times out
+	SubscribeCompletions(*google_protobuf.Empty, TCAPFlow_SubscribeCompletionsServer) error
 }
 
 func RegisterTCAPFlowServer(s *grpc.Server, srv TCAPFlowServer) {
@@ -255,6 +1040,89 @@ func _TCAPFlow_AddState_Handler(srv interface{}, ctx context.Context, dec func(i
 	return interceptor(ctx, in, info, handler)
 }
 
+func _TCAPFlow_StreamStates_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(TCAPFlowServer).StreamStates(&tCAPFlowStreamStatesServer{stream})
+}
+
+type TCAPFlow_StreamStatesServer interface {
+	Send(*BatchAck) error
+	Recv() (*StateBatch, error)
+	grpc.ServerStream
+}
+
+type tCAPFlowStreamStatesServer struct {
+	grpc.ServerStream
+}
+
+func (x *tCAPFlowStreamStatesServer) Send(m *BatchAck) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *tCAPFlowStreamStatesServer) Recv() (*StateBatch, error) {
+	m := new(StateBatch)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _TCAPFlow_GetStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(google_protobuf.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TCAPFlowServer).GetStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/rpc.TCAPFlow/GetStats",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TCAPFlowServer).GetStats(ctx, req.(*google_protobuf.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TCAPFlow_ListDialogues_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DialogueQuery)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TCAPFlowServer).ListDialogues(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/rpc.TCAPFlow/ListDialogues",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TCAPFlowServer).ListDialogues(ctx, req.(*DialogueQuery))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TCAPFlow_SubscribeCompletions_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(google_protobuf.Empty)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(TCAPFlowServer).SubscribeCompletions(m, &tCAPFlowSubscribeCompletionsServer{stream})
+}
+
+type TCAPFlow_SubscribeCompletionsServer interface {
+	Send(*Completion) error
+	grpc.ServerStream
+}
+
+type tCAPFlowSubscribeCompletionsServer struct {
+	grpc.ServerStream
+}
+
+func (x *tCAPFlowSubscribeCompletionsServer) Send(m *Completion) error {
+	return x.ServerStream.SendMsg(m)
+}
+
 var _TCAPFlow_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "rpc.TCAPFlow",
 	HandlerType: (*TCAPFlowServer)(nil),
@@ -263,37 +1131,116 @@ var _TCAPFlow_serviceDesc = grpc.ServiceDesc{
 			MethodName: "AddState",
 			Handler:    _TCAPFlow_AddState_Handler,
 		},
+		{
+			MethodName: "GetStats",
+			Handler:    _TCAPFlow_GetStats_Handler,
+		},
+		{
+			MethodName: "ListDialogues",
+			Handler:    _TCAPFlow_ListDialogues_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamStates",
+			Handler:       _TCAPFlow_StreamStates_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "SubscribeCompletions",
+			Handler:       _TCAPFlow_SubscribeCompletions_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "rpc/tcapcollection.proto",
 }
 
 func init() { proto.RegisterFile("rpc/tcapcollection.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 378 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x74, 0x92, 0xcf, 0x6e, 0xa3, 0x30,
-	0x10, 0xc6, 0x37, 0x01, 0xf2, 0xc7, 0x09, 0xab, 0xc8, 0x87, 0x08, 0xb1, 0xd2, 0x6e, 0x96, 0x53,
-	0xb4, 0x07, 0x22, 0x65, 0xfb, 0x00, 0x8d, 0x68, 0x2b, 0xe5, 0xd4, 0xd4, 0xc9, 0xad, 0x27, 0x82,
-	0x1d, 0x84, 0x0a, 0xb6, 0x05, 0x4e, 0xab, 0xbc, 0x67, 0x1f, 0xa8, 0x9a, 0x31, 0x54, 0x55, 0xab,
-	0xde, 0x3e, 0x7f, 0xf3, 0x9b, 0xe1, 0xb3, 0x07, 0x12, 0xd4, 0x3a, 0x5b, 0x99, 0x2c, 0xd5, 0x99,
-	0x2a, 0x4b, 0x91, 0x99, 0x42, 0xc9, 0x58, 0xd7, 0xca, 0x28, 0xea, 0xd4, 0x3a, 0x0b, 0x7f, 0xe5,
-	0x4a, 0xe5, 0xa5, 0x58, 0xa1, 0x75, 0x3c, 0x9f, 0x56, 0xa2, 0xd2, 0xe6, 0x62, 0x89, 0xf0, 0xcf,
-	0xe7, 0xa2, 0x29, 0x2a, 0xd1, 0x98, 0xb4, 0xd2, 0x16, 0x88, 0x5e, 0x7b, 0x64, 0xbc, 0x37, 0xa9,
-	0x11, 0x5b, 0x79, 0x52, 0x34, 0x26, 0x2e, 0x00, 0x41, 0x6f, 0xd1, 0x5b, 0x4e, 0xd6, 0x61, 0x6c,
-	0xbb, 0xe3, 0xae, 0x3b, 0x3e, 0x74, 0xdd, 0x0c, 0x39, 0xfa, 0x8f, 0x0c, 0xb3, 0xb4, 0x2c, 0x0b,
-	0x99, 0x07, 0x7d, 0x6c, 0x99, 0xc5, 0xb5, 0xce, 0xe2, 0x7d, 0x92, 0xec, 0x36, 0x9c, 0xd7, 0xa2,
-	0x69, 0x58, 0x07, 0xd0, 0x25, 0x19, 0x80, 0x14, 0x3c, 0x70, 0xbe, 0x41, 0xdb, 0x3a, 0xfd, 0x4b,
-	0x5c, 0xb8, 0x6e, 0xe0, 0x22, 0xe7, 0x23, 0x77, 0x48, 0x36, 0x3b, 0x88, 0xc8, 0xb0, 0x44, 0x7f,
-	0x13, 0xa7, 0x56, 0x4d, 0xe0, 0x2d, 0x9c, 0xe5, 0x64, 0x3d, 0x45, 0x82, 0xdd, 0xef, 0x11, 0x80,
-	0x42, 0xf4, 0x48, 0x26, 0x1f, 0x26, 0xd3, 0x19, 0x71, 0x9a, 0x46, 0xe2, 0xb5, 0x7c, 0x06, 0x12,
-	0x1c, 0xa3, 0x24, 0xa6, 0xf6, 0x19, 0x48, 0x70, 0xa4, 0x2e, 0x30, 0x9c, 0xcf, 0x40, 0xd2, 0x39,
-	0x19, 0xc8, 0x73, 0x75, 0x14, 0x35, 0x26, 0x19, 0xb3, 0xf6, 0x14, 0xdd, 0x90, 0x51, 0x17, 0x87,
-	0x52, 0xe2, 0x2a, 0x53, 0x70, 0x1c, 0x3d, 0x65, 0xa8, 0xc1, 0xe3, 0xe0, 0xf5, 0xad, 0x07, 0x1a,
-	0xbf, 0x97, 0xe6, 0x38, 0xdd, 0x63, 0x20, 0xa3, 0x07, 0x32, 0x6c, 0x23, 0x43, 0x83, 0xb9, 0x68,
-	0xfb, 0xec, 0x1e, 0x43, 0x4d, 0x43, 0x32, 0x2a, 0xe4, 0xb3, 0x7a, 0x12, 0x5b, 0x3b, 0xc8, 0x63,
-	0xef, 0x67, 0x08, 0xa6, 0x74, 0xa2, 0xb8, 0x68, 0xe7, 0xb5, 0xa7, 0xf5, 0xb5, 0x0d, 0x76, 0x57,
-	0xaa, 0x17, 0x7a, 0x45, 0x46, 0x1b, 0xce, 0x71, 0xb5, 0xf4, 0xa7, 0x7d, 0xea, 0x6e, 0xcd, 0xe1,
-	0xfc, 0xcb, 0x62, 0x6f, 0xe1, 0x9f, 0x89, 0x7e, 0x1c, 0x07, 0xe8, 0xfc, 0x7f, 0x0b, 0x00, 0x00,
-	0xff, 0xff, 0xd3, 0xcb, 0xe1, 0x88, 0x74, 0x02, 0x00, 0x00,
+	// 1315 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x94, 0x56, 0xcd, 0x6e, 0x1b, 0x37,
+	0x10, 0xf6, 0x6a, 0xf5, 0x3b, 0xb6, 0x12, 0x97, 0x08, 0x82, 0x85, 0x1a, 0xa4, 0xea, 0xa2, 0x68,
+	0x85, 0x14, 0x50, 0x8c, 0x34, 0x2d, 0x12, 0xf4, 0xe4, 0x28, 0x4d, 0x91, 0xa2, 0x46, 0x1c, 0x2a,
+	0xb7, 0x9e, 0xe8, 0x5d, 0x5a, 0x5e, 0x78, 0xb5, 0xdc, 0x92, 0x54, 0x12, 0x3d, 0x53, 0xd1, 0x53,
+	0x2f, 0xbd, 0xf5, 0x15, 0x7a, 0xec, 0x13, 0xf4, 0xd8, 0x67, 0x28, 0x66, 0xc8, 0xdd, 0x95, 0x1d,
+	0x39, 0x4e, 0x6e, 0x33, 0xc3, 0x21, 0x39, 0x9c, 0xf9, 0xbe, 0xe1, 0x40, 0xa4, 0xcb, 0xe4, 0xbe,
+	0x4d, 0x44, 0x99, 0xa8, 0x3c, 0x97, 0x89, 0xcd, 0x54, 0x31, 0x2d, 0xb5, 0xb2, 0x8a, 0x85, 0xba,
+	0x4c, 0x46, 0x9f, 0x2e, 0x94, 0x5a, 0xe4, 0xf2, 0x3e, 0x99, 0x4e, 0x56, 0xa7, 0xf7, 0xe5, 0xb2,
+	0xb4, 0x6b, 0xe7, 0x31, 0xfa, 0xec, 0xf2, 0xa2, 0xcd, 0x96, 0xd2, 0x58, 0xb1, 0x2c, 0x9d, 0x43,
+	0xfc, 0x67, 0x0b, 0x06, 0x73, 0x2b, 0xac, 0x7c, 0x5e, 0x9c, 0x2a, 0x36, 0x85, 0x36, 0x3a, 0x44,
+	0xc1, 0x38, 0x98, 0xec, 0x3e, 0x18, 0x4d, 0xdd, 0xee, 0x69, 0xb5, 0x7b, 0xfa, 0xaa, 0xda, 0xcd,
+	0xc9, 0x8f, 0xdd, 0x83, 0x5e, 0x22, 0xf2, 0x3c, 0x2b, 0x16, 0x51, 0x8b, 0xb6, 0xec, 0x4f, 0x75,
+	0x99, 0x4c, 0xe7, 0xb3, 0xd9, 0xf1, 0x61, 0x9a, 0x6a, 0x69, 0x0c, 0xaf, 0x1c, 0xd8, 0x04, 0xba,
+	0x28, 0xca, 0x34, 0x0a, 0xaf, 0x70, 0xf5, 0xeb, 0xec, 0x73, 0x68, 0xe3, 0x73, 0xa3, 0x36, 0xf9,
+	0x0d, 0xc9, 0xef, 0xd5, 0xec, 0xf0, 0x18, 0x43, 0xe4, 0xb4, 0xc4, 0xee, 0x42, 0xa8, 0x95, 0x89,
+	0x3a, 0xe3, 0x70, 0xb2, 0xfb, 0x60, 0x8f, 0x3c, 0xf8, 0x8b, 0x39, 0x39, 0xe0, 0x02, 0xbb, 0x05,
+	0x9d, 0x52, 0xab, 0x13, 0x19, 0x75, 0xc7, 0xc1, 0x64, 0xc0, 0x9d, 0xc2, 0x46, 0xd0, 0x37, 0xf2,
+	0xd7, 0x95, 0x2c, 0x12, 0x19, 0xf5, 0xc6, 0xc1, 0xa4, 0xcd, 0x6b, 0x9d, 0x1d, 0x40, 0x5f, 0x4b,
+	0x53, 0xaa, 0xc2, 0xc8, 0xa8, 0x4f, 0x17, 0xdf, 0x72, 0xc7, 0x7a, 0xe3, 0x7c, 0xb5, 0x5c, 0x0a,
+	0xbd, 0xe6, 0xb5, 0x57, 0xfc, 0x0b, 0xec, 0x6e, 0x44, 0xcf, 0xf6, 0x21, 0x34, 0xa6, 0xa0, 0xd4,
+	0x0d, 0x39, 0x8a, 0x68, 0xb1, 0xaa, 0xa0, 0xcc, 0x0c, 0x39, 0x8a, 0x68, 0x29, 0xca, 0x8c, 0x12,
+	0x30, 0xe4, 0x28, 0xb2, 0xdb, 0xd0, 0x2d, 0x56, 0xcb, 0x13, 0xa9, 0xe9, 0xb5, 0x03, 0xee, 0xb5,
+	0xd8, 0x42, 0xbf, 0x7a, 0x32, 0x63, 0xd0, 0x56, 0x36, 0x4b, 0xe9, 0xe8, 0x3d, 0x4e, 0x32, 0xda,
+	0x52, 0xb4, 0xb5, 0x9c, 0x0d, 0x65, 0xba, 0x4f, 0x2c, 0xe8, 0xf4, 0x0e, 0x47, 0x91, 0x4d, 0x81,
+	0x89, 0xb2, 0xcc, 0xb3, 0x44, 0x20, 0x6a, 0x66, 0xaa, 0xb0, 0xf2, 0xad, 0xf5, 0x37, 0x6d, 0x59,
+	0x89, 0x5f, 0x42, 0xcf, 0xa7, 0x11, 0x2f, 0xb0, 0xeb, 0xd2, 0x41, 0xa1, 0xc3, 0x49, 0xc6, 0xfc,
+	0x65, 0xc5, 0x6b, 0x75, 0x2e, 0x9f, 0xbb, 0x8b, 0x3b, 0xbc, 0xd6, 0xf1, 0x21, 0xaa, 0x9c, 0xa9,
+	0x54, 0xfa, 0xfb, 0xbd, 0x16, 0x1f, 0x03, 0x10, 0xbe, 0x9e, 0x08, 0x9b, 0x9c, 0x5d, 0xa8, 0x40,
+	0x70, 0xa9, 0x02, 0x5f, 0x42, 0xd7, 0xa0, 0xa7, 0x89, 0x5a, 0x54, 0xd6, 0x1b, 0x0e, 0x20, 0x15,
+	0x38, 0xb9, 0x5f, 0x8d, 0x9f, 0x40, 0x9f, 0x0e, 0x3b, 0x4c, 0xce, 0xdf, 0x7b, 0xde, 0x08, 0xfa,
+	0x22, 0x49, 0x64, 0x69, 0x65, 0xea, 0x6b, 0x50, 0xeb, 0xf1, 0xbf, 0x01, 0xc0, 0x31, 0x62, 0x02,
+	0x8f, 0x37, 0xf8, 0xd8, 0x42, 0x78, 0xdc, 0x0f, 0x38, 0xc9, 0xb8, 0x7d, 0x29, 0x8d, 0x11, 0x0b,
+	0x0a, 0x88, 0x8e, 0xae, 0x74, 0xf6, 0x1d, 0xf4, 0x73, 0x61, 0xec, 0x5c, 0xca, 0x22, 0x0a, 0xaf,
+	0xe5, 0x4a, 0xed, 0xcb, 0x62, 0xd8, 0x73, 0xb2, 0x0f, 0xb9, 0x4d, 0xe7, 0x5e, 0xb0, 0x61, 0x2c,
+	0x0b, 0x51, 0x22, 0xb6, 0x71, 0x8d, 0x64, 0x8c, 0x45, 0xe3, 0x61, 0xda, 0x9a, 0x0a, 0xb8, 0x95,
+	0x8e, 0x89, 0x37, 0x59, 0x2e, 0x0b, 0x4b, 0xb0, 0xed, 0x73, 0xaf, 0xfd, 0xd4, 0xee, 0x77, 0xf7,
+	0x7b, 0xf1, 0x1b, 0xd8, 0x9d, 0xe5, 0x2a, 0x39, 0x7f, 0x71, 0x7a, 0x6a, 0xa4, 0x6d, 0x78, 0x11,
+	0x6c, 0xf2, 0xe2, 0x0e, 0x0c, 0xb4, 0x3c, 0x95, 0x9a, 0x62, 0x6a, 0xd1, 0x4a, 0x63, 0xc0, 0xcb,
+	0x15, 0xed, 0x3e, 0x32, 0xf4, 0xd8, 0x80, 0xd7, 0x3a, 0x8b, 0xa0, 0x67, 0xc4, 0xb2, 0xcc, 0xa5,
+	0xf1, 0x6f, 0xa9, 0xd4, 0xf8, 0x9f, 0x10, 0x76, 0xe7, 0x52, 0xbf, 0x96, 0xda, 0xa5, 0x18, 0xc3,
+	0x3c, 0x13, 0x3a, 0x35, 0x9e, 0x21, 0x5e, 0x73, 0x15, 0x34, 0x26, 0x53, 0x45, 0x9d, 0xe6, 0x4a,
+	0xc7, 0x74, 0x49, 0xa1, 0xf3, 0xf5, 0xb1, 0x2c, 0x52, 0xec, 0x31, 0xa1, 0x4b, 0xd7, 0xa6, 0x0d,
+	0x41, 0xaf, 0xf2, 0xd4, 0xdf, 0x8e, 0x22, 0x25, 0xab, 0x4c, 0x66, 0x22, 0xcf, 0xab, 0x24, 0xd6,
+	0x3a, 0xbb, 0x07, 0xfb, 0xba, 0x4c, 0x8e, 0x32, 0x63, 0xb2, 0x62, 0xf1, 0x2c, 0x93, 0x79, 0x6a,
+	0xa8, 0x45, 0xb4, 0xf9, 0x3b, 0x76, 0xf6, 0x15, 0x74, 0x29, 0x3d, 0x98, 0x72, 0xc4, 0xe3, 0x4d,
+	0xc2, 0x63, 0x83, 0x1a, 0xee, 0x97, 0x91, 0x65, 0x89, 0xc2, 0x57, 0x23, 0x95, 0xcc, 0x53, 0xad,
+	0xca, 0x52, 0xa6, 0x54, 0x8d, 0x36, 0xdf, 0xb2, 0xc2, 0x1e, 0xc2, 0x5e, 0xd2, 0xd4, 0xc4, 0x44,
+	0x83, 0x71, 0x58, 0xf7, 0xc3, 0x8d, 0x62, 0xf1, 0x0b, 0x5e, 0xec, 0x2e, 0x80, 0x96, 0x4a, 0xa7,
+	0x52, 0x63, 0x2a, 0x80, 0x4e, 0xdf, 0xb0, 0x38, 0x6c, 0x59, 0x79, 0xa8, 0x75, 0xf6, 0x5a, 0xe4,
+	0x26, 0xda, 0xad, 0xb0, 0xd5, 0xd8, 0xd8, 0x17, 0xd0, 0x29, 0x85, 0x3d, 0x33, 0xd1, 0xde, 0x06,
+	0xc3, 0x8e, 0x85, 0x3d, 0x7b, 0x2a, 0x73, 0xb1, 0xe6, 0x6e, 0x11, 0x6f, 0x4a, 0x57, 0xae, 0x37,
+	0x48, 0x13, 0x0d, 0xdd, 0x4d, 0x8d, 0x25, 0xfe, 0x2d, 0x80, 0xe1, 0xd3, 0x4c, 0xe4, 0x6a, 0xb1,
+	0x92, 0x2f, 0x57, 0x52, 0xaf, 0xa9, 0xf3, 0xf8, 0x06, 0x35, 0xe0, 0x28, 0xb2, 0x1b, 0xd0, 0x5a,
+	0x58, 0x8f, 0xa5, 0xd6, 0xc2, 0x56, 0xdd, 0x31, 0x6c, 0xba, 0x63, 0xd3, 0x30, 0xda, 0x9b, 0x0d,
+	0x83, 0x78, 0x97, 0x15, 0x87, 0x0b, 0x79, 0xe4, 0xca, 0x37, 0xe4, 0xb5, 0x8e, 0xf0, 0xcd, 0xb3,
+	0x65, 0x66, 0xa9, 0x66, 0x43, 0xee, 0x14, 0x84, 0xef, 0x99, 0x30, 0x2f, 0xdc, 0x61, 0x3d, 0x22,
+	0x41, 0x63, 0x88, 0xff, 0x6e, 0x41, 0xbf, 0x8a, 0x16, 0x0f, 0xa0, 0x2e, 0x52, 0xe1, 0x9f, 0x14,
+	0x0c, 0xee, 0x5c, 0xae, 0x7d, 0xb4, 0x28, 0xb2, 0x47, 0x30, 0x20, 0x7a, 0x21, 0x89, 0x3f, 0x80,
+	0xe1, 0x8d, 0x33, 0xde, 0x20, 0x28, 0xf6, 0x36, 0x51, 0xc5, 0x29, 0x75, 0x0b, 0xef, 0x6c, 0x69,
+	0xe1, 0xdd, 0x8d, 0x16, 0xbe, 0xf1, 0xa1, 0xf6, 0x3e, 0xfc, 0x43, 0xed, 0x5f, 0xf3, 0xa1, 0x6e,
+	0xff, 0x06, 0x06, 0x57, 0x7d, 0x03, 0x08, 0x00, 0x55, 0x4a, 0x4d, 0x36, 0x13, 0xc1, 0x38, 0x9c,
+	0x74, 0xf8, 0x86, 0x25, 0xfe, 0x1e, 0xf6, 0xaa, 0x8c, 0xfe, 0x9c, 0x19, 0xcb, 0xbe, 0x86, 0x41,
+	0xea, 0x75, 0xa4, 0x77, 0x58, 0xff, 0xda, 0x95, 0x17, 0x6f, 0xd6, 0xe3, 0xff, 0x5a, 0x00, 0xb3,
+	0x9a, 0x14, 0x17, 0x33, 0x1d, 0x7c, 0x4c, 0xa6, 0x1f, 0x42, 0x4f, 0x16, 0x29, 0xed, 0x6b, 0x5d,
+	0xbb, 0xaf, 0x72, 0xdd, 0xcc, 0x70, 0xf8, 0xe1, 0x19, 0x6e, 0x5f, 0x93, 0xe1, 0x6d, 0xf5, 0xdd,
+	0x9e, 0xf5, 0xee, 0x7b, 0xb2, 0x4e, 0x33, 0x4d, 0xef, 0xaa, 0x99, 0xe6, 0x0e, 0x0c, 0x90, 0xcc,
+	0x45, 0xb2, 0x3e, 0x32, 0x54, 0xf2, 0x80, 0x37, 0x06, 0xec, 0xc4, 0x6a, 0x65, 0x13, 0xb5, 0x94,
+	0xbe, 0xb0, 0x95, 0x1a, 0xff, 0x15, 0xc0, 0xa0, 0xe6, 0x38, 0x46, 0x7a, 0xaa, 0xd5, 0xb2, 0xfa,
+	0xea, 0x50, 0x46, 0xb2, 0x5a, 0x55, 0x91, 0xd5, 0x2a, 0xc4, 0x70, 0xa2, 0x56, 0x85, 0xf5, 0x0d,
+	0xd7, 0x29, 0x68, 0x2d, 0xbf, 0x3d, 0x68, 0x90, 0x4d, 0x0a, 0x59, 0x1f, 0x1f, 0x78, 0xae, 0x06,
+	0xdc, 0x29, 0xce, 0xfa, 0xf8, 0xc8, 0x35, 0x57, 0xb2, 0x3e, 0x76, 0xd6, 0xa5, 0x78, 0x7b, 0xe4,
+	0xfe, 0xb0, 0x80, 0x3b, 0x85, 0x8d, 0x61, 0x77, 0x55, 0x24, 0x4a, 0x6b, 0x99, 0xd8, 0xba, 0x6f,
+	0x6e, 0x9a, 0xe2, 0x3f, 0x02, 0xb8, 0x79, 0x69, 0x0e, 0xfb, 0xe8, 0x51, 0xd5, 0x0f, 0x47, 0xad,
+	0x66, 0x38, 0xf2, 0xf9, 0x0e, 0xaf, 0xca, 0xf7, 0x06, 0x52, 0xda, 0xd7, 0x21, 0x65, 0x4b, 0xfd,
+	0x1f, 0xfc, 0xde, 0x72, 0x33, 0xdc, 0xb3, 0x5c, 0xbd, 0x61, 0x0f, 0xa1, 0x7f, 0x98, 0xa6, 0x34,
+	0xcc, 0xb0, 0x4b, 0x83, 0xcd, 0xe8, 0xf6, 0x3b, 0xc1, 0xff, 0x80, 0x23, 0x7c, 0xbc, 0x83, 0x3f,
+	0xc5, 0xdc, 0x6a, 0x29, 0x96, 0xe4, 0x6c, 0xd8, 0xcd, 0x66, 0x27, 0x8d, 0x40, 0x23, 0x47, 0xb3,
+	0x6a, 0x1c, 0x8a, 0x77, 0x26, 0xc1, 0x41, 0x80, 0xd3, 0xc9, 0x8f, 0xd2, 0xfa, 0x6f, 0x77, 0xfb,
+	0xd9, 0x23, 0xff, 0x96, 0xe6, 0x83, 0x8e, 0x77, 0xd8, 0x23, 0x18, 0x22, 0x9d, 0x2b, 0xd2, 0x1a,
+	0xc6, 0x2e, 0x90, 0x98, 0x5a, 0xfd, 0xe8, 0x93, 0x0b, 0x36, 0xf4, 0x8f, 0x77, 0xd8, 0x0c, 0x6e,
+	0xcd, 0x57, 0x27, 0x26, 0xd1, 0xd9, 0x89, 0x6c, 0xb8, 0x7d, 0xf5, 0xed, 0xee, 0x1d, 0x8d, 0x67,
+	0xbc, 0x73, 0x10, 0x9c, 0x74, 0xc9, 0xe9, 0x9b, 0xff, 0x07, 0x00, 0x53, 0x76, 0x6c, 0xa9, 0xf0,
+	0x0c, 0x00, 0x00,
 }
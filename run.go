@@ -6,6 +6,7 @@ import (
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
 	"io"
+	"time"
 )
 
 func reportParseError(handler DataHandler, data []uint8) {
@@ -15,62 +16,177 @@ func reportParseError(handler DataHandler, data []uint8) {
 
 }
 
-func handleSCTPData(handler DataHandler, data *layers.SCTPData, packet gopacket.Packet) {
+func handleSCTPData(handler DataHandler, data *layers.SCTPData, packet gopacket.Packet, frame uint64) {
 	defer reportParseError(handler, data.Payload)
 
+	msg := &Message{
+		Frame:           frame,
+		Stream:          data.StreamId,
+		StreamSequence:  data.StreamSequence,
+		PayloadProtocol: uint32(data.PayloadProtocol),
+	}
 	switch data.PayloadProtocol {
 	case layers.SCTPPayloadM2UA:
 		HandleM2UA(handler, data, packet)
 	case layers.SCTPPayloadM3UA:
-		HandleM3UA(handler, data.Payload, packet)
+		handleM3UA(handler, msg, data.Payload, packet)
 	case layers.SCTPPayloadM2PA:
-		HandleM2PA(handler, data.Payload, packet)
+		handleM2PA(handler, msg, data.Payload, packet)
 	case layers.SCTPPayloadSUA:
 		HandleSUA(handler, data, packet)
 	}
 }
 
-func handlePacket(handler DataHandler, packet gopacket.Packet) {
+func handlePacket(handler DataHandler, sctp *SCTPReassembler, packet gopacket.Packet, frame uint64) {
 	for _, p := range packet.Layers() {
 		if data, err := p.(*layers.SCTPData); err {
-			handleSCTPData(handler, data, packet)
+			data = sctp.Reassemble(data, packet)
+			if data != nil {
+				handleSCTPData(handler, data, packet, frame)
+			}
 		}
 	}
 }
 
+// Live captures wake up this often to check whether to stop
+const readTimeout = 500 * time.Millisecond
+
+func stopped(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func openHandle(pcapFile string, pcapDevice string, pcapFilter string) (*pcap.Handle, error) {
+	if len(pcapFile) > 0 {
+		return pcap.OpenOffline(pcapFile)
+	}
+
+	handle, err := pcap.OpenLive(pcapDevice, 0, true, readTimeout)
+	if err != nil {
+		return nil, err
+	}
+	err = handle.SetBPFFilter(pcapFilter)
+	if err != nil {
+		handle.Close()
+		return nil, err
+	}
+	return handle, nil
+}
+
+// pacer delays the packets of a capture file to the speed they were
+// captured at.
+type pacer struct {
+	enabled bool
+	first   time.Time
+	started time.Time
+}
+
+func (p *pacer) wait(packet gopacket.Packet) {
+	if !p.enabled {
+		return
+	}
+	ts := packet.Metadata().Timestamp
+	if p.started.IsZero() {
+		p.first = ts
+		p.started = time.Now()
+		return
+	}
+	if delay := ts.Sub(p.first) - time.Since(p.started); delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// captureDrops counts the packets the kernel dropped
+type captureDrops struct {
+	last int
+}
+
+// Packets dropped since the last call
+func (d *captureDrops) since(handle *pcap.Handle) uint64 {
+	stats, err := handle.Stats()
+	if err != nil {
+		return 0
+	}
+	dropped := stats.PacketsDropped + stats.PacketsIfDropped
+	count := 0
+	if dropped > d.last {
+		count = dropped - d.last
+	}
+	d.last = dropped
+	return uint64(count)
+}
+
+// LoopConfig changes how RunLoopWith reads packets
+type LoopConfig struct {
+	// Read a capture file at the speed it was captured
+	RealTime bool
+
+	// Stop reading once this is closed
+	Stop <-chan struct{}
+
+	// Periodic report of the packets read and dropped by the kernel
+	// since the last one. Called from the capture loop.
+	StatsInterval time.Duration
+	Stats         func(stats PipelineStageStats)
+}
+
 func RunLoop(pcapFile string, pcapDevice string, pcapFilter string, handler DataHandler) {
+	RunLoopWith(pcapFile, pcapDevice, pcapFilter, LoopConfig{}, handler)
+}
+
+// RunReplay is like RunLoop but reads the file at the speed it was captured.
+func RunReplay(pcapFile string, handler DataHandler) {
+	RunLoopWith(pcapFile, "", "", LoopConfig{RealTime: true}, handler)
+}
+
+func RunLoopWith(pcapFile string, pcapDevice string, pcapFilter string, config LoopConfig, handler DataHandler) {
 	// Open file or live...
-	var handle *pcap.Handle
-	var err error
-	if len(pcapFile) > 0 {
-		handle, err = pcap.OpenOffline(pcapFile)
-		if err != nil {
-			fmt.Printf("ERROR: %v\n", err)
-			return
-		}
-	} else {
-		handle, err = pcap.OpenLive(pcapDevice, 0, true, pcap.BlockForever)
-		if err != nil {
-			fmt.Printf("ERROR: %v\n", err)
-			return
-		}
-		err = handle.SetBPFFilter(pcapFilter)
-		if err != nil {
-			fmt.Printf("ERROR: %v\n", err)
-			return
-		}
+	handle, err := openHandle(pcapFile, pcapDevice, pcapFilter)
+	if err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+		return
 	}
 	defer handle.Close()
 
 	// Main loop..
+	defrag := NewIPDefragmenter()
+	sctp := NewSCTPReassembler()
 	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
-	for {
+	pace := pacer{enabled: config.RealTime && len(pcapFile) > 0}
+	frame := uint64(0)
+
+	if config.StatsInterval <= 0 {
+		config.StatsInterval = 10 * time.Second
+	}
+	var drops captureDrops
+	reported, lastReport := frame, time.Now()
+	report := func() {
+		config.Stats(PipelineStageStats{Processed: frame - reported, Dropped: drops.since(handle)})
+		reported, lastReport = frame, time.Now()
+	}
+
+	for !stopped(config.Stop) {
 		packet, err := packetSource.NextPacket()
 		if err == io.EOF {
 			break
 		} else if err == nil {
-			handlePacket(handler, packet)
+			pace.wait(packet)
+			frame++
+			packet = defrag.Defrag(handler, packet)
+			if packet != nil {
+				handlePacket(handler, sctp, packet, frame)
+			}
 			handler.AfterOnePacket()
 		}
+		if config.Stats != nil && time.Since(lastReport) >= config.StatsInterval {
+			report()
+		}
+	}
+	if config.Stats != nil {
+		report()
 	}
 }
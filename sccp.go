@@ -1,7 +1,6 @@
 package tcapflow
 
 import (
-	"bytes"
 	"encoding/binary"
 	"fmt"
 
@@ -21,6 +20,9 @@ type SCCPAddress struct {
 	Ton    uint8
 	Npi    uint8
 	Number string
+
+	// MTP point code the message was routed from or to
+	PointCode uint32
 }
 
 func parseAddr(data []uint8) (addr SCCPAddress, err error) {
@@ -50,32 +52,150 @@ func parseAddr(data []uint8) (addr SCCPAddress, err error) {
 	return
 }
 
-func handleSCCP(handler DataHandler, data []uint8, packet gopacket.Packet) {
-	sccp := SCCPUDT{}
-	if data[0] != 0x09 {
-		fmt.Printf("SCCP: Not unitdata\n")
+// Connectionless SCCP message types
+const (
+	sccpUDT   = 0x09
+	sccpUDTS  = 0x0a
+	sccpXUDT  = 0x11
+	sccpXUDTS = 0x12
+	sccpLUDT  = 0x13
+	sccpLUDTS = 0x14
+
+	sccpSegmentation = 0x10 // Optional parameter of XUDT and LUDT
+)
+
+// sccpPart returns the variable part the pointer at offset points to.
+// LUDT has two octet pointers and a two octet length of its data, least
+// significant octet first.
+func sccpPart(data []uint8, offset int, widePointer, wideLength bool) ([]uint8, error) {
+	size := 1
+	if widePointer {
+		size = 2
+	}
+	if offset+size > len(data) {
+		return nil, fmt.Errorf("SCCP: pointer at %d beyond %d bytes", offset, len(data))
+	}
+	start := offset + int(data[offset])
+	if widePointer {
+		start = offset + int(binary.LittleEndian.Uint16(data[offset:]))
+	}
+
+	size = 1
+	if wideLength {
+		size = 2
+	}
+	if start+size > len(data) {
+		return nil, fmt.Errorf("SCCP: length at %d beyond %d bytes", start, len(data))
+	}
+	length := int(data[start])
+	if wideLength {
+		length = int(binary.LittleEndian.Uint16(data[start:]))
+	}
+	start += size
+	if start+length > len(data) {
+		return nil, fmt.Errorf("SCCP: %d bytes at %d beyond %d bytes", length, start, len(data))
+	}
+	return data[start : start+length], nil
+}
+
+// Only a message that is not segmented carries a whole TCAP message
+func sccpSegmented(optional []uint8) bool {
+	for len(optional) >= 2 && optional[0] != 0 {
+		tag, length := optional[0], int(optional[1])
+		if 2+length > len(optional) {
+			return false
+		}
+		if tag == sccpSegmentation && length > 0 {
+			first := optional[2]&0x80 != 0
+			remaining := optional[2] & 0x0f
+			return !first || remaining > 0
+		}
+		optional = optional[2+length:]
+	}
+	return false
+}
+
+// SCCPServiceHandler is implemented by handlers that want to count the
+// service messages (UDTS, XUDTS, LUDTS) returning data that could not be
+// delivered. They are not passed on as data as the returned TCAP message
+// is not part of a dialogue between the two addresses.
+type SCCPServiceHandler interface {
+	DataHandler
+	OnSCCPService(msg *Message, cause uint8)
+}
+
+func isSCCPService(t uint8) bool {
+	return t == sccpUDTS || t == sccpXUDTS || t == sccpLUDTS
+}
+
+func handleSCCP(handler DataHandler, msg *Message, data []uint8, packet gopacket.Packet) {
+	if len(data) < 2 {
+		handler.ParseError(data, fmt.Errorf("SCCP: %d bytes", len(data)))
 		return
 	}
-	buf := bytes.NewReader(data)
-	err := binary.Read(buf, binary.BigEndian, &sccp)
+
+	// Offset of the first pointer
+	pointers := 3
+	wide := false
+	switch data[0] {
+	case sccpUDT, sccpUDTS:
+		pointers = 2
+	case sccpXUDT, sccpXUDTS:
+	case sccpLUDT, sccpLUDTS:
+		wide = true
+	default:
+		handler.ParseError(data, fmt.Errorf("SCCP: message type %#x is not connectionless data", data[0]))
+		return
+	}
+	size := 1
+	if wide {
+		size = 2
+	}
+
+	calledDat, err := sccpPart(data, pointers, wide, false)
 	if err != nil {
-		fmt.Printf("Failed SCCP: %v\n", err)
+		handler.ParseError(data, err)
+		return
+	}
+	callingDat, err := sccpPart(data, pointers+size, wide, false)
+	if err != nil {
+		handler.ParseError(data, err)
+		return
+	}
+	payloadDat, err := sccpPart(data, pointers+2*size, wide, wide)
+	if err != nil {
+		handler.ParseError(data, err)
 		return
 	}
 
-	offset := 2 + sccp.FirstMandatory
-	calledLen := data[offset]
-	calledDat := data[offset+1 : offset+1+calledLen]
-	calledAddr, err := parseAddr(calledDat)
+	// XUDT and LUDT point to their optional parameters. Zero if none.
+	if optionalAt := pointers + 3*size; pointers == 3 && optionalAt+size <= len(data) {
+		pointer := int(data[optionalAt])
+		if wide {
+			pointer = int(binary.LittleEndian.Uint16(data[optionalAt:]))
+		}
+		if pointer != 0 && optionalAt+pointer < len(data) && sccpSegmented(data[optionalAt+pointer:]) {
+			handler.ParseError(data, fmt.Errorf("SCCP: segmented %v", SCCPTypeName(data[0])))
+			return
+		}
+	}
 
-	offset = 3 + sccp.SecondMandatory
-	callingLen := data[offset]
-	callingDat := data[offset+1 : offset+1+callingLen]
-	callingAddr, err := parseAddr(callingDat)
+	calledAddr, _ := parseAddr(calledDat)
+	calledAddr.PointCode = msg.DPC
+	callingAddr, _ := parseAddr(callingDat)
+	callingAddr.PointCode = msg.OPC
 
-	offset = 4 + sccp.ThirdMandatory
-	payloadLen := data[offset]
-	payloadDat := data[offset+1 : offset+1+payloadLen]
+	msg.SCCPType = data[0]
+	msg.Called = calledAddr
+	msg.Calling = callingAddr
 
-	handler.OnData(calledAddr, callingAddr, payloadDat, packet)
+	// Service messages carry the return cause where data has its class
+	if isSCCPService(data[0]) {
+		if h, ok := handler.(SCCPServiceHandler); ok {
+			h.OnSCCPService(msg, data[1])
+		}
+		return
+	}
+	msg.ProtocolClass = data[1] & 0x0f
+	deliver(handler, msg, payloadDat, packet)
 }
@@ -0,0 +1,161 @@
+package tcapflow
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/gopacket"
+)
+
+// messageRecorder also keeps the lower layers of each message and the
+// return causes of service messages
+type messageRecorder struct {
+	recordingHandler
+	lower    []Message
+	services []uint8
+}
+
+func (r *messageRecorder) OnSCCPService(msg *Message, cause uint8) {
+	r.lower = append(r.lower, *msg)
+	r.services = append(r.services, cause)
+}
+
+func (r *messageRecorder) OnMessage(msg *Message, data []uint8, packet gopacket.Packet) {
+	r.lower = append(r.lower, *msg)
+	r.OnData(msg.Called, msg.Calling, data, packet)
+}
+
+func testXUDT(called, calling, data, optional []byte) []byte {
+	b := []byte{sccpXUDT, 0x81, 15, 4, byte(4 + len(called)), byte(4 + len(called) + len(calling)), 0}
+	if optional != nil {
+		b[6] = byte(2 + len(called) + 1 + len(calling) + 1 + len(data))
+	}
+	b = append(b, byte(len(called)))
+	b = append(b, called...)
+	b = append(b, byte(len(calling)))
+	b = append(b, calling...)
+	b = append(b, byte(len(data)))
+	b = append(b, data...)
+	return append(b, optional...)
+}
+
+// UDTS returning data with cause 1, no translation for this address
+func testUDTS(called, calling, data []byte) []byte {
+	b := testUDT(called, calling, data)
+	b[0], b[1] = sccpUDTS, 0x01
+	return b
+}
+
+func testLUDT(called, calling, data []byte) []byte {
+	b := []byte{sccpLUDT, 0x00, 15, 8, 0, byte(7 + len(called)), 0, byte(6 + len(called) + len(calling)), 0, 0, 0}
+	b = append(b, byte(len(called)))
+	b = append(b, called...)
+	b = append(b, byte(len(calling)))
+	b = append(b, calling...)
+	b = append(b, byte(len(data)), byte(len(data)>>8))
+	return append(b, data...)
+}
+
+func decodeSCCP(data []byte) *messageRecorder {
+	handler := &messageRecorder{}
+	msg := &Message{OPC: 1, DPC: 2}
+	packet := gopacket.NewPacket(nil, gopacket.DecodePayload, gopacket.Default)
+	func() {
+		defer reportParseError(handler, data)
+		handleSCCP(handler, msg, data, packet)
+	}()
+	return handler
+}
+
+func TestSCCPConnectionless(t *testing.T) {
+	tcap := testTCAP(TCbeginApp, []byte{1, 2, 3, 4}, nil, testInvoke(2))
+	called, calling := testGT("4970000"), testGT("4912345")
+	segment := []byte{sccpSegmentation, 4, 0x80, 1, 2, 3, 0}
+
+	for _, c := range []struct {
+		name     string
+		data     []byte
+		typeName string
+		protocol uint8
+	}{
+		{"UDT", testUDT(called, calling, tcap), "UDT", 0},
+		{"XUDT", testXUDT(called, calling, tcap, nil), "XUDT", 1},
+		{"XUDT with a single segment", testXUDT(called, calling, tcap, segment), "XUDT", 1},
+		{"LUDT", testLUDT(called, calling, tcap), "LUDT", 0},
+	} {
+		handler := decodeSCCP(c.data)
+		if handler.errors != 0 || len(handler.messages) != 1 {
+			t.Errorf("%v: %d errors, %d messages", c.name, handler.errors, len(handler.messages))
+			continue
+		}
+		msg := handler.lower[0]
+		if SCCPTypeName(msg.SCCPType) != c.typeName || msg.ProtocolClass != c.protocol {
+			t.Errorf("%v: type %v class %d", c.name, SCCPTypeName(msg.SCCPType), msg.ProtocolClass)
+		}
+		if msg.Called.Number != "4970000" || msg.Calling.Number != "4912345" || msg.Called.PointCode != 2 || msg.Calling.PointCode != 1 {
+			t.Errorf("%v: addresses %+v %+v", c.name, msg.Called, msg.Calling)
+		}
+		if !bytes.Equal(handler.messages[0].data, tcap) {
+			t.Errorf("%v: data %x", c.name, handler.messages[0].data)
+		}
+	}
+}
+
+// Returned data is counted but not part of a dialogue
+func TestSCCPService(t *testing.T) {
+	tcap := testTCAP(TCbeginApp, []byte{1, 2, 3, 4}, nil, testInvoke(2))
+	called, calling := testGT("4970000"), testGT("4912345")
+	udts := testUDTS(called, calling, tcap)
+
+	handler := decodeSCCP(udts)
+	if handler.errors != 0 || len(handler.messages) != 0 || len(handler.services) != 1 {
+		t.Fatalf("%d errors, %d messages, %d services", handler.errors, len(handler.messages), len(handler.services))
+	}
+	msg := handler.lower[0]
+	if handler.services[0] != 1 || SCCPTypeName(msg.SCCPType) != "UDTS" || msg.Called.Number != "4970000" {
+		t.Errorf("cause %d type %v called %+v", handler.services[0], SCCPTypeName(msg.SCCPType), msg.Called)
+	}
+
+	// Dropped by handlers not counting them
+	plain := &recordingHandler{}
+	handleSCCP(plain, &Message{}, udts, gopacket.NewPacket(nil, gopacket.DecodePayload, gopacket.Default))
+	if plain.errors != 0 || len(plain.messages) != 0 {
+		t.Errorf("%d errors, %d messages", plain.errors, len(plain.messages))
+	}
+}
+
+func TestSCCPParseErrors(t *testing.T) {
+	tcap := testTCAP(TCbeginApp, []byte{1, 2, 3, 4}, nil, testInvoke(2))
+	called, calling := testGT("4970000"), testGT("4912345")
+	udt := testUDT(called, calling, tcap)
+
+	for name, data := range map[string][]byte{
+		"connection request": {0x01, 0, 0, 0, 0},
+		"empty":              {},
+		"truncated":          udt[:len(udt)-3],
+		"bad pointer":        {sccpUDT, 0, 200, 1, 1},
+		"first segment":      testXUDT(called, calling, tcap, []byte{sccpSegmentation, 4, 0x81, 1, 2, 3, 0}),
+		"later segment":      testXUDT(called, calling, tcap, []byte{sccpSegmentation, 4, 0x00, 1, 2, 3, 0}),
+	} {
+		handler := decodeSCCP(data)
+		if handler.errors != 1 || len(handler.messages) != 0 {
+			t.Errorf("%v: %d errors, %d messages", name, handler.errors, len(handler.messages))
+		}
+	}
+}
+
+// Truncated lower layers are parse errors and not printed
+func TestLowerLayerParseErrors(t *testing.T) {
+	packet := gopacket.NewPacket(nil, gopacket.DecodePayload, gopacket.Default)
+	for name, handle := range map[string]func(DataHandler){
+		"M3UA": func(h DataHandler) { HandleM3UA(h, []byte{1, 0, 1}, packet) },
+		"M2PA": func(h DataHandler) { HandleM2PA(h, []byte{1, 0}, packet) },
+		"MTP":  func(h DataHandler) { handleMTP(h, &Message{}, []byte{3}, packet) },
+	} {
+		handler := &messageRecorder{}
+		handle(handler)
+		if handler.errors != 1 || len(handler.messages) != 0 {
+			t.Errorf("%v: %d errors, %d messages", name, handler.errors, len(handler.messages))
+		}
+	}
+}
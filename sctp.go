@@ -0,0 +1,156 @@
+package tcapflow
+
+import (
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// A user message larger than the path MTU is split by SCTP into several
+// DATA chunks with consecutive TSNs. The first one carries the B flag,
+// the last one the E flag. Fragments of ordered messages share the stream
+// sequence number while unordered ones can only be told apart by TSN.
+type sctpStreamKey struct {
+	net       gopacket.Flow
+	transport gopacket.Flow
+	stream    uint16
+	unordered bool
+	sequence  uint16
+}
+
+type sctpFragment struct {
+	begin   bool
+	end     bool
+	payload []byte
+}
+
+type sctpFragments struct {
+	fragments map[uint32]sctpFragment
+	seen      time.Time
+}
+
+type SCTPReassembler struct {
+	streams map[sctpStreamKey]*sctpFragments
+
+	// Fragments that never completed are removed after this time
+	ExpireDuration time.Duration
+	lastExpire     time.Time
+}
+
+func NewSCTPReassembler() *SCTPReassembler {
+	return &SCTPReassembler{
+		streams:        make(map[sctpStreamKey]*sctpFragments),
+		ExpireDuration: 30 * time.Second,
+	}
+}
+
+func buildSCTPStreamKey(data *layers.SCTPData, packet gopacket.Packet) sctpStreamKey {
+	key := sctpStreamKey{
+		stream:    data.StreamId,
+		unordered: data.Unordered,
+	}
+	if !data.Unordered {
+		key.sequence = data.StreamSequence
+	}
+	if net := packet.NetworkLayer(); net != nil {
+		key.net = net.NetworkFlow()
+	}
+	if transport := packet.TransportLayer(); transport != nil {
+		key.transport = transport.TransportFlow()
+	}
+	return key
+}
+
+// Try to find a run of B...E fragments with consecutive TSNs
+func (f *sctpFragments) assemble() (payload []byte, ok bool) {
+	for tsn, frag := range f.fragments {
+		if !frag.begin {
+			continue
+		}
+
+		size := 0
+		last := tsn
+		for {
+			cur, found := f.fragments[last]
+			if !found {
+				break
+			}
+			size += len(cur.payload)
+			if cur.end {
+				ok = true
+				break
+			}
+			last++
+		}
+		if !ok {
+			continue
+		}
+
+		payload = make([]byte, 0, size)
+		for i := tsn; ; i++ {
+			payload = append(payload, f.fragments[i].payload...)
+			delete(f.fragments, i)
+			if i == last {
+				break
+			}
+		}
+		return
+	}
+	return
+}
+
+// Reassemble returns the SCTP DATA chunk holding the complete user
+// message or nil if more fragments are needed.
+func (r *SCTPReassembler) Reassemble(data *layers.SCTPData, packet gopacket.Packet) *layers.SCTPData {
+	now := packet.Metadata().Timestamp
+	r.expire(now)
+
+	if data.BeginFragment && data.EndFragment {
+		return data
+	}
+
+	key := buildSCTPStreamKey(data, packet)
+	frags, ok := r.streams[key]
+	if !ok {
+		frags = &sctpFragments{fragments: make(map[uint32]sctpFragment)}
+		r.streams[key] = frags
+	}
+	frags.seen = now
+
+	// The packet data might be re-used. Keep a copy.
+	payload := make([]byte, len(data.Payload))
+	copy(payload, data.Payload)
+	frags.fragments[data.TSN] = sctpFragment{
+		begin:   data.BeginFragment,
+		end:     data.EndFragment,
+		payload: payload,
+	}
+
+	full, ok := frags.assemble()
+	if !ok {
+		return nil
+	}
+	if len(frags.fragments) == 0 {
+		delete(r.streams, key)
+	}
+
+	result := *data
+	result.BeginFragment = true
+	result.EndFragment = true
+	result.Payload = full
+	return &result
+}
+
+func (r *SCTPReassembler) expire(now time.Time) {
+	if now.Sub(r.lastExpire) < time.Second {
+		return
+	}
+	r.lastExpire = now
+
+	for key, frags := range r.streams {
+		if now.Sub(frags.seen) > r.ExpireDuration {
+			delete(r.streams, key)
+		}
+	}
+}
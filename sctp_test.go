@@ -0,0 +1,95 @@
+package tcapflow
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// A decoded SCTP DATA chunk of stream 1 between 10.0.0.1 and 10.0.0.2
+func testChunk(t *testing.T, at time.Time, tsn uint32, sequence uint16, flags byte, payload []byte) (*layers.SCTPData, gopacket.Packet) {
+	ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolSCTP, SrcIP: []byte{10, 0, 0, 1}, DstIP: []byte{10, 0, 0, 2}}
+	chunk := []byte{0, flags, 0, byte(16 + len(payload)),
+		byte(tsn >> 24), byte(tsn >> 16), byte(tsn >> 8), byte(tsn), 0, 1, byte(sequence >> 8), byte(sequence), 0, 0, 0, 3}
+	header := []byte{0x0b, 0x59, 0x0b, 0x59, 0, 0, 0, 0, 0, 0, 0, 0}
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, ip, gopacket.Payload(append(append(header, chunk...), payload...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+	packet.Metadata().Timestamp = at
+	for _, l := range packet.Layers() {
+		if data, ok := l.(*layers.SCTPData); ok {
+			return data, packet
+		}
+	}
+	t.Fatalf("no SCTP DATA in %v", packet)
+	return nil, nil
+}
+
+const (
+	sctpBegin     = 2
+	sctpEnd       = 1
+	sctpUnordered = 4
+)
+
+func TestSCTPReassemblesOutOfOrder(t *testing.T) {
+	r := NewSCTPReassembler()
+	now := time.Unix(1000, 0)
+	last, lastPacket := testChunk(t, now, 12, 5, sctpEnd, []byte{9, 10, 11, 12})
+	first, firstPacket := testChunk(t, now, 10, 5, sctpBegin, []byte{1, 2, 3, 4})
+	middle, middlePacket := testChunk(t, now, 11, 5, 0, []byte{5, 6, 7, 8})
+
+	if r.Reassemble(last, lastPacket) != nil || r.Reassemble(first, firstPacket) != nil {
+		t.Fatal("reassembled before the middle fragment")
+	}
+	full := r.Reassemble(middle, middlePacket)
+	if full == nil {
+		t.Fatal("not reassembled")
+	}
+	if !bytes.Equal(full.Payload, []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}) || !full.BeginFragment || !full.EndFragment {
+		t.Errorf("reassembled %+v", full)
+	}
+	if len(r.streams) != 0 {
+		t.Errorf("%d streams left", len(r.streams))
+	}
+}
+
+func TestSCTPUnfragmentedAndUnordered(t *testing.T) {
+	r := NewSCTPReassembler()
+	now := time.Unix(1000, 0)
+	whole, packet := testChunk(t, now, 1, 0, sctpBegin|sctpEnd, []byte{1, 2, 3, 4})
+	if r.Reassemble(whole, packet) != whole {
+		t.Error("unfragmented chunk not passed through")
+	}
+
+	// Unordered fragments only have the TSN in common
+	first, firstPacket := testChunk(t, now, 20, 7, sctpUnordered|sctpBegin, []byte{1, 2, 3, 4})
+	last, lastPacket := testChunk(t, now, 21, 9, sctpUnordered|sctpEnd, []byte{5, 6, 7, 8})
+	r.Reassemble(first, firstPacket)
+	full := r.Reassemble(last, lastPacket)
+	if full == nil || len(full.Payload) != 8 {
+		t.Errorf("unordered message %+v", full)
+	}
+}
+
+func TestSCTPExpiresIncompleteMessages(t *testing.T) {
+	r := NewSCTPReassembler()
+	now := time.Unix(1000, 0)
+	first, firstPacket := testChunk(t, now, 10, 5, sctpBegin, []byte{1, 2, 3, 4})
+	r.Reassemble(first, firstPacket)
+
+	other, otherPacket := testChunk(t, now.Add(time.Minute), 30, 6, sctpBegin, []byte{1, 2, 3, 4})
+	r.Reassemble(other, otherPacket)
+	last, lastPacket := testChunk(t, now.Add(time.Minute), 11, 5, sctpEnd, []byte{5, 6, 7, 8})
+	if full := r.Reassemble(last, lastPacket); full != nil {
+		t.Errorf("completed an expired message %+v", full)
+	}
+	if len(r.streams) != 2 {
+		t.Errorf("%d streams", len(r.streams))
+	}
+}
@@ -0,0 +1,300 @@
+package tcapflow
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var ErrSpoolFull = errors.New("spool is full")
+
+// Spool is a bounded on-disk FIFO of records. Records are appended to
+// segment files in Dir and read back in order with Peek and Commit. The
+// read position is kept in Dir as well so a restart continues where it
+// left off. A record torn by a crash or a failed write is cut off when
+// opened and a corrupt one ends the reading of its segment. It is not
+// safe for concurrent use.
+type Spool struct {
+	Dir         string
+	MaxBytes    int64
+	SegmentSize int64
+
+	segments []uint64 // Oldest first
+	size     int64    // Bytes of all segments
+	count    int      // Records not committed
+
+	writer  *os.File
+	written int64
+
+	offset int64   // Committed read offset in the first segment
+	peeked []int64 // Offsets after the peeked records
+}
+
+func spoolName(dir string, segment uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%016d.spool", segment))
+}
+
+// Each record is preceded by its length and CRC-32
+const spoolHeader = 8
+
+// Read the records of a segment starting at offset. Returns the records
+// and the offsets after each. torn is true when a truncated or corrupt
+// record was found, which ends what can be read of the segment.
+func readSegment(name string, offset int64, max int) (records [][]byte, ends []int64, torn bool, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return nil, nil, false, err
+	}
+
+	r := bufio.NewReader(f)
+	header := make([]byte, spoolHeader)
+	for max < 0 || len(records) < max {
+		if _, err := io.ReadFull(r, header); err != nil {
+			torn = err != io.EOF
+			break
+		}
+		length := int64(binary.BigEndian.Uint32(header))
+		if offset+spoolHeader+length > info.Size() {
+			torn = true
+			break
+		}
+		record := make([]byte, length)
+		if _, err := io.ReadFull(r, record); err != nil || crc32.ChecksumIEEE(record) != binary.BigEndian.Uint32(header[4:]) {
+			torn = true
+			break
+		}
+		offset += spoolHeader + length
+		records = append(records, record)
+		ends = append(ends, offset)
+	}
+	return records, ends, torn, nil
+}
+
+func OpenSpool(dir string, maxBytes, segmentSize int64) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &Spool{Dir: dir, MaxBytes: maxBytes, SegmentSize: segmentSize}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*.spool"))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		segment, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), ".spool"), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, segment)
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i] < s.segments[j] })
+
+	// Continue at the saved position of the first segment
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "position")); err == nil && len(s.segments) > 0 {
+		var segment uint64
+		var offset int64
+		if _, err := fmt.Sscan(string(data), &segment, &offset); err == nil && segment == s.segments[0] {
+			s.offset = offset
+		}
+	}
+
+	// Cut off what was torn by a crash or a failed write
+	for i, segment := range s.segments {
+		name := spoolName(dir, segment)
+		offset := int64(0)
+		if i == 0 {
+			offset = s.offset
+		}
+		records, ends, torn, err := readSegment(name, offset, -1)
+		if err != nil {
+			return nil, err
+		}
+		if torn {
+			end := offset
+			if len(ends) > 0 {
+				end = ends[len(ends)-1]
+			}
+			if err := os.Truncate(name, end); err != nil {
+				return nil, err
+			}
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		s.size += info.Size()
+		s.count += len(records)
+	}
+	return s, nil
+}
+
+// Count the records again after some were found corrupt
+func (s *Spool) recount() {
+	s.count = 0
+	for i, segment := range s.segments {
+		offset := int64(0)
+		if i == 0 {
+			offset = s.offset
+		}
+		records, _, _, _ := readSegment(spoolName(s.Dir, segment), offset, -1)
+		s.count += len(records)
+	}
+}
+
+// Len is the number of records not committed
+func (s *Spool) Len() int {
+	return s.count
+}
+
+// Size is the number of bytes on disk
+func (s *Spool) Size() int64 {
+	return s.size
+}
+
+func (s *Spool) Append(record []byte) error {
+	length := spoolHeader + int64(len(record))
+	if s.MaxBytes > 0 && s.size+length > s.MaxBytes {
+		return ErrSpoolFull
+	}
+
+	if s.writer != nil && s.written >= s.SegmentSize {
+		s.writer.Close()
+		s.writer = nil
+	}
+	if s.writer == nil {
+		segment := uint64(1)
+		if len(s.segments) > 0 {
+			segment = s.segments[len(s.segments)-1] + 1
+		}
+		f, err := os.OpenFile(spoolName(s.Dir, segment), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		s.writer = f
+		s.written = 0
+		s.segments = append(s.segments, segment)
+	}
+
+	data := make([]byte, length)
+	binary.BigEndian.PutUint32(data, uint32(len(record)))
+	binary.BigEndian.PutUint32(data[4:], crc32.ChecksumIEEE(record))
+	copy(data[spoolHeader:], record)
+	n, err := s.writer.Write(data)
+	if err != nil {
+		s.cutTorn(n)
+		return err
+	}
+	s.written += int64(n)
+	s.size += int64(n)
+	s.count++
+	return nil
+}
+
+// Remove the n bytes of a failed write. If that fails as well the segment
+// is closed and the reader skips the torn record at its end.
+func (s *Spool) cutTorn(n int) {
+	err := s.writer.Truncate(s.written)
+	if err == nil {
+		_, err = s.writer.Seek(s.written, io.SeekStart)
+	}
+	if err != nil {
+		s.written += int64(n)
+		s.size += int64(n)
+		s.writer.Close()
+		s.writer = nil
+	}
+}
+
+// Peek returns up to max of the oldest records without removing them.
+// Segments that were read or whose rest is corrupt are removed.
+func (s *Spool) Peek(max int) ([][]byte, error) {
+	s.peeked = nil
+	for len(s.segments) > 0 {
+		records, ends, torn, err := readSegment(spoolName(s.Dir, s.segments[0]), s.offset, max)
+		if err != nil {
+			return nil, err
+		}
+		if len(records) > 0 {
+			s.peeked = ends
+			return records, nil
+		}
+		// Still being written to
+		if !torn && len(s.segments) == 1 && s.writer != nil {
+			break
+		}
+		err = s.removeSegment()
+		if torn {
+			s.recount()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(s.segments) == 0 {
+		s.count = 0
+	}
+	return nil, nil
+}
+
+// Commit removes the first n records returned by Peek
+func (s *Spool) Commit(n int) error {
+	if n <= 0 || n > len(s.peeked) {
+		return nil
+	}
+	s.offset = s.peeked[n-1]
+	s.peeked = nil
+	s.count -= n
+
+	info, err := os.Stat(spoolName(s.Dir, s.segments[0]))
+	if err != nil {
+		return err
+	}
+	if s.offset < info.Size() {
+		return ioutil.WriteFile(filepath.Join(s.Dir, "position"),
+			[]byte(fmt.Sprintf("%d %d\n", s.segments[0], s.offset)), 0644)
+	}
+	return s.removeSegment()
+}
+
+// Remove the first segment. The next Append starts a new one if it was
+// still written to.
+func (s *Spool) removeSegment() error {
+	name := spoolName(s.Dir, s.segments[0])
+	if len(s.segments) == 1 && s.writer != nil {
+		s.writer.Close()
+		s.writer = nil
+	}
+	if info, err := os.Stat(name); err == nil {
+		s.size -= info.Size()
+	}
+	s.segments = s.segments[1:]
+	s.offset = 0
+	os.Remove(filepath.Join(s.Dir, "position"))
+	return os.Remove(name)
+}
+
+func (s *Spool) Close() error {
+	if s.writer == nil {
+		return nil
+	}
+	err := s.writer.Close()
+	s.writer = nil
+	return err
+}
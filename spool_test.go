@@ -0,0 +1,187 @@
+package tcapflow
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openTestSpool(t *testing.T, dir string) *Spool {
+	s, err := OpenSpool(dir, 1000, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// Peek and commit everything left
+func drainSpool(t *testing.T, s *Spool) []string {
+	var records []string
+	for s.Len() > 0 {
+		peeked, err := s.Peek(4)
+		if err != nil || len(peeked) == 0 {
+			t.Fatalf("peeked %d with %d left: %v", len(peeked), s.Len(), err)
+		}
+		for _, record := range peeked {
+			records = append(records, string(record))
+		}
+		if err := s.Commit(len(peeked)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return records
+}
+
+func TestSpoolKeepsOrderAcrossRestarts(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := openTestSpool(t, dir)
+	for i := 0; i < 20; i++ {
+		if err := s.Append([]byte(fmt.Sprintf("rec%02d", i))); err != nil {
+			t.Fatal(i, err)
+		}
+	}
+	if s.Len() != 20 {
+		t.Fatalf("%d records", s.Len())
+	}
+	peeked, _ := s.Peek(3)
+	if len(peeked) != 3 || string(peeked[0]) != "rec00" {
+		t.Fatalf("peeked %q", peeked)
+	}
+	s.Commit(2)
+	s.Close()
+
+	s = openTestSpool(t, dir)
+	if s.Len() != 18 {
+		t.Fatalf("%d records after the restart", s.Len())
+	}
+	records := drainSpool(t, s)
+	if len(records) != 18 || records[0] != "rec02" || records[17] != "rec19" || s.Size() != 0 {
+		t.Errorf("records %v, %d bytes left", records, s.Size())
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("%d files left", len(files))
+	}
+
+	// Appending again after everything was read
+	s.Append([]byte("x"))
+	if records := drainSpool(t, s); len(records) != 1 || records[0] != "x" {
+		t.Errorf("records %v", records)
+	}
+	s.Close()
+}
+
+func TestSpoolFull(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := openTestSpool(t, dir)
+	defer s.Close()
+	for i := 0; ; i++ {
+		err := s.Append(make([]byte, 10))
+		if err == ErrSpoolFull {
+			if s.Size() > s.MaxBytes || s.Size() < s.MaxBytes-50 {
+				t.Errorf("full at %d bytes", s.Size())
+			}
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	names, _ := filepath.Glob(filepath.Join(dir, "*.spool"))
+	if len(names) < 10 {
+		t.Errorf("%d segments", len(names))
+	}
+}
+
+func appendRecords(t *testing.T, s *Spool, from, to int) {
+	for i := from; i < to; i++ {
+		if err := s.Append([]byte(fmt.Sprintf("rec%02d", i))); err != nil {
+			t.Fatal(i, err)
+		}
+	}
+}
+
+// A record torn by a crash is cut off when the spool is opened again
+func TestSpoolTornTail(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := openTestSpool(t, dir)
+	appendRecords(t, s, 0, 2)
+	s.Close()
+	name := spoolName(dir, s.segments[0])
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 5, 1, 2})
+	f.Close()
+
+	s = openTestSpool(t, dir)
+	if s.Len() != 2 {
+		t.Fatalf("%d records", s.Len())
+	}
+	if info, _ := os.Stat(name); info.Size() != s.Size() || s.Size() != 2*(spoolHeader+5) {
+		t.Errorf("%d bytes on disk, size %d", info.Size(), s.Size())
+	}
+	if records := drainSpool(t, s); len(records) != 2 || records[1] != "rec01" {
+		t.Errorf("records %v", records)
+	}
+	s.Close()
+}
+
+// The rest of a segment after a corrupt record is skipped
+func TestSpoolSkipsCorruptSegment(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := openTestSpool(t, dir)
+	appendRecords(t, s, 0, 10)
+	if len(s.segments) < 2 {
+		t.Fatalf("%d segments", len(s.segments))
+	}
+	// Flip a bit of the second record of the first segment
+	name := spoolName(dir, s.segments[0])
+	data, _ := ioutil.ReadFile(name)
+	data[spoolHeader+5+spoolHeader] ^= 1
+	ioutil.WriteFile(name, data, 0644)
+
+	records := drainSpool(t, s)
+	if len(records) == 0 || records[0] != "rec00" || records[len(records)-1] != "rec09" {
+		t.Errorf("records %v", records)
+	}
+	segmentSize := int(s.SegmentSize+spoolHeader+5-1) / (spoolHeader + 5)
+	if len(records) != 10-segmentSize+1 {
+		t.Errorf("%d records left of 10 with %d per segment", len(records), segmentSize)
+	}
+	if s.Len() != 0 || s.Size() != 0 {
+		t.Errorf("%d records and %d bytes left", s.Len(), s.Size())
+	}
+	s.Close()
+}
+
+// A failed write neither tears the segment nor stops the spool
+func TestSpoolFailedWrite(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s := openTestSpool(t, dir)
+	appendRecords(t, s, 0, 1)
+	s.writer.Close()
+	if err := s.Append([]byte("lost")); err == nil {
+		t.Fatal("appended to a closed segment")
+	}
+	appendRecords(t, s, 1, 3)
+	if s.Len() != 3 {
+		t.Errorf("%d records", s.Len())
+	}
+	if records := drainSpool(t, s); len(records) != 3 || records[2] != "rec02" {
+		t.Errorf("records %v", records)
+	}
+	s.Close()
+}
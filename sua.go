@@ -7,5 +7,5 @@ import (
 )
 
 func HandleSUA(handler DataHandler, data *layers.SCTPData, packet gopacket.Packet) {
-	fmt.Printf("SUA not implemented\n")
+	handler.ParseError(data.Payload, fmt.Errorf("SUA not implemented"))
 }
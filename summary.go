@@ -0,0 +1,320 @@
+package tcapflow
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// LatencyHistogram records microseconds in log-linear buckets like an HDR
+// histogram with two significant digits. Buckets are sparse so histograms
+// of different probes can be merged.
+type LatencyHistogram struct {
+	Counts map[int]uint64 `json:"counts"`
+	Total  uint64         `json:"total"`
+	Max    int64          `json:"maxMicros"`
+}
+
+// Values below subBuckets are exact. Above, each power of two is split
+// in halfBuckets.
+const (
+	subBuckets  = 128
+	halfBuckets = subBuckets / 2
+)
+
+func histogramIndex(value int64) int {
+	if value < subBuckets {
+		return int(value)
+	}
+	shift := bits.Len64(uint64(value)) - 7
+	return shift*halfBuckets + int(value>>uint(shift))
+}
+
+// Highest value that falls into the bucket
+func histogramUpper(index int) int64 {
+	if index < subBuckets {
+		return int64(index)
+	}
+	shift := uint(index/halfBuckets - 1)
+	sub := int64(index - int(shift)*halfBuckets)
+	return (sub+1)<<shift - 1
+}
+
+func (h *LatencyHistogram) Record(latency time.Duration) {
+	value := int64(latency / time.Microsecond)
+	if value < 0 {
+		value = 0
+	}
+	if h.Counts == nil {
+		h.Counts = make(map[int]uint64)
+	}
+	h.Counts[histogramIndex(value)]++
+	h.Total++
+	if value > h.Max {
+		h.Max = value
+	}
+}
+
+func (h *LatencyHistogram) Merge(other LatencyHistogram) {
+	if h.Counts == nil {
+		h.Counts = make(map[int]uint64)
+	}
+	for index, count := range other.Counts {
+		h.Counts[index] += count
+	}
+	h.Total += other.Total
+	if other.Max > h.Max {
+		h.Max = other.Max
+	}
+}
+
+// Percentile p in [0, 100]
+func (h *LatencyHistogram) Percentile(p float64) time.Duration {
+	if h.Total == 0 {
+		return 0
+	}
+	indices := make([]int, 0, len(h.Counts))
+	for index := range h.Counts {
+		indices = append(indices, index)
+	}
+	sort.Ints(indices)
+
+	rank := uint64(p / 100 * float64(h.Total))
+	if rank == 0 {
+		rank = 1
+	}
+	seen := uint64(0)
+	value := h.Max
+	for _, index := range indices {
+		seen += h.Counts[index]
+		if seen >= rank {
+			value = histogramUpper(index)
+			break
+		}
+	}
+	if value > h.Max {
+		value = h.Max
+	}
+	return time.Duration(value) * time.Microsecond
+}
+
+// SummaryEntry holds the dialogues of one operation towards one peer. The
+// percentiles and ratios are filled in when writing the summary.
+type SummaryEntry struct {
+	Operation string           `json:"operation"`
+	Peer      string           `json:"peer"`
+	Latency   LatencyHistogram `json:"latency"`
+	Aborts    uint64           `json:"aborts"`
+	Timeouts  uint64           `json:"timeouts"`
+
+	Count        uint64  `json:"count"`
+	P50          float64 `json:"p50Ms"`
+	P90          float64 `json:"p90Ms"`
+	P99          float64 `json:"p99Ms"`
+	MaxMs        float64 `json:"maxMs"`
+	AbortRatio   float64 `json:"abortRatio"`
+	TimeoutRatio float64 `json:"timeoutRatio"`
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (e *SummaryEntry) compute() {
+	e.Count = e.Latency.Total + e.Timeouts
+	e.P50 = milliseconds(e.Latency.Percentile(50))
+	e.P90 = milliseconds(e.Latency.Percentile(90))
+	e.P99 = milliseconds(e.Latency.Percentile(99))
+	e.MaxMs = milliseconds(time.Duration(e.Latency.Max) * time.Microsecond)
+	e.AbortRatio = 0
+	e.TimeoutRatio = 0
+	if e.Count > 0 {
+		e.AbortRatio = float64(e.Aborts) / float64(e.Count)
+		e.TimeoutRatio = float64(e.Timeouts) / float64(e.Count)
+	}
+}
+
+// Summary collects latencies between two reports. It is safe for
+// concurrent use by the pipeline shards.
+type Summary struct {
+	sync.Mutex
+	Probes  []string        `json:"probes,omitempty"`
+	Start   time.Time       `json:"start"`
+	End     time.Time       `json:"end"`
+	Entries []*SummaryEntry `json:"entries"`
+
+	index map[string]*SummaryEntry
+}
+
+func NewSummary(probe string, start time.Time) *Summary {
+	s := &Summary{Start: start, index: make(map[string]*SummaryEntry)}
+	if probe != "" {
+		s.Probes = []string{probe}
+	}
+	return s
+}
+
+// The lock needs to be held
+func (s *Summary) entry(operation, peer string) *SummaryEntry {
+	if s.index == nil {
+		s.index = make(map[string]*SummaryEntry)
+		for _, e := range s.Entries {
+			s.index[e.Operation+"\x00"+e.Peer] = e
+		}
+	}
+	key := operation + "\x00" + peer
+	e, ok := s.index[key]
+	if !ok {
+		e = &SummaryEntry{Operation: operation, Peer: peer}
+		s.index[key] = e
+		s.Entries = append(s.Entries, e)
+	}
+	return e
+}
+
+func (s *Summary) Completed(operation, peer string, latency time.Duration, abort bool) {
+	s.Lock()
+	defer s.Unlock()
+	e := s.entry(operation, peer)
+	e.Latency.Record(latency)
+	if abort {
+		e.Aborts++
+	}
+}
+
+func (s *Summary) Timeout(operation, peer string) {
+	s.Lock()
+	defer s.Unlock()
+	s.entry(operation, peer).Timeouts++
+}
+
+// Rotate hands out the collected entries and starts over at now.
+func (s *Summary) Rotate(now time.Time) *Summary {
+	s.Lock()
+	defer s.Unlock()
+	done := &Summary{
+		Probes:  s.Probes,
+		Start:   s.Start,
+		End:     now,
+		Entries: s.Entries,
+	}
+	s.Start = now
+	s.Entries = nil
+	s.index = make(map[string]*SummaryEntry)
+	return done
+}
+
+// Merge adds the entries of another probe or interval.
+func (s *Summary) Merge(other *Summary) {
+	s.Lock()
+	defer s.Unlock()
+	if s.Start.IsZero() || (!other.Start.IsZero() && other.Start.Before(s.Start)) {
+		s.Start = other.Start
+	}
+	if other.End.After(s.End) {
+		s.End = other.End
+	}
+	for _, probe := range other.Probes {
+		known := false
+		for _, p := range s.Probes {
+			known = known || p == probe
+		}
+		if !known {
+			s.Probes = append(s.Probes, probe)
+		}
+	}
+	for _, o := range other.Entries {
+		e := s.entry(o.Operation, o.Peer)
+		e.Latency.Merge(o.Latency)
+		e.Aborts += o.Aborts
+		e.Timeouts += o.Timeouts
+	}
+}
+
+func (s *Summary) sorted() {
+	sort.Slice(s.Entries, func(i, j int) bool {
+		if s.Entries[i].Operation != s.Entries[j].Operation {
+			return s.Entries[i].Operation < s.Entries[j].Operation
+		}
+		return s.Entries[i].Peer < s.Entries[j].Peer
+	})
+	for _, e := range s.Entries {
+		e.compute()
+	}
+}
+
+// WriteJSON writes the summary as a single line so files of several
+// probes can be concatenated and merged.
+func (s *Summary) WriteJSON(w io.Writer) error {
+	s.Lock()
+	defer s.Unlock()
+	s.sorted()
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+func (s *Summary) WriteTable(w io.Writer) error {
+	s.Lock()
+	defer s.Unlock()
+	s.sorted()
+
+	fmt.Fprintf(w, "SUMMARY %v - %v %v\n", s.Start.Format(time.RFC3339), s.End.Format(time.RFC3339), s.Probes)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "OPERATION\tPEER\tCOUNT\tP50(ms)\tP90(ms)\tP99(ms)\tMAX(ms)\tABORT%%\tTIMEOUT%%\t\n")
+	for _, e := range s.Entries {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%.1f\t%.1f\t%.1f\t%.1f\t%.2f\t%.2f\t\n",
+			e.Operation, e.Peer, e.Count, e.P50, e.P90, e.P99, e.MaxMs,
+			100*e.AbortRatio, 100*e.TimeoutRatio)
+	}
+	return tw.Flush()
+}
+
+// Write in "table" or "json" format
+func (s *Summary) Write(w io.Writer, format string) error {
+	if format == "json" {
+		return s.WriteJSON(w)
+	}
+	return s.WriteTable(w)
+}
+
+// ReadSummaries merges all JSON summaries of the files.
+func ReadSummaries(files []string) (*Summary, error) {
+	merged := NewSummary("", time.Time{})
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 64*1024*1024)
+		for scanner.Scan() {
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+			var summary Summary
+			err = json.Unmarshal(scanner.Bytes(), &summary)
+			if err != nil {
+				f.Close()
+				return nil, fmt.Errorf("%v: %v", file, err)
+			}
+			merged.Merge(&summary)
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return merged, nil
+}
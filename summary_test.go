@@ -0,0 +1,95 @@
+package tcapflow
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogramPercentiles(t *testing.T) {
+	var h LatencyHistogram
+	for i := 1; i <= 10000; i++ {
+		h.Record(time.Duration(i) * time.Millisecond)
+	}
+	for _, p := range []float64{50, 90, 99, 100} {
+		got := h.Percentile(p)
+		want := time.Duration(p*100) * time.Millisecond
+		if got < want || float64(got) > float64(want)*1.02 {
+			t.Errorf("p%v = %v, want %v", p, got, want)
+		}
+	}
+	for i := 0; i < 5000; i++ {
+		index := histogramIndex(int64(i))
+		if histogramUpper(index) < int64(i) || (index > 0 && histogramUpper(index-1) >= int64(i)) {
+			t.Fatalf("%d is in bucket %d", i, index)
+		}
+	}
+}
+
+func TestSummaryRatios(t *testing.T) {
+	s := NewSummary("a", time.Unix(0, 0))
+	s.Completed("op2", "peer", 10*time.Millisecond, false)
+	s.Completed("op2", "peer", 20*time.Millisecond, true)
+	s.Timeout("op2", "peer")
+	s.Timeout("op2", "peer")
+
+	var buf bytes.Buffer
+	if err := s.Rotate(time.Unix(60, 0)).WriteJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var out Summary
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	e := out.Entries[0]
+	if e.Count != 4 || e.AbortRatio != 0.25 || e.TimeoutRatio != 0.5 {
+		t.Errorf("got %+v", e)
+	}
+	if len(s.Rotate(time.Unix(120, 0)).Entries) != 0 {
+		t.Errorf("entries were not handed out")
+	}
+}
+
+func TestReadSummariesMerges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "summary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var files []string
+	for i, probe := range []string{"a", "b"} {
+		s := NewSummary(probe, time.Unix(int64(i), 0))
+		s.Completed("op2", "peer", time.Duration(i+1)*time.Millisecond, false)
+		s.Timeout("op"+probe, "peer")
+		var buf bytes.Buffer
+		s.Rotate(time.Unix(60, 0)).WriteJSON(&buf)
+		file := filepath.Join(dir, probe+".json")
+		ioutil.WriteFile(file, buf.Bytes(), 0644)
+		files = append(files, file)
+	}
+
+	merged, err := ReadSummaries(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	merged.WriteTable(&buf)
+	table := buf.String()
+	if !strings.Contains(table, "opa") || !strings.Contains(table, "opb") {
+		t.Errorf("missing entries\n%s", table)
+	}
+	for _, e := range merged.Entries {
+		if e.Operation == "op2" && e.Latency.Total != 2 {
+			t.Errorf("op2 merged %d latencies", e.Latency.Total)
+		}
+	}
+	if len(merged.Probes) != 2 {
+		t.Errorf("probes %v", merged.Probes)
+	}
+}
@@ -2,6 +2,7 @@ package tcapflow
 
 import (
 	"encoding/asn1"
+	"errors"
 	"strconv"
 )
 
@@ -59,3 +60,49 @@ func DecodeTCAP(data []byte) (tag int, otid asn1.RawValue, dtid asn1.RawValue, d
 	}
 	return
 }
+
+// DecodeApplicationContext extracts the application-context-name of the
+// AARQ/AARE carried in the dialogue portion.
+func DecodeApplicationContext(dialoguePortion asn1.RawValue) (ac asn1.ObjectIdentifier, err error) {
+	var external asn1.RawValue
+
+	_, err = asn1.Unmarshal(dialoguePortion.Bytes, &external)
+	if err != nil {
+		return
+	}
+
+	data := external.Bytes
+	for len(data) > 0 {
+		var tmp asn1.RawValue
+		data, err = asn1.Unmarshal(data, &tmp)
+		if err != nil {
+			return
+		}
+
+		// single-ASN1-type [0] holds the dialogue PDU
+		if tmp.Class != asn1.ClassContextSpecific || tmp.Tag != 0 {
+			continue
+		}
+		var pdu asn1.RawValue
+		_, err = asn1.Unmarshal(tmp.Bytes, &pdu)
+		if err != nil {
+			return
+		}
+
+		fields := pdu.Bytes
+		for len(fields) > 0 {
+			var field asn1.RawValue
+			fields, err = asn1.Unmarshal(fields, &field)
+			if err != nil {
+				return
+			}
+			// application-context-name [1]
+			if field.Class == asn1.ClassContextSpecific && field.Tag == 1 {
+				_, err = asn1.Unmarshal(field.Bytes, &ac)
+				return
+			}
+		}
+	}
+	err = errors.New("No application context")
+	return
+}
@@ -0,0 +1,284 @@
+package tcapflow
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TDR is the transaction detail record of one TCAP dialogue.
+type TDR struct {
+	StartTime          time.Time
+	EndTime            time.Time // Zero when no response was seen
+	Latency            time.Duration
+	Calling            SCCPAddress
+	Called             SCCPAddress
+	Otid               []byte
+	Dtid               []byte // The TID of the responder
+	ApplicationContext string
+	Operations         []int
+	ErrorCodes         []int
+	Rejects            int
+	Outcome            string
+	Messages           int
+}
+
+// AddComponents notes the invoked operations and errors of one message.
+func (r *TDR) AddComponents(infos []ROSInfo) {
+	for _, info := range infos {
+		switch info.Type {
+		case ROSInvoke:
+			known := false
+			for _, op := range r.Operations {
+				known = known || op == info.OpCode
+			}
+			if !known {
+				r.Operations = append(r.Operations, info.OpCode)
+			}
+		case ROSError:
+			r.ErrorCodes = append(r.ErrorCodes, info.ErrorCode)
+		case ROSReject:
+			r.Rejects++
+		}
+	}
+}
+
+var tdrColumns = []string{
+	"startTime", "endTime", "latencyMs",
+	"callingGt", "callingSsn", "callingPc",
+	"calledGt", "calledSsn", "calledPc",
+	"otid", "dtid", "applicationContext",
+	"operations", "errorCodes", "rejects", "outcome", "messages",
+}
+
+func tdrTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func joinInts(values []int) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = strconv.Itoa(v)
+	}
+	return strings.Join(parts, ";")
+}
+
+func (r *TDR) fields() []string {
+	return []string{
+		tdrTime(r.StartTime), tdrTime(r.EndTime),
+		strconv.FormatFloat(milliseconds(r.Latency), 'f', 3, 64),
+		r.Calling.Number, strconv.Itoa(int(r.Calling.Ssn)), strconv.Itoa(int(r.Calling.PointCode)),
+		r.Called.Number, strconv.Itoa(int(r.Called.Ssn)), strconv.Itoa(int(r.Called.PointCode)),
+		hex.EncodeToString(r.Otid), hex.EncodeToString(r.Dtid), r.ApplicationContext,
+		joinInts(r.Operations), joinInts(r.ErrorCodes), strconv.Itoa(r.Rejects),
+		r.Outcome, strconv.Itoa(r.Messages),
+	}
+}
+
+type tdrJSON struct {
+	StartTime          string  `json:"startTime"`
+	EndTime            string  `json:"endTime,omitempty"`
+	LatencyMs          float64 `json:"latencyMs"`
+	CallingGt          string  `json:"callingGt"`
+	CallingSsn         uint8   `json:"callingSsn"`
+	CallingPc          uint32  `json:"callingPc"`
+	CalledGt           string  `json:"calledGt"`
+	CalledSsn          uint8   `json:"calledSsn"`
+	CalledPc           uint32  `json:"calledPc"`
+	Otid               string  `json:"otid"`
+	Dtid               string  `json:"dtid,omitempty"`
+	ApplicationContext string  `json:"applicationContext,omitempty"`
+	Operations         []int   `json:"operations"`
+	ErrorCodes         []int   `json:"errorCodes,omitempty"`
+	Rejects            int     `json:"rejects,omitempty"`
+	Outcome            string  `json:"outcome"`
+	Messages           int     `json:"messages"`
+}
+
+func (r *TDR) MarshalJSON() ([]byte, error) {
+	return json.Marshal(tdrJSON{
+		StartTime:          tdrTime(r.StartTime),
+		EndTime:            tdrTime(r.EndTime),
+		LatencyMs:          milliseconds(r.Latency),
+		CallingGt:          r.Calling.Number,
+		CallingSsn:         r.Calling.Ssn,
+		CallingPc:          r.Calling.PointCode,
+		CalledGt:           r.Called.Number,
+		CalledSsn:          r.Called.Ssn,
+		CalledPc:           r.Called.PointCode,
+		Otid:               hex.EncodeToString(r.Otid),
+		Dtid:               hex.EncodeToString(r.Dtid),
+		ApplicationContext: r.ApplicationContext,
+		Operations:         r.Operations,
+		ErrorCodes:         r.ErrorCodes,
+		Rejects:            r.Rejects,
+		Outcome:            r.Outcome,
+		Messages:           r.Messages,
+	})
+}
+
+// TDRWriter writes records as JSON Lines or CSV to files named
+// <path>-<time>-<seq>.jsonl (or .csv). A new file is started after
+// RotateInterval or once RotateSize bytes are written. Closed files are
+// gzipped in the background when Compress is set.
+type TDRWriter struct {
+	sync.Mutex
+	Path           string
+	Format         string // "json" or "csv"
+	RotateInterval time.Duration
+	RotateSize     int64
+	Compress       bool
+
+	file    *os.File
+	csv     *csv.Writer
+	opened  time.Time
+	written int64
+	seq     int
+	gzips   sync.WaitGroup
+}
+
+func NewTDRWriter(path, format string) (*TDRWriter, error) {
+	if format != "json" && format != "csv" {
+		return nil, fmt.Errorf("unknown TDR format %q", format)
+	}
+	return &TDRWriter{Path: path, Format: format}, nil
+}
+
+func (w *TDRWriter) extension() string {
+	if w.Format == "csv" {
+		return ".csv"
+	}
+	return ".jsonl"
+}
+
+// The lock needs to be held
+func (w *TDRWriter) open(now time.Time) error {
+	w.seq++
+	name := fmt.Sprintf("%s-%s-%04d%s", w.Path, now.UTC().Format("20060102-150405"), w.seq, w.extension())
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w.file = file
+	w.opened = now
+	w.written = 0
+	if w.Format == "csv" {
+		w.csv = csv.NewWriter(&countingWriter{w: file, n: &w.written})
+		w.csv.Write(tdrColumns)
+	}
+	return nil
+}
+
+// The lock needs to be held
+func (w *TDRWriter) closeFile() error {
+	if w.file == nil {
+		return nil
+	}
+	if w.csv != nil {
+		w.csv.Flush()
+		w.csv = nil
+	}
+	name := w.file.Name()
+	err := w.file.Close()
+	w.file = nil
+	if err == nil && w.Compress {
+		w.gzips.Add(1)
+		go func() {
+			defer w.gzips.Done()
+			err := gzipFile(name)
+			if err != nil {
+				fmt.Printf("ERROR: TDR compression: %v\n", err)
+			}
+		}()
+	}
+	return err
+}
+
+func (w *TDRWriter) Write(record *TDR) error {
+	w.Lock()
+	defer w.Unlock()
+
+	now := time.Now()
+	if w.file != nil && ((w.RotateInterval > 0 && now.Sub(w.opened) >= w.RotateInterval) ||
+		(w.RotateSize > 0 && w.written >= w.RotateSize)) {
+		w.closeFile()
+	}
+	if w.file == nil {
+		err := w.open(now)
+		if err != nil {
+			return err
+		}
+	}
+
+	if w.csv != nil {
+		w.csv.Write(record.fields())
+		// Flush per record so the size is known for rotation
+		w.csv.Flush()
+		return w.csv.Error()
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	n, err := w.file.Write(data)
+	w.written += int64(n)
+	return err
+}
+
+// Close the current file and wait for the compression to finish
+func (w *TDRWriter) Close() error {
+	w.Lock()
+	err := w.closeFile()
+	w.Unlock()
+	w.gzips.Wait()
+	return err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	*c.n += int64(n)
+	return n, err
+}
+
+func gzipFile(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(name+".gz", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+	return os.Remove(name)
+}
@@ -0,0 +1,156 @@
+package tcapflow
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testRecord(i int) *TDR {
+	r := &TDR{
+		StartTime: time.Unix(1000, 0),
+		EndTime:   time.Unix(1000, int64(i)*int64(time.Millisecond)),
+		Latency:   time.Duration(i) * time.Millisecond,
+		Calling:   SCCPAddress{Number: "4912345", Ssn: 7},
+		Called:    SCCPAddress{Number: "4970000", Ssn: 6, PointCode: 2},
+		Otid:      []byte{byte(i)},
+		Dtid:      []byte{0xb, byte(i)},
+		Outcome:   OutcomeEnd,
+		Messages:  2,
+	}
+	r.AddComponents([]ROSInfo{
+		{Type: ROSInvoke, OpCode: 2},
+		{Type: ROSInvoke, OpCode: 2},
+		{Type: ROSError, ErrorCode: 27},
+		{Type: ROSReject},
+	})
+	return r
+}
+
+func tdrFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "tdr-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func TestTDRWriterJSON(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	w, err := NewTDRWriter(filepath.Join(dir, "tdr"), "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		if err := w.Write(testRecord(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	files := tdrFiles(t, dir)
+	if len(files) != 1 || !strings.HasSuffix(files[0], "-0001.jsonl") {
+		t.Fatalf("files %v", files)
+	}
+	f, _ := os.Open(files[0])
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	lines := 0
+	for scanner.Scan() {
+		lines++
+		var record map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		if lines == 2 && (record["latencyMs"] != 2.0 || record["dtid"] != "0b02" ||
+			record["calledPc"] != 2.0 || record["rejects"] != 1.0 || record["outcome"] != OutcomeEnd) {
+			t.Errorf("record %s", scanner.Text())
+		}
+		if ops := record["operations"].([]interface{}); len(ops) != 1 {
+			t.Errorf("operations %v", ops)
+		}
+	}
+	if lines != 3 {
+		t.Errorf("%d records", lines)
+	}
+}
+
+func TestTDRWriterCSV(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	w, _ := NewTDRWriter(filepath.Join(dir, "tdr"), "csv")
+	w.Write(testRecord(1))
+	w.Close()
+
+	f, _ := os.Open(tdrFiles(t, dir)[0])
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || strings.Join(rows[0], ",") != strings.Join(tdrColumns, ",") {
+		t.Fatalf("rows %v", rows)
+	}
+	want := "1970-01-01T00:16:40Z,1970-01-01T00:16:40.001Z,1.000,4912345,7,0,4970000,6,2,01,0b01,,2,27,1,end,2"
+	if got := strings.Join(rows[1], ","); got != want {
+		t.Errorf("got  %v\nwant %v", got, want)
+	}
+}
+
+func TestTDRWriterRotatesAndCompresses(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	w, _ := NewTDRWriter(filepath.Join(dir, "tdr"), "json")
+	w.RotateSize = 1
+	w.Compress = true
+	for i := 1; i <= 3; i++ {
+		w.Write(testRecord(i))
+	}
+	w.Close()
+
+	files := tdrFiles(t, dir)
+	if len(files) != 3 {
+		t.Fatalf("files %v", files)
+	}
+	for _, name := range files {
+		if !strings.HasSuffix(name, ".jsonl.gz") {
+			t.Fatalf("%v is not compressed", name)
+		}
+		f, _ := os.Open(name)
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var record map[string]interface{}
+		if err := json.NewDecoder(zr).Decode(&record); err != nil {
+			t.Errorf("%v: %v", name, err)
+		}
+		f.Close()
+	}
+
+	// By time
+	w, _ = NewTDRWriter(filepath.Join(dir, "tdr"), "csv")
+	w.RotateInterval = time.Nanosecond
+	w.Write(testRecord(1))
+	time.Sleep(time.Millisecond)
+	w.Write(testRecord(2))
+	w.Close()
+	if files := tdrFiles(t, dir); len(files) != 5 {
+		t.Errorf("files %v", files)
+	}
+}
+
+func TestTDRWriterFormat(t *testing.T) {
+	if _, err := NewTDRWriter("tdr", "xml"); err == nil {
+		t.Error("accepted xml")
+	}
+}
@@ -0,0 +1,243 @@
+package tcapflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// TimerProfile tells how long the response to a TC-Begin may take. Once
+// Overdue has passed the dialogue is flagged but can still be matched, after
+// Expire the state is removed and the dialogue counts as unanswered.
+type TimerProfile struct {
+	Overdue time.Duration
+	Expire  time.Duration
+}
+
+// 3GPP TS 29.002 operation timer classes. Values are the upper end of
+// each range.
+var (
+	TimerShort      = TimerProfile{Overdue: 5 * time.Second, Expire: 10 * time.Second}
+	TimerMedium     = TimerProfile{Overdue: 15 * time.Second, Expire: 30 * time.Second}
+	TimerMediumLong = TimerProfile{Overdue: time.Minute, Expire: 10 * time.Minute}
+
+	// CAMEL first responses come quickly as the call setup is waiting
+	TimerCAP = TimerProfile{Overdue: 3 * time.Second, Expire: 10 * time.Second}
+)
+
+// Default MAP operation timers
+var mapOperationTimers = map[int]TimerProfile{
+	2:  TimerMedium,     // updateLocation
+	3:  TimerMedium,     // cancelLocation
+	4:  TimerMedium,     // provideRoamingNumber
+	5:  TimerMedium,     // noteSubscriberDataModified
+	6:  TimerMedium,     // resumeCallHandling
+	7:  TimerMedium,     // insertSubscriberData
+	8:  TimerMedium,     // deleteSubscriberData
+	10: TimerMedium,     // registerSS
+	11: TimerMedium,     // eraseSS
+	12: TimerMedium,     // activateSS
+	13: TimerMedium,     // deactivateSS
+	14: TimerMedium,     // interrogateSS
+	15: TimerMedium,     // authenticationFailureReport
+	17: TimerMediumLong, // registerPassword
+	18: TimerMedium,     // getPassword
+	22: TimerMedium,     // sendRoutingInfo
+	23: TimerMedium,     // updateGprsLocation
+	24: TimerMedium,     // sendRoutingInfoForGprs
+	25: TimerMedium,     // failureReport
+	26: TimerMedium,     // noteMsPresentForGprs
+	37: TimerMedium,     // reset
+	38: TimerShort,      // forwardCheckSS-Indication
+	43: TimerMedium,     // checkIMEI
+	44: TimerMediumLong, // mt-forwardSM
+	45: TimerMedium,     // sendRoutingInfoForSM
+	46: TimerMediumLong, // mo-forwardSM
+	47: TimerShort,      // reportSM-DeliveryStatus
+	50: TimerMedium,     // activateTraceMode
+	51: TimerMedium,     // deactivateTraceMode
+	55: TimerShort,      // sendIdentification
+	56: TimerMedium,     // sendAuthenticationInfo
+	57: TimerMedium,     // restoreData
+	58: TimerMedium,     // sendIMSI
+	59: TimerMediumLong, // processUnstructuredSS-Request
+	60: TimerMediumLong, // unstructuredSS-Request
+	61: TimerMediumLong, // unstructuredSS-Notify
+	62: TimerMedium,     // anyTimeSubscriptionInterrogation
+	63: TimerShort,      // informServiceCentre
+	64: TimerShort,      // alertServiceCentre
+	65: TimerMedium,     // anyTimeModification
+	66: TimerMedium,     // readyForSM
+	67: TimerMedium,     // purgeMS
+	68: TimerMedium,     // prepareHandover
+	69: TimerMedium,     // prepareSubsequentHandover
+	70: TimerMedium,     // provideSubscriberInfo
+	71: TimerMedium,     // anyTimeInterrogation
+	72: TimerMedium,     // ss-InvocationNotification
+	73: TimerMedium,     // setReportingState
+	74: TimerMedium,     // statusReport
+	75: TimerMediumLong, // remoteUserFree
+	76: TimerMedium,     // registerCC-Entry
+	77: TimerMedium,     // eraseCC-Entry
+	83: TimerMediumLong, // provideSubscriberLocation
+	85: TimerMedium,     // sendRoutingInfoForLCS
+	86: TimerMedium,     // subscriberLocationReport
+	87: TimerMedium,     // ist-Alert
+	88: TimerMedium,     // ist-Command
+	89: TimerMedium,     // noteMM-Event
+}
+
+// Operation codes of CAP overlap with MAP. The application context tells
+// them apart.
+var capApplicationContexts = []string{
+	"0.4.0.0.1.0.50", // CAP v1/v2 gsmSSF to gsmSCF
+	"0.4.0.0.1.0.51", // CAP v2 assist handoff gsmSSF to gsmSCF
+	"0.4.0.0.1.0.52", // CAP v2 gsmSRF to gsmSCF
+	"0.4.0.0.1.21.3", // CAP v3
+	"0.4.0.0.1.22.3", // CAP v4
+}
+
+type TimerProfiles struct {
+	Default    TimerProfile
+	Operations map[int]TimerProfile
+
+	// Keyed by the dotted OID. A profile applies to all application
+	// contexts starting with the key.
+	ApplicationContexts map[string]TimerProfile
+}
+
+// DefaultTimerProfiles has the MAP operation timers and a CAP profile.
+// Everything else uses expire for both values.
+func DefaultTimerProfiles(expire time.Duration) *TimerProfiles {
+	profiles := &TimerProfiles{
+		Default:             TimerProfile{Overdue: expire, Expire: expire},
+		Operations:          make(map[int]TimerProfile),
+		ApplicationContexts: make(map[string]TimerProfile),
+	}
+	for op, profile := range mapOperationTimers {
+		profiles.Operations[op] = profile
+	}
+	for _, ac := range capApplicationContexts {
+		profiles.ApplicationContexts[ac] = TimerCAP
+	}
+	return profiles
+}
+
+// Lookup picks the profile of the application context and falls back to
+// the longest timer of the invoked operations.
+func (p *TimerProfiles) Lookup(ac string, infos []ROSInfo) TimerProfile {
+	best := ""
+	for prefix := range p.ApplicationContexts {
+		if len(prefix) > len(best) && (ac == prefix || strings.HasPrefix(ac, prefix+".")) {
+			best = prefix
+		}
+	}
+	if best != "" {
+		return p.ApplicationContexts[best]
+	}
+
+	found := false
+	result := TimerProfile{}
+	for _, info := range infos {
+		if info.Type != ROSInvoke {
+			continue
+		}
+		profile, ok := p.Operations[info.OpCode]
+		if !ok {
+			continue
+		}
+		found = true
+		if profile.Overdue > result.Overdue {
+			result.Overdue = profile.Overdue
+		}
+		if profile.Expire > result.Expire {
+			result.Expire = profile.Expire
+		}
+	}
+	if !found {
+		return p.Default
+	}
+	return result
+}
+
+type timerProfileJSON struct {
+	Overdue string `json:"overdue"`
+	Expire  string `json:"expire"`
+}
+
+type timerProfilesJSON struct {
+	Default             *timerProfileJSON           `json:"default"`
+	Operations          map[int]timerProfileJSON    `json:"operations"`
+	ApplicationContexts map[string]timerProfileJSON `json:"applicationContexts"`
+}
+
+func (j timerProfileJSON) parse(base TimerProfile) (profile TimerProfile, err error) {
+	profile = base
+	if j.Expire != "" {
+		profile.Expire, err = time.ParseDuration(j.Expire)
+		if err != nil {
+			return
+		}
+		// Only the expiry is given
+		if j.Overdue == "" {
+			profile.Overdue = profile.Expire
+		}
+	}
+	if j.Overdue != "" {
+		profile.Overdue, err = time.ParseDuration(j.Overdue)
+		if err != nil {
+			return
+		}
+	}
+	if profile.Overdue > profile.Expire {
+		err = fmt.Errorf("overdue %v is after expire %v", profile.Overdue, profile.Expire)
+	}
+	return
+}
+
+// LoadTimerProfiles reads overrides from a JSON file like
+//
+//	{
+//	  "default": {"overdue": "5s", "expire": "10s"},
+//	  "operations": {"59": {"overdue": "2m", "expire": "10m"}},
+//	  "applicationContexts": {"0.4.0.0.1.21.3": {"expire": "5s"}}
+//	}
+//
+// A profile may leave out a field. Without overdue it is the profile's own
+// expire and not the one of the default, so the dialogue is only reported
+// when it expires. Without expire the default's is kept. The operations
+// and application contexts build on the default of the file.
+func (p *TimerProfiles) LoadTimerProfiles(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	var config timerProfilesJSON
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return fmt.Errorf("%v: %v", file, err)
+	}
+
+	if config.Default != nil {
+		p.Default, err = config.Default.parse(p.Default)
+		if err != nil {
+			return fmt.Errorf("%v: default: %v", file, err)
+		}
+	}
+	for op, profile := range config.Operations {
+		p.Operations[op], err = profile.parse(p.Default)
+		if err != nil {
+			return fmt.Errorf("%v: operation %v: %v", file, op, err)
+		}
+	}
+	for ac, profile := range config.ApplicationContexts {
+		p.ApplicationContexts[ac], err = profile.parse(p.Default)
+		if err != nil {
+			return fmt.Errorf("%v: application context %v: %v", file, ac, err)
+		}
+	}
+	return nil
+}
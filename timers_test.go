@@ -0,0 +1,96 @@
+package tcapflow
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimerProfileLookup(t *testing.T) {
+	p := DefaultTimerProfiles(7 * time.Second)
+	invoke := func(ops ...int) []ROSInfo {
+		var infos []ROSInfo
+		for _, op := range ops {
+			infos = append(infos, ROSInfo{Type: ROSInvoke, OpCode: op})
+		}
+		return infos
+	}
+
+	if got := p.Lookup("0.4.0.0.1.21.3.4", invoke(59)); got != TimerCAP {
+		t.Errorf("CAP v3 context got %v", got)
+	}
+	if got := p.Lookup("0.4.0.0.1.21.30", nil); got != p.Default {
+		t.Errorf("context only sharing a prefix got %v", got)
+	}
+	if got := p.Lookup("", invoke(2, 59)); got != TimerMediumLong {
+		t.Errorf("longest operation timer got %v", got)
+	}
+	// Results do not pick a timer
+	results := []ROSInfo{{Type: ROSResult, OpCode: 59}}
+	if got := p.Lookup("", results); got != (TimerProfile{Overdue: 7 * time.Second, Expire: 7 * time.Second}) {
+		t.Errorf("default got %v", got)
+	}
+}
+
+func loadProfiles(t *testing.T, config string) (*TimerProfiles, error) {
+	dir, err := ioutil.TempDir("", "timers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "timers.json")
+	if err := ioutil.WriteFile(file, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p := DefaultTimerProfiles(10 * time.Second)
+	return p, p.LoadTimerProfiles(file)
+}
+
+func TestLoadTimerProfiles(t *testing.T) {
+	p, err := loadProfiles(t, `{
+		"default": {"overdue": "2s", "expire": "4s"},
+		"operations": {"59": {"expire": "1m"}, "2": {"overdue": "3s"}},
+		"applicationContexts": {"1.2.3": {"overdue": "1s", "expire": "1s"}, "1.2.4": {"expire": "1s"}, "1.2.5": {"expire": "5s"}}
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Default != (TimerProfile{Overdue: 2 * time.Second, Expire: 4 * time.Second}) {
+		t.Errorf("default %v", p.Default)
+	}
+	// Only the expiry is given
+	if p.Operations[59] != (TimerProfile{Overdue: time.Minute, Expire: time.Minute}) {
+		t.Errorf("operation 59 %v", p.Operations[59])
+	}
+	// The rest comes from the default
+	if p.Operations[2] != (TimerProfile{Overdue: 3 * time.Second, Expire: 4 * time.Second}) {
+		t.Errorf("operation 2 %v", p.Operations[2])
+	}
+	if got := p.Lookup("1.2.3.1", nil); got.Expire != time.Second {
+		t.Errorf("application context %v", got)
+	}
+	// The overdue of the default is not kept with a partial override
+	if got := p.Lookup("1.2.4", nil); got != (TimerProfile{Overdue: time.Second, Expire: time.Second}) {
+		t.Errorf("application context 1.2.4 %v", got)
+	}
+	if got := p.Lookup("1.2.5", nil); got != (TimerProfile{Overdue: 5 * time.Second, Expire: 5 * time.Second}) {
+		t.Errorf("application context 1.2.5 %v", got)
+	}
+}
+
+func TestLoadTimerProfilesErrors(t *testing.T) {
+	for config, want := range map[string]string{
+		`{"default": {"overdue": "20s"}}`:                          "default: overdue 20s is after expire 10s",
+		`{"operations": {"2": {"overdue": "2s", "expire": "1s"}}}`: "operation 2: overdue 2s is after expire 1s",
+		`{"applicationContexts": {"1.2": {"expire": "soon"}}}`:     "application context 1.2",
+		`{"default": `: "unexpected end",
+	} {
+		_, err := loadProfiles(t, config)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want %q", config, err, want)
+		}
+	}
+}
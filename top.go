@@ -0,0 +1,222 @@
+package tcapflow
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Top counts messages and dialogues for the live terminal view. It is
+// shared by all pipeline shards.
+type Top struct {
+	sync.Mutex
+	current TopSnapshot
+}
+
+type TopSnapshot struct {
+	Time       time.Time
+	Types      map[string]uint64
+	Operations map[string]uint64
+	Calling    map[string]uint64
+	Called     map[string]uint64
+	Latency    LatencyHistogram
+	Answered   uint64
+	Aborts     uint64
+	Timeouts   uint64
+}
+
+func NewTop() *Top {
+	return &Top{current: TopSnapshot{
+		Types:      make(map[string]uint64),
+		Operations: make(map[string]uint64),
+		Calling:    make(map[string]uint64),
+		Called:     make(map[string]uint64),
+	}}
+}
+
+func (t *Top) Message(tag int, calling, called SCCPAddress, infos []ROSInfo) {
+	t.Lock()
+	defer t.Unlock()
+	t.current.Types[TCprocName(tag)]++
+	t.current.Calling[calling.Number]++
+	t.current.Called[called.Number]++
+	if tag == TCbeginApp {
+		t.current.Operations[OperationLabel(infos)]++
+	}
+}
+
+func (t *Top) Completed(latency time.Duration, abort bool) {
+	t.Lock()
+	defer t.Unlock()
+	t.current.Latency.Record(latency)
+	t.current.Answered++
+	if abort {
+		t.current.Aborts++
+	}
+}
+
+func (t *Top) Timeout() {
+	t.Lock()
+	t.current.Timeouts++
+	t.Unlock()
+}
+
+func copyCounts(counts map[string]uint64) map[string]uint64 {
+	result := make(map[string]uint64, len(counts))
+	for k, v := range counts {
+		result[k] = v
+	}
+	return result
+}
+
+func (t *Top) Snapshot(now time.Time) TopSnapshot {
+	t.Lock()
+	defer t.Unlock()
+	s := t.current
+	s.Time = now
+	s.Types = copyCounts(s.Types)
+	s.Operations = copyCounts(s.Operations)
+	s.Calling = copyCounts(s.Calling)
+	s.Called = copyCounts(s.Called)
+	s.Latency = LatencyHistogram{}
+	s.Latency.Merge(t.current.Latency)
+	return s
+}
+
+const (
+	TopSortRate  = "rate"
+	TopSortTotal = "total"
+	TopSortName  = "name"
+)
+
+type TopRow struct {
+	Name  string
+	Total uint64
+	Rate  float64
+}
+
+func rate(cur, prev uint64, interval time.Duration) float64 {
+	if interval <= 0 || cur < prev {
+		return 0
+	}
+	return float64(cur-prev) / interval.Seconds()
+}
+
+// TopRows ranks the counters with their rate since the previous snapshot.
+// Only names containing filter are kept.
+func TopRows(cur, prev map[string]uint64, interval time.Duration, sortBy, filter string, limit int) []TopRow {
+	rows := make([]TopRow, 0, len(cur))
+	for name, total := range cur {
+		if !strings.Contains(name, filter) {
+			continue
+		}
+		rows = append(rows, TopRow{Name: name, Total: total, Rate: rate(total, prev[name], interval)})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		switch sortBy {
+		case TopSortTotal:
+			if rows[i].Total != rows[j].Total {
+				return rows[i].Total > rows[j].Total
+			}
+		case TopSortName:
+		default:
+			if rows[i].Rate != rows[j].Rate {
+				return rows[i].Rate > rows[j].Rate
+			}
+		}
+		return rows[i].Name < rows[j].Name
+	})
+	if limit >= 0 && len(rows) > limit {
+		rows = rows[:limit]
+	}
+	return rows
+}
+
+// TopView renders the last snapshot with the rates since the one before.
+type TopView struct {
+	Sort   string
+	Filter string
+	prev   TopSnapshot
+	last   TopSnapshot
+}
+
+func (v *TopView) Update(cur TopSnapshot) {
+	v.prev = v.last
+	v.last = cur
+}
+
+func percent(part, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(part) / float64(total)
+}
+
+func (v *TopView) writeTable(w io.Writer, title string, cur, prev map[string]uint64, interval time.Duration, limit int) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "%s\tRATE/s\tTOTAL\t\n", title)
+	for _, row := range TopRows(cur, prev, interval, v.Sort, v.Filter, limit) {
+		fmt.Fprintf(tw, "%s\t%.1f\t%d\t\n", row.Name, row.Rate, row.Total)
+	}
+	tw.Flush()
+}
+
+// Render draws one screen of height lines. oldest are the open dialogues
+// to list, oldest first.
+func (v *TopView) Render(out io.Writer, oldest []AdminDialogue, height int, status string) {
+	cur, prev := v.last, v.prev
+	interval := cur.Time.Sub(prev.Time)
+	if prev.Time.IsZero() {
+		interval = 0
+	}
+
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+
+	// Home, clear and draw
+	fmt.Fprint(w, "\x1b[H\x1b[2J")
+	fmt.Fprintf(w, "tcapflow top - %s  sort: %s  filter: %q  %s\n",
+		cur.Time.Format("15:04:05"), v.Sort, v.Filter, status)
+
+	var types []string
+	for _, name := range []string{"BEGIN", "CONTINUE", "END", "ABORT"} {
+		types = append(types, fmt.Sprintf("%s %.1f", strings.ToLower(name), rate(cur.Types[name], prev.Types[name], interval)))
+	}
+	fmt.Fprintf(w, "Messages/s  %s\n", strings.Join(types, "  "))
+	fmt.Fprintf(w, "Latency  p50 %.1fms  p90 %.1fms  p99 %.1fms  max %.1fms\n",
+		milliseconds(cur.Latency.Percentile(50)), milliseconds(cur.Latency.Percentile(90)),
+		milliseconds(cur.Latency.Percentile(99)), float64(cur.Latency.Max)/1000)
+	dialogues := cur.Answered + cur.Timeouts
+	fmt.Fprintf(w, "Aborts %.1f/s (%.1f%%)  Timeouts %.1f/s (%.1f%%)\n",
+		rate(cur.Aborts, prev.Aborts, interval), percent(cur.Aborts, dialogues),
+		rate(cur.Timeouts, prev.Timeouts, interval), percent(cur.Timeouts, dialogues))
+
+	// Split the remaining lines between the four tables
+	limit := (height - 5 - 4*2) / 4
+	if limit < 1 {
+		limit = 1
+	}
+	fmt.Fprint(w, "\n")
+	v.writeTable(w, "OPERATION", cur.Operations, prev.Operations, interval, limit)
+	fmt.Fprint(w, "\n")
+	v.writeTable(w, "CALLING GT", cur.Calling, prev.Calling, interval, limit)
+	fmt.Fprint(w, "\n")
+	v.writeTable(w, "CALLED GT", cur.Called, prev.Called, interval, limit)
+	fmt.Fprint(w, "\n")
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "OLDEST OPEN\tAGE\tCALLING\tCALLED\tOTID\tOPERATIONS\n")
+	for i, d := range oldest {
+		if i >= limit {
+			break
+		}
+		fmt.Fprintf(tw, "%s\t%.1fs\t%s\t%s\t%s\t%v\n", d.State, d.Age/1000, d.Calling.Gt, d.Called.Gt, d.Otid, d.Operations)
+	}
+	tw.Flush()
+	fmt.Fprint(w, "\n[s]ort  [/]filter  [q]uit")
+}
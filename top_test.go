@@ -0,0 +1,83 @@
+package tcapflow
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTopSnapshot(t *testing.T) {
+	top := NewTop()
+	vlr, hlr := SCCPAddress{Number: "4912345"}, SCCPAddress{Number: "4970000"}
+	invoke := []ROSInfo{{Type: ROSInvoke, OpCode: 2}}
+	top.Message(TCbeginApp, vlr, hlr, invoke)
+	top.Message(TCbeginApp, vlr, hlr, nil)
+	top.Message(TCendApp, hlr, vlr, nil)
+	top.Completed(20*time.Millisecond, false)
+	top.Completed(40*time.Millisecond, true)
+	top.Timeout()
+
+	now := time.Unix(1000, 0)
+	s := top.Snapshot(now)
+	if !s.Time.Equal(now) || s.Types["BEGIN"] != 2 || s.Types["END"] != 1 || s.Calling["4912345"] != 2 || s.Called["4912345"] != 1 {
+		t.Errorf("snapshot %+v", s)
+	}
+	if !reflect.DeepEqual(s.Operations, map[string]uint64{"2": 1, "none": 1}) {
+		t.Errorf("operations %v", s.Operations)
+	}
+	if s.Answered != 2 || s.Aborts != 1 || s.Timeouts != 1 || s.Latency.Total != 2 {
+		t.Errorf("dialogues %+v", s)
+	}
+
+	// The snapshot is a copy
+	top.Message(TCbeginApp, vlr, hlr, invoke)
+	top.Completed(time.Millisecond, false)
+	if s.Types["BEGIN"] != 2 || s.Latency.Total != 2 {
+		t.Errorf("snapshot changed %+v", s)
+	}
+}
+
+func TestTopRows(t *testing.T) {
+	cur := map[string]uint64{"a": 100, "b": 50, "c": 300, "ab": 10}
+	prev := map[string]uint64{"a": 0, "b": 0, "c": 290, "ab": 0}
+
+	names := func(rows []TopRow) (result []string) {
+		for _, row := range rows {
+			result = append(result, row.Name)
+		}
+		return
+	}
+	if rows := TopRows(cur, prev, 10*time.Second, TopSortRate, "", -1); !reflect.DeepEqual(names(rows), []string{"a", "b", "ab", "c"}) || rows[0].Rate != 10 {
+		t.Errorf("by rate %v", rows)
+	}
+	if rows := TopRows(cur, prev, time.Second, TopSortTotal, "", 2); !reflect.DeepEqual(names(rows), []string{"c", "a"}) {
+		t.Errorf("by total %v", rows)
+	}
+	if rows := TopRows(cur, prev, time.Second, TopSortName, "a", -1); !reflect.DeepEqual(names(rows), []string{"a", "ab"}) {
+		t.Errorf("by name %v", rows)
+	}
+	if rows := TopRows(cur, nil, 0, TopSortRate, "", -1); rows[0].Rate != 0 {
+		t.Errorf("rate without an interval %v", rows)
+	}
+}
+
+func TestTopViewRender(t *testing.T) {
+	top := NewTop()
+	view := TopView{Sort: TopSortRate}
+	view.Update(top.Snapshot(time.Unix(1000, 0)))
+	top.Message(TCbeginApp, SCCPAddress{Number: "4912345"}, SCCPAddress{Number: "4970000"}, []ROSInfo{{Type: ROSInvoke, OpCode: 2}})
+	top.Completed(10*time.Millisecond, false)
+	view.Update(top.Snapshot(time.Unix(1002, 0)))
+
+	oldest := []AdminDialogue{{State: "session", Age: 1500, Otid: "cafe"}}
+	var out bytes.Buffer
+	view.Render(&out, oldest, 40, "live")
+	screen := out.String()
+	for _, want := range []string{"\x1b[H\x1b[2J", "Messages/s  begin 0.5", "OPERATION", "CALLING GT", "4912345", "1.5s", "[q]uit"} {
+		if !strings.Contains(screen, want) {
+			t.Errorf("screen lacks %q:\n%s", want, screen)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package tcapflow
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type sighting struct {
+	probe   string
+	capt    time.Time
+	arrived time.Time
+	probes  []string // Reported it, first one first
+}
+
+// PathDelay is the transit delay distribution of messages seen at From and
+// then at To. Uncorrected counts the delays measured before the clock
+// offset of the probes was known.
+type PathDelay struct {
+	From        string           `json:"from"`
+	To          string           `json:"to"`
+	Delay       LatencyHistogram `json:"delay"`
+	Uncorrected uint64           `json:"uncorrected"`
+}
+
+// TransitTracker recognises a message reported by more than one probe and
+// measures how long it took from one probe to the next. The capture times
+// are corrected by the clock offset estimated by Probes. Messages are
+// remembered for Window after they first arrived and only match when they
+// were captured within Window.
+type TransitTracker struct {
+	Window time.Duration
+	Probes *ProbeTracker
+
+	sync.Mutex
+	seen       map[string]*sighting
+	arrivals   []evictionEntry
+	paths      map[probePair]*PathDelay
+	duplicates uint64
+}
+
+func NewTransitTracker(window time.Duration, probes *ProbeTracker) *TransitTracker {
+	return &TransitTracker{
+		Window: window,
+		Probes: probes,
+		seen:   make(map[string]*sighting),
+		paths:  make(map[probePair]*PathDelay),
+	}
+}
+
+// Forget the messages that arrived before the window. The lock needs to
+// be held.
+func (t *TransitTracker) expire(now time.Time) {
+	for len(t.arrivals) > 0 {
+		entry := t.arrivals[0]
+		if now.Sub(entry.added) < t.Window {
+			break
+		}
+		if s, ok := t.seen[entry.key]; ok && s.arrived.Equal(entry.added) {
+			delete(t.seen, entry.key)
+		}
+		t.arrivals[0] = evictionEntry{}
+		t.arrivals = t.arrivals[1:]
+	}
+}
+
+// Message records the message with fingerprint captured by probe. A
+// message first reported by another probe is a duplicate. The delay and
+// path it took are returned then. Repeats by the same probe are not
+// duplicates.
+func (t *TransitTracker) Message(probe, fingerprint string, capt, now time.Time) (from, to string, delay time.Duration, duplicate bool) {
+	t.Lock()
+	defer t.Unlock()
+	t.expire(now)
+
+	s, ok := t.seen[fingerprint]
+	if !ok || capt.Sub(s.capt) > t.Window || s.capt.Sub(capt) > t.Window {
+		t.seen[fingerprint] = &sighting{probe: probe, capt: capt, arrived: now, probes: []string{probe}}
+		t.arrivals = append(t.arrivals, evictionEntry{key: fingerprint, added: now})
+		return "", "", 0, false
+	}
+	if probe == s.probe {
+		return "", "", 0, false
+	}
+	for _, seenBy := range s.probes {
+		if seenBy == probe {
+			return "", "", 0, true
+		}
+	}
+	s.probes = append(s.probes, probe)
+	t.duplicates++
+
+	// The first report does not need to be from the first probe
+	from, to = s.probe, probe
+	offset, corrected := t.Probes.Offset(to, from)
+	delay = capt.Sub(s.capt) - offset
+	if delay < 0 {
+		from, to, delay = to, from, -delay
+	}
+
+	pair := probePair{from, to}
+	path, ok := t.paths[pair]
+	if !ok {
+		path = &PathDelay{From: from, To: to}
+		t.paths[pair] = path
+	}
+	path.Delay.Record(delay)
+	if !corrected {
+		path.Uncorrected++
+	}
+	return from, to, delay, true
+}
+
+// Duplicates is the number of messages already reported by another probe
+func (t *TransitTracker) Duplicates() uint64 {
+	t.Lock()
+	defer t.Unlock()
+	return t.duplicates
+}
+
+// Paths returns a copy of the delays ordered by path
+func (t *TransitTracker) Paths() []PathDelay {
+	t.Lock()
+	defer t.Unlock()
+	paths := make([]PathDelay, 0, len(t.paths))
+	for _, path := range t.paths {
+		copied := *path
+		copied.Delay = LatencyHistogram{}
+		copied.Delay.Merge(path.Delay)
+		paths = append(paths, copied)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		if paths[i].From != paths[j].From {
+			return paths[i].From < paths[j].From
+		}
+		return paths[i].To < paths[j].To
+	})
+	return paths
+}
@@ -0,0 +1,76 @@
+package tcapflow
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTransitTracker(t *testing.T) {
+	probes := NewProbeTracker(time.Minute)
+	tracker := NewTransitTracker(5*time.Second, probes)
+	capt := time.Unix(1000, 0)
+	now := time.Unix(2000, 0)
+
+	if _, _, _, duplicate := tracker.Message("a", "m1", capt, now); duplicate {
+		t.Error("first sighting is a duplicate")
+	}
+	if _, _, _, duplicate := tracker.Message("a", "m1", capt, now); duplicate {
+		t.Error("repeat of the same probe is a duplicate")
+	}
+
+	// Reported by b first but captured at a first
+	tracker.Message("b", "m2", capt.Add(30*time.Millisecond), now)
+	from, to, delay, duplicate := tracker.Message("a", "m2", capt, now)
+	if !duplicate || from != "a" || to != "b" || delay != 30*time.Millisecond {
+		t.Errorf("m2 %v->%v %v %v", from, to, delay, duplicate)
+	}
+	from, to, delay, duplicate = tracker.Message("b", "m1", capt.Add(20*time.Millisecond), now)
+	if !duplicate || from != "a" || to != "b" || delay != 20*time.Millisecond {
+		t.Errorf("m1 %v->%v %v %v", from, to, delay, duplicate)
+	}
+	if _, _, _, duplicate := tracker.Message("b", "m1", capt, now); !duplicate {
+		t.Error("third report is no duplicate")
+	}
+
+	paths := tracker.Paths()
+	if tracker.Duplicates() != 2 || len(paths) != 1 || paths[0].Delay.Total != 2 || paths[0].Uncorrected != 2 {
+		t.Errorf("%d duplicates, paths %+v", tracker.Duplicates(), paths)
+	}
+}
+
+func TestTransitTrackerCorrectsClocks(t *testing.T) {
+	probes := NewProbeTracker(time.Minute)
+	capt := time.Unix(1000, 0)
+
+	// b is 10ms ahead
+	probes.Dialogue("a", "b", 15*time.Millisecond, capt)
+	probes.Dialogue("b", "a", -5*time.Millisecond, capt)
+
+	tracker := NewTransitTracker(5*time.Second, probes)
+	tracker.Message("a", "m", capt, capt)
+	_, _, delay, _ := tracker.Message("b", "m", capt.Add(15*time.Millisecond), capt)
+	if delay != 5*time.Millisecond || tracker.Paths()[0].Uncorrected != 0 {
+		t.Errorf("delay %v, paths %+v", delay, tracker.Paths())
+	}
+}
+
+func TestTransitTrackerWindow(t *testing.T) {
+	tracker := NewTransitTracker(5*time.Second, NewProbeTracker(time.Minute))
+	capt := time.Unix(1000, 0)
+	now := time.Unix(2000, 0)
+	tracker.Message("a", "m", capt, now)
+
+	// Captured too far apart to be the same message
+	if _, _, _, duplicate := tracker.Message("b", "m", capt.Add(6*time.Second), now); duplicate {
+		t.Error("matched outside the capture window")
+	}
+
+	// Forgotten once the window passed since it arrived
+	tracker.Message("a", "n", capt, now)
+	if _, _, _, duplicate := tracker.Message("b", "n", capt, now.Add(5*time.Second)); duplicate {
+		t.Error("matched after the window")
+	}
+	if len(tracker.seen) != 1 {
+		t.Errorf("%d remembered", len(tracker.seen))
+	}
+}